@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+// runAnalytics recounts the analytics rollups from the stored orders, e.g.
+// after an import, which bypasses the service and so the rollups.
+func runAnalytics(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("analytics", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl analytics rebuild")
+		fmt.Fprintln(os.Stderr, "orders created while the rebuild runs may be missed; rebuild again if the service was busy")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "rebuild" {
+		fs.Usage()
+		return errors.New("want an action")
+	}
+	if cfg.Storage.Driver == storage.DriverMemory {
+		return errors.New("memory storage is private to the service process")
+	}
+
+	repo, err := storage.NewOrderRepository(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	n, err := analytics.NewService(repo, log).Rebuild(ctx, repo)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(map[string]int{"orders": n})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+)
+
+// apiClient calls a running service over HTTP.
+type apiClient struct {
+	url string
+	key string
+}
+
+// apiFlags registers --api-url and --api-key on fs.
+func apiFlags(fs *pflag.FlagSet, cfg *config.Config) *apiClient {
+	c := &apiClient{}
+	fs.StringVar(&c.url, "api-url", "http://localhost"+cfg.HTTPPort, "service address")
+	fs.StringVar(&c.key, "api-key", os.Getenv("WB_API_KEY"), "API key, sent as X-API-Key")
+	return c
+}
+
+// do sends a request and returns the response body, or an error carrying the
+// body for any status but 200.
+func (c *apiClient) do(ctx context.Context, method, path string, query url.Values) ([]byte, error) {
+	u := strings.TrimSuffix(c.url, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.key != "" {
+		req.Header.Set("X-API-Key", c.key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// printJSON writes a JSON response indented to stdout.
+func printJSON(body []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(body), "", "  "); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(os.Stdout)
+	return err
+}
+
+// runGet prints one order as the service returns it to the caller's role.
+func runGet(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("get", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl get [flags] ORDER_UID")
+		fs.PrintDefaults()
+	}
+	api := apiFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("want exactly one order UID")
+	}
+
+	body, err := api.do(ctx, http.MethodGet, "/orders/"+url.PathEscape(fs.Arg(0)), url.Values{"format": {"json"}})
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
+
+// runList prints the orders list, or search results when any filter is set.
+func runList(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("list", pflag.ContinueOnError)
+	api := apiFlags(fs, cfg)
+	filters := map[string]*string{}
+	for _, f := range []struct{ flag, param, usage string }{
+		{"q", "q", "free text"},
+		{"customer-id", "customer_id", "only this customer's orders"},
+		{"delivery-service", "delivery_service", "only orders shipped by this service"},
+		{"city", "city", "only orders delivered to this city"},
+		{"brand", "brand", "only orders with an item of this brand"},
+		{"currency", "currency", "only orders paid in this currency"},
+		{"from", "from", "created at or after, RFC 3339 or YYYY-MM-DD"},
+		{"to", "to", "created before, RFC 3339 or YYYY-MM-DD"},
+		{"limit", "limit", "page size"},
+		{"offset", "offset", "orders to skip"},
+	} {
+		filters[f.param] = fs.String(f.flag, "", f.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path, query := "/orders", url.Values{"format": {"json"}}
+	for param, value := range filters {
+		if *value != "" {
+			path = "/orders/search"
+			query.Set(param, *value)
+		}
+	}
+	body, err := api.do(ctx, http.MethodGet, path, query)
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+)
+
+// runCache inspects or resets the cache of a running service. It needs an
+// admin API key.
+func runCache(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("cache", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl cache [flags] stats|flush|refresh")
+		fs.PrintDefaults()
+	}
+	api := apiFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("want exactly one action")
+	}
+
+	method, path := http.MethodPost, ""
+	switch fs.Arg(0) {
+	case "stats":
+		method, path = http.MethodGet, "/admin/cache"
+	case "flush":
+		path = "/admin/cache/flush"
+	case "refresh":
+		path = "/admin/cache/refresh"
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", fs.Arg(0))
+	}
+	body, err := api.do(ctx, method, path, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
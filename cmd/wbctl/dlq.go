@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	natsclient "github.com/velvetriddles/wb-level0/internal/nats"
+)
+
+// dlqEntry is a dead letter as printed by dlq list, with the message body as
+// text.
+type dlqEntry struct {
+	natsclient.DeadLetter
+	Data string `json:"data"`
+}
+
+// runDLQ lists, replays or purges the messages the service dead lettered on
+// nats_dlq_subject.
+func runDLQ(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("dlq", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl dlq [flags] list | replay --all | replay SEQ... | purge")
+		fs.PrintDefaults()
+	}
+	limit := fs.Int("limit", 0, "list at most this many dead letters, 0 for all")
+	all := fs.Bool("all", false, "replay every dead letter")
+	subject := fs.String("subject", "", "replay to this subject instead of the original one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("want an action")
+	}
+
+	nc, js, err := connectNATS(cfg)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	dlq := natsclient.NewDeadLetters(js, cfg.NatsDLQSubject)
+
+	switch action, rest := fs.Arg(0), fs.Args()[1:]; action {
+	case "list":
+		letters, err := dlq.List(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, dl := range letters {
+			if err := enc.Encode(dlqEntry{DeadLetter: dl, Data: string(dl.Data)}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "replay":
+		if *all == (len(rest) > 0) {
+			fs.Usage()
+			return errors.New("want either --all or sequence numbers")
+		}
+		letters, err := dlq.List(ctx, 0)
+		if err != nil {
+			return err
+		}
+		if !*all {
+			if letters, err = pick(letters, rest); err != nil {
+				return err
+			}
+		}
+		for _, dl := range letters {
+			if err := dlq.Replay(ctx, dl, *subject); err != nil {
+				return err
+			}
+			log.Info("Dead letter replayed",
+				slog.Uint64("seq", dl.Seq),
+				slog.String("reason", dl.Reason))
+		}
+		log.Info("Replay finished", slog.Int("replayed", len(letters)))
+		return nil
+
+	case "purge":
+		if err := dlq.Purge(ctx); err != nil {
+			return err
+		}
+		log.Info("Dead letters purged", slog.String("subject", cfg.NatsDLQSubject))
+		return nil
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// pick returns the dead letters with the given sequence numbers.
+func pick(letters []natsclient.DeadLetter, seqs []string) ([]natsclient.DeadLetter, error) {
+	bySeq := make(map[uint64]natsclient.DeadLetter, len(letters))
+	for _, dl := range letters {
+		bySeq[dl.Seq] = dl
+	}
+	picked := make([]natsclient.DeadLetter, 0, len(seqs))
+	for _, s := range seqs {
+		seq, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad sequence number %q", s)
+		}
+		dl, ok := bySeq[seq]
+		if !ok {
+			return nil, fmt.Errorf("no dead letter with sequence %d", seq)
+		}
+		picked = append(picked, dl)
+	}
+	return picked, nil
+}
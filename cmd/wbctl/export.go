@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+// runExport streams orders from storage, bypassing the service and its
+// cache. Personal data is redacted unless --role may see it.
+func runExport(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("export", pflag.ContinueOnError)
+	format := fs.String("format", "csv", "csv, ndjson or parquet")
+	items := fs.Bool("items", false, "one CSV/Parquet row per item instead of per order")
+	gzip := fs.Bool("gzip", false, "compress the output; implied by an --output ending in .gz")
+	output := fs.StringP("output", "o", "-", "file to write, - for stdout")
+	role := fs.String("role", cfg.Redaction.DefaultRole, "viewer gets personal data redacted; support or admin do not")
+	var q domain.SearchQuery
+	fs.StringVar(&q.Text, "q", "", "free text")
+	fs.StringVar(&q.CustomerID, "customer-id", "", "only this customer's orders")
+	fs.StringVar(&q.DeliveryService, "delivery-service", "", "only orders shipped by this service")
+	fs.StringVar(&q.City, "city", "", "only orders delivered to this city")
+	fs.StringVar(&q.Brand, "brand", "", "only orders with an item of this brand")
+	fs.StringVar(&q.Currency, "currency", "", "only orders paid in this currency")
+	from := fs.String("from", "", "created at or after, RFC 3339 or YYYY-MM-DD")
+	to := fs.String("to", "", "created before, RFC 3339 or YYYY-MM-DD")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := export.Options{ItemRows: *items, Gzip: *gzip || strings.HasSuffix(*output, ".gz")}
+	var err error
+	if opts.Format, err = export.ParseFormat(*format); err != nil {
+		return err
+	}
+	r, err := auth.ParseRole(*role)
+	if err != nil {
+		return err
+	}
+	q.IncludePII = r.CanSeePII()
+	if q.From, err = domain.ParseSearchTime(*from); err != nil {
+		return fmt.Errorf("--from: %w", err)
+	}
+	if q.To, err = domain.ParseSearchTime(*to); err != nil {
+		return fmt.Errorf("--to: %w", err)
+	}
+
+	repo, err := storage.NewOrderRepository(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w, err := export.NewWriter(out, opts)
+	if err != nil {
+		return err
+	}
+	redactor := redact.New(cfg.Redaction.HashKey)
+	err = repo.StreamOrders(ctx, q, func(order *domain.Order) error {
+		if !r.CanSeePII() {
+			order = redact.Apply(redactor, order)
+		}
+		return w.Write(order)
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Exported orders",
+		slog.Int("count", w.Count()),
+		slog.String("format", string(opts.Format)),
+		slog.String("output", *output))
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+	"github.com/velvetriddles/wb-level0/internal/importer"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+// checkpoint records how far an import got, so that it can be resumed.
+type checkpoint struct {
+	File      string    `json:"file"`
+	Records   int       `json:"records"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// runImport loads orders from an NDJSON or CSV file (one row per item, as
+// written by export --items) into storage.
+func runImport(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("import", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl import [flags] FILE|-")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "", "ndjson or csv; by default taken from the file extension")
+	batchSize := fs.Int("batch-size", importer.DefaultBatchSize, "orders written per transaction")
+	dryRun := fs.Bool("dry-run", false, "validate only, write nothing")
+	checkpointPath := fs.String("checkpoint", "", "progress file for resuming (default FILE.checkpoint)")
+	rejectsPath := fs.String("rejects", "", "NDJSON file listing rejected records with reasons (default FILE.rejects.ndjson)")
+	refresh := fs.Bool("refresh-cache", false, "reload the running service's cache afterwards (needs an admin --api-key)")
+	api := apiFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("want exactly one input file")
+	}
+	path := fs.Arg(0)
+
+	in, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := inputFormat(path, *format)
+	if err != nil {
+		return err
+	}
+	rd, err := export.NewReader(in, f)
+	if err != nil {
+		return err
+	}
+
+	// stdin cannot be resumed, so it gets no checkpoint unless asked for
+	if *checkpointPath == "" && path != "-" {
+		*checkpointPath = path + ".checkpoint"
+	}
+	if *rejectsPath == "" {
+		*rejectsPath = "rejects.ndjson"
+		if path != "-" {
+			*rejectsPath = path + ".rejects.ndjson"
+		}
+	}
+
+	var skip int
+	if *checkpointPath != "" && !*dryRun {
+		cp, err := readCheckpoint(*checkpointPath)
+		if err != nil {
+			return err
+		}
+		if cp != nil && cp.File == absPath(path) {
+			skip = cp.Records
+			log.Info("Resuming import from checkpoint",
+				slog.String("checkpoint", *checkpointPath),
+				slog.Int("records", skip),
+				slog.Time("updatedAt", cp.UpdatedAt))
+		}
+	}
+
+	// a resumed run adds to the rejects of the runs before it
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if skip > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	rejects, err := os.OpenFile(*rejectsPath, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer rejects.Close()
+	rejectEnc := json.NewEncoder(rejects)
+
+	repo, err := storage.NewOrderRepository(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	opts := importer.Options{
+		Rules: domain.Rules{
+			GoodsTotal: cfg.Validation.GoodsTotal,
+			Amount:     cfg.Validation.Amount,
+			ItemTotal:  cfg.Validation.ItemTotal,
+		},
+		BatchSize: *batchSize,
+		DryRun:    *dryRun,
+		Skip:      skip,
+		Reject:    func(r importer.Reject) error { return rejectEnc.Encode(r) },
+	}
+	if *checkpointPath != "" {
+		opts.Checkpoint = func(records int) error {
+			return writeCheckpoint(*checkpointPath, checkpoint{File: absPath(path), Records: records, UpdatedAt: time.Now()})
+		}
+	}
+
+	summary, err := importer.Run(domain.WithSource(ctx, "import:"+filepath.Base(path)), rd, repo, opts, log)
+	log.Info("Import finished",
+		slog.Any("summary", summary),
+		slog.String("rejects", *rejectsPath))
+	if encErr := json.NewEncoder(os.Stdout).Encode(summary); encErr != nil && err == nil {
+		err = encErr
+	}
+	if err != nil {
+		if opts.Checkpoint != nil {
+			return fmt.Errorf("%w (rerun the same command to resume)", err)
+		}
+		return err
+	}
+	if err := rejects.Close(); err != nil {
+		return err
+	}
+	if opts.Checkpoint != nil && !*dryRun {
+		if err := os.Remove(*checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if *refresh && !*dryRun {
+		body, err := api.do(ctx, http.MethodPost, "/admin/cache/refresh", nil)
+		if err != nil {
+			return fmt.Errorf("failed to refresh cache: %w", err)
+		}
+		log.Info("Service cache refreshed", slog.String("response", strings.TrimSpace(string(body))))
+	}
+	return nil
+}
+
+// openInput opens path, - meaning stdin, and decompresses it when it ends in
+// .gz.
+func openInput(path string) (io.ReadCloser, error) {
+	var f io.ReadCloser = os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+func inputFormat(path, flag string) (export.Format, error) {
+	if flag != "" {
+		return export.ParseFormat(flag)
+	}
+	switch ext := filepath.Ext(strings.TrimSuffix(path, ".gz")); ext {
+	case ".ndjson", ".jsonl":
+		return export.NDJSON, nil
+	case ".csv":
+		return export.CSV, nil
+	default:
+		return "", fmt.Errorf("cannot tell the format of %q, pass --format", path)
+	}
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("bad checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically, so a crash leaves
+// either the old or the new one.
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,96 @@
+// Command wbctl operates the order service from the command line:
+//
+//	wbctl [config flags] <command> [command flags]
+//
+// Config flags (--config, --database-url, --storage-driver, ...) and WB_*
+// variables are read the same way as by the service itself. Logs go to
+// stderr so that commands can write their output to stdout.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+)
+
+type command struct {
+	summary string
+	run     func(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error
+}
+
+var commands = map[string]command{
+	"publish":   {"send generated orders or an NDJSON file to NATS", runPublish},
+	"get":       {"print an order from the running service", runGet},
+	"list":      {"list or search orders through the running service", runList},
+	"dlq":       {"list, replay or purge dead lettered messages", runDLQ},
+	"migrate":   {"apply or revert the Postgres schema migrations", runMigrate},
+	"export":    {"write orders matching filters as CSV, NDJSON or Parquet", runExport},
+	"import":    {"load orders from NDJSON or CSV files into storage", runImport},
+	"cache":     {"show, flush or refresh the running service's cache", runCache},
+	"rebalance": {"move orders to their shards after storage.shards changed", runRebalance},
+	"analytics": {"rebuild the analytics rollups from the stored orders", runAnalytics},
+}
+
+func main() {
+	name, global, args := splitArgs(os.Args[1:])
+	if name == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(global)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wbctl: failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	log := logger.New(logger.Options{
+		Level:  logger.NewLevel(cfg.LogLevel),
+		Format: logger.FormatText,
+		Output: os.Stderr,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := commands[name].run(ctx, cfg, log, args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "wbctl %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// splitArgs finds the command: the arguments before it are config flags, the
+// ones after it belong to the command.
+func splitArgs(args []string) (name string, global, rest []string) {
+	for i, arg := range args {
+		if _, ok := commands[arg]; ok {
+			return arg, args[:i], args[i+1:]
+		}
+	}
+	return "", args, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wbctl [config flags] <command> [command flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun wbctl <command> --help for the command's flags.")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/migrate"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+	"github.com/velvetriddles/wb-level0/migrations"
+)
+
+// runMigrate applies the embedded migrations to database_url, or to every
+// shard of the sharded driver. SQLite and memory storage create their schema
+// themselves.
+func runMigrate(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl migrate up [N] | down [N] | version | force VERSION")
+		fmt.Fprintln(os.Stderr, "up applies every pending migration and down reverts one unless N is given")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("want an action")
+	}
+	dsns := []string{cfg.DatabaseURL}
+	switch d := cfg.Storage.Driver; d {
+	case storage.DriverPostgres, "":
+	case storage.DriverSharded:
+		dsns = cfg.Storage.Shards
+	default:
+		return fmt.Errorf("storage driver %q has no migrations", d)
+	}
+
+	action := fs.Arg(0)
+	var n uint64
+	if fs.NArg() == 2 {
+		var err error
+		if n, err = strconv.ParseUint(fs.Arg(1), 10, 64); err != nil {
+			return fmt.Errorf("bad number %q", fs.Arg(1))
+		}
+	} else if action == "down" {
+		n = 1
+	} else if action == "force" {
+		fs.Usage()
+		return errors.New("force needs a version")
+	}
+	if action != "up" && action != "down" && action != "force" && action != "version" {
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	for i, dsn := range dsns {
+		label, shardLog := "", log
+		if len(dsns) > 1 {
+			label = fmt.Sprintf("shard %d: ", i)
+			shardLog = log.With(slog.Int("shard", i))
+		}
+		if err := migrateDatabase(ctx, dsn, label, action, n, shardLog); err != nil {
+			return fmt.Errorf("%s%w", label, err)
+		}
+	}
+	return nil
+}
+
+// migrateDatabase runs action on one database and prints its version after
+// label.
+func migrateDatabase(ctx context.Context, dsn, label, action string, n uint64, log *slog.Logger) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to DB: %w", err)
+	}
+	defer db.Close()
+	m, err := migrate.New(db, migrations.FS, log)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up", "down":
+		step := m.Up
+		if action == "down" {
+			step = m.Down
+		}
+		done, err := step(ctx, int(n))
+		log.Info("Migrations finished", slog.String("direction", action), slog.Int("applied", done))
+		if err != nil {
+			return err
+		}
+	case "force":
+		if err := m.Force(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%sversion %d", label, version)
+	if dirty {
+		fmt.Fprint(os.Stdout, " (dirty)")
+	}
+	fmt.Fprintln(os.Stdout)
+	return nil
+}
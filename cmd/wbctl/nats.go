@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/velvetriddles/wb-level0/internal/config"
+)
+
+func connectNATS(cfg *config.Config) (*nats.Conn, nats.JetStreamContext, error) {
+	nc, err := nats.Connect(cfg.NatsURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("failed to create JetStream: %w", err)
+	}
+	return nc, js, nil
+}
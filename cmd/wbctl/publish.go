@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain/generator"
+	natsclient "github.com/velvetriddles/wb-level0/internal/nats"
+	"golang.org/x/time/rate"
+)
+
+// publishSummary is printed to stdout when publishing finishes.
+type publishSummary struct {
+	Published int            `json:"published"`
+	Mutated   map[string]int `json:"mutated,omitempty"`
+	Duration  time.Duration  `json:"duration_ns"`
+}
+
+// runPublish sends orders to NATS: generated ones, optionally mixed with
+// mutated orders the service must reject, or the lines of an NDJSON file as
+// they are, so that broken records reach the service too.
+func runPublish(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("publish", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl publish [flags]")
+		fs.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\nmutations (the check each one fails):")
+		for _, m := range generator.Mutations {
+			fmt.Fprintf(os.Stderr, "  %-24s %s\n", m.Name, m.Expect)
+		}
+	}
+	file := fs.StringP("file", "f", "", "NDJSON file to publish line by line, - for stdin; orders are generated without it")
+	count := fs.Int("count", 0, "messages to publish (default 1 generated order or the whole file)")
+	perSecond := fs.Float64("rate", 0, "messages per second, 0 for as fast as possible")
+	subject := fs.String("subject", cfg.NatsSubject, "subject to publish to")
+	mutate := fs.Float64("mutate", 0, "share of generated orders to corrupt, 0 to 1")
+	invalid := fs.Bool("invalid", false, "corrupt every generated order, same as --mutate 1")
+	names := fs.StringSlice("mutations", nil, "corrupt orders only with these mutations (default all)")
+	seed := fs.Int64("seed", 0, "generator seed; the same seed gives the same orders, dates aside (default from the clock)")
+	spread := fs.Duration("spread", 30*24*time.Hour, "date_created of generated orders is spread over this long before now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("unexpected arguments")
+	}
+	if *invalid {
+		*mutate = 1
+	}
+	if *mutate < 0 || *mutate > 1 {
+		return fmt.Errorf("--mutate %v is not between 0 and 1", *mutate)
+	}
+	if *file != "" && (*mutate > 0 || len(*names) > 0) {
+		return errors.New("--mutate, --invalid and --mutations apply to generated orders only")
+	}
+	var mutations []generator.Mutation
+	for _, name := range *names {
+		m, ok := generator.MutationNamed(name)
+		if !ok {
+			return fmt.Errorf("unknown mutation %q", name)
+		}
+		mutations = append(mutations, m)
+	}
+
+	var next func() (generator.Sample, error)
+	if *file != "" {
+		in, err := openInput(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		next = lines(in)
+	} else {
+		if *count <= 0 {
+			*count = 1
+		}
+		if !fs.Changed("seed") {
+			*seed = time.Now().UnixNano()
+		}
+		gcfg := generator.DefaultConfig(*seed)
+		gcfg.Spread = *spread
+		gen, err := generator.New(gcfg)
+		if err != nil {
+			return err
+		}
+		log.Info("Generating orders", slog.Int64("seed", *seed), slog.Float64("mutate", *mutate))
+		next = func() (generator.Sample, error) {
+			return gen.Sample(*mutate, mutations), nil
+		}
+	}
+
+	nc, js, err := connectNATS(cfg)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	publisher := natsclient.NewPublisher(js, log)
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if *perSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*perSecond), 1)
+	}
+
+	start := time.Now()
+	summary := publishSummary{Mutated: map[string]int{}}
+	for *count <= 0 || summary.Published < *count {
+		sample, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := publisher.Publish(ctx, *subject, sample.Data); err != nil {
+			return err
+		}
+		summary.Published++
+		if m := sample.Mutation; m != nil {
+			summary.Mutated[m.Name]++
+			log.Debug("Mutated order published",
+				slog.String("orderID", sample.OrderUID),
+				slog.String("mutation", m.Name),
+				slog.String("expect", m.Expect.String()))
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+	summary.Duration = time.Since(start)
+
+	log.Info("Publishing finished",
+		slog.String("subject", *subject),
+		slog.Int("published", summary.Published),
+		slog.Duration("duration", summary.Duration))
+	return json.NewEncoder(os.Stdout).Encode(summary)
+}
+
+// lines returns the non-empty lines of r one by one, then io.EOF.
+func lines(r io.Reader) func() (generator.Sample, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	return func() (generator.Sample, error) {
+		for sc.Scan() {
+			if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+				return generator.Sample{Data: bytes.Clone(line)}, nil
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return generator.Sample{}, err
+		}
+		return generator.Sample{}, io.EOF
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/repository/sharded"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+// runRebalance moves orders to their home shards under storage.shards, e.g.
+// after shards were added to the map, and empties the --drain shards.
+func runRebalance(ctx context.Context, cfg *config.Config, log *slog.Logger, args []string) error {
+	fs := pflag.NewFlagSet("rebalance", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: wbctl rebalance [--drain DSN]... [--dry-run]")
+		fmt.Fprintln(os.Stderr, "after adding shards: switch the service to the new storage.shards first, then rebalance")
+		fmt.Fprintln(os.Stderr, "to remove shards: rebalance with the new storage.shards and --drain, then switch the service and rebalance again")
+		fs.PrintDefaults()
+	}
+	drain := fs.StringArray("drain", nil, "DSN of a shard left out of storage.shards whose orders are moved off it")
+	dryRun := fs.Bool("dry-run", false, "only count the orders to move")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cfg.Storage.Driver != storage.DriverSharded {
+		return errors.New("rebalance needs the sharded storage driver")
+	}
+	for _, dsn := range *drain {
+		for _, s := range cfg.Storage.Shards {
+			if dsn == s {
+				return fmt.Errorf("--drain %s is in storage.shards", dsn)
+			}
+		}
+	}
+
+	shards, closeShards, err := storage.OpenShards(ctx, cfg, cfg.Storage.Shards, log)
+	if err != nil {
+		return err
+	}
+	defer closeShards()
+	drained, closeDrained, err := storage.OpenShards(ctx, cfg, *drain, log)
+	if err != nil {
+		return err
+	}
+	defer closeDrained()
+
+	repo := sharded.NewOrderRepository(shards, log)
+	stats, err := repo.Rebalance(ctx, drained, *dryRun)
+	if encErr := json.NewEncoder(os.Stdout).Encode(stats); encErr != nil && err == nil {
+		err = encErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w (rerun the same command to resume)", err)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+// Package analytics answers aggregate questions about orders: how many came
+// in per hour, day or week, what they brought in per currency and which
+// brands and delivery services lead. Answers come from rollups, counters per
+// time bucket kept up to date as orders are created, so no query scans the
+// orders themselves.
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var tracer = tracing.Tracer("analytics")
+
+// Grain is the length of a time bucket. Buckets are in UTC; weeks start on
+// Monday.
+type Grain string
+
+const (
+	Hour Grain = "hour"
+	Day  Grain = "day"
+	Week Grain = "week"
+)
+
+// Grains lists every grain rollups are kept for.
+var Grains = []Grain{Hour, Day, Week}
+
+// Dimension is what rollups are grouped by besides time.
+type Dimension string
+
+const (
+	// Total rows count every order, under an empty key.
+	Total           Dimension = ""
+	Brand           Dimension = "brand"
+	DeliveryService Dimension = "delivery_service"
+	Provider        Dimension = "provider"
+)
+
+// Dimensions lists every dimension rollups are kept for.
+var Dimensions = []Dimension{Total, Brand, DeliveryService, Provider}
+
+// MaxBuckets caps the number of time buckets a query may span.
+const MaxBuckets = 2000
+
+// ErrInvalidQuery wraps the reasons a query is rejected.
+var ErrInvalidQuery = errors.New("invalid analytics query")
+
+func ParseGrain(s string) (Grain, error) {
+	for _, g := range Grains {
+		if s == string(g) {
+			return g, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown bucket %q, want hour, day or week", ErrInvalidQuery, s)
+}
+
+func ParseDimension(s string) (Dimension, error) {
+	if s == "none" {
+		return Total, nil
+	}
+	for _, d := range Dimensions {
+		if s == string(d) {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown dimension %q, want brand, delivery_service or provider", ErrInvalidQuery, s)
+}
+
+// Start returns the start of the bucket holding t.
+func (g Grain) Start(t time.Time) time.Time {
+	t = t.UTC()
+	switch g {
+	case Hour:
+		return t.Truncate(time.Hour)
+	case Week:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// Next returns the start of the bucket after the one starting at start.
+func (g Grain) Next(start time.Time) time.Time {
+	switch g {
+	case Hour:
+		return start.Add(time.Hour)
+	case Week:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// defaultSpan is the range a query without From covers.
+func (g Grain) defaultSpan() time.Duration {
+	switch g {
+	case Hour:
+		return 48 * time.Hour
+	case Week:
+		return 26 * 7 * 24 * time.Hour
+	default:
+		return 30 * 24 * time.Hour
+	}
+}
+
+// Row holds the counters of one bucket of one grain, for one key of a
+// dimension and one currency. Amounts are in the minor units orders carry
+// them in and are never summed across currencies.
+type Row struct {
+	Grain     Grain     `json:"-"`
+	Start     time.Time `json:"start"`
+	Dimension Dimension `json:"-"`
+	Key       string    `json:"key,omitempty"`
+	Currency  string    `json:"currency"`
+	Orders    int64     `json:"orders"`
+	// Items and Revenue of brand rows count only the items of that brand.
+	Items        int64 `json:"items"`
+	Revenue      int64 `json:"revenue"`
+	DeliveryCost int64 `json:"delivery_cost"`
+}
+
+// Point is a row as served, with the averages derived from it.
+type Point struct {
+	Row
+	AvgBasket float64 `json:"avg_basket"`
+	AvgItems  float64 `json:"avg_items"`
+}
+
+func newPoint(r Row) Point {
+	p := Point{Row: r}
+	if r.Orders > 0 {
+		p.AvgBasket = float64(r.Revenue) / float64(r.Orders)
+		p.AvgItems = float64(r.Items) / float64(r.Orders)
+	}
+	return p
+}
+
+// Query selects rows of one grain and dimension whose bucket starts in
+// [From, To), so the bucket holding From is included and To is exclusive,
+// like in searches.
+type Query struct {
+	Grain     Grain
+	Dimension Dimension
+	From, To  time.Time
+	// Currency and Key narrow the rows down when set.
+	Currency string
+	Key      string
+}
+
+// Store keeps rollup rows.
+type Store interface {
+	// AddRollups adds the counters of rows to the stored rows with the same
+	// grain, start, dimension, key and currency, creating missing ones.
+	// Those must be unique within rows.
+	AddRollups(ctx context.Context, rows []Row) error
+	// Rollups returns the rows matching q ordered by start, key and
+	// currency.
+	Rollups(ctx context.Context, q Query) ([]Row, error)
+	// ClearRollups deletes every row.
+	ClearRollups(ctx context.Context) error
+}
+
+// OrderSource lists the orders rollups are rebuilt from.
+type OrderSource interface {
+	StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) error
+}
+
+type Service struct {
+	store  Store
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+func NewService(store Store, logger *slog.Logger) *Service {
+	return &Service{store: store, logger: logger, now: time.Now}
+}
+
+// RecordOrder counts a new order into every rollup. It is called once per
+// order; counting an order twice counts it double.
+func (s *Service) RecordOrder(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "Service.RecordOrder")
+	defer func() { tracing.End(span, err) }()
+
+	rows := make(map[rowKey]*Row)
+	addOrder(rows, order)
+	if err := s.store.AddRollups(ctx, flatten(rows)); err != nil {
+		return fmt.Errorf("failed to update rollups: %w", err)
+	}
+	return nil
+}
+
+// Series returns the rows of q, one per bucket, key and currency that had
+// orders.
+func (s *Service) Series(ctx context.Context, q Query) (_ []Point, err error) {
+	ctx, span := tracer.Start(ctx, "Service.Series")
+	defer func() { tracing.End(span, err) }()
+
+	if q, err = s.normalize(q); err != nil {
+		return nil, err
+	}
+	rows, err := s.store.Rollups(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollups: %w", err)
+	}
+	points := make([]Point, len(rows))
+	for i, r := range rows {
+		points[i] = newPoint(r)
+	}
+	return points, nil
+}
+
+// Top sums the daily rows of q per key and currency and returns the limit
+// keys with the most orders, then the most revenue. The points start at the
+// first day of the range. q.Grain is ignored.
+func (s *Service) Top(ctx context.Context, q Query, limit int) (_ []Point, err error) {
+	ctx, span := tracer.Start(ctx, "Service.Top")
+	defer func() { tracing.End(span, err) }()
+
+	if q.Dimension == Total {
+		return nil, fmt.Errorf("%w: top needs a dimension", ErrInvalidQuery)
+	}
+	q.Grain = Day
+	if q, err = s.normalize(q); err != nil {
+		return nil, err
+	}
+	rows, err := s.store.Rollups(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollups: %w", err)
+	}
+
+	sums := make(map[rowKey]*Row)
+	for _, r := range rows {
+		r.Start = q.From
+		add(sums, r)
+	}
+	top := flatten(sums)
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i], top[j]
+		if a.Orders != b.Orders {
+			return a.Orders > b.Orders
+		}
+		if a.Revenue != b.Revenue {
+			return a.Revenue > b.Revenue
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Currency < b.Currency
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	points := make([]Point, len(top))
+	for i, r := range top {
+		points[i] = newPoint(r)
+	}
+	span.SetAttributes(attribute.Int("analytics.keys", len(sums)))
+	return points, nil
+}
+
+// Rebuild replaces every rollup with one counted from the orders of source,
+// cancelled ones included, since they were counted when they were created.
+// It fixes rollups that drifted from the orders: orders imported or written
+// while rollups failed, and orders changed after they were created, which
+// rollups do not follow. Orders created during a rebuild may be missed.
+func (s *Service) Rebuild(ctx context.Context, source OrderSource) (n int, err error) {
+	ctx, span := tracer.Start(ctx, "Service.Rebuild")
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.store.ClearRollups(ctx); err != nil {
+		return 0, fmt.Errorf("failed to clear rollups: %w", err)
+	}
+	// orders come newest first, so hourly buckets of a batch rarely repeat
+	// in the next one and batches stay small
+	const batchSize = 500
+	rows := make(map[rowKey]*Row)
+	flush := func() error {
+		if err := s.store.AddRollups(ctx, flatten(rows)); err != nil {
+			return fmt.Errorf("failed to update rollups: %w", err)
+		}
+		clear(rows)
+		return nil
+	}
+	err = source.StreamOrders(ctx, domain.SearchQuery{IncludeDeleted: true}, func(o *domain.Order) error {
+		addOrder(rows, o)
+		n++
+		if n%batchSize == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(rows) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return n, err
+	}
+	span.SetAttributes(attribute.Int("analytics.orders", n))
+	s.logger.InfoContext(ctx, "Rollups rebuilt", slog.Int("orders", n))
+	return n, nil
+}
+
+// normalize validates q, fills in the default range ending now and moves
+// From to the start of its bucket.
+func (s *Service) normalize(q Query) (Query, error) {
+	if _, err := ParseGrain(string(q.Grain)); err != nil {
+		return q, err
+	}
+	if _, err := ParseDimension(string(q.Dimension)); err != nil {
+		return q, err
+	}
+	if q.To.IsZero() {
+		q.To = s.now()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-q.Grain.defaultSpan())
+	}
+	q.From = q.Grain.Start(q.From)
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from must be before to", ErrInvalidQuery)
+	}
+	buckets := 0
+	for t := q.From; t.Before(q.To); t = q.Grain.Next(t) {
+		if buckets++; buckets > MaxBuckets {
+			return q, fmt.Errorf("%w: the range spans more than %d buckets", ErrInvalidQuery, MaxBuckets)
+		}
+	}
+	q.Currency = strings.ToUpper(q.Currency)
+	return q, nil
+}
+
+type rowKey struct {
+	grain     Grain
+	start     int64
+	dimension Dimension
+	key       string
+	currency  string
+}
+
+// add merges r into rows.
+func add(rows map[rowKey]*Row, r Row) {
+	k := rowKey{r.Grain, r.Start.Unix(), r.Dimension, r.Key, r.Currency}
+	sum, ok := rows[k]
+	if !ok {
+		rows[k] = &r
+		return
+	}
+	sum.Orders += r.Orders
+	sum.Items += r.Items
+	sum.Revenue += r.Revenue
+	sum.DeliveryCost += r.DeliveryCost
+}
+
+// addOrder adds the rows an order counts into, for every grain and
+// dimension.
+func addOrder(rows map[rowKey]*Row, o *domain.Order) {
+	currency := strings.ToUpper(o.Payment.Currency)
+	order := Row{
+		Currency:     currency,
+		Orders:       1,
+		Items:        int64(len(o.Items)),
+		Revenue:      int64(o.Payment.Amount),
+		DeliveryCost: int64(o.Payment.DeliveryCost),
+	}
+	brands := make(map[string]*Row)
+	for _, it := range o.Items {
+		b, ok := brands[it.Brand]
+		if !ok {
+			b = &Row{Dimension: Brand, Key: it.Brand, Currency: currency, Orders: 1}
+			brands[it.Brand] = b
+		}
+		b.Items++
+		b.Revenue += int64(it.TotalPrice)
+	}
+
+	for _, g := range Grains {
+		start := g.Start(o.DateCreated)
+		for _, d := range []Dimension{Total, DeliveryService, Provider} {
+			r := order
+			r.Grain, r.Start, r.Dimension = g, start, d
+			switch d {
+			case DeliveryService:
+				r.Key = o.DeliveryService
+			case Provider:
+				r.Key = o.Payment.Provider
+			}
+			add(rows, r)
+		}
+		for _, b := range brands {
+			r := *b
+			r.Grain, r.Start = g, start
+			add(rows, r)
+		}
+	}
+}
+
+func flatten(rows map[rowKey]*Row) []Row {
+	out := make([]Row, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, *r)
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package analytics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Monday, 4 March 2024
+var monday = time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+func order(uid string, created time.Time, currency string, brands ...string) *domain.Order {
+	o := repotest.NewOrder(uid, len(brands))
+	o.DateCreated = created
+	o.Payment.Currency = currency
+	for i, b := range brands {
+		o.Items[i].Brand = b
+	}
+	return o
+}
+
+// record stores and counts orders like OrderService.CreateOrder.
+func record(t *testing.T, repo *memory.OrderRepository, s *analytics.Service, orders ...*domain.Order) {
+	t.Helper()
+	for _, o := range orders {
+		if err := repo.SaveOrder(context.Background(), o); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+		if err := s.RecordOrder(context.Background(), o); err != nil {
+			t.Fatalf("RecordOrder: %v", err)
+		}
+	}
+}
+
+func sample() []*domain.Order {
+	return []*domain.Order{
+		order("a", monday.Add(9*time.Hour), "USD", "Acme", "Acme"),
+		order("b", monday.Add(9*time.Hour+30*time.Minute), "usd", "Zeta"),
+		order("c", monday.Add(33*time.Hour), "RUB", "Acme", "Zeta"),
+		// Sunday belongs to the same week
+		order("d", monday.AddDate(0, 0, 6).Add(23*time.Hour), "USD", "Zeta"),
+	}
+}
+
+func TestGrainStart(t *testing.T) {
+	at := time.Date(2024, 3, 10, 23, 45, 0, 0, time.FixedZone("MSK", 3*3600))
+	for grain, want := range map[analytics.Grain]time.Time{
+		analytics.Hour: time.Date(2024, 3, 10, 20, 0, 0, 0, time.UTC),
+		analytics.Day:  time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+		analytics.Week: monday,
+	} {
+		if got := grain.Start(at); !got.Equal(want) {
+			t.Errorf("%s: want %v, got %v", grain, want, got)
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	repo := memory.NewOrderRepository(logger)
+	s := analytics.NewService(repo, logger)
+	record(t, repo, s, sample()...)
+	ctx := context.Background()
+
+	days, err := s.Series(ctx, analytics.Query{Grain: analytics.Day, From: monday, To: monday.AddDate(0, 0, 7)})
+	if err != nil {
+		t.Fatalf("Series: %v", err)
+	}
+	type bucket struct {
+		day      int
+		currency string
+		orders   int64
+		revenue  int64
+	}
+	var got []bucket
+	for _, p := range days {
+		got = append(got, bucket{p.Start.Day(), p.Currency, p.Orders, p.Revenue})
+	}
+	// every sample order pays 1817; currencies are upper-cased and kept apart
+	want := []bucket{{4, "USD", 2, 3634}, {5, "RUB", 1, 1817}, {10, "USD", 1, 1817}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("daily series: want %+v, got %+v", want, got)
+	}
+	if days[0].AvgBasket != 1817 || days[0].AvgItems != 1.5 {
+		t.Errorf("averages: want 1817 and 1.5, got %v and %v", days[0].AvgBasket, days[0].AvgItems)
+	}
+
+	weeks, err := s.Series(ctx, analytics.Query{Grain: analytics.Week, From: monday, To: monday.AddDate(0, 0, 7), Currency: "usd"})
+	if err != nil || len(weeks) != 1 || weeks[0].Orders != 3 || !weeks[0].Start.Equal(monday) {
+		t.Errorf("weekly series in USD: want one week of 3 orders, got %+v, %v", weeks, err)
+	}
+
+	brands, err := s.Series(ctx, analytics.Query{Grain: analytics.Hour, Dimension: analytics.Brand,
+		From: monday.Add(9 * time.Hour), To: monday.Add(10 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Series by brand: %v", err)
+	}
+	if len(brands) != 2 || brands[0].Key != "Acme" || brands[0].Orders != 1 || brands[0].Items != 2 || brands[0].Revenue != 634 {
+		t.Errorf("hourly series by brand: want Acme with 1 order of 2 items worth 634 first, got %+v", brands)
+	}
+}
+
+func TestTop(t *testing.T) {
+	repo := memory.NewOrderRepository(logger)
+	s := analytics.NewService(repo, logger)
+	record(t, repo, s, sample()...)
+
+	top, err := s.Top(context.Background(), analytics.Query{Dimension: analytics.Brand, From: monday,
+		To: monday.AddDate(0, 0, 7), Currency: "USD"}, 1)
+	if err != nil {
+		t.Fatalf("Top: %v", err)
+	}
+	if len(top) != 1 || top[0].Key != "Zeta" || top[0].Orders != 2 {
+		t.Errorf("top brand in USD: want Zeta with 2 orders, got %+v", top)
+	}
+
+	_, err = s.Top(context.Background(), analytics.Query{}, 1)
+	if !errors.Is(err, analytics.ErrInvalidQuery) {
+		t.Errorf("Top without a dimension: want ErrInvalidQuery, got %v", err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	s := analytics.NewService(memory.NewOrderRepository(logger), logger)
+	for name, q := range map[string]analytics.Query{
+		"too many buckets": {Grain: analytics.Hour, From: monday, To: monday.AddDate(1, 0, 0)},
+		"reversed range":   {Grain: analytics.Day, From: monday, To: monday.AddDate(0, 0, -1)},
+		"unknown grain":    {Grain: "month"},
+	} {
+		if _, err := s.Series(context.Background(), q); !errors.Is(err, analytics.ErrInvalidQuery) {
+			t.Errorf("%s: want ErrInvalidQuery, got %v", name, err)
+		}
+	}
+}
+
+func TestRebuildMatchesIncrementalRollups(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewOrderRepository(logger)
+	s := analytics.NewService(repo, logger)
+	record(t, repo, s, sample()...)
+	q := analytics.Query{Grain: analytics.Hour, Dimension: analytics.Brand, From: monday, To: monday.AddDate(0, 0, 7)}
+	want, err := s.Series(ctx, q)
+	if err != nil {
+		t.Fatalf("Series: %v", err)
+	}
+
+	// an imported order is stored without being counted
+	if err := repo.SaveOrder(ctx, order("e", monday.Add(time.Hour), "USD", "Acme")); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	n, err := s.Rebuild(ctx, repo)
+	if err != nil || n != 5 {
+		t.Fatalf("Rebuild: want 5 orders, got %d, %v", n, err)
+	}
+	got, err := s.Series(ctx, q)
+	if err != nil {
+		t.Fatalf("Series: %v", err)
+	}
+	if len(got) != len(want)+1 || !reflect.DeepEqual(got[1:], want) {
+		t.Errorf("after rebuild: want the imported order added to %+v, got %+v", want, got)
+	}
+}
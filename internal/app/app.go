@@ -0,0 +1,582 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/delivery/rest/handlers"
+	"github.com/velvetriddles/wb-level0/internal/delivery/rest/middleware"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/feed"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+	natsClient "github.com/velvetriddles/wb-level0/internal/nats"
+	"github.com/velvetriddles/wb-level0/internal/ratelimit"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/repository/cache"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+	"github.com/velvetriddles/wb-level0/internal/retention"
+	"github.com/velvetriddles/wb-level0/internal/service"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+)
+
+// Phase orders shutdown. Stop hooks of an earlier phase finish before any
+// hook of a later phase runs, regardless of startup order.
+type Phase int
+
+const (
+	// PhaseStopConsuming stops taking new work from NATS.
+	PhaseStopConsuming Phase = iota
+	// PhaseDrain waits for messages that are already being handled.
+	PhaseDrain
+	// PhaseFlush pushes buffered outgoing data (acks, publishes) to NATS.
+	PhaseFlush
+	// PhaseHTTP stops the HTTP server and waits for open requests.
+	PhaseHTTP
+	// PhaseClose releases connections: storage and NATS.
+	PhaseClose
+)
+
+var phaseNames = map[Phase]string{
+	PhaseStopConsuming: "stop consuming",
+	PhaseDrain:         "drain in-flight",
+	PhaseFlush:         "flush outbox",
+	PhaseHTTP:          "close http",
+	PhaseClose:         "close connections",
+}
+
+func (p Phase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("phase %d", int(p))
+}
+
+// Hook is a component taking part in the app lifecycle. Start hooks run in
+// registration order; Stop hooks run phase by phase, and in reverse
+// registration order inside a phase. Either func may be nil.
+type Hook struct {
+	Name  string
+	Phase Phase
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Option customises an App built by New.
+type Option func(a *App)
+
+// WithReloader lets the app follow config reloads and serve /admin/config.
+func WithReloader(r *config.Reloader) Option {
+	return func(a *App) {
+		a.reloader = r
+	}
+}
+
+// App wires storage, cache, service, NATS subscriber and HTTP server the same
+// way for the binary and for tests.
+type App struct {
+	cfg    *config.Config
+	logger *slog.Logger
+
+	hooks   []Hook
+	started []Hook
+
+	reloader    *config.Reloader
+	cancelWatch context.CancelFunc
+
+	shutdownTracing func(context.Context) error
+	watcherDone     chan struct{}
+
+	repo       storage.Repository
+	cache      *cache.OrderCache
+	service    *service.OrderService
+	limiter    *ratelimit.Limiter
+	dbReads    *ratelimit.Concurrency
+	feed       *feed.Hub
+	analytics  *analytics.Service
+	retention  *retention.Job
+	nc         *nats.Conn
+	js         nats.JetStreamContext
+	subscriber *natsClient.Subscriber
+	srv        *http.Server
+	listener   net.Listener
+	serveErr   chan error
+}
+
+func New(cfg *config.Config, logger *slog.Logger, opts ...Option) *App {
+	a := &App{
+		cfg:      cfg,
+		logger:   logger,
+		serveErr: make(chan error, 1),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	a.hooks = []Hook{
+		// registered first so that it is closed last and sees every span
+		{Name: "tracing", Phase: PhaseClose, Start: a.startTracing, Stop: a.stopTracing},
+		{Name: "storage", Phase: PhaseClose, Start: a.startStorage, Stop: a.closeStorage},
+		{Name: "cache", Start: a.startCache},
+		{Name: "nats", Phase: PhaseClose, Start: a.startNATS, Stop: a.closeNATS},
+		{Name: "nats outbox", Phase: PhaseFlush, Stop: a.flushNATS},
+		// after nats, as the job broadcasts its evictions from its first run
+		{Name: "retention", Phase: PhaseStopConsuming, Start: a.startRetention, Stop: a.stopRetention},
+		{Name: "subscriber", Phase: PhaseStopConsuming, Start: a.startSubscriber, Stop: a.stopSubscriber},
+		{Name: "subscriber drain", Phase: PhaseDrain, Stop: a.drainSubscriber},
+		{Name: "http", Phase: PhaseHTTP, Start: a.startHTTP, Stop: a.stopHTTP},
+	}
+	if a.reloader != nil {
+		a.hooks = append(a.hooks, Hook{Name: "config watcher", Phase: PhaseStopConsuming, Start: a.startWatcher, Stop: a.stopWatcher})
+	}
+	return a
+}
+
+// AddHook registers an extra component. It must be called before Start;
+// its Start runs after every built-in component is up.
+func (a *App) AddHook(h Hook) {
+	a.hooks = append(a.hooks, h)
+}
+
+// Start brings components up in order. If one fails, the ones already
+// started are stopped before the error is returned.
+func (a *App) Start(ctx context.Context) error {
+	begin := time.Now()
+	for _, h := range a.hooks {
+		stepStart := time.Now()
+		if h.Start != nil {
+			if err := h.Start(ctx); err != nil {
+				a.logger.Error("Component failed to start",
+					slog.String("component", h.Name),
+					slog.String("error", err.Error()))
+
+				stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if stopErr := a.Stop(stopCtx); stopErr != nil {
+					err = errors.Join(err, stopErr)
+				}
+				return fmt.Errorf("failed to start %s: %w", h.Name, err)
+			}
+			a.logger.Info("Component started",
+				slog.String("component", h.Name),
+				slog.String("duration", time.Since(stepStart).String()))
+		}
+		a.started = append(a.started, h)
+	}
+
+	a.logger.Info("Application started", slog.String("duration", time.Since(begin).String()))
+	return nil
+}
+
+// Stop shuts down every started component phase by phase. It keeps going
+// when a hook fails and returns all errors joined.
+func (a *App) Stop(ctx context.Context) error {
+	begin := time.Now()
+	var errs []error
+
+	for phase := PhaseStopConsuming; phase <= PhaseClose; phase++ {
+		phaseStart := time.Now()
+		ran := false
+		for i := len(a.started) - 1; i >= 0; i-- {
+			h := a.started[i]
+			if h.Phase != phase || h.Stop == nil {
+				continue
+			}
+			ran = true
+			if err := h.Stop(ctx); err != nil {
+				a.logger.Error("Component failed to stop",
+					slog.String("component", h.Name),
+					slog.String("phase", phase.String()),
+					slog.String("error", err.Error()))
+				errs = append(errs, fmt.Errorf("%s: %w", h.Name, err))
+			}
+		}
+		if ran {
+			a.logger.Info("Shutdown phase finished",
+				slog.String("phase", phase.String()),
+				slog.String("duration", time.Since(phaseStart).String()))
+		}
+	}
+	a.started = nil
+
+	a.logger.Info("Application stopped", slog.String("duration", time.Since(begin).String()))
+	return errors.Join(errs...)
+}
+
+// Err reports a fatal HTTP server error after a successful Start.
+func (a *App) Err() <-chan error {
+	return a.serveErr
+}
+
+// Router builds the HTTP routes. /metrics is open; everything else goes
+// through authentication, updating and cancelling an order need the support
+// or admin role and /admin needs the admin role.
+func (a *App) Router() (http.Handler, error) {
+	httpLogger := logger.Component(a.logger, "http")
+	redactor := redact.New(a.cfg.Redaction.HashKey)
+	orderHandler := handlers.NewOrderHandler(a.service, redactor, httpLogger)
+	if a.js != nil && a.cfg.NatsCancelSubject != "" {
+		orderHandler.SetCancelPublisher(natsClient.NewPublisher(a.js, logger.Component(a.logger, "nats")), a.cfg.NatsCancelSubject)
+	}
+	feedHandler := handlers.NewFeedHandler(a.feed, redactor, a.cfg.Feed.Heartbeat, httpLogger)
+	exportHandler := handlers.NewExportHandler(a.service, redactor, httpLogger)
+	analyticsHandler := handlers.NewAnalyticsHandler(a.analytics, httpLogger)
+
+	r := mux.NewRouter()
+	r.Use(middleware.Tracing)
+	r.Use(middleware.Correlation)
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+
+	api := r.NewRoute().Subrouter()
+	if a.cfg.Auth.Enabled() {
+		authenticators, err := newAuthenticators(a.cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		api.Use(middleware.Authenticate(authenticators, auth.Role(a.cfg.Auth.AnonymousRole), httpLogger))
+	} else {
+		a.logger.Warn("No authentication configured, every request gets the default role",
+			slog.String("role", a.cfg.Redaction.DefaultRole))
+		api.Use(middleware.DefaultRole(auth.Role(a.cfg.Redaction.DefaultRole)))
+	}
+	api.Use(middleware.RateLimit(a.limiter, a.cfg.RateLimit.TrustProxy, httpLogger))
+	api.HandleFunc("/orders", orderHandler.ListOrders).Methods(http.MethodGet).Name("orders_list")
+	// registered before /orders/{id}, which would match them too
+	api.HandleFunc("/orders/search", orderHandler.SearchOrders).Methods(http.MethodGet).Name("orders_search")
+	api.HandleFunc("/orders/export", exportHandler.Export).Methods(http.MethodGet).Name("orders_export")
+	api.HandleFunc("/orders/stream", feedHandler.Stream).Methods(http.MethodGet).Name("orders_stream")
+	api.HandleFunc("/orders/ws", feedHandler.WebSocket).Methods(http.MethodGet).Name("orders_ws")
+	api.HandleFunc("/orders/{id}", orderHandler.GetOrder).Methods(http.MethodGet).Name("order_get")
+	api.HandleFunc("/orders/{id}/versions", orderHandler.OrderVersions).Methods(http.MethodGet).Name("order_versions")
+	writers := middleware.RequireRole(httpLogger, auth.RoleSupport, auth.RoleAdmin)
+	api.Handle("/orders/{id}", writers(http.HandlerFunc(orderHandler.UpdateOrder))).Methods(http.MethodPut).Name("order_update")
+	api.Handle("/orders/{id}", writers(http.HandlerFunc(orderHandler.CancelOrder))).Methods(http.MethodDelete).Name("order_cancel")
+	api.HandleFunc("/analytics", analyticsHandler.Dashboard).Methods(http.MethodGet).Name("analytics_dashboard")
+	api.HandleFunc("/analytics/series", analyticsHandler.Series).Methods(http.MethodGet).Name("analytics_series")
+	api.HandleFunc("/analytics/top", analyticsHandler.Top).Methods(http.MethodGet).Name("analytics_top")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.RequireRole(httpLogger, auth.RoleAdmin))
+	cacheHandler := handlers.NewCacheHandler(a.cache, httpLogger)
+	admin.HandleFunc("/cache", cacheHandler.Stats).Methods(http.MethodGet).Name("admin_cache")
+	admin.HandleFunc("/cache/refresh", cacheHandler.Refresh).Methods(http.MethodPost).Name("admin_cache_refresh")
+	admin.HandleFunc("/cache/flush", cacheHandler.Flush).Methods(http.MethodPost).Name("admin_cache_flush")
+	if a.reloader != nil {
+		adminHandler := handlers.NewAdminHandler(a.reloader, httpLogger)
+		admin.HandleFunc("/config", adminHandler.GetConfig).Methods(http.MethodGet).Name("admin_config")
+	}
+	retentionHandler := handlers.NewRetentionHandler(a.retention, httpLogger)
+	admin.HandleFunc("/retention", retentionHandler.Runs).Methods(http.MethodGet).Name("admin_retention")
+	admin.HandleFunc("/retention/run", retentionHandler.Run).Methods(http.MethodPost).Name("admin_retention_run")
+	return r, nil
+}
+
+func newAuthenticators(cfg config.AuthConfig) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	if len(cfg.APIKeys) > 0 {
+		keys := make([]auth.APIKey, len(cfg.APIKeys))
+		for i, k := range cfg.APIKeys {
+			keys[i] = auth.APIKey{Name: k.Name, Key: k.Key, Role: auth.Role(k.Role)}
+		}
+		authenticators = append(authenticators, auth.NewAPIKeys(keys))
+	}
+	if len(cfg.HMAC.Clients) > 0 {
+		clients := make([]auth.HMACClient, len(cfg.HMAC.Clients))
+		for i, c := range cfg.HMAC.Clients {
+			clients[i] = auth.HMACClient{ID: c.ID, Secret: c.Secret, Role: auth.Role(c.Role)}
+		}
+		authenticators = append(authenticators, auth.NewHMAC(clients, cfg.HMAC.MaxSkew))
+	}
+	if cfg.JWT.JWKSFile != "" {
+		jwtAuth, err := auth.NewJWT(auth.JWTOptions{
+			JWKSFile:  cfg.JWT.JWKSFile,
+			Issuer:    cfg.JWT.Issuer,
+			Audience:  cfg.JWT.Audience,
+			RoleClaim: cfg.JWT.RoleClaim,
+		})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwtAuth)
+	}
+	return authenticators, nil
+}
+
+// Addr is the address the HTTP server actually listens on, which differs from
+// the configured one when the port is ":0".
+func (a *App) Addr() string {
+	if a.listener == nil {
+		return ""
+	}
+	return a.listener.Addr().String()
+}
+
+// JetStream exposes the app's JetStream context, e.g. for publishing in tests.
+func (a *App) JetStream() nats.JetStreamContext {
+	return a.js
+}
+
+func (a *App) startTracing(ctx context.Context) error {
+	shutdown, err := tracing.Setup(ctx, tracing.Options{
+		Exporter:    a.cfg.Tracing.Exporter,
+		Endpoint:    a.cfg.Tracing.Endpoint,
+		Insecure:    a.cfg.Tracing.Insecure,
+		File:        a.cfg.Tracing.File,
+		SampleRatio: a.cfg.Tracing.SampleRatio,
+		ServiceName: a.cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	a.shutdownTracing = shutdown
+	return nil
+}
+
+func (a *App) stopTracing(ctx context.Context) error {
+	return a.shutdownTracing(ctx)
+}
+
+func (a *App) startStorage(ctx context.Context) error {
+	repo, err := storage.NewOrderRepository(ctx, a.cfg, logger.Component(a.logger, "storage"))
+	if err != nil {
+		return err
+	}
+	a.repo = repo
+	return nil
+}
+
+func (a *App) closeStorage(ctx context.Context) error {
+	return a.repo.Close()
+}
+
+func (a *App) startCache(ctx context.Context) error {
+	a.cache = cache.NewOrderCache(logger.Component(a.logger, "cache"), a.repo)
+	if err := a.cache.Restore(ctx); err != nil {
+		return err
+	}
+	a.service = service.NewOrderService(a.repo, a.cache, logger.Component(a.logger, "service"))
+	a.dbReads = ratelimit.NewConcurrency(a.cfg.RateLimit.DBConcurrency, a.cfg.RateLimit.DBWait)
+	a.service.SetReadLimiter(a.dbReads)
+	a.feed = feed.NewHub(a.cfg.Feed.History, a.cfg.Feed.ClientBuffer)
+	a.service.SetNotifier(a.feed)
+	a.analytics = analytics.NewService(a.repo, logger.Component(a.logger, "analytics"))
+	a.service.SetAnalytics(a.analytics)
+	a.limiter = ratelimit.NewLimiter(ratelimit.Budget{}, nil)
+	a.applyRuntimeConfig(a.cfg)
+	return nil
+}
+
+// startRetention builds the retention job and the archive it moves orders
+// to, which the service then falls back on for orders missing from storage.
+// The job can always be run through /admin/retention/run; it runs on its own
+// only with an interval and a policy configured.
+func (a *App) startRetention(ctx context.Context) error {
+	cfg := a.cfg.Retention
+	var archive retention.Archive = a.repo
+	if cfg.Archive == retention.ArchiveNDJSON {
+		ndjson, err := retention.NewNDJSONArchive(cfg.ArchiveDir)
+		if err != nil {
+			return err
+		}
+		archive = ndjson
+	}
+	a.service.SetArchive(archive)
+
+	a.retention = retention.NewJob(a.repo, archive, a.cache, retention.Policy{
+		ArchiveAfter:  cfg.ArchiveAfterMonths,
+		PurgePIIAfter: cfg.PurgePIIAfterMonths,
+		Archive:       cfg.Archive,
+		BatchSize:     cfg.BatchSize,
+	}, logger.Component(a.logger, "retention"))
+	if a.cfg.NatsEvictSubject != "" {
+		a.retention.SetBroadcaster(evictionBroadcast{
+			publisher: natsClient.NewPublisher(a.js, logger.Component(a.logger, "nats")),
+			subject:   a.cfg.NatsEvictSubject,
+		})
+	}
+	if cfg.Interval > 0 && cfg.Enabled() {
+		a.retention.Start(cfg.Interval)
+	}
+	return nil
+}
+
+func (a *App) stopRetention(ctx context.Context) error {
+	return a.retention.Stop(ctx)
+}
+
+// evictionBatch bounds the ids per eviction message, keeping it well under
+// domain.MaxOrderSize.
+const evictionBatch = 500
+
+// evictionBroadcast publishes the retention job's evictions to every
+// instance, this one included.
+type evictionBroadcast struct {
+	publisher *natsClient.Publisher
+	subject   string
+}
+
+func (b evictionBroadcast) BroadcastEviction(ctx context.Context, ids []string, reason string) error {
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), evictionBatch)]
+		ids = ids[len(batch):]
+		if err := b.publisher.PublishEviction(ctx, b.subject, domain.Eviction{OrderUIDs: batch, Reason: reason}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRuntimeConfig pushes the settings that may change on reload into the
+// running components.
+func (a *App) applyRuntimeConfig(cfg *config.Config) {
+	a.cache.SetLimit(cfg.Cache.MaxEntries)
+	a.service.SetRules(domain.Rules{
+		GoodsTotal: cfg.Validation.GoodsTotal,
+		Amount:     cfg.Validation.Amount,
+		ItemTotal:  cfg.Validation.ItemTotal,
+	})
+
+	routes := make(map[string]ratelimit.Budget, len(cfg.RateLimit.Routes))
+	for route, b := range cfg.RateLimit.Routes {
+		routes[route] = ratelimit.Budget{Rate: b.Rate, Burst: b.Burst}
+	}
+	def := cfg.RateLimit.Default
+	a.limiter.SetBudgets(ratelimit.Budget{Rate: def.Rate, Burst: def.Burst}, routes)
+	a.limiter.SetEnabled(cfg.RateLimit.Enabled)
+	a.dbReads.SetLimit(cfg.RateLimit.DBConcurrency, cfg.RateLimit.DBWait)
+}
+
+func (a *App) startWatcher(ctx context.Context) error {
+	a.reloader.OnReload(a.applyRuntimeConfig)
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	a.cancelWatch = cancel
+	a.watcherDone = make(chan struct{})
+	go func() {
+		defer close(a.watcherDone)
+		if err := a.reloader.Watch(watchCtx); err != nil {
+			a.logger.Error("Config watcher stopped", slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (a *App) stopWatcher(ctx context.Context) error {
+	a.cancelWatch()
+	select {
+	case <-a.watcherDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *App) startNATS(ctx context.Context) error {
+	nc, err := nats.Connect(a.cfg.NatsURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	a.nc = nc
+
+	a.js, err = nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to create JetStream: %w", err)
+	}
+
+	_, err = a.js.AddStream(&nats.StreamConfig{
+		Name:     natsClient.StreamName,
+		Subjects: []string{"orders.*"},
+	}, nats.Context(ctx))
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to create stream: %w", err)
+	}
+	return nil
+}
+
+func (a *App) flushNATS(ctx context.Context) error {
+	if a.nc.IsClosed() {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return a.nc.FlushTimeout(5 * time.Second)
+	}
+	return a.nc.FlushWithContext(ctx)
+}
+
+func (a *App) closeNATS(ctx context.Context) error {
+	a.nc.Close()
+	return nil
+}
+
+func (a *App) startSubscriber(ctx context.Context) error {
+	a.subscriber = natsClient.NewSubscriber(a.js, logger.Component(a.logger, "nats"), a.service)
+	a.subscriber.SetDeadLetterSubject(a.cfg.NatsDLQSubject)
+	if err := a.subscriber.Subscribe(a.cfg.NatsSubject); err != nil {
+		return err
+	}
+	if a.cfg.NatsUpdateSubject != "" {
+		if err := a.subscriber.SubscribeUpdates(a.cfg.NatsUpdateSubject); err != nil {
+			return err
+		}
+	}
+	if a.cfg.NatsCancelSubject != "" {
+		if err := a.subscriber.SubscribeCancellations(a.cfg.NatsCancelSubject); err != nil {
+			return err
+		}
+	}
+	if a.cfg.NatsEvictSubject == "" {
+		return nil
+	}
+	return a.subscriber.SubscribeEvictions(a.cfg.NatsEvictSubject)
+}
+
+func (a *App) stopSubscriber(ctx context.Context) error {
+	return a.subscriber.Unsubscribe()
+}
+
+func (a *App) drainSubscriber(ctx context.Context) error {
+	return a.subscriber.Wait(ctx)
+}
+
+func (a *App) startHTTP(ctx context.Context) error {
+	handler, err := a.Router()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", a.cfg.HTTPPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", a.cfg.HTTPPort, err)
+	}
+	a.listener = listener
+	a.srv = &http.Server{Handler: handler}
+	// feed streams never end on their own; close them so Shutdown can finish
+	a.srv.RegisterOnShutdown(a.feed.Close)
+
+	go func() {
+		a.logger.Info("Server starting", "addr", listener.Addr().String())
+		if err := a.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("Server failed", "error", err)
+			a.serveErr <- err
+		}
+	}()
+	return nil
+}
+
+func (a *App) stopHTTP(ctx context.Context) error {
+	if err := a.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,905 @@
+package app_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/app"
+	"github.com/velvetriddles/wb-level0/internal/app/apptest"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/domain/generator"
+	natsClient "github.com/velvetriddles/wb-level0/internal/nats"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const waitTimeout = 5 * time.Second
+
+func TestPublishedOrderIsServed(t *testing.T) {
+	for _, driver := range []string{storage.DriverMemory, storage.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			h := apptest.Start(t, apptest.WithStorage(driver, filepath.Join(t.TempDir(), "wb.db")))
+
+			order := repotest.NewOrder("b563feb7b2b84b6test", 2)
+			h.Publish(order)
+
+			body := h.WaitFor("/orders/"+order.OrderUID, http.StatusOK, waitTimeout)
+			for _, want := range []string{order.OrderUID, order.TrackNumber, order.Delivery.City, order.Items[1].RID} {
+				if !strings.Contains(body, want) {
+					t.Errorf("detail page does not contain %q", want)
+				}
+			}
+
+			code, body := h.Get("/orders")
+			if code != http.StatusOK {
+				t.Fatalf("GET /orders: want 200, got %d", code)
+			}
+			if !strings.Contains(body, order.OrderUID) {
+				t.Errorf("list page does not contain %q", order.OrderUID)
+			}
+		})
+	}
+}
+
+func TestPersonalDataIsRedactedByRole(t *testing.T) {
+	order := repotest.NewOrder("pii", 1)
+	// html/template escapes the leading +
+	phone := strings.TrimPrefix(order.Delivery.Phone, "+")
+
+	viewer := apptest.Start(t)
+	viewer.Publish(order)
+	body := viewer.WaitFor("/orders/pii", http.StatusOK, waitTimeout)
+	if strings.Contains(body, order.Delivery.Email) || strings.Contains(body, phone) {
+		t.Errorf("viewer detail page shows personal data:\n%s", body)
+	}
+	if !strings.Contains(body, "t***@gmail.com") {
+		t.Errorf("viewer detail page does not contain the masked email")
+	}
+	_, body = viewer.Get("/orders/pii?format=json")
+	if strings.Contains(body, order.Delivery.Email) || !strings.Contains(body, `"order_uid":"pii"`) {
+		t.Errorf("viewer JSON response: want redacted order, got %s", body)
+	}
+
+	support := apptest.Start(t, apptest.WithRole("support"))
+	support.Publish(order)
+	body = support.WaitFor("/orders/pii", http.StatusOK, waitTimeout)
+	for _, want := range []string{order.Delivery.Email, phone, order.Delivery.Address} {
+		if !strings.Contains(body, want) {
+			t.Errorf("support detail page does not contain %q", want)
+		}
+	}
+}
+
+func TestAPIRequiresAuthentication(t *testing.T) {
+	h := apptest.Start(t,
+		apptest.WithAPIKey("dashboard", "viewer-key", "viewer"),
+		apptest.WithAPIKey("support", "support-key", "support"))
+	order := repotest.NewOrder("authed", 1)
+	h.Publish(order)
+
+	h.Header = http.Header{"X-Api-Key": {"support-key"}}
+	body := h.WaitFor("/orders/authed", http.StatusOK, waitTimeout)
+	if !strings.Contains(body, order.Delivery.Email) {
+		t.Errorf("support key: want the full order")
+	}
+
+	h.Header = http.Header{"X-Api-Key": {"viewer-key"}}
+	if _, body := h.Get("/orders/authed"); strings.Contains(body, order.Delivery.Email) {
+		t.Errorf("viewer key: want personal data redacted")
+	}
+	if code, _ := h.Get("/metrics"); code != http.StatusOK {
+		t.Errorf("GET /metrics: want 200 without credentials, got %d", code)
+	}
+
+	for _, header := range []http.Header{nil, {"X-Api-Key": {"wrong"}}} {
+		h.Header = header
+		if code, _ := h.Get("/orders/authed"); code != http.StatusUnauthorized {
+			t.Errorf("GET with %v: want 401, got %d", header, code)
+		}
+	}
+
+	_, metrics := h.Get("/metrics")
+	if !strings.Contains(metrics, `wb_auth_failures_total{method="api_key",reason="invalid"}`) {
+		t.Errorf("auth failures not counted:\n%s", metrics)
+	}
+}
+
+func TestAdminCacheFlushAndRefresh(t *testing.T) {
+	h := apptest.Start(t, apptest.WithRole("admin"))
+	h.Publish(repotest.NewOrder("cached", 1))
+	h.WaitFor("/orders/cached", http.StatusOK, waitTimeout)
+
+	stats := func() string {
+		t.Helper()
+		code, body := h.Get("/admin/cache")
+		if code != http.StatusOK {
+			t.Fatalf("GET /admin/cache: want 200, got %d", code)
+		}
+		return body
+	}
+	if body := stats(); !strings.Contains(body, `"orders":1,`) || !strings.Contains(body, `"complete":true`) {
+		t.Fatalf("stats before flush: %s", body)
+	}
+
+	if code, body := h.Do(http.MethodPost, "/admin/cache/flush"); code != http.StatusOK || !strings.Contains(body, `"orders":1`) {
+		t.Fatalf("POST /admin/cache/flush: %d %s", code, body)
+	}
+	if body := stats(); !strings.Contains(body, `"orders":0,`) || !strings.Contains(body, `"complete":false`) {
+		t.Fatalf("stats after flush: %s", body)
+	}
+	if code, _ := h.Get("/orders/cached"); code != http.StatusOK {
+		t.Fatalf("GET /orders/cached after flush: want 200 from storage, got %d", code)
+	}
+
+	if code, body := h.Do(http.MethodPost, "/admin/cache/refresh"); code != http.StatusOK {
+		t.Fatalf("POST /admin/cache/refresh: %d %s", code, body)
+	}
+	if body := stats(); !strings.Contains(body, `"complete":true`) {
+		t.Fatalf("stats after refresh: %s", body)
+	}
+}
+
+func TestRateLimitAnswersTooManyRequests(t *testing.T) {
+	h := apptest.Start(t, func(cfg *config.Config) {
+		cfg.RateLimit = config.RateLimitConfig{
+			Enabled: true,
+			Default: config.RouteBudget{Rate: 100, Burst: 100},
+			Routes:  map[string]config.RouteBudget{"orders_list": {Rate: 0.01, Burst: 2}},
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		if code, _ := h.Get("/orders"); code != http.StatusOK {
+			t.Fatalf("GET /orders #%d: want 200, got %d", i+1, code)
+		}
+	}
+	resp, err := http.Get(h.BaseURL + "/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("GET /orders over budget: want 429, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got == "" || got == "0" {
+		t.Errorf("Retry-After: want whole seconds, got %q", got)
+	}
+
+	if code, _ := h.Get("/orders/missing"); code != http.StatusNotFound {
+		t.Errorf("GET /orders/missing: want its own budget, got %d", code)
+	}
+	_, metrics := h.Get("/metrics")
+	if !strings.Contains(metrics, `wb_rate_limit_rejected_total{route="orders_list"} 1`) {
+		t.Errorf("rejection not counted:\n%s", metrics)
+	}
+}
+
+func TestRateLimitKeysByProxyAddedAddress(t *testing.T) {
+	h := apptest.Start(t, func(cfg *config.Config) {
+		cfg.RateLimit = config.RateLimitConfig{
+			Enabled:    true,
+			TrustProxy: true,
+			Default:    config.RouteBudget{Rate: 100, Burst: 100},
+			Routes:     map[string]config.RouteBudget{"orders_list": {Rate: 0.01, Burst: 1}},
+		}
+	})
+
+	get := func(forwardedFor string) int {
+		req, err := http.NewRequest(http.MethodGet, h.BaseURL+"/orders", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("198.51.100.1, 203.0.113.7"); code != http.StatusOK {
+		t.Fatalf("first request: want 200, got %d", code)
+	}
+	// a client rotating the entries it sends still shares the budget of the
+	// address the proxy saw
+	if code := get("198.51.100.2, 203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("spoofed leftmost entry: want 429, got %d", code)
+	}
+	if code := get("198.51.100.1, 203.0.113.8"); code != http.StatusOK {
+		t.Errorf("another client behind the proxy: want 200, got %d", code)
+	}
+}
+
+func TestLiveFeedPushesNewOrders(t *testing.T) {
+	h := apptest.Start(t)
+
+	resp, err := http.Get(h.BaseURL + "/orders/stream?delivery_service=meest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("SSE content type: got %q", ct)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(h.BaseURL, "http")+"/orders/ws?type=created", nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	skipped := repotest.NewOrder("other-service", 1)
+	skipped.DeliveryService = "dhl"
+	h.Publish(skipped)
+	order := repotest.NewOrder("live", 1)
+	h.Publish(order)
+
+	// SSE: the dhl order is filtered out, the viewer gets the order redacted
+	lines := bufio.NewScanner(resp.Body)
+	var event, data string
+	for lines.Scan() && data == "" {
+		line := lines.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok && event == "created" {
+			data = v
+		}
+	}
+	if !strings.Contains(data, `"order_uid":"live"`) {
+		t.Errorf("SSE event: want the live order, got %s", data)
+	}
+	if strings.Contains(data, order.Delivery.Email) {
+		t.Errorf("SSE event shows personal data to a viewer: %s", data)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(waitTimeout))
+	var got []string
+	for len(got) < 2 {
+		var msg struct {
+			Order struct {
+				OrderUID string `json:"order_uid"`
+			} `json:"order"`
+		}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("read websocket: %v", err)
+		}
+		got = append(got, msg.Order.OrderUID)
+	}
+	if !reflect.DeepEqual(got, []string{"other-service", "live"}) {
+		t.Errorf("websocket orders: got %v", got)
+	}
+
+	// resuming after the first event replays only the second
+	req, _ := http.NewRequest(http.MethodGet, h.BaseURL+"/orders/stream", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	lines = bufio.NewScanner(resumed.Body)
+	for lines.Scan() {
+		if id, ok := strings.CutPrefix(lines.Text(), "id: "); ok {
+			if id != "2" {
+				t.Errorf("resumed stream: want event 2 first, got %s", id)
+			}
+			break
+		}
+	}
+}
+
+func TestSearchHonoursRole(t *testing.T) {
+	order := repotest.NewOrder("findme", 1)
+	order.Items[0].Brand = "Zara"
+
+	viewer := apptest.Start(t)
+	viewer.Publish(order)
+	viewer.WaitFor("/orders/findme", http.StatusOK, waitTimeout)
+
+	code, body := viewer.Get("/orders/search?q=zara")
+	if code != http.StatusOK || !strings.Contains(body, "findme") {
+		t.Errorf("viewer search by brand: want findme, got %d %s", code, body)
+	}
+	if _, body := viewer.Get("/orders/search?q=testov&format=json"); body != "[]\n" {
+		t.Errorf("viewer search by delivery name: want no results, got %s", body)
+	}
+	if code, _ := viewer.Get("/orders/search?customer_id=test"); code != http.StatusForbidden {
+		t.Errorf("viewer customer filter: want 403, got %d", code)
+	}
+	if code, _ := viewer.Get("/orders/search?from=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("bad date: want 400, got %d", code)
+	}
+
+	support := apptest.Start(t, apptest.WithRole("support"))
+	support.Publish(order)
+	support.WaitFor("/orders/findme", http.StatusOK, waitTimeout)
+	if _, body := support.Get("/orders/search?q=testov&customer_id=test&format=json"); !strings.Contains(body, `"order_uid":"findme"`) {
+		t.Errorf("support search by delivery name: want findme, got %s", body)
+	}
+}
+
+func TestExportRedactsByRole(t *testing.T) {
+	order := repotest.NewOrder("exported", 2)
+
+	viewer := apptest.Start(t)
+	viewer.Publish(order)
+	viewer.WaitFor("/orders/exported", http.StatusOK, waitTimeout)
+
+	code, body := viewer.Get("/orders/export?items=true")
+	if code != http.StatusOK {
+		t.Fatalf("viewer CSV export: want 200, got %d %s", code, body)
+	}
+	if lines := strings.Count(body, "\n"); lines != 3 {
+		t.Errorf("viewer CSV export: want header and 2 item rows, got %d lines:\n%s", lines, body)
+	}
+	if strings.Contains(body, "Test Testov") || strings.Contains(body, "test@gmail.com") {
+		t.Errorf("viewer CSV export leaks personal data:\n%s", body)
+	}
+	if code, _ := viewer.Get("/orders/export?format=xlsx"); code != http.StatusBadRequest {
+		t.Errorf("unknown format: want 400, got %d", code)
+	}
+
+	support := apptest.Start(t, apptest.WithRole("support"))
+	support.Publish(order)
+	support.WaitFor("/orders/exported", http.StatusOK, waitTimeout)
+	code, body = support.Get("/orders/export?format=ndjson&customer_id=test")
+	if code != http.StatusOK || !strings.Contains(body, `"email":"test@gmail.com"`) {
+		t.Errorf("support NDJSON export: want personal data, got %d %s", code, body)
+	}
+}
+
+func TestUnknownOrderIsNotFound(t *testing.T) {
+	h := apptest.Start(t)
+
+	if code, _ := h.Get("/orders/missing"); code != http.StatusNotFound {
+		t.Fatalf("GET /orders/missing: want 404, got %d", code)
+	}
+}
+
+func TestInvalidOrdersAreDropped(t *testing.T) {
+	h := apptest.Start(t)
+
+	invalid := repotest.NewOrder("invalid", 1)
+	invalid.Delivery.Email = "not-an-email"
+	h.Publish(invalid)
+	h.PublishRaw([]byte(`{"order_uid": "garbage"`))
+
+	// a valid order published afterwards acts as a barrier: once it is
+	// visible, the messages before it have been handled
+	barrier := repotest.NewOrder("barrier", 1)
+	h.Publish(barrier)
+	h.WaitFor("/orders/barrier", http.StatusOK, waitTimeout)
+
+	if code, _ := h.Get("/orders/invalid"); code != http.StatusNotFound {
+		t.Fatalf("GET /orders/invalid: want 404, got %d", code)
+	}
+	if code, _ := h.Get("/orders/garbage"); code != http.StatusNotFound {
+		t.Fatalf("GET /orders/garbage: want 404, got %d", code)
+	}
+}
+
+func TestRejectedOrdersAreDeadLettered(t *testing.T) {
+	h := apptest.Start(t)
+
+	invalid := repotest.NewOrder("invalid", 1)
+	invalid.Delivery.Email = "not-an-email"
+	h.Publish(invalid)
+	h.PublishRaw([]byte(`{"order_uid": "garbage"`))
+	h.Publish(repotest.NewOrder("barrier", 1))
+	h.WaitFor("/orders/barrier", http.StatusOK, waitTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	dlq := natsClient.NewDeadLetters(h.App.JetStream(), h.Config.NatsDLQSubject)
+	letters, err := dlq.List(ctx, 0)
+	if err != nil {
+		t.Fatalf("list dead letters: %v", err)
+	}
+	var reasons []string
+	for _, dl := range letters {
+		if dl.Subject != h.Config.NatsSubject {
+			t.Errorf("dead letter %d: subject %q, want %q", dl.Seq, dl.Subject, h.Config.NatsSubject)
+		}
+		reasons = append(reasons, dl.Reason)
+	}
+	if want := []string{natsClient.ReasonValidate, natsClient.ReasonDecode}; !reflect.DeepEqual(reasons, want) {
+		t.Fatalf("dead letter reasons = %v, want %v", reasons, want)
+	}
+
+	// replaying an order that is still invalid parks it again
+	if err := dlq.Replay(ctx, letters[0], ""); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	h.Publish(repotest.NewOrder("barrier2", 1))
+	h.WaitFor("/orders/barrier2", http.StatusOK, waitTimeout)
+	letters, err = dlq.List(ctx, 0)
+	if err != nil {
+		t.Fatalf("list dead letters: %v", err)
+	}
+	if len(letters) != 2 || letters[0].Reason != natsClient.ReasonDecode || letters[1].Reason != natsClient.ReasonValidate {
+		t.Fatalf("after replay: got %+v", letters)
+	}
+
+	if err := dlq.Purge(ctx); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if letters, err = dlq.List(ctx, 0); err != nil || len(letters) != 0 {
+		t.Fatalf("after purge: %d dead letters, err %v", len(letters), err)
+	}
+}
+
+func TestMutatedOrdersAreDeadLetteredByTheExpectedRule(t *testing.T) {
+	h := apptest.Start(t, func(cfg *config.Config) {
+		cfg.Validation = config.ValidationConfig{GoodsTotal: true, Amount: true, ItemTotal: true}
+	})
+	gcfg := generator.DefaultConfig(11)
+	gcfg.Until = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	gen, err := generator.New(gcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, m := range generator.Mutations {
+		h.PublishRaw(m.Apply(gen.Order()))
+		switch m.Expect.Stage {
+		case generator.StageRule:
+			want = append(want, m.Expect.Rule)
+		case generator.StageTooLarge:
+			want = append(want, natsClient.ReasonTooLarge)
+		default:
+			want = append(want, m.Expect.Stage)
+		}
+	}
+	valid := gen.Order()
+	h.Publish(&valid)
+	h.WaitFor("/orders/"+valid.OrderUID, http.StatusOK, waitTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	letters, err := natsClient.NewDeadLetters(h.App.JetStream(), h.Config.NatsDLQSubject).List(ctx, 0)
+	if err != nil {
+		t.Fatalf("list dead letters: %v", err)
+	}
+	var got []string
+	for _, dl := range letters {
+		got = append(got, dl.Reason)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dead letter reasons:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestDuplicateOrderKeepsFirstVersion(t *testing.T) {
+	h := apptest.Start(t)
+
+	first := repotest.NewOrder("dup", 1)
+	h.Publish(first)
+	h.WaitFor("/orders/dup", http.StatusOK, waitTimeout)
+
+	second := repotest.NewOrder("dup", 1)
+	second.TrackNumber = "SECONDTRACK"
+	h.Publish(second)
+	h.Publish(repotest.NewOrder("barrier", 1))
+	h.WaitFor("/orders/barrier", http.StatusOK, waitTimeout)
+
+	_, body := h.Get("/orders/dup")
+	if strings.Contains(body, "SECONDTRACK") {
+		t.Fatal("duplicate order overwrote the stored one")
+	}
+}
+
+func TestUpdatesAreVersioned(t *testing.T) {
+	for _, driver := range []string{storage.DriverMemory, storage.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			h := apptest.Start(t,
+				apptest.WithStorage(driver, filepath.Join(t.TempDir(), "wb.db")),
+				apptest.WithAPIKey("dashboard", "viewer-key", "viewer"),
+				apptest.WithAPIKey("support", "support-key", "support"))
+			h.Header = http.Header{"X-Api-Key": {"support-key"}}
+
+			order := repotest.NewOrder("versioned", 1)
+			h.Publish(order)
+			h.WaitFor("/orders/versioned", http.StatusOK, waitTimeout)
+
+			byNATS := repotest.NewOrder("versioned", 1)
+			byNATS.TrackNumber = "NATSTRACK"
+			h.PublishUpdate(byNATS)
+			h.PublishUpdate(byNATS) // a redelivery adds no version
+			deadline := time.Now().Add(waitTimeout)
+			for _, body := h.Get("/orders/versioned"); !strings.Contains(body, "NATSTRACK"); _, body = h.Get("/orders/versioned") {
+				if time.Now().After(deadline) {
+					t.Fatal("update from NATS was not applied")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			byAPI := repotest.NewOrder("versioned", 1)
+			byAPI.TrackNumber = "APITRACK"
+			data, _ := json.Marshal(byAPI)
+			h.Header.Set("X-Api-Key", "viewer-key")
+			if code, _ := h.Send(http.MethodPut, "/orders/versioned", data); code != http.StatusForbidden {
+				t.Errorf("PUT as viewer: want 403, got %d", code)
+			}
+			h.Header.Set("X-Api-Key", "support-key")
+			if code, body := h.Send(http.MethodPut, "/orders/other", data); code != http.StatusBadRequest {
+				t.Errorf("PUT with a mismatched id: want 400, got %d: %s", code, body)
+			}
+			if code, body := h.Send(http.MethodPut, "/orders/versioned", data); code != http.StatusNoContent {
+				t.Fatalf("PUT: want 204, got %d: %s", code, body)
+			}
+
+			code, body := h.Get("/orders/versioned/versions?format=json")
+			if code != http.StatusOK {
+				t.Fatalf("GET versions: want 200, got %d: %s", code, body)
+			}
+			var versions []domain.Version
+			if err := json.Unmarshal([]byte(body), &versions); err != nil {
+				t.Fatalf("decode versions: %v", err)
+			}
+			var sources []string
+			for _, v := range versions {
+				sources = append(sources, fmt.Sprintf("%d %s %s", v.Version, v.Order.TrackNumber, strings.SplitN(v.Source, ":", 2)[0]))
+			}
+			want := []string{"1 " + order.TrackNumber + " nats", "2 NATSTRACK nats", "3 APITRACK api"}
+			if !reflect.DeepEqual(sources, want) {
+				t.Fatalf("versions:\n got %v\nwant %v", sources, want)
+			}
+			if versions[2].Source != "api:support" {
+				t.Errorf("API version source = %q, want api:support", versions[2].Source)
+			}
+
+			asOf := url.QueryEscape(versions[0].CreatedAt.Format(time.RFC3339Nano))
+			if _, body := h.Get("/orders/versioned?format=json&as_of=" + asOf); !strings.Contains(body, order.TrackNumber) {
+				t.Errorf("as_of the first version: want the original order, got %s", body)
+			}
+			if code, _ := h.Get("/orders/versioned?as_of=2000-01-01"); code != http.StatusNotFound {
+				t.Errorf("as_of before the order existed: want 404, got %d", code)
+			}
+			if _, body := h.Get("/orders/versioned"); !strings.Contains(body, "api:support") {
+				t.Error("detail page does not list the history")
+			}
+		})
+	}
+}
+
+func TestCancelledOrdersAreHiddenOnEveryInstance(t *testing.T) {
+	h := apptest.Start(t,
+		apptest.WithAPIKey("dashboard", "viewer-key", "viewer"),
+		apptest.WithAPIKey("support", "support-key", "support"),
+		apptest.WithAPIKey("ops", "admin-key", "admin"))
+	h.Header = http.Header{"X-Api-Key": {"support-key"}}
+	// with memory storage every instance keeps its own copy of the orders,
+	// so only cancellations delivered to both can hide an order on both
+	peer := h.Peer()
+
+	for _, uid := range []string{"cancel-nats", "cancel-api", "kept"} {
+		h.Publish(repotest.NewOrder(uid, 1))
+		h.WaitFor("/orders/"+uid, http.StatusOK, waitTimeout)
+		peer.WaitFor("/orders/"+uid, http.StatusOK, waitTimeout)
+	}
+
+	// each instance gets the unknown order's cancellation before the next
+	h.PublishCancel("never-saved", "typo")
+	h.PublishCancel("cancel-nats", "fraud")
+	h.WaitFor("/orders/cancel-nats", http.StatusNotFound, waitTimeout)
+	peer.WaitFor("/orders/cancel-nats", http.StatusNotFound, waitTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	letters, err := natsClient.NewDeadLetters(h.App.JetStream(), h.Config.NatsDLQSubject).List(ctx, 0)
+	if err != nil || len(letters) != 0 {
+		t.Errorf("cancellation of an unknown order: want it dropped, got %d dead letters, %v", len(letters), err)
+	}
+
+	for _, tc := range []struct {
+		name, key, path string
+		want            int
+	}{
+		{"viewer", "viewer-key", "/orders/cancel-api?reason=test", http.StatusForbidden},
+		{"no reason", "support-key", "/orders/cancel-api", http.StatusBadRequest},
+		{"unknown order", "support-key", "/orders/missing?reason=test", http.StatusNotFound},
+		{"cancel", "support-key", "/orders/cancel-api?reason=customer+request", http.StatusNoContent},
+		{"again", "support-key", "/orders/cancel-api?reason=customer+request", http.StatusNoContent},
+	} {
+		peer.Header.Set("X-Api-Key", tc.key)
+		if code, body := peer.Do(http.MethodDelete, tc.path); code != tc.want {
+			t.Errorf("DELETE %s: want %d, got %d: %s", tc.name, tc.want, code, body)
+		}
+	}
+	// h served the order from its cache until the peer's cancellation arrived
+	h.WaitFor("/orders/cancel-api", http.StatusNotFound, waitTimeout)
+
+	if _, body := h.Get("/orders"); strings.Contains(body, "cancel-") || !strings.Contains(body, "kept") {
+		t.Errorf("list shows cancelled orders or misses live ones: %s", body)
+	}
+	if code, _ := h.Get("/orders?include_deleted=true"); code != http.StatusForbidden {
+		t.Errorf("include_deleted as support: want 403, got %d", code)
+	}
+
+	h.Header.Set("X-Api-Key", "admin-key")
+	if _, body := h.Get("/orders?include_deleted=true"); !strings.Contains(body, "cancel-nats") || !strings.Contains(body, "cancel-api") {
+		t.Errorf("include_deleted list misses cancelled orders: %s", body)
+	}
+	code, body := h.Get("/orders/cancel-nats?include_deleted=true&format=json")
+	if code != http.StatusOK {
+		t.Fatalf("GET cancelled order with include_deleted: want 200, got %d: %s", code, body)
+	}
+	var order domain.Order
+	if err := json.Unmarshal([]byte(body), &order); err != nil {
+		t.Fatalf("decode order: %v", err)
+	}
+	if order.Deletion == nil || order.Deletion.Reason != "fraud" {
+		t.Errorf("cancelled order: want deletion with reason fraud, got %+v", order.Deletion)
+	}
+	if code, body := h.Send(http.MethodPut, "/orders/cancel-nats", []byte(body)); code != http.StatusConflict {
+		t.Errorf("PUT cancelled order: want 409, got %d: %s", code, body)
+	}
+
+	// the version recording the cancellation is under the same rule
+	later := url.QueryEscape(time.Now().Add(time.Second).UTC().Format(time.RFC3339))
+	if _, body := h.Get("/orders/cancel-nats?format=json&include_deleted=true&as_of=" + later); !strings.Contains(body, "fraud") {
+		t.Errorf("as_of after the cancellation with include_deleted: want the deletion, got %s", body)
+	}
+	if _, body := h.Get("/orders/cancel-nats/versions?format=json&include_deleted=true"); !strings.Contains(body, "fraud") {
+		t.Errorf("versions with include_deleted: want the cancellation, got %s", body)
+	}
+	h.Header.Set("X-Api-Key", "support-key")
+	if code, _ := h.Get("/orders/cancel-nats?format=json&as_of=" + later); code != http.StatusNotFound {
+		t.Errorf("as_of after the cancellation as support: want 404, got %d", code)
+	}
+	if code, body := h.Get("/orders/cancel-nats/versions?format=json"); code != http.StatusOK || strings.Contains(body, "fraud") {
+		t.Errorf("versions as support: want the history without the cancellation, got %d: %s", code, body)
+	}
+}
+
+func TestRetentionArchivesOldOrders(t *testing.T) {
+	h := apptest.Start(t,
+		apptest.WithStorage(storage.DriverSQLite, filepath.Join(t.TempDir(), "wb.db")),
+		apptest.WithRetention(12, 6),
+		apptest.WithRole("admin"))
+
+	fresh := repotest.NewOrder("fresh", 1)
+	fresh.DateCreated = time.Now().UTC().Add(-time.Hour)
+	for _, order := range []*domain.Order{repotest.NewOrder("ancient", 1), fresh} {
+		h.Publish(order)
+		h.WaitFor("/orders/"+order.OrderUID, http.StatusOK, waitTimeout)
+	}
+
+	code, body := h.Do(http.MethodPost, "/admin/retention/run")
+	if code != http.StatusOK {
+		t.Fatalf("POST /admin/retention/run: want 200, got %d: %s", code, body)
+	}
+	var run domain.RetentionRun
+	if err := json.Unmarshal([]byte(body), &run); err != nil {
+		t.Fatalf("decode run: %v", err)
+	}
+	if run.Archived != 1 || run.PIIPurged != 1 || run.Trigger != "api" {
+		t.Errorf("run: want the ancient order purged and archived, got %+v", run)
+	}
+
+	if _, body := h.Get("/orders"); strings.Contains(body, "ancient") || !strings.Contains(body, "fresh") {
+		t.Errorf("list shows archived orders or misses live ones: %s", body)
+	}
+	code, body = h.Get("/orders/ancient?format=json")
+	if code != http.StatusOK {
+		t.Fatalf("GET archived order: want 200, got %d: %s", code, body)
+	}
+	var order domain.Order
+	if err := json.Unmarshal([]byte(body), &order); err != nil {
+		t.Fatalf("decode order: %v", err)
+	}
+	if order.Delivery.Phone != "***" {
+		t.Errorf("archived order holds personal data: %+v", order.Delivery)
+	}
+
+	if code, body := h.Get("/admin/retention"); code != http.StatusOK || !strings.Contains(body, `"archived":1`) {
+		t.Errorf("GET /admin/retention: want the run audited, got %d: %s", code, body)
+	}
+}
+
+func TestRetentionEvictsOnEveryInstance(t *testing.T) {
+	h := apptest.Start(t,
+		apptest.WithStorage(storage.DriverSQLite, filepath.Join(t.TempDir(), "wb.db")),
+		apptest.WithRetention(0, 6),
+		apptest.WithRole("admin"))
+	// both instances share the database, so only the peer's cache can still
+	// hold the personal data once h erased it
+	peer := h.Peer()
+
+	h.Publish(repotest.NewOrder("ancient", 1))
+	h.WaitFor("/orders/ancient", http.StatusOK, waitTimeout)
+	if body := peer.WaitFor("/orders/ancient?format=json", http.StatusOK, waitTimeout); !strings.Contains(body, "+9720000000") {
+		t.Fatalf("peer does not serve the order with personal data: %s", body)
+	}
+
+	if code, body := h.Do(http.MethodPost, "/admin/retention/run"); code != http.StatusOK || !strings.Contains(body, `"pii_purged":1`) {
+		t.Fatalf("POST /admin/retention/run: want the order purged, got %d: %s", code, body)
+	}
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		_, body := peer.Get("/orders/ancient?format=json")
+		if !strings.Contains(body, "+9720000000") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer still serves personal data after the purge: %s", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAnalyticsCountsPublishedOrders(t *testing.T) {
+	h := apptest.Start(t, apptest.WithStorage(storage.DriverSQLite, filepath.Join(t.TempDir(), "wb.db")))
+
+	for _, uid := range []string{"first", "second"} {
+		order := repotest.NewOrder(uid, 2)
+		h.Publish(order)
+		h.WaitFor("/orders/"+uid, http.StatusOK, waitTimeout)
+	}
+
+	code, body := h.Get("/analytics/series?bucket=day&from=2021-11-26&to=2021-11-27")
+	if code != http.StatusOK {
+		t.Fatalf("GET /analytics/series: want 200, got %d: %s", code, body)
+	}
+	var series []analytics.Point
+	if err := json.Unmarshal([]byte(body), &series); err != nil {
+		t.Fatalf("decode series: %v", err)
+	}
+	if len(series) != 1 || series[0].Orders != 2 || series[0].Revenue != 2*1817 || series[0].Currency != "USD" {
+		t.Errorf("series: want one day of 2 orders worth 3634 USD, got %+v", series)
+	}
+
+	code, body = h.Get("/analytics/top?dimension=brand&from=2021-11-01&to=2021-12-01")
+	if code != http.StatusOK || !strings.Contains(body, `"key":"Vivienne Sabo"`) {
+		t.Errorf("GET /analytics/top: want the brand listed, got %d: %s", code, body)
+	}
+	if code, body := h.Get("/analytics/series?bucket=month"); code != http.StatusBadRequest {
+		t.Errorf("unknown bucket: want 400, got %d: %s", code, body)
+	}
+	if code, body := h.Get("/analytics"); code != http.StatusOK || !strings.Contains(body, "Order Analytics") {
+		t.Errorf("GET /analytics: want the dashboard, got %d", code)
+	}
+}
+
+func TestTraceFollowsOrderThroughNATS(t *testing.T) {
+	// package tracers bind to the first provider installed, so this is the
+	// only test that installs one
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	h := apptest.Start(t, apptest.WithStorage(storage.DriverSQLite, filepath.Join(t.TempDir(), "wb.db")))
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "test publish")
+	if err := h.Publisher.PublishOrder(ctx, h.Config.NatsSubject, repotest.NewOrder("traced", 1)); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	root.End()
+	h.WaitFor("/orders/traced", http.StatusOK, waitTimeout)
+
+	want := []string{
+		"orders.new publish",
+		"orders.new process",
+		"OrderService.CreateOrder",
+		"OrderService.validate",
+		"OrderRepository.SaveOrder",
+		"INSERT orders",
+		"INSERT items",
+		"OrderCache.Set",
+	}
+	traceID := root.SpanContext().TraceID()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		seen := make(map[string]bool)
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().TraceID() == traceID {
+				seen[span.Name()] = true
+			}
+		}
+		var missing []string
+		for _, name := range want {
+			if !seen[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spans missing from the publisher's trace: %v", missing)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCacheIsRestoredAfterRestart(t *testing.T) {
+	h := apptest.Start(t, apptest.WithStorage(storage.DriverSQLite, filepath.Join(t.TempDir(), "wb.db")))
+
+	order := repotest.NewOrder("persisted", 1)
+	h.Publish(order)
+	h.WaitFor("/orders/persisted", http.StatusOK, waitTimeout)
+
+	h.StopApp()
+	h.StartApp()
+
+	code, body := h.Get("/orders")
+	if code != http.StatusOK || !strings.Contains(body, "persisted") {
+		t.Fatalf("GET /orders after restart: got %d, order missing from list", code)
+	}
+}
+
+func TestStopRunsHooksByPhase(t *testing.T) {
+	a := newBareApp(t)
+
+	var stopped []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		}
+	}
+	a.AddHook(app.Hook{Name: "close", Phase: app.PhaseClose, Stop: record("close")})
+	a.AddHook(app.Hook{Name: "flush", Phase: app.PhaseFlush, Stop: record("flush")})
+	a.AddHook(app.Hook{Name: "consume", Phase: app.PhaseStopConsuming, Stop: record("consume")})
+
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := a.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	want := []string{"consume", "flush", "close"}
+	if !reflect.DeepEqual(stopped, want) {
+		t.Fatalf("stop order: want %v, got %v", want, stopped)
+	}
+}
+
+func TestFailedStartStopsStartedComponents(t *testing.T) {
+	a := newBareApp(t)
+
+	stopped := false
+	a.AddHook(app.Hook{Name: "ok", Phase: app.PhaseClose, Stop: func(context.Context) error {
+		stopped = true
+		return nil
+	}})
+	a.AddHook(app.Hook{Name: "broken", Start: func(context.Context) error {
+		return errors.New("boom")
+	}})
+
+	if err := a.Start(context.Background()); err == nil {
+		t.Fatal("Start: want error from broken hook")
+	}
+	if !stopped {
+		t.Fatal("hook started before the failure was not stopped")
+	}
+}
+
+func newBareApp(t *testing.T) *app.App {
+	ns := apptest.StartNATS(t)
+	cfg := &config.Config{
+		HTTPPort:    "127.0.0.1:0",
+		NatsURL:     ns.ClientURL(),
+		NatsSubject: "orders.new",
+		Storage:     config.StorageConfig{Driver: storage.DriverMemory},
+	}
+	return app.New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
@@ -0,0 +1,255 @@
+// Package apptest runs the whole application in-process for end-to-end tests:
+// an embedded NATS server with JetStream, a non-Postgres storage backend and
+// the real HTTP router on a random port.
+package apptest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/velvetriddles/wb-level0/internal/app"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	natsClient "github.com/velvetriddles/wb-level0/internal/nats"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+type Harness struct {
+	Config    *config.Config
+	NATS      *server.Server
+	App       *app.App
+	Publisher *natsClient.Publisher
+	BaseURL   string
+	// Header is sent with every request made by Get and WaitFor.
+	Header http.Header
+
+	t      *testing.T
+	logger *slog.Logger
+}
+
+// Option tweaks the config before the app starts.
+type Option func(cfg *config.Config)
+
+func WithStorage(driver, sqlitePath string) Option {
+	return func(cfg *config.Config) {
+		cfg.Storage.Driver = driver
+		cfg.Storage.SQLitePath = sqlitePath
+	}
+}
+
+// WithRole sets the role every HTTP request is served with.
+func WithRole(role string) Option {
+	return func(cfg *config.Config) {
+		cfg.Redaction.DefaultRole = role
+	}
+}
+
+// WithAPIKey lets callers authenticate with key in role.
+func WithAPIKey(name, key, role string) Option {
+	return func(cfg *config.Config) {
+		cfg.Auth.APIKeys = append(cfg.Auth.APIKeys, config.APIKeyConfig{Name: name, Key: key, Role: role})
+	}
+}
+
+// WithRetention sets the retention policy; the job then runs only through
+// POST /admin/retention/run.
+func WithRetention(archiveAfterMonths, purgePIIAfterMonths int) Option {
+	return func(cfg *config.Config) {
+		cfg.Retention.ArchiveAfterMonths = archiveAfterMonths
+		cfg.Retention.PurgePIIAfterMonths = purgePIIAfterMonths
+	}
+}
+
+// Start boots a NATS server and the app. Both are stopped on test cleanup.
+// Set WB_TEST_VERBOSE=1 to see application logs.
+func Start(t *testing.T, opts ...Option) *Harness {
+	t.Helper()
+
+	ns := StartNATS(t)
+
+	cfg := &config.Config{
+		HTTPPort:          "127.0.0.1:0",
+		NatsURL:           ns.ClientURL(),
+		NatsSubject:       "orders.new",
+		NatsUpdateSubject: "orders.updated",
+		NatsCancelSubject: "orders.cancelled",
+		NatsEvictSubject:  "orders.evicted",
+		NatsDLQSubject:    "orders.dlq",
+		Storage:           config.StorageConfig{Driver: storage.DriverMemory},
+		Redaction:         config.RedactionConfig{DefaultRole: "viewer"},
+		Feed:              config.FeedConfig{History: 64, ClientBuffer: 16, Heartbeat: time.Second},
+		Retention:         config.RetentionConfig{Archive: "table", BatchSize: 100},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	h := &Harness{Config: cfg, NATS: ns, t: t, logger: testLogger()}
+	h.StartApp()
+	return h
+}
+
+// StartNATS runs an in-process NATS server with JetStream on a random port.
+func StartNATS(t *testing.T) *server.Server {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// StartApp starts a fresh App with the harness config, e.g. after StopApp to
+// check what survives a restart.
+func (h *Harness) StartApp() {
+	h.t.Helper()
+
+	a := app.New(h.Config, h.logger)
+	if err := a.Start(context.Background()); err != nil {
+		h.t.Fatalf("start app: %v", err)
+	}
+	h.App = a
+	h.Publisher = natsClient.NewPublisher(a.JetStream(), h.logger)
+	h.BaseURL = "http://" + a.Addr()
+
+	h.t.Cleanup(func() {
+		if h.App == a {
+			h.StopApp()
+		}
+	})
+}
+
+// Peer starts another app on h's NATS server with a copy of its config, like
+// a second instance of the same deployment. It is stopped on test cleanup.
+func (h *Harness) Peer() *Harness {
+	h.t.Helper()
+
+	cfg := *h.Config
+	p := &Harness{Config: &cfg, NATS: h.NATS, Header: h.Header.Clone(), t: h.t, logger: h.logger}
+	p.StartApp()
+	return p
+}
+
+func (h *Harness) StopApp() {
+	h.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.App.Stop(ctx); err != nil {
+		h.t.Errorf("stop app: %v", err)
+	}
+	h.App = nil
+}
+
+func (h *Harness) Publish(order *domain.Order) {
+	h.t.Helper()
+	if err := h.Publisher.PublishOrder(context.Background(), h.Config.NatsSubject, order); err != nil {
+		h.t.Fatalf("publish order %s: %v", order.OrderUID, err)
+	}
+}
+
+// PublishUpdate publishes a changed order to the update subject.
+func (h *Harness) PublishUpdate(order *domain.Order) {
+	h.t.Helper()
+	if err := h.Publisher.PublishOrder(context.Background(), h.Config.NatsUpdateSubject, order); err != nil {
+		h.t.Fatalf("publish update of %s: %v", order.OrderUID, err)
+	}
+}
+
+// PublishCancel publishes a cancellation to the cancel subject.
+func (h *Harness) PublishCancel(uid, reason string) {
+	h.t.Helper()
+	c := domain.Cancellation{OrderUID: uid, Reason: reason}
+	if err := h.Publisher.PublishCancellation(context.Background(), h.Config.NatsCancelSubject, c); err != nil {
+		h.t.Fatalf("publish cancellation of %s: %v", uid, err)
+	}
+}
+
+// PublishRaw publishes arbitrary bytes to the orders subject.
+func (h *Harness) PublishRaw(data []byte) {
+	h.t.Helper()
+	if _, err := h.App.JetStream().Publish(h.Config.NatsSubject, data); err != nil {
+		h.t.Fatalf("publish raw message: %v", err)
+	}
+}
+
+// Get performs a GET against the app and returns status and body.
+func (h *Harness) Get(path string) (int, string) {
+	h.t.Helper()
+	return h.Do(http.MethodGet, path)
+}
+
+// Do sends a request without a body to the app and returns status and body.
+func (h *Harness) Do(method, path string) (int, string) {
+	h.t.Helper()
+	return h.Send(method, path, nil)
+}
+
+// Send sends a request with body to the app and returns status and body.
+func (h *Harness) Send(method, path string, body []byte) (int, string) {
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, h.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	for key, values := range h.Header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("read body of %s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, string(respBody)
+}
+
+// WaitFor polls GET path until it answers with status or the timeout expires,
+// and returns the last body seen.
+func (h *Harness) WaitFor(path string, status int, timeout time.Duration) string {
+	h.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		code, body := h.Get(path)
+		if code == status {
+			return body
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("GET %s: want status %d within %s, last got %d: %s", path, status, timeout, code, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func testLogger() *slog.Logger {
+	if os.Getenv("WB_TEST_VERBOSE") != "" {
+		return slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+)
+
+// APIKeyHeader carries a static API key. "Authorization: ApiKey <key>" is
+// accepted as well.
+const APIKeyHeader = "X-API-Key"
+
+type APIKey struct {
+	Name string
+	Key  string
+	Role Role
+}
+
+// APIKeys accepts a fixed set of keys.
+type APIKeys struct {
+	// keyed by the SHA-256 of the key so lookups do not compare secrets
+	// byte by byte
+	keys map[[32]byte]Principal
+}
+
+func NewAPIKeys(keys []APIKey) *APIKeys {
+	a := &APIKeys{keys: make(map[[32]byte]Principal, len(keys))}
+	for _, k := range keys {
+		a.keys[sha256.Sum256([]byte(k.Key))] = Principal{Subject: k.Name, Role: k.Role, Method: a.Name()}
+	}
+	return a
+}
+
+func (a *APIKeys) Name() string {
+	return "api_key"
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+			key = v
+		}
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	p, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &p, nil
+}
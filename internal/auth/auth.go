@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials means the request carries no credentials of the
+	// authenticator's kind; the next authenticator is tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means credentials were presented but rejected.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrExpired means the credentials were valid once.
+	ErrExpired = errors.New("credentials expired")
+	// ErrBodyTooLarge means the body of a signed request is over the limit,
+	// so the signature was not checked.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Authenticator identifies the caller of a request.
+type Authenticator interface {
+	// Name labels the method in logs and metrics: "api_key", "hmac", "jwt".
+	Name() string
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Reason classifies an authentication error for logs and metrics.
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoCredentials):
+		return "missing"
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.Is(err, ErrBodyTooLarge):
+		return "too_large"
+	default:
+		return "invalid"
+	}
+}
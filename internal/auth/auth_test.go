@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+func TestAPIKeys(t *testing.T) {
+	a := NewAPIKeys([]APIKey{{Name: "grafana", Key: "secret-key", Role: RoleViewer}})
+
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("no key: want ErrNoCredentials, got %v", err)
+	}
+
+	r.Header.Set(APIKeyHeader, "wrong")
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong key: want ErrInvalidCredentials, got %v", err)
+	}
+
+	r.Header.Del(APIKeyHeader)
+	r.Header.Set("Authorization", "ApiKey secret-key")
+	p, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatalf("valid key: %v", err)
+	}
+	if p.Subject != "grafana" || p.Role != RoleViewer || p.Method != "api_key" {
+		t.Errorf("valid key: got %+v", p)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	h := NewHMAC([]HMACClient{{ID: "support-tool", Secret: "shared", Role: RoleSupport}}, time.Minute)
+	h.now = func() time.Time { return now }
+
+	signed := func(target, secret string, at time.Time) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, strings.NewReader("body"))
+		if err := SignRequest(r, "support-tool", secret, at); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	p, err := h.Authenticate(signed("/orders/1?format=json", "shared", now))
+	if err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if p.Role != RoleSupport || p.Subject != "support-tool" {
+		t.Errorf("valid signature: got %+v", p)
+	}
+
+	if _, err := h.Authenticate(signed("/orders/1", "other", now)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong secret: want ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := h.Authenticate(signed("/orders/1", "shared", now.Add(-2*time.Minute))); !errors.Is(err, ErrExpired) {
+		t.Errorf("old timestamp: want ErrExpired, got %v", err)
+	}
+
+	tampered := signed("/orders/1", "shared", now)
+	tampered.URL.Path = "/orders/2"
+	if _, err := h.Authenticate(tampered); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("tampered path: want ErrInvalidCredentials, got %v", err)
+	}
+
+	// the body is bounded before the signature is checked
+	huge := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(strings.Repeat("x", domain.MaxOrderSize+1)))
+	huge.Header.Set(HMACKeyIDHeader, "support-tool")
+	huge.Header.Set(HMACTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	huge.Header.Set(HMACSignatureHeader, "00")
+	if _, err := h.Authenticate(huge); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("oversized body: want ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, "k1", &key.PublicKey)
+
+	j, err := NewJWT(JWTOptions{JWKSFile: jwksFile, Issuer: "wb-sso", RoleClaim: "role"})
+	if err != nil {
+		t.Fatalf("NewJWT: %v", err)
+	}
+
+	token := func(kid string, signer *rsa.PrivateKey, claims jwt.MapClaims) *http.Request {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set("Authorization", "Bearer "+s)
+		return r
+	}
+	valid := func(role string) jwt.MapClaims {
+		return jwt.MapClaims{"sub": "alice", "iss": "wb-sso", "role": role, "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	p, err := j.Authenticate(token("k1", key, valid("admin")))
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if p.Subject != "alice" || p.Role != RoleAdmin || p.Method != "jwt" {
+		t.Errorf("valid token: got %+v", p)
+	}
+
+	expired := valid("admin")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := j.Authenticate(token("k1", key, expired)); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired token: want ErrExpired, got %v", err)
+	}
+	wrongIssuer := valid("admin")
+	wrongIssuer["iss"] = "someone-else"
+	if _, err := j.Authenticate(token("k1", key, wrongIssuer)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong issuer: want ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := j.Authenticate(token("k1", key, valid("root"))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown role: want ErrInvalidCredentials, got %v", err)
+	}
+
+	// a rotated key is picked up from the changed file
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Authenticate(token("k2", rotated, valid("viewer"))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("unknown key: want ErrInvalidCredentials, got %v", err)
+	}
+	writeJWKS(t, jwksFile, "k2", &rotated.PublicKey)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(jwksFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Authenticate(token("k2", rotated, valid("viewer"))); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+}
+
+func writeJWKS(t *testing.T, path, kid string, key *rsa.PublicKey) {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	set := map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   enc.EncodeToString(key.N.Bytes()),
+		"e":   enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+const (
+	HMACKeyIDHeader     = "X-Auth-Key-ID"
+	HMACTimestampHeader = "X-Auth-Timestamp"
+	HMACSignatureHeader = "X-Auth-Signature"
+)
+
+type HMACClient struct {
+	ID     string
+	Secret string
+	Role   Role
+}
+
+// HMAC accepts requests signed with a shared secret, see SignRequest.
+type HMAC struct {
+	clients map[string]HMACClient
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// NewHMAC rejects signatures whose timestamp is more than maxSkew away from
+// the local clock, which limits how long a captured request can be replayed.
+func NewHMAC(clients []HMACClient, maxSkew time.Duration) *HMAC {
+	h := &HMAC{clients: make(map[string]HMACClient, len(clients)), maxSkew: maxSkew, now: time.Now}
+	for _, c := range clients {
+		h.clients[c.ID] = c
+	}
+	return h
+}
+
+func (h *HMAC) Name() string {
+	return "hmac"
+}
+
+func (h *HMAC) Authenticate(r *http.Request) (*Principal, error) {
+	id := r.Header.Get(HMACKeyIDHeader)
+	if id == "" {
+		return nil, ErrNoCredentials
+	}
+	client, ok := h.clients[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidCredentials, id)
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HMACTimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad timestamp", ErrInvalidCredentials)
+	}
+	if skew := h.now().Sub(time.Unix(ts, 0)).Abs(); skew > h.maxSkew {
+		return nil, fmt.Errorf("%w: timestamp is %s off", ErrExpired, skew.Round(time.Second))
+	}
+
+	got, err := hex.DecodeString(r.Header.Get(HMACSignatureHeader))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidCredentials)
+	}
+	// the body is buffered before the caller is known, so bound it by the
+	// largest body a handler accepts
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(nil, r.Body, domain.MaxOrderSize)
+	}
+	want, err := signature(r, client.Secret, ts)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(got, want) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCredentials)
+	}
+	return &Principal{Subject: client.ID, Role: client.Role, Method: h.Name()}, nil
+}
+
+// SignRequest adds the HMAC headers to r. The signature covers the method,
+// the request URI, the timestamp and the body.
+func SignRequest(r *http.Request, keyID, secret string, now time.Time) error {
+	ts := now.Unix()
+	sig, err := signature(r, secret, ts)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(HMACKeyIDHeader, keyID)
+	r.Header.Set(HMACTimestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(HMACSignatureHeader, hex.EncodeToString(sig))
+	return nil
+}
+
+// signature computes HMAC-SHA256 over
+//
+//	METHOD \n REQUEST-URI \n TIMESTAMP \n hex(SHA-256(body))
+//
+// The body is read and put back for the handler.
+func signature(r *http.Request, secret string, ts int64) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, fmt.Errorf("%w: limit %d bytes", ErrBodyTooLarge, tooLarge.Limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	bodySum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", r.Method, r.URL.RequestURI(), ts, hex.EncodeToString(bodySum[:]))
+	return mac.Sum(nil), nil
+}
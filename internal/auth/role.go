@@ -0,0 +1,66 @@
+// Package auth identifies HTTP callers and the role they act in.
+package auth
+
+import (
+	"context"
+	"fmt"
+)
+
+type Role string
+
+const (
+	// RoleViewer sees orders with personal data redacted.
+	RoleViewer Role = "viewer"
+	// RoleSupport sees orders in full.
+	RoleSupport Role = "support"
+	// RoleAdmin sees orders in full and may use the admin endpoints.
+	RoleAdmin Role = "admin"
+)
+
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleViewer, RoleSupport, RoleAdmin:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q, want viewer, support or admin", s)
+}
+
+// CanSeePII reports whether the role may see unredacted personal data.
+func (r Role) CanSeePII() bool {
+	return r == RoleSupport || r == RoleAdmin
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject names the caller: the API key or HMAC client name, or the
+	// token's sub claim.
+	Subject string
+	Role    Role
+	// Method is the authenticator that accepted the caller.
+	Method string
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the authenticated caller, if any.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// WithRole marks the request as made in role without naming a caller.
+func WithRole(ctx context.Context, role Role) context.Context {
+	return WithPrincipal(ctx, &Principal{Role: role})
+}
+
+// RoleFromContext returns the caller's role, RoleViewer if none was set.
+func RoleFromContext(ctx context.Context) Role {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return p.Role
+	}
+	return RoleViewer
+}
@@ -1,27 +1,742 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is prepended to every environment override, with dots in keys
+// replaced by underscores: storage.driver is WB_STORAGE_DRIVER.
+const EnvPrefix = "WB"
 
 type Config struct {
-	DatabaseURL string `mapstructure:"database_url"`
-	HTTPPort    string `mapstructure:"http_port"`
-	NatsURL     string `mapstructure:"nats_url"`
-	NatsSubject string `mapstructure:"nats_subject"`
-	LogLevel    string `mapstructure:"log_level"`
+	DatabaseURL          string           `mapstructure:"database_url"`
+	DatabasePasswordFile string           `mapstructure:"database_password_file"`
+	HTTPPort             string           `mapstructure:"http_port"`
+	NatsURL              string           `mapstructure:"nats_url"`
+	NatsSubject          string           `mapstructure:"nats_subject"`
+	NatsUpdateSubject    string           `mapstructure:"nats_update_subject"`
+	NatsCancelSubject    string           `mapstructure:"nats_cancel_subject"`
+	NatsEvictSubject     string           `mapstructure:"nats_evict_subject"`
+	NatsDLQSubject       string           `mapstructure:"nats_dlq_subject"`
+	LogLevel             string           `mapstructure:"log_level"`
+	LogFormat            string           `mapstructure:"log_format"`
+	LogSampling          SamplingConfig   `mapstructure:"log_sampling"`
+	ShutdownTimeout      time.Duration    `mapstructure:"shutdown_timeout"`
+	Storage              StorageConfig    `mapstructure:"storage"`
+	Cache                CacheConfig      `mapstructure:"cache"`
+	Validation           ValidationConfig `mapstructure:"validation"`
+	Redaction            RedactionConfig  `mapstructure:"redaction"`
+	Tracing              TracingConfig    `mapstructure:"tracing"`
+	Auth                 AuthConfig       `mapstructure:"auth"`
+	RateLimit            RateLimitConfig  `mapstructure:"rate_limit"`
+	Feed                 FeedConfig       `mapstructure:"feed"`
+	Retention            RetentionConfig  `mapstructure:"retention"`
+}
+
+type StorageConfig struct {
+	// Driver is one of "postgres", "sharded", "sqlite" or "memory".
+	Driver          string        `mapstructure:"driver"`
+	SQLitePath      string        `mapstructure:"sqlite_path"`
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
+	// PartitionsAhead is how many months of Postgres partitions past the
+	// current one are kept created.
+	PartitionsAhead int `mapstructure:"partitions_ahead"`
+	// Shards are the Postgres DSNs of the sharded driver. Their order is the
+	// shard map: an order lives on the shard its OrderUID hashes to, so new
+	// shards go at the end, followed by `wbctl rebalance`.
+	Shards []string `mapstructure:"shards"`
+}
+
+// SamplingConfig limits repeated debug/info log records, see
+// logger.SamplingOptions.
+type SamplingConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Initial    int           `mapstructure:"initial"`
+	Thereafter int           `mapstructure:"thereafter"`
+	Tick       time.Duration `mapstructure:"tick"`
+}
+
+type CacheConfig struct {
+	// MaxEntries caps the number of cached orders; 0 means unlimited.
+	MaxEntries int `mapstructure:"max_entries"`
+}
+
+// ValidationConfig toggles the business rules in domain.Rules.
+type ValidationConfig struct {
+	GoodsTotal bool `mapstructure:"goods_total"`
+	Amount     bool `mapstructure:"amount"`
+	ItemTotal  bool `mapstructure:"item_total"`
+}
+
+// RedactionConfig controls how personal data (fields tagged `pii` in the
+// domain types) is masked.
+type RedactionConfig struct {
+	// Logs redacts personal data in every log record.
+	Logs bool `mapstructure:"logs"`
+	// HashKey keys the hashes of pii:"hash" fields.
+	HashKey string `mapstructure:"hash_key"`
+	// DefaultRole is the role of HTTP callers: viewer sees redacted orders,
+	// support and admin see them in full.
+	DefaultRole string `mapstructure:"default_role"`
+}
+
+// TracingConfig selects where OpenTelemetry spans go.
+type TracingConfig struct {
+	// Exporter is "none", "stdout", "file" or "otlp" (OTLP over HTTP).
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the OTLP collector.
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	File        string  `mapstructure:"file"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+	ServiceName string  `mapstructure:"service_name"`
+}
+
+// AuthConfig lists the ways HTTP callers can authenticate. With none
+// configured every request gets redaction.default_role.
+type AuthConfig struct {
+	// AnonymousRole is given to requests without credentials; empty rejects
+	// them.
+	AnonymousRole string         `mapstructure:"anonymous_role"`
+	APIKeys       []APIKeyConfig `mapstructure:"api_keys"`
+	HMAC          HMACAuthConfig `mapstructure:"hmac"`
+	JWT           JWTAuthConfig  `mapstructure:"jwt"`
+}
+
+type APIKeyConfig struct {
+	Name string `mapstructure:"name"`
+	Key  string `mapstructure:"key"`
+	Role string `mapstructure:"role"`
+}
+
+type HMACAuthConfig struct {
+	MaxSkew time.Duration      `mapstructure:"max_skew"`
+	Clients []HMACClientConfig `mapstructure:"clients"`
+}
+
+type HMACClientConfig struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+	Role   string `mapstructure:"role"`
+}
+
+type JWTAuthConfig struct {
+	// JWKSFile enables JWT authentication.
+	JWKSFile  string `mapstructure:"jwks_file"`
+	Issuer    string `mapstructure:"issuer"`
+	Audience  string `mapstructure:"audience"`
+	RoleClaim string `mapstructure:"role_claim"`
+}
+
+// RateLimitConfig limits how fast each client may call the API and how many
+// storage reads may run at once.
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// TrustProxy keys anonymous clients by the last X-Forwarded-For address,
+	// the one the proxy in front of the service appended, instead of the
+	// connection's remote address. Earlier entries come from the client and
+	// are ignored. Unlike the rest of the block, it needs a restart.
+	TrustProxy bool `mapstructure:"trust_proxy"`
+	// Default applies to routes missing from Routes.
+	Default RouteBudget `mapstructure:"default"`
+	// Routes maps route names (orders_list, orders_search, orders_export,
+	// order_get, admin_config) to budgets.
+	Routes map[string]RouteBudget `mapstructure:"routes"`
+	// DBConcurrency caps storage reads on cache misses; 0 means no limit.
+	DBConcurrency int `mapstructure:"db_concurrency"`
+	// DBWait is how long a read waits for a free slot before the request is
+	// answered with 429.
+	DBWait time.Duration `mapstructure:"db_wait"`
+}
+
+// RouteBudget is a token bucket per client: Rate requests per second with
+// bursts of up to Burst.
+type RouteBudget struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// FeedConfig tunes the live order feed at /orders/stream and /orders/ws.
+type FeedConfig struct {
+	// History is how many recent events are kept for clients resuming with
+	// Last-Event-ID.
+	History int `mapstructure:"history"`
+	// ClientBuffer is how many events a client may fall behind before it is
+	// disconnected.
+	ClientBuffer int           `mapstructure:"client_buffer"`
+	Heartbeat    time.Duration `mapstructure:"heartbeat"`
+}
+
+// RetentionConfig is the policy of the retention job. Ages are in months of
+// date_created; 0 disables the step.
+type RetentionConfig struct {
+	// Interval between scheduled runs; 0 runs the job only when asked to via
+	// POST /admin/retention/run.
+	Interval            time.Duration `mapstructure:"interval"`
+	ArchiveAfterMonths  int           `mapstructure:"archive_after_months"`
+	PurgePIIAfterMonths int           `mapstructure:"purge_pii_after_months"`
+	// Archive is "table" (order_archive in the storage backend) or "ndjson"
+	// (gzipped files in ArchiveDir).
+	Archive    string `mapstructure:"archive"`
+	ArchiveDir string `mapstructure:"archive_dir"`
+	BatchSize  int    `mapstructure:"batch_size"`
+}
+
+// Enabled reports whether the policy has anything to do.
+func (c RetentionConfig) Enabled() bool {
+	return c.ArchiveAfterMonths > 0 || c.PurgePIIAfterMonths > 0
+}
+
+// Enabled reports whether any authentication method is configured.
+func (c AuthConfig) Enabled() bool {
+	return len(c.APIKeys) > 0 || len(c.HMAC.Clients) > 0 || c.JWT.JWKSFile != ""
+}
+
+var defaults = map[string]any{
+	"database_url":              "postgresql://wbuser@localhost:5430/wbdatabase?sslmode=disable",
+	"database_password_file":    "",
+	"http_port":                 ":8080",
+	"nats_url":                  "nats://localhost:4222",
+	"nats_subject":              "orders.new",
+	"nats_update_subject":       "orders.updated",
+	"nats_cancel_subject":       "orders.cancelled",
+	"nats_evict_subject":        "orders.evicted",
+	"nats_dlq_subject":          "orders.dlq",
+	"log_level":                 "info",
+	"log_format":                "json",
+	"log_sampling.enabled":      true,
+	"log_sampling.initial":      100,
+	"log_sampling.thereafter":   100,
+	"log_sampling.tick":         "1s",
+	"shutdown_timeout":          "30s",
+	"storage.driver":            "postgres",
+	"storage.sqlite_path":       "wb.db",
+	"storage.max_open_conns":    10000,
+	"storage.max_idle_conns":    500,
+	"storage.conn_max_lifetime": "5m",
+	"storage.partitions_ahead":  3,
+	"storage.shards":            []string{},
+	"cache.max_entries":         0,
+	"validation.goods_total":    false,
+	"validation.amount":         false,
+	"validation.item_total":     false,
+	"redaction.logs":            true,
+	"redaction.hash_key":        "",
+	"redaction.default_role":    "viewer",
+	"tracing.exporter":          "none",
+	"tracing.endpoint":          "localhost:4318",
+	"tracing.insecure":          true,
+	"tracing.file":              "traces.jsonl",
+	"tracing.sample_ratio":      1.0,
+	"tracing.service_name":      "wb-level0",
+	"auth.anonymous_role":       "",
+	"auth.hmac.max_skew":        "5m",
+	"auth.jwt.jwks_file":        "",
+	"auth.jwt.issuer":           "",
+	"auth.jwt.audience":         "",
+	"auth.jwt.role_claim":       "role",
+	"rate_limit.enabled":        true,
+	"rate_limit.trust_proxy":    false,
+	"rate_limit.default.rate":   20,
+	"rate_limit.default.burst":  40,
+	"rate_limit.routes": map[string]any{
+		"order_get":     map[string]any{"rate": 50, "burst": 100},
+		"orders_list":   map[string]any{"rate": 2, "burst": 5},
+		"orders_search": map[string]any{"rate": 5, "burst": 10},
+		"orders_export": map[string]any{"rate": 0.1, "burst": 2},
+		"admin_config":  map[string]any{"rate": 1, "burst": 5},
+	},
+	"rate_limit.db_concurrency":        64,
+	"rate_limit.db_wait":               "200ms",
+	"feed.history":                     1024,
+	"feed.client_buffer":               64,
+	"feed.heartbeat":                   "15s",
+	"retention.interval":               "0s",
+	"retention.archive_after_months":   0,
+	"retention.purge_pii_after_months": 0,
+	"retention.archive":                "table",
+	"retention.archive_dir":            "archive",
+	"retention.batch_size":             100,
 }
 
+// LoadConfig reads the configuration for the running binary, taking flags
+// from os.Args.
 func LoadConfig() (*Config, error) {
-	viper.SetConfigName("config")
-	viper.AddConfigPath("cmd/config")
+	cfg, err := Load(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	return cfg, err
+}
 
-	if err := viper.ReadInConfig(); err != nil {
+// Load builds the configuration from, in increasing priority: defaults, the
+// config file, WB_* environment variables and command line flags. The result
+// is validated before it is returned.
+func Load(args []string) (*Config, error) {
+	v, err := newViper(args)
+	if err != nil {
 		return nil, err
 	}
+	return decode(v)
+}
 
+func newViper(args []string) (*viper.Viper, error) {
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+
+	fs := pflag.NewFlagSet("wb", pflag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the config file")
+	fs.String("http-port", "", "HTTP listen address, e.g. :8080")
+	fs.String("database-url", "", "Postgres DSN")
+	fs.String("nats-url", "", "NATS server URL")
+	fs.String("nats-subject", "", "subject to consume orders from")
+	fs.String("log-level", "", "debug, info, warn or error")
+	fs.String("storage-driver", "", "postgres, sharded, sqlite or memory")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	for key, flag := range map[string]string{
+		"http_port":      "http-port",
+		"database_url":   "database-url",
+		"nats_url":       "nats-url",
+		"nats_subject":   "nats-subject",
+		"log_level":      "log-level",
+		"storage.driver": "storage-driver",
+	} {
+		if err := v.BindPFlag(key, fs.Lookup(flag)); err != nil {
+			return nil, err
+		}
+	}
+
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	if path := configFile(*configPath); path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+		v.AddConfigPath("cmd/config")
+		v.AddConfigPath("/etc/wb")
+		if err := v.ReadInConfig(); err != nil {
+			var notFound viper.ConfigFileNotFoundError
+			if !errors.As(err, &notFound) {
+				return nil, fmt.Errorf("failed to read config file: %w", err)
+			}
+		}
+	}
+	return v, nil
+}
+
+// configFile picks the explicit config path: the --config flag wins over
+// WB_CONFIG.
+func configFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(EnvPrefix + "_CONFIG")
+}
+
+func decode(v *viper.Viper) (*Config, error) {
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := v.Unmarshal(&config); err != nil {
 		return nil, err
 	}
 
+	if err := config.loadSecrets(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+// loadSecrets puts the password from DatabasePasswordFile (e.g. a mounted
+// docker secret) into DatabaseURL.
+func (c *Config) loadSecrets() error {
+	if c.DatabasePasswordFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.DatabasePasswordFile)
+	if err != nil {
+		return fmt.Errorf("failed to read database password file: %w", err)
+	}
+	u, err := url.Parse(c.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("database_url: %w", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	c.DatabaseURL = withPassword(u, password)
+	for i, dsn := range c.Storage.Shards {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return fmt.Errorf("storage.shards[%d]: %w", i, err)
+		}
+		c.Storage.Shards[i] = withPassword(u, password)
+	}
+	return nil
+}
+
+func withPassword(u *url.URL, password string) string {
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String()
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	switch c.Storage.Driver {
+	case "postgres", "sharded":
+		if c.Storage.Driver == "postgres" {
+			check("database_url", validateURL(c.DatabaseURL, "postgres", "postgresql"))
+		} else {
+			check("storage.shards", validateShards(c.Storage.Shards))
+		}
+		check("storage.max_open_conns", validatePositive(c.Storage.MaxOpenConns))
+		check("storage.max_idle_conns", validatePositive(c.Storage.MaxIdleConns))
+		check("storage.conn_max_lifetime", validateDuration(c.Storage.ConnMaxLifetime))
+		if c.Storage.PartitionsAhead < 0 {
+			check("storage.partitions_ahead", fmt.Errorf("must not be negative, got %d", c.Storage.PartitionsAhead))
+		}
+	case "sqlite":
+		if c.Storage.SQLitePath == "" {
+			check("storage.sqlite_path", errors.New("must not be empty"))
+		}
+	case "memory":
+	default:
+		check("storage.driver", fmt.Errorf("unknown driver %q, want postgres, sharded, sqlite or memory", c.Storage.Driver))
+	}
+
+	check("http_port", validateListenAddr(c.HTTPPort))
+	check("nats_url", validateURL(c.NatsURL, "nats", "tls", "ws", "wss"))
+	subjects := make(map[string]string)
+	for _, s := range []struct{ key, subject string }{
+		{"nats_subject", c.NatsSubject},
+		{"nats_update_subject", c.NatsUpdateSubject},
+		{"nats_cancel_subject", c.NatsCancelSubject},
+		{"nats_evict_subject", c.NatsEvictSubject},
+		{"nats_dlq_subject", c.NatsDLQSubject},
+	} {
+		if !strings.HasPrefix(s.subject, "orders.") || strings.Count(s.subject, ".") != 1 {
+			check(s.key, fmt.Errorf("%q is not covered by the orders.* stream", s.subject))
+		} else if other, ok := subjects[s.subject]; ok {
+			check(s.key, fmt.Errorf("must differ from %s", other))
+		}
+		subjects[s.subject] = s.key
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		check("log_level", err)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		check("log_format", fmt.Errorf("unknown format %q, want json or text", c.LogFormat))
+	}
+	if c.LogSampling.Enabled {
+		if c.LogSampling.Initial < 0 || c.LogSampling.Thereafter < 0 {
+			check("log_sampling", errors.New("initial and thereafter must not be negative"))
+		}
+		check("log_sampling.tick", validateDuration(c.LogSampling.Tick))
+	}
+	check("shutdown_timeout", validateDuration(c.ShutdownTimeout))
+	if c.Cache.MaxEntries < 0 {
+		check("cache.max_entries", fmt.Errorf("must not be negative, got %d", c.Cache.MaxEntries))
+	}
+	check("redaction.default_role", validateRole(c.Redaction.DefaultRole))
+	if c.Auth.AnonymousRole != "" {
+		check("auth.anonymous_role", validateRole(c.Auth.AnonymousRole))
+	}
+	for i, k := range c.Auth.APIKeys {
+		key := fmt.Sprintf("auth.api_keys[%d]", i)
+		if k.Name == "" || k.Key == "" {
+			check(key, errors.New("name and key must not be empty"))
+		}
+		check(key+".role", validateRole(k.Role))
+	}
+	if len(c.Auth.HMAC.Clients) > 0 {
+		check("auth.hmac.max_skew", validateDuration(c.Auth.HMAC.MaxSkew))
+	}
+	for i, cl := range c.Auth.HMAC.Clients {
+		key := fmt.Sprintf("auth.hmac.clients[%d]", i)
+		if cl.ID == "" || cl.Secret == "" {
+			check(key, errors.New("id and secret must not be empty"))
+		}
+		check(key+".role", validateRole(cl.Role))
+	}
+	if c.Auth.JWT.JWKSFile != "" && c.Auth.JWT.RoleClaim == "" {
+		check("auth.jwt.role_claim", errors.New("must not be empty"))
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			check("tracing.file", errors.New("must not be empty"))
+		}
+	case "otlp":
+		if _, _, err := net.SplitHostPort(c.Tracing.Endpoint); err != nil {
+			check("tracing.endpoint", err)
+		}
+	default:
+		check("tracing.exporter", fmt.Errorf("unknown exporter %q, want none, stdout, file or otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		check("tracing.sample_ratio", fmt.Errorf("must be between 0 and 1, got %v", c.Tracing.SampleRatio))
+	}
+	if c.RateLimit.Enabled {
+		check("rate_limit.default", validateBudget(c.RateLimit.Default))
+		for route, b := range c.RateLimit.Routes {
+			check("rate_limit.routes."+route, validateBudget(b))
+		}
+	}
+	if c.RateLimit.DBConcurrency < 0 {
+		check("rate_limit.db_concurrency", fmt.Errorf("must not be negative, got %d", c.RateLimit.DBConcurrency))
+	}
+	if c.Feed.History < 0 {
+		check("feed.history", fmt.Errorf("must not be negative, got %d", c.Feed.History))
+	}
+	check("feed.client_buffer", validatePositive(c.Feed.ClientBuffer))
+	check("feed.heartbeat", validateDuration(c.Feed.Heartbeat))
+	if c.RateLimit.DBConcurrency > 0 {
+		check("rate_limit.db_wait", validateDuration(c.RateLimit.DBWait))
+	}
+	if c.Retention.Interval < 0 {
+		check("retention.interval", fmt.Errorf("must not be negative, got %s", c.Retention.Interval))
+	}
+	if c.Retention.ArchiveAfterMonths < 0 {
+		check("retention.archive_after_months", fmt.Errorf("must not be negative, got %d", c.Retention.ArchiveAfterMonths))
+	}
+	if c.Retention.PurgePIIAfterMonths < 0 {
+		check("retention.purge_pii_after_months", fmt.Errorf("must not be negative, got %d", c.Retention.PurgePIIAfterMonths))
+	}
+	// personal data is erased before an order is archived, never in the archive
+	if c.Retention.ArchiveAfterMonths > 0 && c.Retention.PurgePIIAfterMonths > c.Retention.ArchiveAfterMonths {
+		check("retention.purge_pii_after_months", fmt.Errorf("must not exceed archive_after_months (%d), got %d",
+			c.Retention.ArchiveAfterMonths, c.Retention.PurgePIIAfterMonths))
+	}
+	switch c.Retention.Archive {
+	case "table":
+	case "ndjson":
+		if c.Retention.ArchiveDir == "" {
+			check("retention.archive_dir", errors.New("must not be empty"))
+		}
+	default:
+		check("retention.archive", fmt.Errorf("unknown archive %q, want table or ndjson", c.Retention.Archive))
+	}
+	if c.Retention.BatchSize < 1 || c.Retention.BatchSize > 500 {
+		check("retention.batch_size", fmt.Errorf("must be between 1 and 500, got %d", c.Retention.BatchSize))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ParseLevel maps log_level values to slog levels.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("unknown level %q, want debug, info, warn or error", level)
+	}
+	return l, nil
+}
+
+// LogValue keeps secrets out of the logs when the config is logged.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("database_url", redactURL(c.DatabaseURL)),
+		slog.String("database_password_file", c.DatabasePasswordFile),
+		slog.String("http_port", c.HTTPPort),
+		slog.String("nats_url", redactURL(c.NatsURL)),
+		slog.String("nats_subject", c.NatsSubject),
+		slog.String("nats_update_subject", c.NatsUpdateSubject),
+		slog.String("nats_cancel_subject", c.NatsCancelSubject),
+		slog.String("nats_evict_subject", c.NatsEvictSubject),
+		slog.String("nats_dlq_subject", c.NatsDLQSubject),
+		slog.String("log_level", c.LogLevel),
+		slog.String("log_format", c.LogFormat),
+		slog.Group("log_sampling",
+			slog.Bool("enabled", c.LogSampling.Enabled),
+			slog.Int("initial", c.LogSampling.Initial),
+			slog.Int("thereafter", c.LogSampling.Thereafter),
+			slog.Duration("tick", c.LogSampling.Tick),
+		),
+		slog.Duration("shutdown_timeout", c.ShutdownTimeout),
+		slog.Group("storage",
+			slog.String("driver", c.Storage.Driver),
+			slog.String("sqlite_path", c.Storage.SQLitePath),
+			slog.Int("max_open_conns", c.Storage.MaxOpenConns),
+			slog.Int("max_idle_conns", c.Storage.MaxIdleConns),
+			slog.Duration("conn_max_lifetime", c.Storage.ConnMaxLifetime),
+			slog.Int("partitions_ahead", c.Storage.PartitionsAhead),
+			slog.Int("shards", len(c.Storage.Shards)),
+		),
+		slog.Group("cache",
+			slog.Int("max_entries", c.Cache.MaxEntries),
+		),
+		slog.Group("validation",
+			slog.Bool("goods_total", c.Validation.GoodsTotal),
+			slog.Bool("amount", c.Validation.Amount),
+			slog.Bool("item_total", c.Validation.ItemTotal),
+		),
+		slog.Group("redaction",
+			slog.Bool("logs", c.Redaction.Logs),
+			slog.String("hash_key", redactSecret(c.Redaction.HashKey)),
+			slog.String("default_role", c.Redaction.DefaultRole),
+		),
+		slog.Group("tracing",
+			slog.String("exporter", c.Tracing.Exporter),
+			slog.String("endpoint", c.Tracing.Endpoint),
+			slog.Bool("insecure", c.Tracing.Insecure),
+			slog.String("file", c.Tracing.File),
+			slog.Float64("sample_ratio", c.Tracing.SampleRatio),
+			slog.String("service_name", c.Tracing.ServiceName),
+		),
+		slog.Group("auth",
+			slog.String("anonymous_role", c.Auth.AnonymousRole),
+			slog.Int("api_keys", len(c.Auth.APIKeys)),
+			slog.Int("hmac_clients", len(c.Auth.HMAC.Clients)),
+			slog.Duration("hmac_max_skew", c.Auth.HMAC.MaxSkew),
+			slog.String("jwks_file", c.Auth.JWT.JWKSFile),
+			slog.String("jwt_issuer", c.Auth.JWT.Issuer),
+			slog.String("jwt_audience", c.Auth.JWT.Audience),
+		),
+		slog.Group("rate_limit",
+			slog.Bool("enabled", c.RateLimit.Enabled),
+			slog.Bool("trust_proxy", c.RateLimit.TrustProxy),
+			slog.Float64("default_rate", c.RateLimit.Default.Rate),
+			slog.Int("default_burst", c.RateLimit.Default.Burst),
+			slog.Int("routes", len(c.RateLimit.Routes)),
+			slog.Int("db_concurrency", c.RateLimit.DBConcurrency),
+			slog.Duration("db_wait", c.RateLimit.DBWait),
+		),
+		slog.Group("feed",
+			slog.Int("history", c.Feed.History),
+			slog.Int("client_buffer", c.Feed.ClientBuffer),
+			slog.Duration("heartbeat", c.Feed.Heartbeat),
+		),
+		slog.Group("retention",
+			slog.Duration("interval", c.Retention.Interval),
+			slog.Int("archive_after_months", c.Retention.ArchiveAfterMonths),
+			slog.Int("purge_pii_after_months", c.Retention.PurgePIIAfterMonths),
+			slog.String("archive", c.Retention.Archive),
+			slog.String("archive_dir", c.Retention.ArchiveDir),
+			slog.Int("batch_size", c.Retention.BatchSize),
+		),
+	)
+}
+
+func validateBudget(b RouteBudget) error {
+	if b.Rate <= 0 || b.Burst <= 0 {
+		return fmt.Errorf("rate and burst must be positive, got %v and %d", b.Rate, b.Burst)
+	}
+	return nil
+}
+
+func validateRole(role string) error {
+	switch role {
+	case "viewer", "support", "admin":
+		return nil
+	}
+	return fmt.Errorf("unknown role %q, want viewer, support or admin", role)
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparsable]"
+	}
+	return u.Redacted()
+}
+
+func validateURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("not a valid URL")
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			if u.Host == "" {
+				return errors.New("host is missing")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("scheme %q is not one of %v", u.Scheme, schemes)
+}
+
+// validateShards checks the shard map: Postgres DSNs, none twice.
+func validateShards(dsns []string) error {
+	if len(dsns) == 0 {
+		return errors.New("must list at least one DSN")
+	}
+	seen := make(map[string]bool, len(dsns))
+	for i, dsn := range dsns {
+		if err := validateURL(dsn, "postgres", "postgresql"); err != nil {
+			return fmt.Errorf("[%d]: %w", i, err)
+		}
+		if seen[dsn] {
+			return fmt.Errorf("[%d]: listed twice", i)
+		}
+		seen[dsn] = true
+	}
+	return nil
+}
+
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q is not host:port", addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q is out of range", port)
+	}
+	return nil
+}
+
+func validatePositive(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("must be positive, got %d", n)
+	}
+	return nil
+}
+
+func validateDuration(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("must be a positive duration, got %s", d)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+http_port: ":9000"
+nats_subject: "orders.file"
+log_level: "warn"
+storage:
+  driver: "memory"
+`)
+	t.Setenv("WB_NATS_SUBJECT", "orders.env")
+	t.Setenv("WB_LOG_LEVEL", "debug")
+
+	cfg, err := Load([]string{"--config", path, "--log-level", "error"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.HTTPPort != ":9000" {
+		t.Errorf("http_port from file: got %q", cfg.HTTPPort)
+	}
+	if cfg.NatsSubject != "orders.env" {
+		t.Errorf("nats_subject from env: got %q", cfg.NatsSubject)
+	}
+	if cfg.LogLevel != "error" {
+		t.Errorf("log_level from flag: got %q", cfg.LogLevel)
+	}
+	if cfg.ShutdownTimeout != 30*time.Second {
+		t.Errorf("shutdown_timeout default: got %s", cfg.ShutdownTimeout)
+	}
+	if cfg.Storage.Driver != "memory" {
+		t.Errorf("storage.driver from file: got %q", cfg.Storage.Driver)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+database_url: "mysql://localhost/db"
+http_port: "8080"
+nats_subject: "payments.new"
+nats_update_subject: "updates"
+nats_cancel_subject: "cancelled"
+nats_dlq_subject: "orders.dlq.parked"
+shutdown_timeout: "0s"
+retention:
+  archive_after_months: 6
+  purge_pii_after_months: 12
+auth:
+  api_keys:
+    - name: "dashboard"
+      key: "k"
+      role: "root"
+`)
+
+	_, err := Load([]string{"--config", path})
+	if err == nil {
+		t.Fatal("Load: want validation error")
+	}
+	for _, key := range []string{"database_url", "http_port", "nats_subject", "nats_update_subject", "nats_cancel_subject", "nats_dlq_subject", "shutdown_timeout", "retention.purge_pii_after_months", "auth.api_keys[0].role"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestPasswordFileAndRedaction(t *testing.T) {
+	secret := writeFile(t, "db_password", "s3cr3t\n")
+	path := writeFile(t, "config.yaml", `
+database_url: "postgresql://wbuser@localhost:5430/wbdatabase?sslmode=disable"
+database_password_file: "`+secret+`"
+`)
+
+	cfg, err := Load([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !strings.Contains(cfg.DatabaseURL, "wbuser:s3cr3t@") {
+		t.Fatalf("password not injected into database_url: %s", cfg.DatabaseURL)
+	}
+
+	var out strings.Builder
+	slog.New(slog.NewTextHandler(&out, nil)).Info("config", "config", cfg)
+	if strings.Contains(out.String(), "s3cr3t") {
+		t.Fatalf("password leaked into log: %s", out.String())
+	}
+}
+
+func TestShardsFromEnv(t *testing.T) {
+	secret := writeFile(t, "db_password", "s3cr3t\n")
+	path := writeFile(t, "config.yaml", `
+database_password_file: "`+secret+`"
+storage:
+  driver: "sharded"
+`)
+	t.Setenv("WB_STORAGE_SHARDS", "postgres://wbuser@db1:5432/wb,postgres://wbuser@db2:5432/wb")
+
+	cfg, err := Load([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.Storage.Shards) != 2 {
+		t.Fatalf("storage.shards from env: got %q", cfg.Storage.Shards)
+	}
+	for _, dsn := range cfg.Storage.Shards {
+		if !strings.Contains(dsn, "wbuser:s3cr3t@") {
+			t.Errorf("password not injected into shard DSN: %s", dsn)
+		}
+	}
+
+	t.Setenv("WB_STORAGE_SHARDS", "postgres://db1/wb,postgres://db1/wb")
+	if _, err := Load([]string{"--config", path}); err == nil || !strings.Contains(err.Error(), "storage.shards") {
+		t.Errorf("Load with a shard listed twice: want storage.shards error, got %v", err)
+	}
+}
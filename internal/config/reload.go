@@ -0,0 +1,237 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// runtimeKeys are the settings that may change without a restart. Changes to
+// any other key, and to rate_limit.trust_proxy, which the router reads once,
+// are rejected on reload.
+var runtimeKeys = []string{"log_level", "cache", "validation", "rate_limit"}
+
+// ReloadStatus describes the outcome of the latest reload attempt.
+type ReloadStatus struct {
+	LoadedAt     time.Time `json:"loaded_at"`
+	LastReload   time.Time `json:"last_reload,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	RejectedKeys []string  `json:"rejected_keys,omitempty"`
+}
+
+// Reloader re-reads the configuration on config file changes or SIGHUP and
+// applies the runtime-safe part of it.
+type Reloader struct {
+	args   []string
+	logger *slog.Logger
+
+	mu        sync.RWMutex
+	current   *Config
+	status    ReloadStatus
+	listeners []func(*Config)
+	file      string
+}
+
+// NewReloader starts from cfg, which must have been loaded with the same args.
+func NewReloader(args []string, cfg *Config, logger *slog.Logger) *Reloader {
+	r := &Reloader{
+		args:    args,
+		logger:  logger,
+		current: cfg,
+		status:  ReloadStatus{LoadedAt: time.Now()},
+	}
+	if v, err := newViper(args); err == nil {
+		r.file = v.ConfigFileUsed()
+	}
+	return r
+}
+
+func (r *Reloader) Current() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+func (r *Reloader) Status() ReloadStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.status
+}
+
+// OnReload registers fn to be called with the new config after every
+// successful reload.
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, fn)
+}
+
+// Reload loads the configuration again. Runtime-safe settings are applied;
+// changed restart-only settings are kept at their old values and reported.
+func (r *Reloader) Reload() error {
+	fresh, err := Load(r.args)
+
+	r.mu.Lock()
+	r.status.LastReload = time.Now()
+	if err != nil {
+		r.status.LastError = err.Error()
+		r.mu.Unlock()
+		r.logger.Error("Config reload failed, keeping current config", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+
+	old := r.current
+	next := *old
+	next.LogLevel = fresh.LogLevel
+	next.Cache = fresh.Cache
+	next.Validation = fresh.Validation
+	next.RateLimit = fresh.RateLimit
+	next.RateLimit.TrustProxy = old.RateLimit.TrustProxy
+
+	rejected := Diff(next, *fresh)
+	r.current = &next
+	r.status.LastError = ""
+	r.status.RejectedKeys = rejected
+	listeners := append([]func(*Config){}, r.listeners...)
+	r.mu.Unlock()
+
+	if len(rejected) > 0 {
+		r.logger.Warn("Config changes need a restart and were not applied",
+			slog.Any("keys", rejected))
+	}
+	r.logger.Info("Config reloaded",
+		slog.Any("changed", Diff(*old, next)),
+		slog.Any("config", next))
+
+	for _, fn := range listeners {
+		fn(&next)
+	}
+	return nil
+}
+
+// Watch reloads on SIGHUP and whenever the config file is written, until ctx
+// is done.
+func (r *Reloader) Watch(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	if r.file != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("failed to watch config file: %w", err)
+		}
+		defer watcher.Close()
+		// watch the directory: editors and k8s config maps replace the file
+		if err := watcher.Add(filepath.Dir(r.file)); err != nil {
+			return fmt.Errorf("failed to watch config file: %w", err)
+		}
+		events = watcher.Events
+		r.logger.Info("Watching config file", slog.String("file", r.file))
+	}
+
+	// editors emit several events per save; reload once they settle
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			r.logger.Info("SIGHUP received, reloading config")
+			r.Reload()
+		case ev := <-events:
+			if filepath.Clean(ev.Name) == filepath.Clean(r.file) && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(200 * time.Millisecond)
+			}
+		case <-debounce:
+			debounce = nil
+			r.Reload()
+		}
+	}
+}
+
+// Diff lists the keys whose values differ between a and b.
+func Diff(a, b Config) []string {
+	fa, fb := a.Flatten(), b.Flatten()
+	var keys []string
+	for key, va := range fa {
+		if !reflect.DeepEqual(va, fb[key]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Flatten maps every setting to its dotted config key. Secrets are included
+// as is; use Redacted first when the result is shown to anyone.
+func (c Config) Flatten() map[string]any {
+	out := make(map[string]any)
+	flatten("", reflect.ValueOf(c), out)
+	return out
+}
+
+// Redacted returns a copy safe to display.
+func (c Config) Redacted() Config {
+	c.DatabaseURL = redactURL(c.DatabaseURL)
+	c.NatsURL = redactURL(c.NatsURL)
+	shards := make([]string, len(c.Storage.Shards))
+	for i, dsn := range c.Storage.Shards {
+		shards[i] = redactURL(dsn)
+	}
+	c.Storage.Shards = shards
+	c.Redaction.HashKey = redactSecret(c.Redaction.HashKey)
+
+	keys := make([]APIKeyConfig, len(c.Auth.APIKeys))
+	for i, k := range c.Auth.APIKeys {
+		k.Key = redactSecret(k.Key)
+		keys[i] = k
+	}
+	c.Auth.APIKeys = keys
+	clients := make([]HMACClientConfig, len(c.Auth.HMAC.Clients))
+	for i, cl := range c.Auth.HMAC.Clients {
+		cl.Secret = redactSecret(cl.Secret)
+		clients[i] = cl
+	}
+	c.Auth.HMAC.Clients = clients
+	return c
+}
+
+// RuntimeKeys lists the top-level keys that can change without a restart.
+func RuntimeKeys() []string {
+	return append([]string(nil), runtimeKeys...)
+}
+
+func flatten(prefix string, v reflect.Value, out map[string]any) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			flatten(key, field, out)
+			continue
+		}
+		if d, ok := field.Interface().(time.Duration); ok {
+			out[key] = d.String()
+			continue
+		}
+		out[key] = field.Interface()
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/velvetriddles/wb-level0/internal/config"
+)
+
+type ConfigSource interface {
+	Current() *config.Config
+	Status() config.ReloadStatus
+}
+
+type AdminHandler struct {
+	config ConfigSource
+	logger *slog.Logger
+}
+
+func NewAdminHandler(config ConfigSource, logger *slog.Logger) *AdminHandler {
+	return &AdminHandler{
+		config: config,
+		logger: logger,
+	}
+}
+
+type configResponse struct {
+	Config      map[string]any      `json:"config"`
+	RuntimeKeys []string            `json:"runtime_keys"`
+	Reload      config.ReloadStatus `json:"reload"`
+}
+
+func (h *AdminHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
+	h.logger.InfoContext(r.Context(), "Handling request to show effective config",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path))
+
+	resp := configResponse{
+		Config:      h.config.Current().Redacted().Flatten(),
+		RuntimeKeys: config.RuntimeKeys(),
+		Reload:      h.config.Status(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to encode config",
+			slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/templates"
+)
+
+// defaultTopLimit is how many keys GET /analytics/top returns without
+// ?limit.
+const defaultTopLimit = 10
+
+type Analytics interface {
+	Series(ctx context.Context, q analytics.Query) ([]analytics.Point, error)
+	Top(ctx context.Context, q analytics.Query, limit int) ([]analytics.Point, error)
+}
+
+type AnalyticsHandler struct {
+	analytics Analytics
+	templates *template.Template
+	logger    *slog.Logger
+}
+
+func NewAnalyticsHandler(a Analytics, logger *slog.Logger) *AnalyticsHandler {
+	templates := template.Must(template.ParseFS(templates.FS, "*.html"))
+	return &AnalyticsHandler{analytics: a, templates: templates, logger: logger}
+}
+
+// Dashboard serves the page that charts the JSON endpoints.
+func (h *AnalyticsHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
+	if err := h.templates.ExecuteTemplate(w, "analytics.html", nil); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to execute template",
+			slog.String("template", "analytics.html"),
+			slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Series serves the rollups of ?bucket (hour, day or week; day by default),
+// grouped by ?group_by (brand, delivery_service or provider; totals by
+// default), from ?from to ?to, optionally narrowed to one ?currency and one
+// ?key of the group.
+func (h *AnalyticsHandler) Series(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q, err := parseAnalyticsQuery(values, values.Get("group_by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	points, err := h.analytics.Series(r.Context(), q)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, points)
+}
+
+// Top serves the ?limit keys of ?dimension with the most orders from ?from
+// to ?to, per currency, optionally narrowed to one ?currency.
+func (h *AnalyticsHandler) Top(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q, err := parseAnalyticsQuery(values, values.Get("dimension"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultTopLimit
+	if raw := values.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > domain.MaxSearchLimit {
+			http.Error(w, fmt.Sprintf("limit: want a number between 1 and %d, got %q", domain.MaxSearchLimit, raw),
+				http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	points, err := h.analytics.Top(r.Context(), q, limit)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, points)
+}
+
+// parseAnalyticsQuery reads bucket, from and to (RFC 3339 or YYYY-MM-DD),
+// currency and key; the dimension is passed in, as the endpoints name it
+// differently.
+func parseAnalyticsQuery(values url.Values, dimension string) (analytics.Query, error) {
+	q := analytics.Query{
+		Grain:    analytics.Day,
+		Currency: values.Get("currency"),
+		Key:      values.Get("key"),
+	}
+	var err error
+	if raw := values.Get("bucket"); raw != "" {
+		if q.Grain, err = analytics.ParseGrain(raw); err != nil {
+			return q, err
+		}
+	}
+	if dimension != "" {
+		if q.Dimension, err = analytics.ParseDimension(dimension); err != nil {
+			return q, err
+		}
+	}
+	if q.From, err = domain.ParseSearchTime(values.Get("from")); err != nil {
+		return q, fmt.Errorf("from: %w", err)
+	}
+	if q.To, err = domain.ParseSearchTime(values.Get("to")); err != nil {
+		return q, fmt.Errorf("to: %w", err)
+	}
+	return q, nil
+}
+
+func (h *AnalyticsHandler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, analytics.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.logger.ErrorContext(r.Context(), "Failed to query analytics",
+		slog.String("error", err.Error()))
+	writeServiceError(w, err)
+}
+
+func (h *AnalyticsHandler) writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to encode response",
+			slog.String("error", err.Error()))
+	}
+}
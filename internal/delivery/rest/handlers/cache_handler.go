@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/repository/cache"
+)
+
+type CacheAdmin interface {
+	Restore(ctx context.Context) error
+	Flush(ctx context.Context)
+	Len() int
+	Stats() cache.Stats
+}
+
+type CacheHandler struct {
+	cache  CacheAdmin
+	logger *slog.Logger
+}
+
+func NewCacheHandler(cache CacheAdmin, logger *slog.Logger) *CacheHandler {
+	return &CacheHandler{cache: cache, logger: logger}
+}
+
+type cacheResponse struct {
+	Orders   int    `json:"orders"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Refresh reloads the cache from storage, e.g. after a bulk import wrote
+// orders behind the service's back.
+func (h *CacheHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	h.logger.InfoContext(r.Context(), "Handling request to refresh cache",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path))
+
+	start := time.Now()
+	if err := h.cache.Restore(r.Context()); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to refresh cache",
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+		return
+	}
+
+	h.writeJSON(w, r, cacheResponse{Orders: h.cache.Len(), Duration: time.Since(start).String()})
+}
+
+// Flush empties the cache. Orders are read from storage until the next
+// refresh.
+func (h *CacheHandler) Flush(w http.ResponseWriter, r *http.Request) {
+	h.logger.InfoContext(r.Context(), "Handling request to flush cache",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path))
+
+	flushed := h.cache.Len()
+	h.cache.Flush(r.Context())
+	h.writeJSON(w, r, cacheResponse{Orders: flushed})
+}
+
+func (h *CacheHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, h.cache.Stats())
+}
+
+func (h *CacheHandler) writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to encode response",
+			slog.String("error", err.Error()))
+	}
+}
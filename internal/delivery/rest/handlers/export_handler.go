@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+)
+
+type OrderExporter interface {
+	ExportOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) error
+}
+
+type ExportHandler struct {
+	service  OrderExporter
+	redactor *redact.Redactor
+	logger   *slog.Logger
+}
+
+// NewExportHandler streams orders as a file download. Personal data is
+// redacted the same way as in OrderHandler.
+func NewExportHandler(service OrderExporter, redactor *redact.Redactor, logger *slog.Logger) *ExportHandler {
+	return &ExportHandler{service: service, redactor: redactor, logger: logger}
+}
+
+// Export answers with every order matching the search filters (see
+// parseSearchQuery; limit and offset are ignored) as ?format=csv (default),
+// ndjson or parquet. ?items=true writes one CSV/Parquet row per item and
+// ?gzip=true compresses the file. Admins may add ?include_deleted=true.
+func (h *ExportHandler) Export(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q, err := parseSearchQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if q.IncludeDeleted, ok = includeDeleted(w, r); !ok {
+		return
+	}
+	opts := export.Options{Format: export.CSV}
+	if raw := values.Get("format"); raw != "" {
+		if opts.Format, err = export.ParseFormat(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for name, dst := range map[string]*bool{"items": &opts.ItemRows, "gzip": &opts.Gzip} {
+		if raw := values.Get(name); raw != "" {
+			if *dst, err = strconv.ParseBool(raw); err != nil {
+				http.Error(w, name+": want true or false, got "+strconv.Quote(raw), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	canSeePII := auth.RoleFromContext(r.Context()).CanSeePII()
+	if q.CustomerID != "" && !canSeePII {
+		http.Error(w, "Filtering by customer needs the support role", http.StatusForbidden)
+		return
+	}
+	q.IncludePII = canSeePII
+
+	h.logger.InfoContext(r.Context(), "Handling order export",
+		slog.String("format", string(opts.Format)),
+		slog.Bool("items", opts.ItemRows),
+		slog.Bool("gzip", opts.Gzip))
+
+	out := &startedWriter{w: w}
+	ew, err := export.NewWriter(out, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := opts.FileName("orders-" + time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", opts.ContentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	err = h.service.ExportOrders(r.Context(), q, func(order *domain.Order) error {
+		if !canSeePII {
+			order = redact.Apply(h.redactor, order)
+		}
+		return ew.Write(order)
+	})
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to export orders",
+			slog.String("error", err.Error()),
+			slog.Int("count", ew.Count()))
+		if !out.started {
+			w.Header().Del("Content-Disposition")
+			writeServiceError(w, err)
+			return
+		}
+		// the status line is gone; cut the connection so that the client
+		// sees a broken download rather than a short file
+		panic(http.ErrAbortHandler)
+	}
+
+	h.logger.InfoContext(r.Context(), "Exported orders",
+		slog.Int("count", ew.Count()))
+}
+
+// startedWriter remembers whether anything was written, i.e. whether an
+// error can still be reported with a status code.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/feed"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+)
+
+// writeTimeout bounds a single write to a feed client. A client that does not
+// read for that long is disconnected; its buffer in the hub covers shorter
+// stalls.
+const writeTimeout = 10 * time.Second
+
+// eventReset tells the client it missed events and should reload the list.
+const eventReset = "reset"
+
+type FeedHandler struct {
+	hub       *feed.Hub
+	redactor  *redact.Redactor
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+	logger    *slog.Logger
+}
+
+// NewFeedHandler streams hub events over SSE and WebSocket. Orders are
+// redacted the same way as in OrderHandler. Idle connections get a heartbeat
+// every heartbeat so that proxies keep them open.
+func NewFeedHandler(hub *feed.Hub, redactor *redact.Redactor, heartbeat time.Duration, logger *slog.Logger) *FeedHandler {
+	return &FeedHandler{
+		hub:       hub,
+		redactor:  redactor,
+		heartbeat: heartbeat,
+		logger:    logger,
+	}
+}
+
+type feedMessage struct {
+	ID      uint64        `json:"id,omitempty"`
+	Type    string        `json:"type"`
+	Status  string        `json:"status,omitempty"`
+	Version int           `json:"version,omitempty"`
+	Time    *time.Time    `json:"time,omitempty"`
+	Order   *domain.Order `json:"order,omitempty"`
+}
+
+// Stream serves the feed as Server-Sent Events. Browsers reconnect on their
+// own and send Last-Event-ID to resume.
+func (h *FeedHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := h.parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	sub := h.hub.Subscribe(filter, lastID)
+	defer sub.Close()
+
+	h.logger.InfoContext(r.Context(), "Feed client connected",
+		slog.String("transport", "sse"),
+		slog.Uint64("lastEventID", lastID))
+
+	write := func(format string, args ...any) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := write("retry: 2000\n\n"); err != nil {
+		return
+	}
+	if sub.Gap {
+		if err := write("event: %s\ndata: {}\n\n", eventReset); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if err := write(": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				h.logger.InfoContext(r.Context(), "Feed client disconnected by server",
+					slog.String("transport", "sse"))
+				return
+			}
+			data, err := json.Marshal(h.message(r, e))
+			if err != nil {
+				h.logger.ErrorContext(r.Context(), "Failed to encode feed event",
+					slog.String("error", err.Error()))
+				continue
+			}
+			if err := write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// WebSocket serves the feed over a WebSocket, one JSON message per event.
+// Browsers cannot set headers on WebSocket requests, so the resume point may
+// also be passed as ?last_event_id.
+func (h *FeedHandler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := h.parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// subscribed before the upgrade completes so that nothing published
+	// after the client sees the handshake is missed
+	sub := h.hub.Subscribe(filter, lastID)
+	defer sub.Close()
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the client
+		h.logger.WarnContext(r.Context(), "WebSocket upgrade failed",
+			slog.String("error", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	h.logger.InfoContext(r.Context(), "Feed client connected",
+		slog.String("transport", "websocket"),
+		slog.Uint64("lastEventID", lastID))
+
+	// the client sends nothing but control frames; reading processes them and
+	// notices when the connection goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg feedMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(msg)
+	}
+
+	if sub.Gap {
+		if err := send(feedMessage{Type: eventReset}); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				h.logger.InfoContext(r.Context(), "Feed client disconnected by server",
+					slog.String("transport", "websocket"))
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resume with last_event_id"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if err := send(h.message(r, e)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// parseRequest reads the filters (type, customer_id, delivery_service) and the
+// resume point.
+func (h *FeedHandler) parseRequest(r *http.Request) (feed.Filter, uint64, error) {
+	q := r.URL.Query()
+	filter := feed.Filter{
+		CustomerID:      q.Get("customer_id"),
+		DeliveryService: q.Get("delivery_service"),
+	}
+	if types := q.Get("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			if t != feed.EventCreated && t != feed.EventUpdated && t != feed.EventStatus {
+				return feed.Filter{}, 0, fmt.Errorf("unknown event type %q, want %s, %s or %s", t, feed.EventCreated, feed.EventUpdated, feed.EventStatus)
+			}
+			filter.Types = append(filter.Types, t)
+		}
+	}
+	// callers who see customers hashed filter by the hash
+	if !auth.RoleFromContext(r.Context()).CanSeePII() {
+		filter.HashCustomer = func(s string) string { return h.redactor.Mask(redact.ModeHash, s) }
+	}
+
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = q.Get("last_event_id")
+	}
+	var lastID uint64
+	if raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return feed.Filter{}, 0, fmt.Errorf("invalid last event id %q", raw)
+		}
+		lastID = id
+	}
+	return filter, lastID, nil
+}
+
+func (h *FeedHandler) message(r *http.Request, e feed.Event) feedMessage {
+	order := e.Order
+	if !auth.RoleFromContext(r.Context()).CanSeePII() {
+		order = redact.Apply(h.redactor, order)
+	}
+	return feedMessage{ID: e.ID, Type: e.Type, Status: e.Status, Version: e.Version, Time: &e.Time, Order: order}
+}
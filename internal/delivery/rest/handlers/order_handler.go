@@ -1,92 +1,519 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"github.com/velvetriddles/wb-level0/internal/auth"
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/templates"
 )
 
 type OrderService interface {
-	GetAllOrders() ([]*domain.Order, error)
-	GetOrder(id string) (*domain.Order, error)
+	GetAllOrders(ctx context.Context) ([]*domain.Order, error)
+	GetOrder(ctx context.Context, id string) (*domain.Order, error)
+	SearchOrders(ctx context.Context, q domain.SearchQuery) ([]*domain.Order, error)
+	UpdateOrder(ctx context.Context, order *domain.Order) error
+	OrderVersions(ctx context.Context, id string) ([]*domain.Version, error)
+	GetOrderAsOf(ctx context.Context, id string, t time.Time) (*domain.Order, error)
+	GetOrderIncludingDeleted(ctx context.Context, id string) (*domain.Order, error)
+	ExportOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) error
+	CancelOrder(ctx context.Context, c domain.Cancellation) error
+}
+
+// CancelPublisher passes cancellations made through the API on to the other
+// instances, which evict the order from their caches.
+type CancelPublisher interface {
+	PublishCancellation(ctx context.Context, subject string, c domain.Cancellation) error
 }
 
 type OrderHandler struct {
 	service   OrderService
+	redactor  *redact.Redactor
 	templates *template.Template
 	logger    *slog.Logger
+
+	cancels       CancelPublisher
+	cancelSubject string
 }
 
-func NewOrderHandler(service OrderService, logger *slog.Logger) *OrderHandler {
-	templates := template.Must(template.ParseGlob("./internal/templates/*.html"))
+// NewOrderHandler serves orders as HTML, or as JSON when the client asks for
+// it. Personal data is redacted for callers whose role may not see it.
+func NewOrderHandler(service OrderService, redactor *redact.Redactor, logger *slog.Logger) *OrderHandler {
+	templates := template.Must(template.ParseFS(templates.FS, "*.html"))
 	return &OrderHandler{
 		service:   service,
+		redactor:  redactor,
 		templates: templates,
 		logger:    logger,
 	}
 }
 
+// SetCancelPublisher makes CancelOrder publish every cancellation to subject.
+// It must be called before the handler is used.
+func (h *OrderHandler) SetCancelPublisher(p CancelPublisher, subject string) {
+	h.cancels = p
+	h.cancelSubject = subject
+}
+
+// ListOrders serves the orders that are not cancelled. Admins may add
+// ?include_deleted=true to see the cancelled ones too.
 func (h *OrderHandler) ListOrders(w http.ResponseWriter, r *http.Request) {
-	h.logger.Info("Handling request to list all orders",
+	h.logger.InfoContext(r.Context(), "Handling request to list all orders",
 		slog.String("method", r.Method),
 		slog.String("path", r.URL.Path))
 
-	orders, err := h.service.GetAllOrders()
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	var orders []*domain.Order
+	var err error
+	if withDeleted {
+		// cancelled orders are not cached, so this reads the repository
+		orders = make([]*domain.Order, 0)
+		err = h.service.ExportOrders(r.Context(), domain.SearchQuery{IncludeDeleted: true}, func(o *domain.Order) error {
+			orders = append(orders, o)
+			return nil
+		})
+	} else {
+		orders, err = h.service.GetAllOrders(r.Context())
+	}
 	if err != nil {
-		h.logger.Error("Failed to get all orders",
+		h.logger.ErrorContext(r.Context(), "Failed to get all orders",
 			slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	h.logger.Info("Successfully retrieved orders",
+	h.logger.InfoContext(r.Context(), "Successfully retrieved orders",
 		slog.Int("count", len(orders)))
 
+	if !auth.RoleFromContext(r.Context()).CanSeePII() {
+		orders = redact.Apply(h.redactor, orders)
+	}
+
+	if wantsJSON(r) {
+		h.writeJSON(w, r, orders)
+		return
+	}
+
 	err = h.templates.ExecuteTemplate(w, "list.html", orders)
 	if err != nil {
-		h.logger.Error("Failed to execute template",
+		h.logger.ErrorContext(r.Context(), "Failed to execute template",
 			slog.String("template", "list.html"),
 			slog.String("error", err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// detailPage is the data of detail.html.
+type detailPage struct {
+	*domain.Order
+	// AsOf is the ?as_of time the order is shown at, zero for the latest.
+	AsOf     time.Time
+	Versions []*domain.Version
+}
+
+// GetOrder serves the latest order, or the version in effect at ?as_of
+// (RFC 3339 or YYYY-MM-DD) when given. Cancelled orders, and versions
+// recording their cancellation, are not found unless an admin asks with
+// ?include_deleted=true; the history before the cancellation stays readable.
 func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	h.logger.Info("Handling request to get specific order",
+	h.logger.InfoContext(r.Context(), "Handling request to get specific order",
 		slog.String("method", r.Method),
 		slog.String("path", r.URL.Path),
 		slog.String("orderID", id))
 
-	order, err := h.service.GetOrder(id)
+	asOf, err := domain.ParseSearchTime(r.URL.Query().Get("as_of"))
+	if err != nil {
+		http.Error(w, "as_of: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	var order *domain.Order
+	switch {
+	case !asOf.IsZero():
+		order, err = h.service.GetOrderAsOf(r.Context(), id, asOf)
+	case withDeleted:
+		order, err = h.service.GetOrderIncludingDeleted(r.Context(), id)
+	default:
+		order, err = h.service.GetOrder(r.Context(), id)
+	}
 	if err != nil {
-		h.logger.Error("Failed to get order",
+		h.logger.ErrorContext(r.Context(), "Failed to get order",
 			slog.String("orderID", id),
 			slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
+	if order != nil && order.Deletion != nil && !withDeleted {
+		order = nil
+	}
 
 	if order == nil {
-		h.logger.Info("Order not found",
+		h.logger.InfoContext(r.Context(), "Order not found",
 			slog.String("orderID", id))
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
-	h.logger.Info("Successfully retrieved order",
+	h.logger.InfoContext(r.Context(), "Successfully retrieved order",
 		slog.String("orderID", id))
 
-	err = h.templates.ExecuteTemplate(w, "detail.html", order)
+	if !auth.RoleFromContext(r.Context()).CanSeePII() {
+		order = redact.Apply(h.redactor, order)
+	}
+
+	if wantsJSON(r) {
+		h.writeJSON(w, r, order)
+		return
+	}
+
+	page := detailPage{Order: order, AsOf: asOf}
+	// the page is still useful without its history
+	page.Versions, err = h.service.OrderVersions(r.Context(), id)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "Failed to get order history",
+			slog.String("orderID", id),
+			slog.String("error", err.Error()))
+	}
+	if !withDeleted {
+		page.Versions = liveVersions(page.Versions)
+	}
+	err = h.templates.ExecuteTemplate(w, "detail.html", page)
 	if err != nil {
-		h.logger.Error("Failed to execute template",
+		h.logger.ErrorContext(r.Context(), "Failed to execute template",
 			slog.String("template", "detail.html"),
 			slog.String("error", err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// OrderVersions serves the history of an order, oldest first. HTML clients
+// are sent to the detail page, which lists it. The version recording a
+// cancellation is left out unless an admin asks with ?include_deleted=true.
+func (h *OrderHandler) OrderVersions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.logger.InfoContext(r.Context(), "Handling request to list order versions",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("orderID", id))
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/orders/"+url.PathEscape(id), http.StatusSeeOther)
+		return
+	}
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := h.service.OrderVersions(r.Context(), id)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to get order versions",
+			slog.String("orderID", id),
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+		return
+	}
+	if !withDeleted {
+		versions = liveVersions(versions)
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if !auth.RoleFromContext(r.Context()).CanSeePII() {
+		versions = redact.Apply(h.redactor, versions)
+	}
+	h.writeJSON(w, r, versions)
+}
+
+// UpdateOrder replaces an order with the JSON body, whose order_uid must
+// match the path. The change is recorded as a version from "api:" and the
+// caller's name. Repeating the current order is accepted without a new
+// version.
+func (h *OrderHandler) UpdateOrder(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.logger.InfoContext(r.Context(), "Handling request to update order",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("orderID", id))
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, domain.MaxOrderSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order, err := domain.DecodeOrder(data)
+	if errors.Is(err, domain.ErrOrderTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if order.OrderUID != id {
+		http.Error(w, fmt.Sprintf("order_uid %q does not match the path", order.OrderUID), http.StatusBadRequest)
+		return
+	}
+
+	source := "api"
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		source += ":" + p.Subject
+	}
+	err = h.service.UpdateOrder(domain.WithSource(r.Context(), source), order)
+	var ruleErr *domain.RuleError
+	var validationErr validator.ValidationErrors
+	switch {
+	case err == nil, errors.Is(err, domain.ErrOrderUnchanged):
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, domain.ErrOrderNotFound):
+		http.Error(w, "Order not found", http.StatusNotFound)
+	case errors.Is(err, domain.ErrOrderDeleted):
+		http.Error(w, "Order is cancelled", http.StatusConflict)
+	case errors.As(err, &validationErr), errors.As(err, &ruleErr):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		h.logger.ErrorContext(r.Context(), "Failed to update order",
+			slog.String("orderID", id),
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+	}
+}
+
+// CancelOrder soft-deletes an order for the ?reason given. The order is
+// evicted from this instance's cache at once and, through the cancellation
+// published to NATS, from the others'. Cancelling twice is not an error.
+func (h *OrderHandler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	c := domain.Cancellation{OrderUID: mux.Vars(r)["id"], Reason: r.URL.Query().Get("reason")}
+
+	h.logger.InfoContext(r.Context(), "Handling request to cancel order",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("orderID", c.OrderUID))
+
+	if c.Reason == "" {
+		http.Error(w, "reason: required", http.StatusBadRequest)
+		return
+	}
+
+	source := "api"
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		source += ":" + p.Subject
+	}
+	ctx := domain.WithSource(r.Context(), source)
+	err := h.service.CancelOrder(ctx, c)
+	switch {
+	case err == nil:
+	case errors.Is(err, domain.ErrOrderDeleted):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case errors.Is(err, domain.ErrOrderNotFound):
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	default:
+		h.logger.ErrorContext(ctx, "Failed to cancel order",
+			slog.String("orderID", c.OrderUID),
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+		return
+	}
+
+	if h.cancels != nil {
+		// the order is cancelled either way; instances that miss this keep
+		// serving it from their cache until it is evicted or they restart
+		if err := h.cancels.PublishCancellation(ctx, h.cancelSubject, c); err != nil {
+			h.logger.ErrorContext(ctx, "Failed to publish cancellation",
+				slog.String("orderID", c.OrderUID),
+				slog.String("error", err.Error()))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// includeDeleted reads ?include_deleted, which only admins may set. When the
+// value is not acceptable it answers the request and returns ok false.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	raw := r.URL.Query().Get("include_deleted")
+	if raw == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(raw)
+	if err != nil {
+		http.Error(w, "include_deleted: want true or false, got "+strconv.Quote(raw), http.StatusBadRequest)
+		return false, false
+	}
+	if include && auth.RoleFromContext(r.Context()) != auth.RoleAdmin {
+		http.Error(w, "Including cancelled orders needs the admin role", http.StatusForbidden)
+		return false, false
+	}
+	return include, true
+}
+
+// liveVersions drops the versions recording a cancellation.
+func liveVersions(versions []*domain.Version) []*domain.Version {
+	live := make([]*domain.Version, 0, len(versions))
+	for _, v := range versions {
+		if v.Order.Deletion == nil {
+			live = append(live, v)
+		}
+	}
+	return live
+}
+
+// searchPage is the data of search.html.
+type searchPage struct {
+	Params  url.Values
+	Orders  []*domain.Order
+	PrevURL string
+	NextURL string
+}
+
+// SearchOrders matches free text and filters, see parseSearchQuery. Callers
+// who may not see personal data search only public fields and cannot filter
+// by customer; only admins may include cancelled orders.
+func (h *OrderHandler) SearchOrders(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if q.IncludeDeleted, ok = includeDeleted(w, r); !ok {
+		return
+	}
+	canSeePII := auth.RoleFromContext(r.Context()).CanSeePII()
+	if q.CustomerID != "" && !canSeePII {
+		http.Error(w, "Filtering by customer needs the support role", http.StatusForbidden)
+		return
+	}
+	q.IncludePII = canSeePII
+
+	h.logger.InfoContext(r.Context(), "Handling order search",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path))
+
+	orders, err := h.service.SearchOrders(r.Context(), q)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to search orders",
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+		return
+	}
+	if !canSeePII {
+		orders = redact.Apply(h.redactor, orders)
+	}
+
+	if wantsJSON(r) {
+		h.writeJSON(w, r, orders)
+		return
+	}
+
+	page := searchPage{Params: r.URL.Query(), Orders: orders}
+	if q.Offset > 0 {
+		page.PrevURL = pageURL(r, max(q.Offset-q.Limit, 0))
+	}
+	if len(orders) == q.Limit {
+		page.NextURL = pageURL(r, q.Offset+q.Limit)
+	}
+	err = h.templates.ExecuteTemplate(w, "search.html", page)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to execute template",
+			slog.String("template", "search.html"),
+			slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseSearchQuery reads q (free text), customer_id, delivery_service, city,
+// brand, currency, from and to (RFC 3339 or YYYY-MM-DD; to is exclusive),
+// limit and offset.
+func parseSearchQuery(values url.Values) (domain.SearchQuery, error) {
+	q := domain.SearchQuery{
+		Text:            values.Get("q"),
+		CustomerID:      values.Get("customer_id"),
+		DeliveryService: values.Get("delivery_service"),
+		City:            values.Get("city"),
+		Brand:           values.Get("brand"),
+		Currency:        values.Get("currency"),
+	}
+
+	var err error
+	if q.From, err = domain.ParseSearchTime(values.Get("from")); err != nil {
+		return q, fmt.Errorf("from: %w", err)
+	}
+	if q.To, err = domain.ParseSearchTime(values.Get("to")); err != nil {
+		return q, fmt.Errorf("to: %w", err)
+	}
+	for name, dst := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		raw := values.Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("%s: want a non-negative number, got %q", name, raw)
+		}
+		*dst = n
+	}
+	return q.WithDefaults(), nil
+}
+
+func pageURL(r *http.Request, offset int) string {
+	values := r.URL.Query()
+	values.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + values.Encode()
+}
+
+// writeServiceError answers 429 when storage is overloaded so that clients
+// back off, and 500 for anything else.
+func writeServiceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, domain.ErrOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// wantsJSON reports whether the client asked for JSON through the Accept
+// header or ?format=json.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (h *OrderHandler) writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to encode response",
+			slog.String("error", err.Error()))
+	}
+}
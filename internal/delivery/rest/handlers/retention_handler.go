@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/retention"
+)
+
+// defaultRetentionRuns is how many audit records GET /admin/retention
+// returns without ?limit.
+const defaultRetentionRuns = 20
+
+type RetentionJob interface {
+	Run(ctx context.Context, trigger string) (*domain.RetentionRun, error)
+	Runs(ctx context.Context, limit int) ([]*domain.RetentionRun, error)
+}
+
+type RetentionHandler struct {
+	job    RetentionJob
+	logger *slog.Logger
+}
+
+func NewRetentionHandler(job RetentionJob, logger *slog.Logger) *RetentionHandler {
+	return &RetentionHandler{job: job, logger: logger}
+}
+
+// Runs lists the audit records of the latest ?limit runs, newest first.
+func (h *RetentionHandler) Runs(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRetentionRuns
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > domain.MaxSearchLimit {
+			http.Error(w, fmt.Sprintf("limit: want a number between 1 and %d, got %q", domain.MaxSearchLimit, raw),
+				http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	runs, err := h.job.Runs(r.Context(), limit)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to get retention runs",
+			slog.String("error", err.Error()))
+		writeServiceError(w, err)
+		return
+	}
+	h.writeJSON(w, r, runs)
+}
+
+// Run starts a retention run and answers with its audit record once it is
+// done. A failed run answers 500 with the record, which carries the error.
+func (h *RetentionHandler) Run(w http.ResponseWriter, r *http.Request) {
+	h.logger.InfoContext(r.Context(), "Handling request to run retention",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path))
+
+	trigger := "api"
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		trigger += ":" + p.Subject
+	}
+	run, err := h.job.Run(r.Context(), trigger)
+	switch {
+	case errors.Is(err, retention.ErrRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil && run == nil:
+		writeServiceError(w, err)
+		return
+	case err != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(run)
+		return
+	}
+	h.writeJSON(w, r, run)
+}
+
+func (h *RetentionHandler) writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.ErrorContext(r.Context(), "Failed to encode response",
+			slog.String("error", err.Error()))
+	}
+}
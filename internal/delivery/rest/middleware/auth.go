@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/velvetriddles/wb-level0/internal/auth"
+)
+
+var authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "wb",
+	Name:      "auth_failures_total",
+	Help:      "Rejected HTTP requests by authentication method and reason.",
+}, []string{"method", "reason"})
+
+// Authenticate identifies the caller with the first authenticator that finds
+// credentials in the request. Requests without any credentials get the
+// anonymous role, or are rejected when it is empty.
+func Authenticate(authenticators []auth.Authenticator, anonymous auth.Role, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range authenticators {
+				principal, err := a.Authenticate(r)
+				if errors.Is(err, auth.ErrNoCredentials) {
+					continue
+				}
+				if err != nil {
+					rejectUnauthenticated(w, r, logger, a.Name(), err)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+				return
+			}
+
+			if anonymous == "" {
+				rejectUnauthenticated(w, r, logger, "none", auth.ErrNoCredentials)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithRole(r.Context(), anonymous)))
+		})
+	}
+}
+
+// RequireRole lets through callers acting in one of roles.
+func RequireRole(logger *slog.Logger, roles ...auth.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := auth.RoleFromContext(r.Context())
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			method, subject := "none", ""
+			if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Method != "" {
+				method, subject = p.Method, p.Subject
+			}
+			authFailures.WithLabelValues(method, "forbidden").Inc()
+			logger.WarnContext(r.Context(), "Access denied",
+				slog.String("subject", subject),
+				slog.String("role", string(role)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("remoteAddr", r.RemoteAddr))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+}
+
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, logger *slog.Logger, authMethod string, err error) {
+	reason := auth.Reason(err)
+	authFailures.WithLabelValues(authMethod, reason).Inc()
+	logger.WarnContext(r.Context(), "Authentication failed",
+		slog.String("auth", authMethod),
+		slog.String("reason", reason),
+		slog.String("error", err.Error()),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("remoteAddr", r.RemoteAddr))
+
+	if errors.Is(err, auth.ErrBodyTooLarge) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="wb"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/velvetriddles/wb-level0/internal/logger"
+)
+
+// Correlation tags the request context with the caller's X-Correlation-ID (or
+// X-Request-ID), generating one when neither is set, and echoes it back.
+func Correlation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logger.CorrelationHeader)
+		if id == "" {
+			id = r.Header.Get("X-Request-ID")
+		}
+		if id == "" {
+			id = logger.NewCorrelationID()
+		}
+
+		w.Header().Set(logger.CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(logger.WithCorrelationID(r.Context(), id)))
+	})
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/velvetriddles/wb-level0/internal/auth"
+	"github.com/velvetriddles/wb-level0/internal/ratelimit"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "wb",
+	Name:      "rate_limit_rejected_total",
+	Help:      "HTTP requests rejected with 429 by the per-client rate limit, by route.",
+}, []string{"route"})
+
+// RateLimit answers 429 with Retry-After once a client has used up its
+// budget for the matched route. Authenticated callers are told apart by
+// subject, anonymous ones by IP address. It must run after authentication.
+func RateLimit(limiter *ratelimit.Limiter, trustProxy bool, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeName(r)
+			client := clientKey(r, trustProxy)
+
+			ok, retryAfter := limiter.Allow(route, client)
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rateLimited.WithLabelValues(route).Inc()
+			logger.WarnContext(r.Context(), "Rate limit exceeded",
+				slog.String("route", route),
+				slog.String("client", client),
+				slog.String("retryAfter", retryAfter.String()))
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		})
+	}
+}
+
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		return route.GetName()
+	}
+	return ratelimit.DefaultRoute
+}
+
+func clientKey(r *http.Request, trustProxy bool) string {
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Subject != "" {
+		return p.Method + ":" + p.Subject
+	}
+	if trustProxy {
+		// the client controls every entry but the last, which the trusted
+		// proxy appended
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if last = strings.TrimSpace(last); last != "" {
+				return "ip:" + last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// retryAfterSeconds rounds up to whole seconds, at least one.
+func retryAfterSeconds(d time.Duration) string {
+	secs := math.Ceil(d.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	if secs > math.MaxInt32 {
+		secs = math.MaxInt32
+	}
+	return strconv.Itoa(int(secs))
+}
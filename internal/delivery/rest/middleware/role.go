@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/velvetriddles/wb-level0/internal/auth"
+)
+
+// DefaultRole gives every request the configured role. It stands in for
+// authentication on deployments that do not identify callers.
+func DefaultRole(role auth.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(auth.WithRole(r.Context(), role)))
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Deletion records when and why an order was cancelled. Cancelled orders are
+// kept, only hidden; they are removed for good by the retention job.
+type Deletion struct {
+	DeletedAt time.Time `json:"deleted_at"`
+	Reason    string    `json:"reason"`
+}
+
+// Cancellation asks for an order to be cancelled, as published to
+// orders.cancelled.
+type Cancellation struct {
+	OrderUID string `json:"order_uid" validate:"required"`
+	Reason   string `json:"reason" validate:"required"`
+}
+
+// DecodeCancellation parses and validates a JSON cancellation.
+func DecodeCancellation(data []byte) (*Cancellation, error) {
+	if len(data) > MaxOrderSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrOrderTooLarge, len(data), MaxOrderSize)
+	}
+	var c Cancellation
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Cancellation) Validate() error {
+	return validator.New().Struct(c)
+}
+
+// Eviction asks every instance to drop orders from its cache because stored
+// copies changed behind it, e.g. when the retention job erased their personal
+// data or archived them, as published to orders.evicted.
+type Eviction struct {
+	OrderUIDs []string `json:"order_uids" validate:"required,min=1,dive,required"`
+	Reason    string   `json:"reason"`
+}
+
+// DecodeEviction parses and validates a JSON eviction.
+func DecodeEviction(data []byte) (*Eviction, error) {
+	if len(data) > MaxOrderSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrOrderTooLarge, len(data), MaxOrderSize)
+	}
+	var e Eviction
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if err := validator.New().Struct(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,23 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MaxOrderSize bounds an encoded order. Real orders take a few kilobytes;
+// anything near the 1 MB NATS payload limit is junk.
+const MaxOrderSize = 256 << 10
+
+// DecodeOrder parses a JSON order as published to NATS. It does not
+// validate it.
+func DecodeOrder(data []byte) (*Order, error) {
+	if len(data) > MaxOrderSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrOrderTooLarge, len(data), MaxOrderSize)
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
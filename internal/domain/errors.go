@@ -0,0 +1,26 @@
+package domain
+
+import "errors"
+
+// ErrOrderExists is returned by repositories when an order with the same
+// OrderUID has already been saved.
+var ErrOrderExists = errors.New("order already exists")
+
+// ErrOrderNotFound is returned by repositories when an order to update has
+// never been saved.
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrOrderUnchanged is returned by repositories when an update equals the
+// latest version of the order, e.g. because it was delivered twice.
+var ErrOrderUnchanged = errors.New("order unchanged")
+
+// ErrOrderDeleted is returned by repositories when an order to change has
+// already been cancelled.
+var ErrOrderDeleted = errors.New("order cancelled")
+
+// ErrOrderTooLarge is returned by DecodeOrder for messages over MaxOrderSize.
+var ErrOrderTooLarge = errors.New("order too large")
+
+// ErrOverloaded is returned when storage is too busy to take another read.
+// Callers should back off and retry later.
+var ErrOverloaded = errors.New("storage overloaded")
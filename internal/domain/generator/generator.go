@@ -0,0 +1,290 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// Range is an inclusive interval of integers.
+type Range struct {
+	Min, Max int
+}
+
+func (r Range) pick(rnd *rand.Rand) int {
+	return r.Min + rnd.Intn(r.Max-r.Min+1)
+}
+
+// Choice picks one of Values, with probability proportional to Weights. Nil
+// Weights means every value is equally likely.
+type Choice struct {
+	Values  []string
+	Weights []int
+}
+
+func (c Choice) pick(rnd *rand.Rand) string {
+	if c.Weights == nil {
+		return c.Values[rnd.Intn(len(c.Values))]
+	}
+	total := 0
+	for _, w := range c.Weights {
+		total += w
+	}
+	n := rnd.Intn(total)
+	for i, w := range c.Weights {
+		if n < w {
+			return c.Values[i]
+		}
+		n -= w
+	}
+	return c.Values[len(c.Values)-1]
+}
+
+func (c Choice) validate() error {
+	if len(c.Values) == 0 {
+		return errors.New("no values")
+	}
+	if c.Weights == nil {
+		return nil
+	}
+	if len(c.Weights) != len(c.Values) {
+		return fmt.Errorf("%d weights for %d values", len(c.Weights), len(c.Values))
+	}
+	total := 0
+	for _, w := range c.Weights {
+		if w < 0 {
+			return fmt.Errorf("negative weight %d", w)
+		}
+		total += w
+	}
+	if total == 0 {
+		return errors.New("weights add up to 0")
+	}
+	return nil
+}
+
+// Config describes the orders a Generator produces. Money is in the
+// currency's minor units, as in domain.Payment.
+type Config struct {
+	// Seed makes the sequence of orders reproducible.
+	Seed int64
+
+	Items        Range // items per order
+	Price        Range // item price before the sale
+	Sale         Range // item sale, percent
+	DeliveryCost Range
+	CustomFee    Range
+
+	Currencies       Choice
+	Locales          Choice
+	DeliveryServices Choice
+
+	// DateCreated is spread uniformly over [Until-Spread, Until]. A zero
+	// Until means the time the Generator is created, which makes dates
+	// differ between runs.
+	Until  time.Time
+	Spread time.Duration
+}
+
+// DefaultConfig returns a config for orders that look like a marketplace's:
+// one to five items, mostly paid in rubles and shipped by wb, spread over
+// the last 30 days.
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Seed:         seed,
+		Items:        Range{1, 5},
+		Price:        Range{100, 50000},
+		Sale:         Range{0, 70},
+		DeliveryCost: Range{1, 1500},
+		CustomFee:    Range{0, 0},
+		Currencies:   Choice{Values: []string{"RUB", "KZT", "BYN", "USD"}, Weights: []int{85, 7, 5, 3}},
+		Locales:      Choice{Values: []string{"ru", "en", "kk"}, Weights: []int{80, 15, 5}},
+		DeliveryServices: Choice{
+			Values:  []string{"wb", "meest", "cdek", "boxberry"},
+			Weights: []int{70, 10, 12, 8},
+		},
+		Spread: 30 * 24 * time.Hour,
+	}
+}
+
+func (c Config) validate() error {
+	var errs []error
+	ranges := []struct {
+		name string
+		r    Range
+		min  int
+	}{
+		// the validators need at least one item and non-zero prices and
+		// delivery cost
+		{"items", c.Items, 1},
+		{"price", c.Price, 1},
+		{"sale", c.Sale, 0},
+		{"delivery_cost", c.DeliveryCost, 1},
+		{"custom_fee", c.CustomFee, 0},
+	}
+	for _, r := range ranges {
+		if r.r.Min < r.min || r.r.Max < r.r.Min {
+			errs = append(errs, fmt.Errorf("%s: range [%d, %d] is empty or below %d", r.name, r.r.Min, r.r.Max, r.min))
+		}
+	}
+	if c.Sale.Max > 100 {
+		errs = append(errs, fmt.Errorf("sale: %d%% is over 100%%", c.Sale.Max))
+	}
+	choices := []struct {
+		name string
+		c    Choice
+	}{
+		{"currencies", c.Currencies},
+		{"locales", c.Locales},
+		{"delivery_services", c.DeliveryServices},
+	}
+	for _, c := range choices {
+		if err := c.c.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	if c.Spread < 0 {
+		errs = append(errs, fmt.Errorf("spread: negative %s", c.Spread))
+	}
+	return errors.Join(errs...)
+}
+
+// Generator produces valid orders whose totals satisfy every domain.Rules
+// check. Two generators with the same Config produce the same orders. A
+// Generator is not safe for concurrent use.
+type Generator struct {
+	cfg   Config
+	rnd   *rand.Rand
+	until time.Time
+}
+
+func New(cfg Config) (*Generator, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid generator config: %w", err)
+	}
+	until := cfg.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	return &Generator{cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed)), until: until.UTC()}, nil
+}
+
+// Order returns the next order.
+func (g *Generator) Order() domain.Order {
+	r := g.rnd
+	created := g.until
+	if g.cfg.Spread > 0 {
+		created = created.Add(-time.Duration(r.Int63n(int64(g.cfg.Spread) + 1)))
+	}
+	created = created.Truncate(time.Microsecond)
+
+	uid := g.hex(16)
+	track := "WB" + strings.ToUpper(g.letters(10))
+	first, last := pick(r, firstNames), pick(r, lastNames)
+	city := pick(r, cities)
+
+	order := domain.Order{
+		OrderUID:          uid,
+		TrackNumber:       track,
+		Entry:             "WBIL",
+		Locale:            g.cfg.Locales.pick(r),
+		InternalSignature: "",
+		CustomerID:        "customer-" + strconv.Itoa(r.Intn(100000)+1),
+		DeliveryService:   g.cfg.DeliveryServices.pick(r),
+		Shardkey:          strconv.Itoa(r.Intn(10)),
+		SmID:              r.Intn(999) + 1,
+		DateCreated:       created,
+		OofShard:          strconv.Itoa(r.Intn(10)),
+		Delivery: domain.Delivery{
+			Name:    first + " " + last,
+			Phone:   "+7" + g.digits(10),
+			Zip:     strconv.Itoa(r.Intn(900000) + 100000),
+			City:    city.name,
+			Address: pick(r, streets) + " " + strconv.Itoa(r.Intn(150)+1),
+			Region:  city.region,
+			Email:   strings.ToLower(first+"."+last) + strconv.Itoa(r.Intn(100)) + "@" + pick(r, mailDomains),
+		},
+		Payment: domain.Payment{
+			Transaction:  uid,
+			RequestID:    "",
+			Currency:     g.cfg.Currencies.pick(r),
+			Provider:     pick(r, providers),
+			PaymentDt:    int(created.Unix()),
+			Bank:         pick(r, banks),
+			DeliveryCost: g.cfg.DeliveryCost.pick(r),
+			CustomFee:    g.cfg.CustomFee.pick(r),
+		},
+	}
+
+	n := g.cfg.Items.pick(r)
+	order.Items = make([]domain.Item, n)
+	for i := range order.Items {
+		price, sale := g.cfg.Price.pick(r), g.cfg.Sale.pick(r)
+		total := domain.ItemTotalPrice(price, sale)
+		if total == 0 {
+			// total_price must be positive; a cheap item at a deep sale is
+			// sold without it
+			sale, total = 0, price
+		}
+		product := pick(r, products)
+		order.Items[i] = domain.Item{
+			ChrtID:      r.Intn(9000000) + 1000000,
+			TrackNumber: track,
+			Price:       price,
+			RID:         g.hex(20),
+			Name:        product.name,
+			Sale:        sale,
+			Size:        pick(r, product.sizes),
+			TotalPrice:  total,
+			NmID:        r.Intn(9000000) + 1000000,
+			Brand:       pick(r, product.brands),
+			Status:      202,
+		}
+		order.Payment.GoodsTotal += total
+	}
+	order.Payment.Amount = order.Payment.GoodsTotal + order.Payment.DeliveryCost + order.Payment.CustomFee
+	return order
+}
+
+// Orders returns the next n orders.
+func (g *Generator) Orders(n int) []domain.Order {
+	orders := make([]domain.Order, n)
+	for i := range orders {
+		orders[i] = g.Order()
+	}
+	return orders
+}
+
+func (g *Generator) hex(n int) string {
+	const alphabet = "0123456789abcdef"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[g.rnd.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func (g *Generator) letters(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + g.rnd.Intn(26))
+	}
+	return string(b)
+}
+
+func (g *Generator) digits(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('0' + g.rnd.Intn(10))
+	}
+	return string(b)
+}
+
+func pick[T any](r *rand.Rand, values []T) T {
+	return values[r.Intn(len(values))]
+}
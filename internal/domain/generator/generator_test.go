@@ -0,0 +1,98 @@
+package generator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+var until = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestSameSeedSameOrders(t *testing.T) {
+	cfg := DefaultConfig(42)
+	cfg.Until = until
+
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := New(cfg)
+	if got, want := a.Orders(20), b.Orders(20); !reflect.DeepEqual(got, want) {
+		t.Fatal("generators with the same config produced different orders")
+	}
+
+	cfg.Seed = 43
+	c, _ := New(cfg)
+	if c.Order().OrderUID == a.Order().OrderUID {
+		t.Fatal("different seeds produced the same order")
+	}
+}
+
+func TestOrdersAreValidAndConsistent(t *testing.T) {
+	cfg := DefaultConfig(1)
+	cfg.Until = until
+	cfg.Price = Range{1, 3} // cheap items at deep sales round down to 0
+	cfg.Sale = Range{0, 100}
+	cfg.CustomFee = Range{0, 50}
+	g, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := domain.Rules{GoodsTotal: true, Amount: true, ItemTotal: true}
+	seen := map[string]bool{}
+	for i, order := range g.Orders(500) {
+		if err := order.Validate(); err != nil {
+			t.Fatalf("order %d: %v", i, err)
+		}
+		if err := all.Check(&order); err != nil {
+			t.Fatalf("order %d: %v", i, err)
+		}
+		if seen[order.OrderUID] {
+			t.Fatalf("order %d: duplicate uid %s", i, order.OrderUID)
+		}
+		seen[order.OrderUID] = true
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	cfg := DefaultConfig(7)
+	cfg.Until = until
+	cfg.Spread = 24 * time.Hour
+	cfg.Items = Range{2, 3}
+	cfg.Currencies = Choice{Values: []string{"RUB", "USD"}, Weights: []int{9, 1}}
+	cfg.DeliveryServices = Choice{Values: []string{"cdek"}}
+	g, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currencies := map[string]int{}
+	for i, order := range g.Orders(1000) {
+		if n := len(order.Items); n < 2 || n > 3 {
+			t.Fatalf("order %d: %d items", i, n)
+		}
+		if order.DateCreated.After(until) || order.DateCreated.Before(until.Add(-cfg.Spread)) {
+			t.Fatalf("order %d: created %s, outside the spread", i, order.DateCreated)
+		}
+		if order.DeliveryService != "cdek" {
+			t.Fatalf("order %d: delivery service %q", i, order.DeliveryService)
+		}
+		currencies[order.Payment.Currency]++
+	}
+	if len(currencies) != 2 || currencies["RUB"] < 800 || currencies["USD"] < 50 {
+		t.Fatalf("currencies do not follow the 9:1 weights: %v", currencies)
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	cfg := DefaultConfig(1)
+	cfg.Items = Range{0, 2}
+	cfg.Sale = Range{10, 120}
+	cfg.Currencies = Choice{}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New: want an error")
+	}
+}
@@ -0,0 +1,177 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// Stages at which the service rejects an order, in the order it checks them.
+const (
+	StageTooLarge = "too_large" // domain.DecodeOrder: over domain.MaxOrderSize
+	StageDecode   = "decode"    // domain.DecodeOrder: not an Order in JSON
+	StageValidate = "validate"  // Order.Validate
+	StageRule     = "rule"      // domain.Rules with every rule enabled
+)
+
+// Expect is the single check a mutated order fails.
+type Expect struct {
+	Stage string
+	// Field and Tag name the failing validation for StageValidate, as the
+	// validator reports them: "Order.Payment.Amount" and "gt".
+	Field string
+	Tag   string
+	// Rule is the domain.Rule* name for StageRule.
+	Rule string
+}
+
+func (e Expect) String() string {
+	switch e.Stage {
+	case StageValidate:
+		return e.Stage + " " + e.Field + " " + e.Tag
+	case StageRule:
+		return e.Stage + " " + e.Rule
+	default:
+		return e.Stage
+	}
+}
+
+// Mutation corrupts a valid order in one targeted way.
+type Mutation struct {
+	Name   string
+	Expect Expect
+	// mutate changes the order in place; encode, when set, corrupts the JSON
+	// after that.
+	mutate func(o *domain.Order)
+	encode func(data []byte) []byte
+}
+
+// Apply returns the JSON of a mutated copy of order. order must be valid and
+// consistent, as a Generator's orders are.
+func (m Mutation) Apply(order domain.Order) []byte {
+	order.Items = append([]domain.Item(nil), order.Items...)
+	if m.mutate != nil {
+		m.mutate(&order)
+	}
+	data, err := json.Marshal(order)
+	if err != nil {
+		panic(err) // an Order always encodes
+	}
+	if m.encode != nil {
+		data = m.encode(data)
+	}
+	return data
+}
+
+func invalid(field, tag string) Expect {
+	return Expect{Stage: StageValidate, Field: field, Tag: tag}
+}
+
+// Mutations lists every corruption the fuzzer applies.
+var Mutations = []Mutation{
+	{Name: "missing_order_uid", Expect: invalid("Order.OrderUID", "required"),
+		mutate: func(o *domain.Order) { o.OrderUID = "" }},
+	{Name: "missing_customer_id", Expect: invalid("Order.CustomerID", "required"),
+		mutate: func(o *domain.Order) { o.CustomerID = "" }},
+	{Name: "missing_city", Expect: invalid("Order.Delivery.City", "required"),
+		mutate: func(o *domain.Order) { o.Delivery.City = "" }},
+	{Name: "missing_item_rid", Expect: invalid("Order.Items[0].RID", "required"),
+		mutate: func(o *domain.Order) { o.Items[0].RID = "" }},
+	{Name: "no_items", Expect: invalid("Order.Items", "min"),
+		mutate: func(o *domain.Order) { o.Items = []domain.Item{} }},
+	{Name: "negative_amount", Expect: invalid("Order.Payment.Amount", "gt"),
+		mutate: func(o *domain.Order) { o.Payment.Amount = -o.Payment.Amount }},
+	{Name: "negative_delivery_cost", Expect: invalid("Order.Payment.DeliveryCost", "gte"),
+		mutate: func(o *domain.Order) { o.Payment.DeliveryCost = -o.Payment.DeliveryCost }},
+	{Name: "negative_custom_fee", Expect: invalid("Order.Payment.CustomFee", "gte"),
+		mutate: func(o *domain.Order) { o.Payment.CustomFee = -1 - o.Payment.CustomFee }},
+	{Name: "negative_price", Expect: invalid("Order.Items[0].Price", "gt"),
+		mutate: func(o *domain.Order) { o.Items[0].Price = -o.Items[0].Price }},
+	{Name: "sale_over_100", Expect: invalid("Order.Items[0].Sale", "lte"),
+		mutate: func(o *domain.Order) { o.Items[0].Sale = 150 }},
+	{Name: "negative_sale", Expect: invalid("Order.Items[0].Sale", "gte"),
+		mutate: func(o *domain.Order) { o.Items[0].Sale = -5 }},
+	{Name: "bad_email", Expect: invalid("Order.Delivery.Email", "email"),
+		mutate: func(o *domain.Order) { o.Delivery.Email = strings.ReplaceAll(o.Delivery.Email, "@", " at ") }},
+	{Name: "wrong_item_total", Expect: Expect{Stage: StageRule, Rule: domain.RuleItemTotal},
+		mutate: func(o *domain.Order) {
+			// keep goods_total and amount in step so only item_total breaks
+			o.Items[0].TotalPrice++
+			o.Payment.GoodsTotal++
+			o.Payment.Amount++
+		}},
+	{Name: "wrong_goods_total", Expect: Expect{Stage: StageRule, Rule: domain.RuleGoodsTotal},
+		mutate: func(o *domain.Order) {
+			o.Payment.GoodsTotal++
+			o.Payment.Amount++
+		}},
+	{Name: "wrong_amount", Expect: Expect{Stage: StageRule, Rule: domain.RuleAmount},
+		mutate: func(o *domain.Order) { o.Payment.Amount++ }},
+	{Name: "truncated_json", Expect: Expect{Stage: StageDecode},
+		encode: func(data []byte) []byte { return data[:len(data)/2] }},
+	{Name: "amount_as_string", Expect: Expect{Stage: StageDecode},
+		encode: func(data []byte) []byte {
+			return setJSON(data, func(m map[string]any) {
+				payment := m["payment"].(map[string]any)
+				payment["amount"] = fmt.Sprint(payment["amount"])
+			})
+		}},
+	{Name: "items_as_object", Expect: Expect{Stage: StageDecode},
+		encode: func(data []byte) []byte {
+			return setJSON(data, func(m map[string]any) { m["items"] = m["items"].([]any)[0] })
+		}},
+	{Name: "oversized", Expect: Expect{Stage: StageTooLarge},
+		mutate: func(o *domain.Order) { o.InternalSignature = strings.Repeat("x", domain.MaxOrderSize) }},
+}
+
+// MutationNamed returns the mutation called name.
+func MutationNamed(name string) (Mutation, bool) {
+	for _, m := range Mutations {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Mutation{}, false
+}
+
+// setJSON edits the JSON object in data through its generic form.
+func setJSON(data []byte, edit func(map[string]any)) []byte {
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+	edit(m)
+	out, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Sample is one message of a fuzzing run: a valid order's JSON, or a mutated
+// one with the mutation that produced it.
+type Sample struct {
+	OrderUID string
+	Data     []byte
+	Mutation *Mutation
+}
+
+// Sample returns the next order's JSON, mutated with probability share by
+// one of mutations picked at random (all of Mutations when empty).
+func (g *Generator) Sample(share float64, mutations []Mutation) Sample {
+	order := g.Order()
+	if len(mutations) == 0 {
+		mutations = Mutations
+	}
+	if g.rnd.Float64() >= share {
+		data, err := json.Marshal(order)
+		if err != nil {
+			panic(err)
+		}
+		return Sample{OrderUID: order.OrderUID, Data: data}
+	}
+	m := mutations[g.rnd.Intn(len(mutations))]
+	return Sample{OrderUID: order.OrderUID, Data: m.Apply(order), Mutation: &m}
+}
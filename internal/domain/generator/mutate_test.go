@@ -0,0 +1,87 @@
+package generator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// reject runs data through the checks the service applies and reports every
+// one that fails, so that a test can tell a single expected failure from
+// several.
+func reject(data []byte) []Expect {
+	order, err := domain.DecodeOrder(data)
+	if errors.Is(err, domain.ErrOrderTooLarge) {
+		return []Expect{{Stage: StageTooLarge}}
+	}
+	if err != nil {
+		return []Expect{{Stage: StageDecode}}
+	}
+
+	var failed []Expect
+	var verrs validator.ValidationErrors
+	if err := order.Validate(); errors.As(err, &verrs) {
+		for _, fe := range verrs {
+			failed = append(failed, Expect{Stage: StageValidate, Field: fe.Namespace(), Tag: fe.Tag()})
+		}
+		return failed
+	} else if err != nil {
+		return []Expect{{Stage: "validate: " + err.Error()}}
+	}
+
+	for _, rules := range []domain.Rules{{ItemTotal: true}, {GoodsTotal: true}, {Amount: true}} {
+		var rerr *domain.RuleError
+		if errors.As(rules.Check(order), &rerr) {
+			failed = append(failed, Expect{Stage: StageRule, Rule: rerr.Rule})
+		}
+	}
+	return failed
+}
+
+func TestMutationsTripExactlyTheExpectedRule(t *testing.T) {
+	cfg := DefaultConfig(3)
+	cfg.Until = until
+	g, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range Mutations {
+		t.Run(m.Name, func(t *testing.T) {
+			// several orders, since items, fees and sales vary between them
+			for i := 0; i < 20; i++ {
+				got := reject(m.Apply(g.Order()))
+				if len(got) != 1 || got[0] != m.Expect {
+					t.Fatalf("order %d rejected by %v, want only %v", i, got, m.Expect)
+				}
+			}
+		})
+	}
+}
+
+func TestSampleMixesValidAndMutatedOrders(t *testing.T) {
+	cfg := DefaultConfig(5)
+	cfg.Until = until
+	g, _ := New(cfg)
+
+	mutated := 0
+	for i := 0; i < 1000; i++ {
+		s := g.Sample(0.3, nil)
+		got := reject(s.Data)
+		if s.Mutation == nil {
+			if len(got) != 0 {
+				t.Fatalf("sample %d: valid order rejected by %v", i, got)
+			}
+			continue
+		}
+		mutated++
+		if len(got) != 1 || got[0] != s.Mutation.Expect {
+			t.Fatalf("sample %d (%s): rejected by %v, want %v", i, s.Mutation.Name, got, s.Mutation.Expect)
+		}
+	}
+	if mutated < 200 || mutated > 400 {
+		t.Fatalf("%d of 1000 samples mutated, want about 300", mutated)
+	}
+}
@@ -0,0 +1,55 @@
+package generator
+
+var firstNames = []string{
+	"Ivan", "Anna", "Dmitry", "Maria", "Sergey", "Elena", "Alexey", "Olga",
+	"Nikolay", "Tatiana", "Mikhail", "Natalia", "Andrey", "Irina", "Pavel", "Ekaterina",
+}
+
+var lastNames = []string{
+	"Ivanov", "Smirnov", "Kuznetsov", "Popov", "Vasiliev", "Petrov", "Sokolov", "Mikhailov",
+	"Novikov", "Fedorov", "Morozov", "Volkov", "Alekseev", "Lebedev", "Semenov", "Egorov",
+}
+
+type city struct {
+	name, region string
+}
+
+var cities = []city{
+	{"Moscow", "Moscow"},
+	{"Saint Petersburg", "Saint Petersburg"},
+	{"Novosibirsk", "Novosibirsk Oblast"},
+	{"Yekaterinburg", "Sverdlovsk Oblast"},
+	{"Kazan", "Tatarstan"},
+	{"Nizhny Novgorod", "Nizhny Novgorod Oblast"},
+	{"Krasnodar", "Krasnodar Krai"},
+	{"Samara", "Samara Oblast"},
+	{"Almaty", "Almaty"},
+	{"Minsk", "Minsk"},
+}
+
+var streets = []string{
+	"Lenina", "Pushkina", "Gagarina", "Sovetskaya", "Mira", "Tverskaya", "Sadovaya", "Nevsky prospekt",
+}
+
+var mailDomains = []string{"gmail.com", "mail.ru", "yandex.ru", "outlook.com"}
+
+var providers = []string{"wbpay", "sbp", "visa", "mir"}
+
+var banks = []string{"alpha", "sber", "tinkoff", "vtb", "raiffeisen"}
+
+type product struct {
+	name   string
+	brands []string
+	sizes  []string
+}
+
+var products = []product{
+	{"Mascaras", []string{"Vivienne Sabo", "Maybelline", "L'Oreal"}, []string{"0"}},
+	{"T-shirt", []string{"Befree", "Gloria Jeans", "Zarina"}, []string{"S", "M", "L", "XL"}},
+	{"Sneakers", []string{"Nike", "Adidas", "Puma"}, []string{"39", "40", "41", "42", "43"}},
+	{"Phone case", []string{"Baseus", "Ugreen"}, []string{"0"}},
+	{"Backpack", []string{"Xiaomi", "Samsonite"}, []string{"0"}},
+	{"Jeans", []string{"Levi's", "Gloria Jeans", "O'stin"}, []string{"28", "30", "32", "34"}},
+	{"Kettle", []string{"Tefal", "Polaris", "Redmond"}, []string{"0"}},
+	{"Notebook", []string{"Attache", "Erich Krause"}, []string{"A5", "A4"}},
+}
@@ -12,25 +12,28 @@ type Order struct {
 	Entry             string    `json:"entry" validate:"required"`
 	Delivery          Delivery  `json:"delivery" validate:"required"`
 	Payment           Payment   `json:"payment" validate:"required"`
-	Items             []Item    `json:"items" validate:"required,min=1"`
+	Items             []Item    `json:"items" validate:"required,min=1,dive"`
 	Locale            string    `json:"locale" validate:"required"`
 	InternalSignature string    `json:"internal_signature"`
-	CustomerID        string    `json:"customer_id" validate:"required"`
+	CustomerID        string    `json:"customer_id" validate:"required" pii:"hash"`
 	DeliveryService   string    `json:"delivery_service" validate:"required"`
 	Shardkey          string    `json:"shardkey" validate:"required"`
 	SmID              int       `json:"sm_id" validate:"required"`
 	DateCreated       time.Time `json:"date_created" validate:"required"`
 	OofShard          string    `json:"oof_shard" validate:"required"`
+	// Deletion is set once the order is cancelled. Repositories set it;
+	// anything a client sends here is ignored.
+	Deletion *Deletion `json:"deletion,omitempty"`
 }
 
 type Delivery struct {
-	Name    string `json:"name" validate:"required"`
-	Phone   string `json:"phone" validate:"required"`
-	Zip     string `json:"zip" validate:"required"`
+	Name    string `json:"name" validate:"required" pii:"partial"`
+	Phone   string `json:"phone" validate:"required" pii:"partial"`
+	Zip     string `json:"zip" validate:"required" pii:"full"`
 	City    string `json:"city" validate:"required"`
-	Address string `json:"address" validate:"required"`
+	Address string `json:"address" validate:"required" pii:"full"`
 	Region  string `json:"region" validate:"required"`
-	Email   string `json:"email" validate:"required,email"`
+	Email   string `json:"email" validate:"required,email" pii:"partial"`
 }
 
 type Payment struct {
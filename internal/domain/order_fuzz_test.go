@@ -0,0 +1,203 @@
+package domain_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/domain/generator"
+)
+
+// Run a target with e.g.
+//
+//	go test ./internal/domain -run '^$' -fuzz FuzzDecodeOrder -fuzztime 1m
+//
+// Inputs that failed are kept in testdata/fuzz and replayed by go test.
+
+// seedOrders returns generated orders and every mutation of them.
+func seedOrders(f *testing.F) [][]byte {
+	f.Helper()
+	cfg := generator.DefaultConfig(1)
+	cfg.Until = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	g, err := generator.New(cfg)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	var seeds [][]byte
+	for _, order := range g.Orders(3) {
+		data, err := json.Marshal(order)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	for _, m := range generator.Mutations {
+		if m.Expect.Stage != generator.StageTooLarge { // too big to be a useful seed
+			seeds = append(seeds, m.Apply(g.Order()))
+		}
+	}
+	return append(seeds, []byte(`{}`), []byte(`null`), []byte(`[]`), []byte(`{"items":[{}]}`))
+}
+
+// checkValid fails t if order passed Validate but breaks a constraint the
+// validation tags promise, checked here without the validator.
+func checkValid(t *testing.T, o *domain.Order) {
+	t.Helper()
+	required := map[string]string{
+		"order_uid": o.OrderUID, "track_number": o.TrackNumber, "entry": o.Entry, "locale": o.Locale,
+		"customer_id": o.CustomerID, "delivery_service": o.DeliveryService, "shardkey": o.Shardkey, "oof_shard": o.OofShard,
+		"delivery.name": o.Delivery.Name, "delivery.phone": o.Delivery.Phone, "delivery.zip": o.Delivery.Zip,
+		"delivery.city": o.Delivery.City, "delivery.address": o.Delivery.Address, "delivery.region": o.Delivery.Region,
+		"payment.transaction": o.Payment.Transaction, "payment.currency": o.Payment.Currency,
+		"payment.provider": o.Payment.Provider, "payment.bank": o.Payment.Bank,
+	}
+	for name, v := range required {
+		if v == "" {
+			t.Fatalf("valid order has an empty %s", name)
+		}
+	}
+	if !strings.Contains(o.Delivery.Email, "@") {
+		t.Fatalf("valid order has email %q", o.Delivery.Email)
+	}
+	if o.SmID == 0 || o.DateCreated.IsZero() || o.Payment.PaymentDt == 0 {
+		t.Fatalf("valid order has a zero sm_id, date_created or payment_dt")
+	}
+	p := o.Payment
+	if p.Amount <= 0 || p.GoodsTotal <= 0 || p.DeliveryCost <= 0 || p.CustomFee < 0 {
+		t.Fatalf("valid order has payment %+v", p)
+	}
+	if len(o.Items) == 0 {
+		t.Fatal("valid order has no items")
+	}
+	for i, it := range o.Items {
+		if it.Price <= 0 || it.TotalPrice <= 0 || it.Sale < 0 || it.Sale > 100 {
+			t.Fatalf("valid order has items[%d] %+v", i, it)
+		}
+		if it.ChrtID == 0 || it.NmID == 0 || it.Status == 0 ||
+			it.TrackNumber == "" || it.RID == "" || it.Name == "" || it.Size == "" || it.Brand == "" {
+			t.Fatalf("valid order has items[%d] with an empty required field: %+v", i, it)
+		}
+	}
+}
+
+func FuzzDecodeOrder(f *testing.F) {
+	for _, seed := range seedOrders(f) {
+		f.Add(seed)
+	}
+	rules := domain.Rules{GoodsTotal: true, Amount: true, ItemTotal: true}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		order, err := domain.DecodeOrder(data)
+		if errors.Is(err, domain.ErrOrderTooLarge) && len(data) <= domain.MaxOrderSize {
+			t.Fatalf("%d bytes rejected as too large", len(data))
+		}
+		if err != nil {
+			return
+		}
+		if order.Validate() != nil {
+			return
+		}
+		checkValid(t, order)
+		_ = rules.Check(order)
+
+		// a valid order survives a round trip through JSON
+		again, err := json.Marshal(order)
+		if err != nil {
+			t.Fatalf("valid order does not encode: %v", err)
+		}
+		decoded, err := domain.DecodeOrder(again)
+		if err != nil {
+			t.Fatalf("re-encoded order does not decode: %v", err)
+		}
+		if err := decoded.Validate(); err != nil {
+			t.Fatalf("re-encoded order is no longer valid: %v", err)
+		}
+	})
+}
+
+// TestValidateChecksEveryItem pins the crasher checked in as
+// testdata/fuzz/FuzzDecodeOrder/items_not_validated: an item breaking its
+// own validation tags passed Validate until Order.Items got the dive tag.
+func TestValidateChecksEveryItem(t *testing.T) {
+	for _, tc := range []struct {
+		field  string
+		mutate func(*domain.Item)
+	}{
+		{"RID", func(it *domain.Item) { it.RID = "" }},
+		{"Price", func(it *domain.Item) { it.Price = -453 }},
+		{"Sale", func(it *domain.Item) { it.Sale = 130 }},
+	} {
+		o := validOrder()
+		o.Items = append(o.Items, validItem())
+		tc.mutate(&o.Items[1])
+
+		var verrs validator.ValidationErrors
+		if err := o.Validate(); !errors.As(err, &verrs) || verrs[0].Namespace() != "Order.Items[1]."+tc.field {
+			t.Errorf("bad %s on the second item: want it rejected, got %v", tc.field, err)
+		}
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	f.Add("uid", "test@gmail.com", 1817, 317, 1500, 0, 1, 453, 30, 317)
+	f.Add("", "", 0, 0, 0, 0, 0, 0, 0, 0)
+	f.Add("uid", "a@b", -1, 1, 1, -1, 2, 1, 101, -5)
+
+	f.Fuzz(func(t *testing.T, uid, email string, amount, goodsTotal, deliveryCost, customFee, items, price, sale, total int) {
+		o := validOrder()
+		o.OrderUID = uid
+		o.Delivery.Email = email
+		o.Payment.Amount = amount
+		o.Payment.GoodsTotal = goodsTotal
+		o.Payment.DeliveryCost = deliveryCost
+		o.Payment.CustomFee = customFee
+		o.Items = nil
+		for i := 0; i < items%8; i++ {
+			it := validItem()
+			it.Price, it.Sale, it.TotalPrice = price, sale, total
+			o.Items = append(o.Items, it)
+		}
+
+		err := o.Validate()
+		if err == nil {
+			checkValid(t, o)
+			return
+		}
+		// everything but the email is checked by checkValid's rules, so an
+		// order meeting them can only fail on the email
+		numbersOK := uid != "" && amount > 0 && goodsTotal > 0 && deliveryCost > 0 && customFee >= 0 &&
+			len(o.Items) > 0 && price > 0 && total > 0 && sale >= 0 && sale <= 100
+		if numbersOK && !strings.Contains(err.Error(), "'Email'") {
+			t.Fatalf("order within every constraint rejected: %v", err)
+		}
+	})
+}
+
+func validOrder() *domain.Order {
+	return &domain.Order{
+		OrderUID: "uid", TrackNumber: "WBILMTESTTRACK", Entry: "WBIL", Locale: "en", CustomerID: "test",
+		DeliveryService: "meest", Shardkey: "9", SmID: 99, OofShard: "1",
+		DateCreated: time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC),
+		Delivery: domain.Delivery{
+			Name: "Test Testov", Phone: "+9720000000", Zip: "2639809", City: "Kiryat Mozkin",
+			Address: "Ploshad Mira 15", Region: "Kraiot", Email: "test@gmail.com",
+		},
+		Payment: domain.Payment{
+			Transaction: "uid", Currency: "USD", Provider: "wbpay", Amount: 1817, PaymentDt: 1637907727,
+			Bank: "alpha", DeliveryCost: 1500, GoodsTotal: 317,
+		},
+		Items: []domain.Item{validItem()},
+	}
+}
+
+func validItem() domain.Item {
+	return domain.Item{
+		ChrtID: 9934930, TrackNumber: "WBILMTESTTRACK", Price: 453, RID: "ab4219087a764ae0btest", Name: "Mascaras",
+		Sale: 30, Size: "0", TotalPrice: 317, NmID: 2389212, Brand: "Vivienne Sabo", Status: 202,
+	}
+}
@@ -0,0 +1,24 @@
+package domain
+
+import "time"
+
+// RetentionRun is the audit record of one run of the retention job. Zero
+// cutoffs mean the step was disabled.
+type RetentionRun struct {
+	ID int64 `json:"id"`
+	// Trigger is "schedule" or "api:<caller>".
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Archive names where archived orders went: "table" or "ndjson".
+	Archive string `json:"archive"`
+	// ArchiveBefore and PurgePIIBefore are the DateCreated cutoffs the run
+	// applied.
+	ArchiveBefore  time.Time `json:"archive_before"`
+	PurgePIIBefore time.Time `json:"purge_pii_before"`
+	Archived       int       `json:"archived"`
+	PIIPurged      int       `json:"pii_purged"`
+	// Error is why the run stopped early; the counts cover the work done
+	// until then.
+	Error string `json:"error,omitempty"`
+}
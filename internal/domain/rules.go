@@ -0,0 +1,68 @@
+package domain
+
+import "fmt"
+
+// Rules are business checks on top of the struct validation in Validate.
+// Each one can be switched on and off at runtime.
+type Rules struct {
+	// GoodsTotal: payment.goods_total equals the sum of items' total_price.
+	GoodsTotal bool
+	// Amount: payment.amount equals goods_total + delivery_cost + custom_fee.
+	Amount bool
+	// ItemTotal: every item's total_price is price with the sale applied.
+	ItemTotal bool
+}
+
+const (
+	RuleGoodsTotal = "goods_total"
+	RuleAmount     = "amount"
+	RuleItemTotal  = "item_total"
+)
+
+// RuleError names the business rule an order broke.
+type RuleError struct {
+	Rule    string
+	Message string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("business rule %s: %s", e.Rule, e.Message)
+}
+
+// Check returns a *RuleError for the first enabled rule the order breaks.
+func (r Rules) Check(o *Order) error {
+	if r.ItemTotal {
+		for i, item := range o.Items {
+			if want := ItemTotalPrice(item.Price, item.Sale); item.TotalPrice != want {
+				return &RuleError{Rule: RuleItemTotal, Message: fmt.Sprintf(
+					"items[%d].total_price is %d, want %d", i, item.TotalPrice, want)}
+			}
+		}
+	}
+
+	if r.GoodsTotal {
+		sum := 0
+		for _, item := range o.Items {
+			sum += item.TotalPrice
+		}
+		if o.Payment.GoodsTotal != sum {
+			return &RuleError{Rule: RuleGoodsTotal, Message: fmt.Sprintf(
+				"goods_total is %d, items add up to %d", o.Payment.GoodsTotal, sum)}
+		}
+	}
+
+	if r.Amount {
+		want := o.Payment.GoodsTotal + o.Payment.DeliveryCost + o.Payment.CustomFee
+		if o.Payment.Amount != want {
+			return &RuleError{Rule: RuleAmount, Message: fmt.Sprintf(
+				"amount is %d, want goods_total + delivery_cost + custom_fee = %d", o.Payment.Amount, want)}
+		}
+	}
+
+	return nil
+}
+
+// ItemTotalPrice is the price after a sale given in percent, rounded down.
+func ItemTotalPrice(price, sale int) int {
+	return price * (100 - sale) / 100
+}
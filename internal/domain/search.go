@@ -0,0 +1,177 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 500
+)
+
+// SearchQuery selects orders by free text and structured filters. Empty
+// fields match everything; text matches whole words, all of which must occur.
+type SearchQuery struct {
+	Text string
+	// IncludePII lets Text match personal data: customer, delivery name and
+	// email. Without it only city, brands and item names are searched.
+	IncludePII      bool
+	CustomerID      string
+	DeliveryService string
+	City            string
+	Brand           string
+	Currency        string
+	// From and To bound DateCreated to [From, To).
+	From time.Time
+	To   time.Time
+	// IncludeDeleted also matches cancelled orders, which are hidden by
+	// default.
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+// WithDefaults clamps Limit and Offset to the allowed range.
+func (q SearchQuery) WithDefaults() SearchQuery {
+	if q.Limit <= 0 {
+		q.Limit = DefaultSearchLimit
+	}
+	if q.Limit > MaxSearchLimit {
+		q.Limit = MaxSearchLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return q
+}
+
+// ParseSearchTime reads a From or To bound given as RFC 3339 or YYYY-MM-DD.
+// An empty string is the zero time, i.e. no bound.
+func ParseSearchTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want RFC 3339 or YYYY-MM-DD, got %q", raw)
+	}
+	return t, nil
+}
+
+// Tokenize splits s into lower-case words of letters and digits.
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchTerms returns the words an order is found by, split into those from
+// public fields and those from personal data.
+func SearchTerms(o *Order) (public, private []string) {
+	public = append(public, Tokenize(o.Delivery.City)...)
+	for _, item := range o.Items {
+		public = append(public, Tokenize(item.Brand)...)
+		public = append(public, Tokenize(item.Name)...)
+	}
+	private = append(private, Tokenize(o.CustomerID)...)
+	private = append(private, Tokenize(o.Delivery.Name)...)
+	private = append(private, Tokenize(o.Delivery.Email)...)
+	return public, private
+}
+
+// Match reports whether o satisfies every filter and contains every word of
+// Text. Limit and Offset are ignored.
+func (q SearchQuery) Match(o *Order) bool {
+	if !q.MatchFilters(o) {
+		return false
+	}
+	words := Tokenize(q.Text)
+	if len(words) == 0 {
+		return true
+	}
+	public, private := SearchTerms(o)
+	terms := make(map[string]bool, len(public)+len(private))
+	for _, t := range public {
+		terms[t] = true
+	}
+	if q.IncludePII {
+		for _, t := range private {
+			terms[t] = true
+		}
+	}
+	for _, w := range words {
+		if !terms[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchFilters checks the structured filters only.
+func (q SearchQuery) MatchFilters(o *Order) bool {
+	if o.Deletion != nil && !q.IncludeDeleted {
+		return false
+	}
+	if q.CustomerID != "" && o.CustomerID != q.CustomerID {
+		return false
+	}
+	if q.DeliveryService != "" && !strings.EqualFold(o.DeliveryService, q.DeliveryService) {
+		return false
+	}
+	if q.City != "" && !strings.EqualFold(o.Delivery.City, q.City) {
+		return false
+	}
+	if q.Currency != "" && !strings.EqualFold(o.Payment.Currency, q.Currency) {
+		return false
+	}
+	if !q.From.IsZero() && o.DateCreated.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !o.DateCreated.Before(q.To) {
+		return false
+	}
+	if q.Brand != "" {
+		found := false
+		for _, item := range o.Items {
+			if strings.EqualFold(item.Brand, q.Brand) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SortNewestFirst orders search results: newest first, then by OrderUID.
+func SortNewestFirst(orders []*Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		a, b := orders[i], orders[j]
+		if !a.DateCreated.Equal(b.DateCreated) {
+			return a.DateCreated.After(b.DateCreated)
+		}
+		return a.OrderUID < b.OrderUID
+	})
+}
+
+// Page cuts the page selected by q out of sorted results.
+func (q SearchQuery) Page(orders []*Order) []*Order {
+	q = q.WithDefaults()
+	if q.Offset >= len(orders) {
+		return []*Order{}
+	}
+	orders = orders[q.Offset:]
+	if len(orders) > q.Limit {
+		orders = orders[:q.Limit]
+	}
+	return orders
+}
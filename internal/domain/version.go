@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Version is an immutable snapshot of an order, recorded by the repository
+// every time a change to the order is accepted. Version 1 is the order as it
+// was first saved.
+type Version struct {
+	OrderUID string `json:"order_uid"`
+	Version  int    `json:"version"`
+	// Source says where the change came from, see WithSource.
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+	Order     *Order    `json:"order"`
+}
+
+// SourceUnknown is recorded for changes whose context carries no source.
+const SourceUnknown = "unknown"
+
+type sourceKey struct{}
+
+// WithSource tags ctx with the origin of the changes made under it, e.g.
+// "nats:ORDERS_STREAM:42" or "api:support-bot". Repositories record it in
+// the versions they write.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// SourceFromContext returns the source set by WithSource, or SourceUnknown.
+func SourceFromContext(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey{}).(string); ok && source != "" {
+		return source
+	}
+	return SourceUnknown
+}
+
+// VersionAt returns the version in effect at t: the last one created at or
+// before t. versions must be oldest first. It returns nil when the order did
+// not exist yet.
+func VersionAt(versions []*Version, t time.Time) *Version {
+	var found *Version
+	for _, v := range versions {
+		if v.CreatedAt.After(t) {
+			break
+		}
+		found = v
+	}
+	return found
+}
+
+// Equal reports whether o and other encode to the same JSON, which is how
+// repositories tell a real change from a repeated update.
+func (o *Order) Equal(other *Order) bool {
+	a, err := json.Marshal(o)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
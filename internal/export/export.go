@@ -0,0 +1,370 @@
+// Package export writes orders as CSV, NDJSON or Parquet for spreadsheets
+// and data tools, and reads NDJSON and CSV back for imports. Orders are
+// encoded one at a time, so an export can be streamed straight from the
+// repository to a file or an HTTP response.
+package export
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+type Format string
+
+const (
+	// CSV flattens an order, its delivery and payment into one row, or one
+	// row per item with Options.ItemRows.
+	CSV Format = "csv"
+	// NDJSON writes one domain.Order JSON document per line.
+	NDJSON Format = "ndjson"
+	// Parquet writes the same columns as CSV.
+	Parquet Format = "parquet"
+)
+
+// parquetRowGroup bounds the rows a Parquet writer buffers before it writes
+// them out as a row group.
+const parquetRowGroup = 10000
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case CSV, NDJSON, Parquet:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, want csv, ndjson or parquet", s)
+	}
+}
+
+type Options struct {
+	Format Format
+	// ItemRows writes one row per item instead of one per order. It has no
+	// effect on NDJSON, which keeps items nested.
+	ItemRows bool
+	// Gzip compresses the whole output.
+	Gzip bool
+}
+
+// ContentType is the media type of the output.
+func (o Options) ContentType() string {
+	if o.Gzip {
+		return "application/gzip"
+	}
+	switch o.Format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case NDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// FileName appends the extension of the output to base.
+func (o Options) FileName(base string) string {
+	name := base + "." + string(o.Format)
+	if o.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// Writer encodes orders to an io.Writer. Close flushes what is buffered and
+// must be called once all orders are written; it does not close the
+// underlying writer.
+type Writer struct {
+	enc encoder
+	gz  *gzip.Writer
+	n   int
+}
+
+type encoder interface {
+	encode(o *domain.Order) error
+	close() error
+}
+
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	ew := &Writer{}
+	if opts.Gzip {
+		ew.gz = gzip.NewWriter(w)
+		w = ew.gz
+	}
+
+	switch opts.Format {
+	case CSV:
+		enc, err := newCSVEncoder(w, opts.ItemRows)
+		if err != nil {
+			return nil, err
+		}
+		ew.enc = enc
+	case NDJSON:
+		ew.enc = &ndjsonEncoder{enc: json.NewEncoder(w)}
+	case Parquet:
+		if opts.ItemRows {
+			ew.enc = newParquetEncoder(w, ItemRows)
+		} else {
+			ew.enc = newParquetEncoder(w, func(o *domain.Order) []OrderRow { return []OrderRow{NewOrderRow(o)} })
+		}
+	default:
+		return nil, fmt.Errorf("unknown export format %q", opts.Format)
+	}
+	return ew, nil
+}
+
+func (w *Writer) Write(o *domain.Order) error {
+	if err := w.enc.encode(o); err != nil {
+		return fmt.Errorf("failed to encode order %s: %w", o.OrderUID, err)
+	}
+	w.n++
+	return nil
+}
+
+// Count returns the number of orders written.
+func (w *Writer) Count() int {
+	return w.n
+}
+
+func (w *Writer) Close() error {
+	if err := w.enc.close(); err != nil {
+		return fmt.Errorf("failed to finish export: %w", err)
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return fmt.Errorf("failed to finish export: %w", err)
+		}
+	}
+	return nil
+}
+
+// OrderColumns are the order, delivery and payment fields shared by both row
+// layouts. The parquet tags name the columns of CSV and Parquet alike.
+type OrderColumns struct {
+	OrderUID            string    `parquet:"order_uid"`
+	TrackNumber         string    `parquet:"track_number"`
+	Entry               string    `parquet:"entry"`
+	Locale              string    `parquet:"locale"`
+	InternalSignature   string    `parquet:"internal_signature"`
+	CustomerID          string    `parquet:"customer_id"`
+	DeliveryService     string    `parquet:"delivery_service"`
+	Shardkey            string    `parquet:"shardkey"`
+	SmID                int64     `parquet:"sm_id"`
+	DateCreated         time.Time `parquet:"date_created,timestamp(microsecond)"`
+	OofShard            string    `parquet:"oof_shard"`
+	DeliveryName        string    `parquet:"delivery_name"`
+	DeliveryPhone       string    `parquet:"delivery_phone"`
+	DeliveryZip         string    `parquet:"delivery_zip"`
+	DeliveryCity        string    `parquet:"delivery_city"`
+	DeliveryAddress     string    `parquet:"delivery_address"`
+	DeliveryRegion      string    `parquet:"delivery_region"`
+	DeliveryEmail       string    `parquet:"delivery_email"`
+	PaymentTransaction  string    `parquet:"payment_transaction"`
+	PaymentRequestID    string    `parquet:"payment_request_id"`
+	PaymentCurrency     string    `parquet:"payment_currency"`
+	PaymentProvider     string    `parquet:"payment_provider"`
+	PaymentAmount       int64     `parquet:"payment_amount"`
+	PaymentDt           int64     `parquet:"payment_dt"`
+	PaymentBank         string    `parquet:"payment_bank"`
+	PaymentDeliveryCost int64     `parquet:"payment_delivery_cost"`
+	PaymentGoodsTotal   int64     `parquet:"payment_goods_total"`
+	PaymentCustomFee    int64     `parquet:"payment_custom_fee"`
+}
+
+// OrderRow is one order per row.
+type OrderRow struct {
+	OrderColumns
+	ItemsCount int64 `parquet:"items_count"`
+}
+
+// ItemRow is one item per row, repeating the order's columns.
+type ItemRow struct {
+	OrderColumns
+	ItemChrtID      int64  `parquet:"item_chrt_id"`
+	ItemTrackNumber string `parquet:"item_track_number"`
+	ItemPrice       int64  `parquet:"item_price"`
+	ItemRID         string `parquet:"item_rid"`
+	ItemName        string `parquet:"item_name"`
+	ItemSale        int64  `parquet:"item_sale"`
+	ItemSize        string `parquet:"item_size"`
+	ItemTotalPrice  int64  `parquet:"item_total_price"`
+	ItemNmID        int64  `parquet:"item_nm_id"`
+	ItemBrand       string `parquet:"item_brand"`
+	ItemStatus      int64  `parquet:"item_status"`
+}
+
+func newOrderColumns(o *domain.Order) OrderColumns {
+	return OrderColumns{
+		OrderUID:            o.OrderUID,
+		TrackNumber:         o.TrackNumber,
+		Entry:               o.Entry,
+		Locale:              o.Locale,
+		InternalSignature:   o.InternalSignature,
+		CustomerID:          o.CustomerID,
+		DeliveryService:     o.DeliveryService,
+		Shardkey:            o.Shardkey,
+		SmID:                int64(o.SmID),
+		DateCreated:         o.DateCreated.UTC(),
+		OofShard:            o.OofShard,
+		DeliveryName:        o.Delivery.Name,
+		DeliveryPhone:       o.Delivery.Phone,
+		DeliveryZip:         o.Delivery.Zip,
+		DeliveryCity:        o.Delivery.City,
+		DeliveryAddress:     o.Delivery.Address,
+		DeliveryRegion:      o.Delivery.Region,
+		DeliveryEmail:       o.Delivery.Email,
+		PaymentTransaction:  o.Payment.Transaction,
+		PaymentRequestID:    o.Payment.RequestID,
+		PaymentCurrency:     o.Payment.Currency,
+		PaymentProvider:     o.Payment.Provider,
+		PaymentAmount:       int64(o.Payment.Amount),
+		PaymentDt:           int64(o.Payment.PaymentDt),
+		PaymentBank:         o.Payment.Bank,
+		PaymentDeliveryCost: int64(o.Payment.DeliveryCost),
+		PaymentGoodsTotal:   int64(o.Payment.GoodsTotal),
+		PaymentCustomFee:    int64(o.Payment.CustomFee),
+	}
+}
+
+func NewOrderRow(o *domain.Order) OrderRow {
+	return OrderRow{OrderColumns: newOrderColumns(o), ItemsCount: int64(len(o.Items))}
+}
+
+// ItemRows flattens o into one row per item. An order without items still
+// gets a row, with the item columns empty.
+func ItemRows(o *domain.Order) []ItemRow {
+	cols := newOrderColumns(o)
+	if len(o.Items) == 0 {
+		return []ItemRow{{OrderColumns: cols}}
+	}
+	rows := make([]ItemRow, 0, len(o.Items))
+	for _, item := range o.Items {
+		rows = append(rows, ItemRow{
+			OrderColumns:    cols,
+			ItemChrtID:      int64(item.ChrtID),
+			ItemTrackNumber: item.TrackNumber,
+			ItemPrice:       int64(item.Price),
+			ItemRID:         item.RID,
+			ItemName:        item.Name,
+			ItemSale:        int64(item.Sale),
+			ItemSize:        item.Size,
+			ItemTotalPrice:  int64(item.TotalPrice),
+			ItemNmID:        int64(item.NmID),
+			ItemBrand:       item.Brand,
+			ItemStatus:      int64(item.Status),
+		})
+	}
+	return rows
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(o *domain.Order) error { return e.enc.Encode(o) }
+func (e *ndjsonEncoder) close() error                 { return nil }
+
+type csvEncoder struct {
+	w        *csv.Writer
+	itemRows bool
+	record   []string
+}
+
+// newCSVEncoder writes the header right away, so an export without orders
+// still names its columns.
+func newCSVEncoder(w io.Writer, itemRows bool) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w), itemRows: itemRows}
+	header := Columns(reflect.TypeOf(OrderRow{}))
+	if itemRows {
+		header = Columns(reflect.TypeOf(ItemRow{}))
+	}
+	e.record = make([]string, len(header))
+	if err := e.w.Write(header); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *csvEncoder) encode(o *domain.Order) error {
+	if !e.itemRows {
+		return e.write(reflect.ValueOf(NewOrderRow(o)))
+	}
+	for _, row := range ItemRows(o) {
+		if err := e.write(reflect.ValueOf(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvEncoder) write(row reflect.Value) error {
+	e.record = appendValues(e.record[:0], row)
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// Columns returns the column names of a row type: the parquet tag names of
+// its fields, with embedded structs flattened in place.
+func Columns(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			names = append(names, Columns(f.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("parquet"), ",")
+		names = append(names, name)
+	}
+	return names
+}
+
+func appendValues(record []string, v reflect.Value) []string {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if v.Type().Field(i).Anonymous {
+			record = appendValues(record, f)
+			continue
+		}
+		switch x := f.Interface().(type) {
+		case string:
+			record = append(record, x)
+		case int64:
+			record = append(record, strconv.FormatInt(x, 10))
+		case time.Time:
+			record = append(record, x.Format(time.RFC3339Nano))
+		default:
+			panic(fmt.Sprintf("export: unsupported column type %T", x))
+		}
+	}
+	return record
+}
+
+type parquetEncoder[T any] struct {
+	w    *parquet.GenericWriter[T]
+	rows func(*domain.Order) []T
+}
+
+func newParquetEncoder[T any](w io.Writer, rows func(*domain.Order) []T) *parquetEncoder[T] {
+	return &parquetEncoder[T]{
+		w:    parquet.NewGenericWriter[T](w, parquet.MaxRowsPerRowGroup(parquetRowGroup)),
+		rows: rows,
+	}
+}
+
+func (e *parquetEncoder[T]) encode(o *domain.Order) error {
+	_, err := e.w.Write(e.rows(o))
+	return err
+}
+
+func (e *parquetEncoder[T]) close() error { return e.w.Close() }
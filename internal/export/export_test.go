@@ -0,0 +1,196 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+)
+
+func write(t *testing.T, opts Options, orders ...*domain.Order) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, o := range orders {
+		if err := w.Write(o); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	a, b := repotest.NewOrder("a", 1), repotest.NewOrder("b", 2)
+
+	records, err := csv.NewReader(bytes.NewReader(write(t, Options{Format: CSV}, a, b))).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("want header and 2 rows, got %d records", len(records))
+	}
+	header := records[0]
+	col := func(record []string, name string) string {
+		for i, h := range header {
+			if h == name {
+				return record[i]
+			}
+		}
+		t.Fatalf("no column %q in %v", name, header)
+		return ""
+	}
+	if got := col(records[2], "order_uid"); got != "b" {
+		t.Errorf("order_uid = %q, want b", got)
+	}
+	if got := col(records[2], "items_count"); got != "2" {
+		t.Errorf("items_count = %q, want 2", got)
+	}
+	if got := col(records[1], "delivery_city"); got != a.Delivery.City {
+		t.Errorf("delivery_city = %q, want %q", got, a.Delivery.City)
+	}
+	if got := col(records[1], "date_created"); got != "2021-11-26T06:22:19.123456Z" {
+		t.Errorf("date_created = %q", got)
+	}
+
+	records, err = csv.NewReader(bytes.NewReader(write(t, Options{Format: CSV, ItemRows: true}, a, b))).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("want header and 3 item rows, got %d records", len(records))
+	}
+	if !reflect.DeepEqual(records[0], Columns(reflect.TypeOf(ItemRow{}))) {
+		t.Errorf("header = %v", records[0])
+	}
+	header = records[0]
+	if got := col(records[3], "item_rid"); got != b.Items[1].RID {
+		t.Errorf("item_rid = %q, want %q", got, b.Items[1].RID)
+	}
+	if got := col(records[3], "payment_amount"); got != "1817" {
+		t.Errorf("payment_amount = %q, want 1817", got)
+	}
+}
+
+func TestCSVEmptyHasHeader(t *testing.T) {
+	records, err := csv.NewReader(bytes.NewReader(write(t, Options{Format: CSV}))).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 1 || records[0][0] != "order_uid" {
+		t.Fatalf("want only the header, got %v", records)
+	}
+}
+
+func TestNDJSONGzip(t *testing.T) {
+	a, b := repotest.NewOrder("a", 1), repotest.NewOrder("b", 2)
+
+	zr, err := gzip.NewReader(bytes.NewReader(write(t, Options{Format: NDJSON, Gzip: true}, a, b)))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	dec := json.NewDecoder(zr)
+	for _, want := range []*domain.Order{a, b} {
+		var got domain.Order
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if got.OrderUID != want.OrderUID || len(got.Items) != len(want.Items) {
+			t.Errorf("got %s with %d items, want %s with %d", got.OrderUID, len(got.Items), want.OrderUID, len(want.Items))
+		}
+	}
+	if err := dec.Decode(new(domain.Order)); err != io.EOF {
+		t.Errorf("want EOF after two orders, got %v", err)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	a, b := repotest.NewOrder("a", 1), repotest.NewOrder("b", 2)
+
+	data := write(t, Options{Format: Parquet, ItemRows: true}, a, b)
+	rows, err := parquet.Read[ItemRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	want := append(ItemRows(a), ItemRows(b)...)
+	if len(rows) != len(want) {
+		t.Fatalf("want %d rows, got %d", len(want), len(rows))
+	}
+	for i := range want {
+		if !rows[i].DateCreated.Equal(want[i].DateCreated) {
+			t.Errorf("row %d: date_created = %v, want %v", i, rows[i].DateCreated, want[i].DateCreated)
+		}
+		rows[i].DateCreated = want[i].DateCreated
+		if rows[i] != want[i] {
+			t.Errorf("row %d:\ngot  %+v\nwant %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("CSV"); err != nil || f != CSV {
+		t.Errorf("ParseFormat(CSV) = %q, %v", f, err)
+	}
+	if _, err := ParseFormat("xlsx"); err == nil {
+		t.Error("ParseFormat(xlsx): want an error")
+	}
+	if got := (Options{Format: NDJSON, Gzip: true}).FileName("orders"); got != "orders.ndjson.gz" {
+		t.Errorf("FileName = %q", got)
+	}
+}
+
+func TestReadCSVRoundTrip(t *testing.T) {
+	a, b := repotest.NewOrder("a", 1), repotest.NewOrder("b", 3)
+	data := string(write(t, Options{Format: CSV, ItemRows: true}, a, b, repotest.NewOrder("c", 2), repotest.NewOrder("d", 1)))
+	// a bad number in one row spoils its whole order but not the next one
+	data = strings.Replace(data, "\nc,WBILMTESTTRACK,WBIL,en,,test,meest,9,99,", "\nc,WBILMTESTTRACK,WBIL,en,,test,meest,9,x,", 1)
+
+	rd, err := NewReader(strings.NewReader(data), CSV)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	for _, want := range []*domain.Order{a, b, nil, repotest.NewOrder("d", 1)} {
+		got, err := rd.Next()
+		if want == nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.OrderUID != "c" || decodeErr.Record != 3 {
+				t.Fatalf("want a DecodeError for record 3, order c, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !got.DateCreated.Equal(want.DateCreated) {
+			t.Errorf("order %s: DateCreated %v, want %v", want.OrderUID, got.DateCreated, want.DateCreated)
+		}
+		got.DateCreated = want.DateCreated
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("order %s:\ngot  %+v\nwant %+v", want.OrderUID, got, want)
+		}
+	}
+	if _, err := rd.Next(); err != io.EOF {
+		t.Errorf("want EOF, got %v", err)
+	}
+	if rd.Count() != 4 {
+		t.Errorf("Count = %d, want 4", rd.Count())
+	}
+
+	if _, err := NewReader(bytes.NewReader(write(t, Options{Format: CSV}, a)), CSV); err == nil {
+		t.Error("NewReader: want an error for a CSV with one row per order")
+	}
+}
@@ -0,0 +1,263 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// maxLine bounds one NDJSON line.
+const maxLine = 16 << 20
+
+// DecodeError is a record that could not be turned into an order. Reading
+// can go on past it.
+type DecodeError struct {
+	// Record is the 1-based number of the bad record.
+	Record int
+	// OrderUID is set when it could be read despite the error.
+	OrderUID string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Reader reads back orders written as NDJSON, or as CSV with one row per
+// item (Options.ItemRows). The rows of one order must be adjacent, as the
+// writer produces them.
+type Reader struct {
+	next func() (*domain.Order, error)
+	n    int
+}
+
+func NewReader(r io.Reader, format Format) (*Reader, error) {
+	rd := &Reader{}
+	switch format {
+	case NDJSON:
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 0, 64<<10), maxLine)
+		rd.next = rd.ndjson(sc)
+	case CSV:
+		next, err := rd.csv(csv.NewReader(r))
+		if err != nil {
+			return nil, err
+		}
+		rd.next = next
+	default:
+		return nil, fmt.Errorf("cannot read %s, only ndjson and csv", format)
+	}
+	return rd, nil
+}
+
+// Next returns the next order, a *DecodeError for a malformed one, or io.EOF
+// at the end of the input. Any other error ends the input.
+func (r *Reader) Next() (*domain.Order, error) {
+	return r.next()
+}
+
+// Count returns the number of records read so far, good or bad. Skipping
+// that many records on a later run resumes after them.
+func (r *Reader) Count() int {
+	return r.n
+}
+
+func (r *Reader) ndjson(sc *bufio.Scanner) func() (*domain.Order, error) {
+	return func() (*domain.Order, error) {
+		for sc.Scan() {
+			line := sc.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			r.n++
+			var order domain.Order
+			if err := json.Unmarshal(line, &order); err != nil {
+				return nil, &DecodeError{Record: r.n, OrderUID: order.OrderUID, Err: err}
+			}
+			return &order, nil
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+func (r *Reader) csv(cr *csv.Reader) (func() (*domain.Order, error), error) {
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := Columns(reflect.TypeOf(ItemRow{}))
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[name] = i
+	}
+	for _, name := range columns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("CSV column %s is missing; import needs one row per item", name)
+		}
+	}
+	// rows may differ in length only through the error they carry
+	cr.FieldsPerRecord = -1
+
+	// pending is the first row of the next order, read while looking for
+	// the end of the previous one
+	var pending *ItemRow
+	var pendingErr error
+	readRow := func() (*ItemRow, error) {
+		record, err := cr.Read()
+		if err != nil {
+			// a malformed line becomes a bad record of its own
+			if errors.As(err, new(*csv.ParseError)) {
+				return &ItemRow{}, err
+			}
+			return nil, err
+		}
+		var row ItemRow
+		if len(record) != len(header) {
+			return &row, fmt.Errorf("want %d fields, got %d", len(header), len(record))
+		}
+		values := make([]string, len(columns))
+		for i, name := range columns {
+			values[i] = record[index[name]]
+		}
+		_, err = setValues(reflect.ValueOf(&row).Elem(), values)
+		return &row, err
+	}
+
+	return func() (*domain.Order, error) {
+		if pending == nil {
+			pending, pendingErr = readRow()
+		}
+		if pending == nil {
+			return nil, pendingErr
+		}
+
+		r.n++
+		first, badErr := pending, pendingErr
+		order := first.order()
+		for {
+			row, err := readRow()
+			if row == nil || row.OrderUID != first.OrderUID {
+				pending, pendingErr = row, err
+				break
+			}
+			if err != nil && badErr == nil {
+				badErr = err
+			}
+			order.Items = append(order.Items, row.item())
+		}
+		if badErr != nil {
+			return nil, &DecodeError{Record: r.n, OrderUID: first.OrderUID, Err: badErr}
+		}
+		return order, nil
+	}, nil
+}
+
+// setValues parses values into the columns of v in the order Columns lists
+// them and returns the values left over.
+func setValues(v reflect.Value, values []string) ([]string, error) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		field := v.Type().Field(i)
+		if field.Anonymous {
+			var err error
+			if values, err = setValues(f, values); err != nil {
+				return values, err
+			}
+			continue
+		}
+		raw := values[0]
+		values = values[1:]
+		switch f.Interface().(type) {
+		case string:
+			f.SetString(raw)
+		case int64:
+			if raw == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return values, fmt.Errorf("%s: want a number, got %q", field.Tag.Get("parquet"), raw)
+			}
+			f.SetInt(n)
+		case time.Time:
+			t, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				return values, fmt.Errorf("%s: want an RFC 3339 time, got %q", field.Tag.Get("parquet"), raw)
+			}
+			f.Set(reflect.ValueOf(t))
+		}
+	}
+	return values, nil
+}
+
+func (row *ItemRow) order() *domain.Order {
+	c := row.OrderColumns
+	order := &domain.Order{
+		OrderUID:          c.OrderUID,
+		TrackNumber:       c.TrackNumber,
+		Entry:             c.Entry,
+		Locale:            c.Locale,
+		InternalSignature: c.InternalSignature,
+		CustomerID:        c.CustomerID,
+		DeliveryService:   c.DeliveryService,
+		Shardkey:          c.Shardkey,
+		SmID:              int(c.SmID),
+		DateCreated:       c.DateCreated,
+		OofShard:          c.OofShard,
+		Delivery: domain.Delivery{
+			Name:    c.DeliveryName,
+			Phone:   c.DeliveryPhone,
+			Zip:     c.DeliveryZip,
+			City:    c.DeliveryCity,
+			Address: c.DeliveryAddress,
+			Region:  c.DeliveryRegion,
+			Email:   c.DeliveryEmail,
+		},
+		Payment: domain.Payment{
+			Transaction:  c.PaymentTransaction,
+			RequestID:    c.PaymentRequestID,
+			Currency:     c.PaymentCurrency,
+			Provider:     c.PaymentProvider,
+			Amount:       int(c.PaymentAmount),
+			PaymentDt:    int(c.PaymentDt),
+			Bank:         c.PaymentBank,
+			DeliveryCost: int(c.PaymentDeliveryCost),
+			GoodsTotal:   int(c.PaymentGoodsTotal),
+			CustomFee:    int(c.PaymentCustomFee),
+		},
+	}
+	// ItemRows writes an order without items as a row with empty item columns
+	if row.ItemRID != "" || row.ItemChrtID != 0 {
+		order.Items = []domain.Item{row.item()}
+	}
+	return order
+}
+
+func (row *ItemRow) item() domain.Item {
+	return domain.Item{
+		ChrtID:      int(row.ItemChrtID),
+		TrackNumber: row.ItemTrackNumber,
+		Price:       int(row.ItemPrice),
+		RID:         row.ItemRID,
+		Name:        row.ItemName,
+		Sale:        int(row.ItemSale),
+		Size:        row.ItemSize,
+		TotalPrice:  int(row.ItemTotalPrice),
+		NmID:        int(row.ItemNmID),
+		Brand:       row.ItemBrand,
+		Status:      int(row.ItemStatus),
+	}
+}
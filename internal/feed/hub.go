@@ -0,0 +1,250 @@
+// Package feed fans order events out to live subscribers (the SSE and
+// WebSocket endpoints) and keeps a short history so that reconnecting clients
+// can resume where they left off.
+package feed
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// Event types.
+const (
+	// EventCreated is published when OrderService.CreateOrder succeeds.
+	EventCreated = "created"
+	// EventUpdated is published when OrderService.UpdateOrder succeeds.
+	EventUpdated = "updated"
+	// EventStatus is published when an order's status changes.
+	EventStatus = "status"
+
+	// StatusCancelled is the Status of the EventStatus published when
+	// OrderService.CancelOrder succeeds.
+	StatusCancelled = "cancelled"
+)
+
+var (
+	subscribersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wb",
+		Name:      "feed_subscribers",
+		Help:      "Clients connected to the live order feed.",
+	})
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wb",
+		Name:      "feed_events_total",
+		Help:      "Events published to the live order feed, by type.",
+	}, []string{"type"})
+	droppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wb",
+		Name:      "feed_slow_clients_total",
+		Help:      "Feed subscribers disconnected because they did not keep up.",
+	})
+)
+
+type Event struct {
+	// ID grows by one with every event published by this instance.
+	ID     uint64
+	Type   string
+	Status string
+	// Version is the order's new version for EventUpdated.
+	Version int
+	Time    time.Time
+	Order   *domain.Order
+}
+
+// Filter selects the events a subscriber receives. Empty fields match
+// everything.
+type Filter struct {
+	Types           []string
+	CustomerID      string
+	DeliveryService string
+	// HashCustomer, when set, is applied to the order's customer before it is
+	// compared with CustomerID, for callers who only see hashed customers.
+	HashCustomer func(string) string
+}
+
+func (f Filter) Match(e Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	if f.DeliveryService != "" && !strings.EqualFold(f.DeliveryService, e.Order.DeliveryService) {
+		return false
+	}
+	if f.CustomerID != "" {
+		customer := e.Order.CustomerID
+		if f.HashCustomer != nil {
+			customer = f.HashCustomer(customer)
+		}
+		if customer != f.CustomerID {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription delivers matching events on C. C is closed when the client
+// falls more than its buffer behind or the hub closes; a client that was
+// dropped for being slow can resubscribe from its last event ID.
+type Subscription struct {
+	C <-chan Event
+	// Gap is set when the requested resume point is no longer in the
+	// history, so some events were missed.
+	Gap bool
+
+	c      chan Event
+	filter Filter
+	hub    *Hub
+}
+
+// Close unsubscribes. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+}
+
+// Hub publishes events to subscribers. Publishing never blocks: subscribers
+// that cannot take an event are disconnected instead of slowing down order
+// processing.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	size    int
+	buffer  int
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewHub keeps the last history events for resuming clients and lets each
+// subscriber fall up to buffer events behind.
+func NewHub(history, buffer int) *Hub {
+	return &Hub{
+		nextID:  1,
+		history: make([]Event, 0, history),
+		size:    history,
+		buffer:  buffer,
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// OrderCreated publishes an EventCreated for order.
+func (h *Hub) OrderCreated(order *domain.Order) {
+	h.Publish(Event{Type: EventCreated, Order: order})
+}
+
+// OrderUpdated publishes an EventUpdated for order.
+func (h *Hub) OrderUpdated(order *domain.Order, version int) {
+	h.Publish(Event{Type: EventUpdated, Version: version, Order: order})
+}
+
+// OrderCancelled publishes an EventStatus with StatusCancelled for order.
+func (h *Hub) OrderCancelled(order *domain.Order) {
+	h.Publish(Event{Type: EventStatus, Status: StatusCancelled, Order: order})
+}
+
+// Publish assigns the event its ID and time and sends it to every matching
+// subscriber.
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	e.ID = h.nextID
+	h.nextID++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if h.size > 0 {
+		if len(h.history) == h.size {
+			copy(h.history, h.history[1:])
+			h.history = h.history[:h.size-1]
+		}
+		h.history = append(h.history, e)
+	}
+	eventsTotal.WithLabelValues(e.Type).Inc()
+
+	for s := range h.subs {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			droppedTotal.Inc()
+			h.removeLocked(s)
+		}
+	}
+}
+
+// Subscribe starts a subscription. With lastID > 0 the events after lastID
+// still in the history are replayed first.
+func (h *Hub) Subscribe(filter Filter, lastID uint64) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []Event
+	gap := false
+	if lastID > 0 {
+		// history holds the IDs from oldest up to nextID-1; an ID at or past
+		// nextID is from before a restart
+		oldest := h.nextID - uint64(len(h.history))
+		gap = lastID+1 < oldest || lastID >= h.nextID
+		for _, e := range h.history {
+			if e.ID > lastID && filter.Match(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	c := make(chan Event, h.buffer+len(backlog))
+	for _, e := range backlog {
+		c <- e
+	}
+	s := &Subscription{C: c, Gap: gap, c: c, filter: filter, hub: h}
+	if h.closed {
+		close(c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	subscribersGauge.Inc()
+	return s
+}
+
+// Close disconnects every subscriber; later publishes are dropped.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.removeLocked(s)
+	}
+}
+
+func (h *Hub) remove(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(s)
+}
+
+func (h *Hub) removeLocked(s *Subscription) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	subscribersGauge.Dec()
+	close(s.c)
+}
@@ -0,0 +1,65 @@
+package feed
+
+import (
+	"testing"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+func order(uid, customer, delivery string) *domain.Order {
+	return &domain.Order{OrderUID: uid, CustomerID: customer, DeliveryService: delivery}
+}
+
+func TestSubscribeFiltersAndResumes(t *testing.T) {
+	h := NewHub(3, 8)
+
+	meest := h.Subscribe(Filter{DeliveryService: "meest"}, 0)
+	defer meest.Close()
+
+	h.OrderCreated(order("a", "alice", "meest"))
+	h.OrderCreated(order("b", "bob", "dhl"))
+	h.Publish(Event{Type: EventStatus, Status: "cancelled", Order: order("a", "alice", "meest")})
+
+	if e := <-meest.C; e.Order.OrderUID != "a" || e.Type != EventCreated || e.ID != 1 {
+		t.Errorf("first event: got %+v", e)
+	}
+	if e := <-meest.C; e.Type != EventStatus || e.ID != 3 {
+		t.Errorf("second event: want status #3, got %+v", e)
+	}
+
+	resumed := h.Subscribe(Filter{CustomerID: "bob"}, 1)
+	defer resumed.Close()
+	if resumed.Gap {
+		t.Error("resume from #1: want no gap")
+	}
+	if e := <-resumed.C; e.Order.OrderUID != "b" {
+		t.Errorf("replayed event: want b, got %+v", e)
+	}
+
+	h.OrderCreated(order("c", "carol", "dhl"))
+	h.OrderCreated(order("d", "dave", "dhl"))
+	if late := h.Subscribe(Filter{}, 1); !late.Gap {
+		t.Error("resume from an event no longer in history: want gap")
+	}
+	if restarted := h.Subscribe(Filter{}, 100); !restarted.Gap {
+		t.Error("resume from an unknown event: want gap")
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	h := NewHub(0, 2)
+	slow := h.Subscribe(Filter{}, 0)
+
+	for _, uid := range []string{"a", "b", "c"} {
+		h.OrderCreated(order(uid, "alice", "meest"))
+	}
+
+	var got []string
+	for e := range slow.C {
+		got = append(got, e.Order.OrderUID)
+	}
+	if len(got) != 2 {
+		t.Errorf("want the 2 buffered events before the channel closes, got %v", got)
+	}
+	slow.Close()
+}
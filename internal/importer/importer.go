@@ -0,0 +1,225 @@
+// Package importer loads orders from files into storage in batches,
+// validating them the same way as orders arriving over NATS.
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+)
+
+const DefaultBatchSize = 1000
+
+// Reasons a record is rejected, besides the business rule names.
+const (
+	RejectDecode    = "decode"
+	RejectValidate  = "validate"
+	RejectDuplicate = "duplicate"
+	RejectExists    = "exists"
+)
+
+// Saver is the part of service.OrderRepository the importer writes with.
+type Saver interface {
+	SaveOrders(ctx context.Context, orders []*domain.Order) (existing []string, err error)
+}
+
+type Options struct {
+	Rules     domain.Rules
+	BatchSize int
+	// DryRun validates without writing anything or calling Checkpoint.
+	DryRun bool
+	// Skip is the number of records a previous run already got through, as
+	// passed to its last Checkpoint.
+	Skip int
+	// Checkpoint is called after every stored batch with the number of
+	// records read so far, from the start of the input.
+	Checkpoint func(records int) error
+	// Reject is told about every record that was not imported. Rejects of a
+	// batch are reported once the batch is stored, right before its
+	// checkpoint, so a resumed run does not report them twice.
+	Reject func(Reject) error
+}
+
+// Reject is a record that was not imported.
+type Reject struct {
+	Record   int    `json:"record"`
+	OrderUID string `json:"order_uid,omitempty"`
+	// Reason is RejectDecode, RejectValidate, RejectDuplicate, RejectExists
+	// or the name of the broken business rule.
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+type Summary struct {
+	Records  int           `json:"records"`
+	Skipped  int           `json:"skipped"`
+	Imported int           `json:"imported"`
+	Existing int           `json:"existing"`
+	Rejected int           `json:"rejected"`
+	DryRun   bool          `json:"dry_run"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+func (s Summary) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("records", s.Records),
+		slog.Int("skipped", s.Skipped),
+		slog.Int("imported", s.Imported),
+		slog.Int("existing", s.Existing),
+		slog.Int("rejected", s.Rejected),
+		slog.Bool("dryRun", s.DryRun),
+		slog.String("duration", s.Duration.String()))
+}
+
+type importer struct {
+	repo    Saver
+	opts    Options
+	logger  *slog.Logger
+	summary Summary
+
+	batch   []*domain.Order
+	records []int
+	uids    map[string]bool
+	rejects []Reject
+}
+
+// Run imports every order rd yields. It stops at the first storage or
+// checkpoint error; records of the failed batch are picked up again when
+// the import is resumed from the last checkpoint.
+func Run(ctx context.Context, rd *export.Reader, repo Saver, opts Options, logger *slog.Logger) (Summary, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	im := &importer{
+		repo:    repo,
+		opts:    opts,
+		logger:  logger,
+		summary: Summary{DryRun: opts.DryRun},
+		uids:    make(map[string]bool),
+	}
+	start := time.Now()
+	err := im.run(ctx, rd)
+	im.summary.Records = rd.Count()
+	im.summary.Duration = time.Since(start)
+	return im.summary, err
+}
+
+func (im *importer) run(ctx context.Context, rd *export.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		order, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		record := rd.Count()
+		if record <= im.opts.Skip {
+			im.summary.Skipped = record
+			continue
+		}
+
+		var decodeErr *export.DecodeError
+		switch {
+		case errors.As(err, &decodeErr):
+			im.reject(Reject{Record: record, OrderUID: decodeErr.OrderUID, Reason: RejectDecode, Error: decodeErr.Err.Error()})
+		case err != nil:
+			return fmt.Errorf("failed to read record %d: %w", record+1, err)
+		default:
+			im.add(record, order)
+		}
+
+		if len(im.batch) >= im.opts.BatchSize {
+			if err := im.flush(ctx, rd.Count()); err != nil {
+				return err
+			}
+		}
+	}
+	return im.flush(ctx, rd.Count())
+}
+
+func (im *importer) add(record int, order *domain.Order) {
+	if err := order.Validate(); err != nil {
+		im.reject(Reject{Record: record, OrderUID: order.OrderUID, Reason: RejectValidate, Error: err.Error()})
+		return
+	}
+	if err := im.opts.Rules.Check(order); err != nil {
+		var ruleErr *domain.RuleError
+		reason := RejectValidate
+		if errors.As(err, &ruleErr) {
+			reason = ruleErr.Rule
+		}
+		im.reject(Reject{Record: record, OrderUID: order.OrderUID, Reason: reason, Error: err.Error()})
+		return
+	}
+	// SaveOrders needs unique ids within a batch; a repeat in a later batch
+	// is reported by SaveOrders as existing
+	if im.uids[order.OrderUID] {
+		im.reject(Reject{Record: record, OrderUID: order.OrderUID, Reason: RejectDuplicate, Error: "order_uid repeats earlier in the batch"})
+		return
+	}
+	im.uids[order.OrderUID] = true
+	im.batch = append(im.batch, order)
+	im.records = append(im.records, record)
+}
+
+func (im *importer) reject(r Reject) {
+	im.summary.Rejected++
+	im.rejects = append(im.rejects, r)
+}
+
+// flush stores the batch, reports its rejects and checkpoints at records.
+func (im *importer) flush(ctx context.Context, records int) error {
+	if len(im.batch) == 0 && len(im.rejects) == 0 {
+		return nil
+	}
+	if im.opts.DryRun {
+		im.summary.Imported += len(im.batch)
+	} else if len(im.batch) > 0 {
+		existing, err := im.repo.SaveOrders(ctx, im.batch)
+		if err != nil {
+			return fmt.Errorf("failed to save batch ending at record %d: %w", records, err)
+		}
+		stored := make(map[string]bool, len(existing))
+		for _, uid := range existing {
+			stored[uid] = true
+		}
+		for i, order := range im.batch {
+			if stored[order.OrderUID] {
+				im.rejects = append(im.rejects, Reject{Record: im.records[i], OrderUID: order.OrderUID,
+					Reason: RejectExists, Error: domain.ErrOrderExists.Error()})
+			}
+		}
+		im.summary.Existing += len(existing)
+		im.summary.Imported += len(im.batch) - len(existing)
+	}
+
+	if im.opts.Reject != nil {
+		for _, r := range im.rejects {
+			if err := im.opts.Reject(r); err != nil {
+				return fmt.Errorf("failed to report rejected record %d: %w", r.Record, err)
+			}
+		}
+	}
+	if !im.opts.DryRun && im.opts.Checkpoint != nil {
+		if err := im.opts.Checkpoint(records); err != nil {
+			return fmt.Errorf("failed to checkpoint: %w", err)
+		}
+	}
+
+	im.logger.InfoContext(ctx, "Import batch done",
+		slog.Int("records", records),
+		slog.Int("batch", len(im.batch)),
+		slog.Int("rejected", len(im.rejects)))
+	im.batch = im.batch[:0]
+	im.records = im.records[:0]
+	im.rejects = im.rejects[:0]
+	clear(im.uids)
+	return nil
+}
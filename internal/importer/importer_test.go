@@ -0,0 +1,125 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// input has seven records: three good orders, a malformed line, an invalid
+// order, one breaking item_total and a repeat of the first order.
+func input(t *testing.T) string {
+	t.Helper()
+	invalid := repotest.NewOrder("invalid", 1)
+	invalid.Delivery.Email = "not-an-email"
+	badTotal := repotest.NewOrder("bad-total", 1)
+	badTotal.Items[0].TotalPrice = 1
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, o := range []*domain.Order{repotest.NewOrder("a", 1), repotest.NewOrder("b", 2), nil,
+		invalid, badTotal, repotest.NewOrder("c", 1), repotest.NewOrder("a", 1)} {
+		if o == nil {
+			buf.WriteString("{\"order_uid\": \"broken\"\n")
+			continue
+		}
+		if err := enc.Encode(o); err != nil {
+			t.Fatalf("record %d: %v", i+1, err)
+		}
+	}
+	return buf.String()
+}
+
+func run(t *testing.T, data string, repo Saver, opts Options) (Summary, []Reject, []int) {
+	t.Helper()
+	rd, err := export.NewReader(strings.NewReader(data), export.NDJSON)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var rejects []Reject
+	var checkpoints []int
+	opts.Reject = func(r Reject) error { rejects = append(rejects, r); return nil }
+	opts.Checkpoint = func(n int) error { checkpoints = append(checkpoints, n); return nil }
+	summary, err := Run(context.Background(), rd, repo, opts, discard)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return summary, rejects, checkpoints
+}
+
+func TestImport(t *testing.T) {
+	repo := memory.NewOrderRepository(discard)
+	summary, rejects, checkpoints := run(t, input(t), repo, Options{
+		Rules:     domain.Rules{ItemTotal: true},
+		BatchSize: 2,
+	})
+
+	want := Summary{Records: 7, Imported: 3, Existing: 1, Rejected: 3}
+	summary.Duration = 0
+	if summary != want {
+		t.Errorf("summary: got %+v, want %+v", summary, want)
+	}
+	if !reflect.DeepEqual(checkpoints, []int{2, 7}) {
+		t.Errorf("checkpoints: got %v", checkpoints)
+	}
+
+	reasons := make(map[int]string)
+	for _, r := range rejects {
+		reasons[r.Record] = r.Reason
+	}
+	wantReasons := map[int]string{3: RejectDecode, 4: RejectValidate, 5: domain.RuleItemTotal, 7: RejectExists}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("rejects: got %v, want %v", reasons, wantReasons)
+	}
+
+	for _, uid := range []string{"a", "b", "c"} {
+		if o, _ := repo.GetOrderByID(context.Background(), uid); o == nil {
+			t.Errorf("order %s was not imported", uid)
+		}
+	}
+}
+
+func TestImportResumesFromCheckpoint(t *testing.T) {
+	repo := memory.NewOrderRepository(discard)
+	if err := repo.SaveOrder(context.Background(), repotest.NewOrder("a", 1)); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	summary, rejects, _ := run(t, input(t), repo, Options{Rules: domain.Rules{ItemTotal: true}, BatchSize: 2, Skip: 4})
+
+	if summary.Skipped != 4 || summary.Imported != 1 || summary.Existing != 1 {
+		t.Errorf("summary: got %+v, want 4 skipped, 1 imported, 1 existing", summary)
+	}
+	if o, _ := repo.GetOrderByID(context.Background(), "b"); o != nil {
+		t.Error("order b before the checkpoint was imported")
+	}
+	if len(rejects) != 2 || rejects[0].Record != 5 || rejects[1].Record != 7 {
+		t.Errorf("rejects: want records 5 and 7, got %+v", rejects)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	repo := memory.NewOrderRepository(discard)
+	summary, rejects, checkpoints := run(t, input(t), repo, Options{BatchSize: 2, DryRun: true})
+
+	if !summary.DryRun || summary.Imported != 5 || summary.Rejected != 2 {
+		t.Errorf("summary: got %+v, want 5 valid and 2 rejected", summary)
+	}
+	if len(rejects) != 2 || len(checkpoints) != 0 {
+		t.Errorf("want 2 rejects and no checkpoints, got %v and %v", rejects, checkpoints)
+	}
+	if all, _ := repo.GetAllOrders(context.Background()); len(all) != 0 {
+		t.Errorf("dry run stored %d orders", len(all))
+	}
+}
@@ -1,12 +1,79 @@
 package logger
 
 import (
+	"io"
 	"log/slog"
 	"os"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/redact"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
 )
 
-func NewLogger() *slog.Logger {
-	handler := slog.NewJSONHandler(os.Stdout,nil)
-	logger := slog.New(handler)
-	return logger
+type Options struct {
+	Level slog.Leveler
+	// Format is FormatJSON (default) or FormatText.
+	Format   string
+	Output   io.Writer
+	Sampling SamplingOptions
+	// Redactor, when set, masks personal data in every record.
+	Redactor *redact.Redactor
+}
+
+// SamplingOptions thin out repeated debug/info records: within every Tick the
+// first Initial records with the same level and message are logged, then
+// only every Thereafter-th one. Warnings and errors are never dropped.
+type SamplingOptions struct {
+	Enabled    bool
+	Initial    int
+	Thereafter int
+	Tick       time.Duration
+}
+
+func NewLogger(level string) *slog.Logger {
+	return New(Options{Level: NewLevel(level)})
+}
+
+// NewLevel parses a log_level value into a level that can be changed while
+// loggers built from it are in use. Unknown values fall back to info.
+func NewLevel(level string) *slog.LevelVar {
+	lv := new(slog.LevelVar)
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err == nil {
+		lv.Set(l)
+	}
+	return lv
+}
+
+// New builds the application logger. Records carry the correlation ID found
+// in the context passed to the *Context logging methods.
+func New(opts Options) *slog.Logger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+
+	var handler slog.Handler
+	if opts.Format == FormatText {
+		handler = slog.NewTextHandler(out, handlerOpts)
+	} else {
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	}
+	if opts.Redactor != nil {
+		handler = redact.NewHandler(handler, opts.Redactor)
+	}
+	if opts.Sampling.Enabled {
+		handler = newSamplingHandler(handler, opts.Sampling)
+	}
+	return slog.New(&contextHandler{Handler: handler})
+}
+
+// Component returns a logger tagging every record with the component name.
+func Component(l *slog.Logger, name string) *slog.Logger {
+	return l.With(slog.String("component", name))
 }
@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSamplingDropsRepeatedMessages(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(Options{
+		Level:    slog.LevelInfo,
+		Output:   &buf,
+		Sampling: SamplingOptions{Enabled: true, Initial: 2, Thereafter: 3, Tick: time.Hour},
+	})
+
+	for i := 0; i < 8; i++ {
+		l.Info("repeated")
+	}
+	l.Warn("warning")
+	l.Warn("warning")
+
+	// 2 initial + the 3rd and 6th after them, warnings always pass
+	if got := strings.Count(buf.String(), `"repeated"`); got != 4 {
+		t.Errorf("want 4 sampled info records, got %d", got)
+	}
+	if got := strings.Count(buf.String(), `"warning"`); got != 2 {
+		t.Errorf("want every warning logged, got %d", got)
+	}
+}
+
+func TestCorrelationIDIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	l := Component(New(Options{Level: slog.LevelInfo, Output: &buf}), "test")
+
+	ctx := WithCorrelationID(context.Background(), "abc123")
+	l.InfoContext(ctx, "hello")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decode log record: %v", err)
+	}
+	if rec["correlation_id"] != "abc123" {
+		t.Errorf("correlation_id: want abc123, got %v", rec["correlation_id"])
+	}
+	if rec["component"] != "test" {
+		t.Errorf("component: want test, got %v", rec["component"])
+	}
+}
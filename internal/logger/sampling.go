@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type samplingKey struct {
+	level   slog.Level
+	message string
+}
+
+// sampler is shared by all handlers derived through WithAttrs/WithGroup so
+// that per-component loggers are counted together.
+type sampler struct {
+	opts SamplingOptions
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[samplingKey]int
+}
+
+func (s *sampler) allow(r slog.Record) bool {
+	if r.Level >= slog.LevelWarn {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Time.Sub(s.windowStart) >= s.opts.Tick {
+		s.windowStart = r.Time
+		clear(s.counts)
+	}
+
+	key := samplingKey{level: r.Level, message: r.Message}
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= s.opts.Initial {
+		return true
+	}
+	return s.opts.Thereafter > 0 && (n-s.opts.Initial)%s.opts.Thereafter == 0
+}
+
+type samplingHandler struct {
+	slog.Handler
+	sampler *sampler
+}
+
+func newSamplingHandler(h slog.Handler, opts SamplingOptions) *samplingHandler {
+	if opts.Tick <= 0 {
+		opts.Tick = time.Second
+	}
+	return &samplingHandler{
+		Handler: h,
+		sampler: &sampler{opts: opts, counts: make(map[samplingKey]int)},
+	}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.sampler.allow(r) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
@@ -0,0 +1,302 @@
+// Package migrate applies the SQL migrations from the migrations directory to
+// Postgres. It keeps its state in golang-migrate's schema_migrations table,
+// so databases migrated by the migrate/migrate image (see docker-compose) and
+// by wbctl can be mixed.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrDirty means a migration failed half way outside of this package, e.g.
+// under golang-migrate. Fix the schema by hand and call Force.
+var ErrDirty = errors.New("database is dirty")
+
+// lockKey is the advisory lock that serializes migrators running against the
+// same database. The value is arbitrary.
+const lockKey = 727500
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is one schema version with the statements to apply and revert it.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load reads NNNNNN_name.up.sql and NNNNNN_name.down.sql files from fsys,
+// ordered by version. Other files are ignored.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		m := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	logger     *slog.Logger
+}
+
+func New(db *sql.DB, fsys fs.FS, logger *slog.Logger) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, logger: logger}, nil
+}
+
+// Version returns the applied schema version, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (version uint64, dirty bool, err error) {
+	conn, err := m.lock(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer m.unlock(conn)
+	return readVersion(ctx, conn)
+}
+
+// Up applies up to n pending migrations, all of them when n <= 0, and returns
+// how many were applied.
+func (m *Migrator) Up(ctx context.Context, n int) (int, error) {
+	return m.step(ctx, n, true)
+}
+
+// Down reverts up to n applied migrations, all of them when n <= 0, and
+// returns how many were reverted.
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	return m.step(ctx, n, false)
+}
+
+// Force records version as applied and clean without running anything.
+func (m *Migrator) Force(ctx context.Context, version uint64) error {
+	conn, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.unlock(conn)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := writeVersion(ctx, tx, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) step(ctx context.Context, n int, up bool) (int, error) {
+	conn, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.unlock(conn)
+
+	current, dirty, err := readVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("%w at version %d", ErrDirty, current)
+	}
+	plan, err := m.plan(current, up)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 && n < len(plan) {
+		plan = plan[:n]
+	}
+
+	for i, mig := range plan {
+		start := time.Now()
+		body, target := mig.Up, mig.Version
+		if !up {
+			body, target = mig.Down, m.previous(mig.Version)
+		}
+		if err := apply(ctx, conn, body, target); err != nil {
+			return i, fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		m.logger.InfoContext(ctx, "Migration applied",
+			slog.Uint64("version", mig.Version),
+			slog.String("name", mig.Name),
+			slog.Bool("up", up),
+			slog.Duration("duration", time.Since(start)))
+	}
+	return len(plan), nil
+}
+
+// plan lists the migrations to run from current, in the order to run them.
+func (m *Migrator) plan(current uint64, up bool) ([]Migration, error) {
+	if current != 0 && !m.known(current) {
+		return nil, fmt.Errorf("database is at version %d, which has no migration file", current)
+	}
+
+	var plan []Migration
+	if up {
+		for _, mig := range m.migrations {
+			if mig.Version > current {
+				plan = append(plan, mig)
+			}
+		}
+		return plan, nil
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version > current {
+			continue
+		}
+		if mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+		}
+		plan = append(plan, mig)
+	}
+	return plan, nil
+}
+
+func (m *Migrator) known(version uint64) bool {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// previous returns the version before version, 0 for the first one.
+func (m *Migrator) previous(version uint64) uint64 {
+	var prev uint64
+	for _, mig := range m.migrations {
+		if mig.Version >= version {
+			break
+		}
+		prev = mig.Version
+	}
+	return prev
+}
+
+// lock takes a session advisory lock on a dedicated connection, so that two
+// migrators never interleave.
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to lock database: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		m.unlock(conn)
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return conn, nil
+}
+
+func (m *Migrator) unlock(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+		m.logger.Warn("Failed to unlock database", slog.String("error", err.Error()))
+	}
+	conn.Close()
+}
+
+func readVersion(ctx context.Context, conn *sql.Conn) (uint64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+	err := conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return uint64(version), dirty, nil
+}
+
+// writeVersion stores version the way golang-migrate does: a single row, none
+// for an empty database.
+func writeVersion(ctx context.Context, tx *sql.Tx, version uint64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return fmt.Errorf("failed to write schema version: %w", err)
+	}
+	if version == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, int64(version)); err != nil {
+		return fmt.Errorf("failed to write schema version: %w", err)
+	}
+	return nil
+}
+
+// apply runs body and records target in one transaction, so a failed
+// migration leaves neither the schema nor the version half changed.
+func apply(ctx context.Context, conn *sql.Conn, body string, target uint64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if err := writeVersion(ctx, tx, target); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
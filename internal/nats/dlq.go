@@ -0,0 +1,134 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+)
+
+// StreamName is the JetStream stream that holds every orders.* subject,
+// including the dead letter subject.
+const StreamName = "ORDERS_STREAM"
+
+// maxDeliver is how many times a message is delivered before it is dead
+// lettered.
+const maxDeliver = 3
+
+// Headers set on dead lettered messages.
+const (
+	HeaderDLQReason  = "Wb-Dlq-Reason"
+	HeaderDLQError   = "Wb-Dlq-Error"
+	HeaderDLQSubject = "Wb-Dlq-Subject"
+)
+
+// Reasons a message is dead lettered. Business rule rejections use the rule
+// name instead.
+const (
+	ReasonDecode    = "decode"
+	ReasonTooLarge  = "too_large"
+	ReasonValidate  = "validate"
+	ReasonExhausted = "exhausted"
+)
+
+// DeadLetter is a message parked on the dead letter subject.
+type DeadLetter struct {
+	Seq     uint64      `json:"seq"`
+	Time    time.Time   `json:"time"`
+	Subject string      `json:"subject"`
+	Reason  string      `json:"reason"`
+	Error   string      `json:"error"`
+	Data    []byte      `json:"data"`
+	Header  nats.Header `json:"-"`
+}
+
+// DeadLetters lists, replays and purges messages on the dead letter subject.
+type DeadLetters struct {
+	js      nats.JetStreamContext
+	subject string
+}
+
+func NewDeadLetters(js nats.JetStreamContext, subject string) *DeadLetters {
+	return &DeadLetters{js: js, subject: subject}
+}
+
+// List returns up to limit dead letters, oldest first. limit <= 0 means all.
+func (d *DeadLetters) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	last, err := d.js.GetLastMsg(StreamName, d.subject, nats.Context(ctx))
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	sub, err := d.js.SubscribeSync(d.subject, nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	var letters []DeadLetter
+	for limit <= 0 || len(letters) < limit {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return letters, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return letters, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		letters = append(letters, DeadLetter{
+			Seq:     meta.Sequence.Stream,
+			Time:    meta.Timestamp,
+			Subject: msg.Header.Get(HeaderDLQSubject),
+			Reason:  msg.Header.Get(HeaderDLQReason),
+			Error:   msg.Header.Get(HeaderDLQError),
+			Data:    msg.Data,
+			Header:  msg.Header,
+		})
+		if meta.Sequence.Stream >= last.Sequence {
+			break
+		}
+	}
+	return letters, nil
+}
+
+// Replay publishes the dead letter again, to subject or to the subject it
+// was first published on when subject is empty, and removes it from the
+// stream.
+func (d *DeadLetters) Replay(ctx context.Context, dl DeadLetter, subject string) error {
+	if subject == "" {
+		subject = dl.Subject
+	}
+	if subject == "" {
+		return fmt.Errorf("dead letter %d has no subject to replay to", dl.Seq)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = dl.Data
+	for _, key := range []string{logger.CorrelationHeader, "traceparent", "tracestate"} {
+		if v := dl.Header.Get(key); v != "" {
+			msg.Header.Set(key, v)
+		}
+	}
+	if _, err := d.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to replay dead letter %d: %w", dl.Seq, err)
+	}
+	if err := d.js.DeleteMsg(StreamName, dl.Seq, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to remove replayed dead letter %d: %w", dl.Seq, err)
+	}
+	return nil
+}
+
+// Purge removes every dead letter.
+func (d *DeadLetters) Purge(ctx context.Context) error {
+	err := d.js.PurgeStream(StreamName, &nats.StreamPurgeRequest{Subject: d.subject}, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to purge dead letters: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package nats
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -8,6 +9,9 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Publisher struct {
@@ -22,17 +26,76 @@ func NewPublisher(js nats.JetStreamContext, logger *slog.Logger) *Publisher {
 	}
 }
 
-func (p *Publisher) PublishOrder(subject string, order *domain.Order) error {
+// PublishOrder sends the order to subject. A correlation ID and the trace
+// context in ctx are passed along in the message headers.
+func (p *Publisher) PublishOrder(ctx context.Context, subject string, order *domain.Order) error {
 	orderJSON, err := json.Marshal(order)
 	if err != nil {
 		return fmt.Errorf("failed to marshal order: %w", err)
 	}
 
-	_, err = p.js.Publish(subject, orderJSON)
+	if err := p.publish(ctx, subject, orderJSON, order.OrderUID); err != nil {
+		return err
+	}
+	p.logger.InfoContext(ctx, "Order published", slog.String("orderID", order.OrderUID))
+	return nil
+}
+
+// PublishCancellation sends c to subject, with headers as by PublishOrder.
+func (p *Publisher) PublishCancellation(ctx context.Context, subject string, c domain.Cancellation) error {
+	data, err := json.Marshal(c)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
+		return fmt.Errorf("failed to marshal cancellation: %w", err)
+	}
+
+	if err := p.publish(ctx, subject, data, c.OrderUID); err != nil {
+		return err
+	}
+	p.logger.InfoContext(ctx, "Cancellation published", slog.String("orderID", c.OrderUID))
+	return nil
+}
+
+// PublishEviction sends e to subject, with headers as by PublishOrder.
+func (p *Publisher) PublishEviction(ctx context.Context, subject string, e domain.Eviction) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal eviction: %w", err)
+	}
+
+	if err := p.publish(ctx, subject, data, ""); err != nil {
+		return err
 	}
+	p.logger.InfoContext(ctx, "Eviction published",
+		slog.Int("count", len(e.OrderUIDs)),
+		slog.String("reason", e.Reason))
+	return nil
+}
+
+// Publish sends data to subject as is, e.g. orders read from a file that may
+// not even decode. Headers are set as by PublishOrder.
+func (p *Publisher) Publish(ctx context.Context, subject string, data []byte) error {
+	if err := p.publish(ctx, subject, data, ""); err != nil {
+		return err
+	}
+	p.logger.DebugContext(ctx, "Message published", slog.Int("bytes", len(data)))
+	return nil
+}
 
-	p.logger.Info("Order published", slog.String("orderID", order.OrderUID))
+func (p *Publisher) publish(ctx context.Context, subject string, data []byte, orderUID string) (err error) {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if id := logger.CorrelationID(ctx); id != "" {
+		msg.Header.Set(logger.CorrelationHeader, id)
+	}
+	ctx, span := startPublishSpan(ctx, msg)
+	defer func() { tracing.End(span, err) }()
+	if orderUID != "" {
+		span.SetAttributes(attribute.String("order.uid", orderUID))
+	}
+
+	_, err = p.js.PublishMsg(msg, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
 	return nil
 }
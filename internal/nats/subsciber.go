@@ -1,8 +1,10 @@
 package nats
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"log/slog"
@@ -10,15 +12,26 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/nats-io/nats.go"
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/logger"
 	"github.com/velvetriddles/wb-level0/internal/service"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Subscriber struct {
 	js      nats.JetStreamContext
 	logger  *slog.Logger
 	service *service.OrderService
+	subs    []subscription
+	dlq     string
+
+	inflight sync.WaitGroup
+}
+
+type subscription struct {
 	sub     *nats.Subscription
 	subject string
+	closed  <-chan nats.SubStatus
 }
 
 func NewSubscriber(js nats.JetStreamContext, logger *slog.Logger, service *service.OrderService) *Subscriber {
@@ -29,54 +42,273 @@ func NewSubscriber(js nats.JetStreamContext, logger *slog.Logger, service *servi
 	}
 }
 
+// SetDeadLetterSubject makes the subscriber park messages it cannot process
+// on subject instead of dropping them: undecodable and invalid orders at
+// once, others after the last delivery attempt.
+func (s *Subscriber) SetDeadLetterSubject(subject string) {
+	s.dlq = subject
+}
+
+// Subscribe consumes new orders from subject.
 func (s *Subscriber) Subscribe(subject string) error {
-	sub, err := s.js.Subscribe(subject, func(msg *nats.Msg) {
-		var order domain.Order
-		err := json.Unmarshal(msg.Data, &order)
-		if err != nil {
-			s.logger.Error("Failed to unmarshal order", slog.String("error", err.Error()))
-			msg.Nak() //retry
-			return
+	return s.subscribe(subject, s.handle)
+}
+
+// SubscribeUpdates consumes changed orders from subject. Each accepted change
+// is stored as a new version of the order.
+func (s *Subscriber) SubscribeUpdates(subject string) error {
+	return s.subscribe(subject, s.handleUpdate)
+}
+
+// SubscribeCancellations consumes cancellations from subject. Every instance
+// handles each of them, so that all of them evict the order from their cache.
+func (s *Subscriber) SubscribeCancellations(subject string) error {
+	return s.subscribe(subject, s.handleCancel)
+}
+
+// SubscribeEvictions consumes evictions from subject. Like cancellations,
+// every instance handles each of them.
+func (s *Subscriber) SubscribeEvictions(subject string) error {
+	return s.subscribe(subject, s.handleEvict)
+}
+
+func (s *Subscriber) subscribe(subject string, handler nats.MsgHandler) error {
+	sub, err := s.js.Subscribe(subject, handler,
+		nats.DeliverNew(), nats.ManualAck(), nats.AckWait(10*time.Second), nats.MaxDeliver(maxDeliver)) // retries
+
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	s.subs = append(s.subs, subscription{
+		sub:     sub,
+		subject: subject,
+		closed:  sub.StatusChanged(nats.SubscriptionClosed),
+	})
+	s.logger.Info("Subscribed to subject", slog.String("subject", subject))
+	return nil
+}
+
+func (s *Subscriber) handle(msg *nats.Msg) {
+	s.process(msg, s.service.CreateOrder)
+}
+
+func (s *Subscriber) handleUpdate(msg *nats.Msg) {
+	s.process(msg, s.service.UpdateOrder)
+}
+
+// process decodes the order in msg and passes it to save, acking, retrying
+// or dead lettering the message depending on the outcome.
+func (s *Subscriber) process(msg *nats.Msg, save func(context.Context, *domain.Order) error) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+
+	ctx, span := startProcessSpan(messageContext(msg), msg)
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	order, err := domain.DecodeOrder(msg.Data)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to unmarshal order", slog.String("error", err.Error()))
+		reason := ReasonDecode
+		if errors.Is(err, domain.ErrOrderTooLarge) {
+			reason = ReasonTooLarge
 		}
+		s.deadLetter(ctx, msg, reason, err)
+		return
+	}
+	span.SetAttributes(attribute.String("order.uid", order.OrderUID))
 
-		err = s.service.CreateOrder(&order)
-		if err != nil {
-			if _, ok := err.(validator.ValidationErrors); ok {
-				s.logger.Error("Validation failed for order", slog.String("error", err.Error()))
-				msg.Ack()
+	err = save(ctx, order)
+	if err != nil {
+		var ruleErr *domain.RuleError
+		if _, ok := err.(validator.ValidationErrors); ok {
+			s.logger.ErrorContext(ctx, "Validation failed for order", slog.String("error", err.Error()))
+			s.deadLetter(ctx, msg, ReasonValidate, err)
+		} else if errors.As(err, &ruleErr) {
+			s.logger.ErrorContext(ctx, "Order rejected by business rule",
+				slog.String("rule", ruleErr.Rule),
+				slog.String("error", err.Error()))
+			s.deadLetter(ctx, msg, ruleErr.Rule, err)
+		} else if errors.Is(err, domain.ErrOrderExists) || errors.Is(err, domain.ErrOrderUnchanged) {
+			s.logger.InfoContext(ctx, "Order already stored, skipping redelivery", slog.String("orderID", order.OrderUID))
+			msg.Ack()
+		} else {
+			s.logger.ErrorContext(ctx, "Failed to create order", slog.String("error", err.Error()))
+			if meta, merr := msg.Metadata(); merr == nil && meta.NumDelivered >= maxDeliver {
+				s.deadLetter(ctx, msg, ReasonExhausted, err)
 			} else {
-				s.logger.Error("Failed to create order", slog.String("error", err.Error()))
 				msg.Nak()
 			}
-			return
 		}
+		return
+	}
+
+	s.logger.InfoContext(ctx, "Order processed", slog.String("orderID", order.OrderUID))
+	msg.Ack()
+}
+
+func (s *Subscriber) handleCancel(msg *nats.Msg) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+
+	ctx, span := startProcessSpan(messageContext(msg), msg)
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	c, err := domain.DecodeCancellation(msg.Data)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to decode cancellation", slog.String("error", err.Error()))
+		reason := ReasonDecode
+		if errors.Is(err, domain.ErrOrderTooLarge) {
+			reason = ReasonTooLarge
+		} else if _, ok := err.(validator.ValidationErrors); ok {
+			reason = ReasonValidate
+		}
+		s.deadLetter(ctx, msg, reason, err)
+		return
+	}
+	span.SetAttributes(attribute.String("order.uid", c.OrderUID))
 
-		s.logger.Info("Order processed", slog.String("orderID", order.OrderUID))
+	err = s.service.CancelOrder(ctx, *c)
+	switch {
+	case err == nil:
+		s.logger.InfoContext(ctx, "Cancellation processed", slog.String("orderID", c.OrderUID))
+		msg.Ack()
+	case errors.Is(err, domain.ErrOrderDeleted):
+		s.logger.InfoContext(ctx, "Order already cancelled, skipping redelivery", slog.String("orderID", c.OrderUID))
+		msg.Ack()
+	case errors.Is(err, domain.ErrOrderNotFound):
+		// every instance gets the message; dead lettering it here would park
+		// one copy per instance
+		s.logger.WarnContext(ctx, "Cancelled order is unknown, dropping cancellation", slog.String("orderID", c.OrderUID))
 		msg.Ack()
-	}, nats.DeliverNew(), nats.ManualAck(), nats.AckWait(10*time.Second), nats.MaxDeliver(3)) // retries
+	default:
+		s.logger.ErrorContext(ctx, "Failed to cancel order", slog.String("error", err.Error()))
+		if meta, merr := msg.Metadata(); merr == nil && meta.NumDelivered >= maxDeliver {
+			s.deadLetter(ctx, msg, ReasonExhausted, err)
+		} else {
+			msg.Nak()
+		}
+	}
+}
+
+func (s *Subscriber) handleEvict(msg *nats.Msg) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+
+	ctx, span := startProcessSpan(messageContext(msg), msg)
+	var err error
+	defer func() { tracing.End(span, err) }()
 
+	e, err := domain.DecodeEviction(msg.Data)
 	if err != nil {
-		return fmt.Errorf("failed to subscribe: %w", err)
+		s.logger.ErrorContext(ctx, "Failed to decode eviction", slog.String("error", err.Error()))
+		reason := ReasonDecode
+		if errors.Is(err, domain.ErrOrderTooLarge) {
+			reason = ReasonTooLarge
+		} else if _, ok := err.(validator.ValidationErrors); ok {
+			reason = ReasonValidate
+		}
+		s.deadLetter(ctx, msg, reason, err)
+		return
 	}
+	span.SetAttributes(attribute.Int("eviction.orders", len(e.OrderUIDs)))
 
-	s.sub = sub
-	s.subject = subject
-	s.logger.Info("Subscribed to subject", slog.String("subject", subject))
-	return nil
+	s.service.EvictOrders(ctx, e.OrderUIDs, e.Reason)
+	msg.Ack()
 }
 
+// deadLetter copies msg to the dead letter subject and acks it. Without a
+// dead letter subject the message is dropped; if the copy cannot be
+// published the message is redelivered.
+func (s *Subscriber) deadLetter(ctx context.Context, msg *nats.Msg, reason string, cause error) {
+	if s.dlq == "" {
+		msg.Ack()
+		return
+	}
+
+	dl := nats.NewMsg(s.dlq)
+	dl.Data = msg.Data
+	for key, values := range msg.Header {
+		dl.Header[key] = values
+	}
+	dl.Header.Set(HeaderDLQReason, reason)
+	dl.Header.Set(HeaderDLQError, cause.Error())
+	dl.Header.Set(HeaderDLQSubject, msg.Subject)
+
+	if _, err := s.js.PublishMsg(dl, nats.Context(ctx)); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to dead letter message", slog.String("error", err.Error()))
+		msg.Nak()
+		return
+	}
+	s.logger.WarnContext(ctx, "Message dead lettered",
+		slog.String("subject", s.dlq),
+		slog.String("reason", reason))
+	msg.Ack()
+}
+
+// messageContext carries the publisher's correlation ID, or a fresh one when
+// the message has none, and the message's stream position as the source of
+// the changes it makes.
+func messageContext(msg *nats.Msg) context.Context {
+	id := msg.Header.Get(logger.CorrelationHeader)
+	if id == "" {
+		id = logger.NewCorrelationID()
+	}
+	ctx := logger.WithCorrelationID(context.Background(), id)
+	return domain.WithSource(ctx, messageSource(msg))
+}
+
+// messageSource is "nats:STREAM:SEQ", or "nats:SUBJECT" for a message that
+// did not come from a stream.
+func messageSource(msg *nats.Msg) string {
+	if meta, err := msg.Metadata(); err == nil {
+		return fmt.Sprintf("nats:%s:%d", meta.Stream, meta.Sequence.Stream)
+	}
+	return "nats:" + msg.Subject
+}
+
+// Unsubscribe stops consuming new messages. Messages already delivered to the
+// client are still handled; use Wait to block until they are done.
 func (s *Subscriber) Unsubscribe() error {
-	if s.sub == nil {
+	if len(s.subs) == 0 {
 		return fmt.Errorf("not subscribed to any subject")
 	}
 
-	err := s.sub.Unsubscribe()
-	if err != nil {
-		return fmt.Errorf("failed to unsubscribe: %w", err)
+	var errs []error
+	for _, sub := range s.subs {
+		if err := sub.sub.Drain(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unsubscribe from %s: %w", sub.subject, err))
+			continue
+		}
+		s.logger.Info("Unsubscribed from subject", slog.String("subject", sub.subject))
 	}
+	return errors.Join(errs...)
+}
 
-	s.logger.Info("Unsubscribed from subject", slog.String("subject", s.subject))
-	s.sub = nil
-	s.subject = ""
-	return nil
+// Wait blocks until the subscription is fully drained after Unsubscribe and
+// every message handler has returned, or ctx is done.
+func (s *Subscriber) Wait(ctx context.Context) error {
+	for _, sub := range s.subs {
+		select {
+		case <-sub.closed:
+		case <-ctx.Done():
+			return fmt.Errorf("subscription drain interrupted: %w", ctx.Err())
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.logger.Info("In-flight messages drained")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("in-flight messages not drained: %w", ctx.Err())
+	}
 }
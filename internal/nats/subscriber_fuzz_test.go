@@ -0,0 +1,67 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/domain/generator"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+	"github.com/velvetriddles/wb-level0/internal/repository/cache"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+// FuzzSubscriberHandle feeds arbitrary messages to the subscriber's handler
+// with an in-memory service behind it. The handler must not panic, and
+// whatever it stores must be a valid order:
+//
+//	go test ./internal/nats -run '^$' -fuzz FuzzSubscriberHandle -fuzztime 1m
+//
+// The messages are not bound to a subscription, so acks are no-ops.
+func FuzzSubscriberHandle(f *testing.F) {
+	cfg := generator.DefaultConfig(1)
+	cfg.Until = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	g, err := generator.New(cfg)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, order := range g.Orders(3) {
+		data, _ := json.Marshal(order)
+		f.Add(data, "")
+	}
+	for _, m := range generator.Mutations {
+		if m.Expect.Stage != generator.StageTooLarge {
+			f.Add(m.Apply(g.Order()), "corr-1")
+		}
+	}
+	f.Add([]byte(`null`), "\x00")
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f.Fuzz(func(t *testing.T, data []byte, correlationID string) {
+		repo := memory.NewOrderRepository(log)
+		svc := service.NewOrderService(repo, cache.NewOrderCache(log, repo), log)
+		svc.SetRules(domain.Rules{GoodsTotal: true, Amount: true, ItemTotal: true})
+		s := NewSubscriber(nil, log, svc)
+
+		msg := nats.NewMsg("orders.new")
+		msg.Data = data
+		msg.Header.Set(logger.CorrelationHeader, correlationID)
+		s.handle(msg)
+
+		orders, err := repo.GetAllOrders(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, order := range orders {
+			if err := order.Validate(); err != nil {
+				t.Fatalf("stored an invalid order: %v", err)
+			}
+		}
+	})
+}
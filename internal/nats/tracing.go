@@ -0,0 +1,74 @@
+package nats
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("nats")
+
+var messagingSystem = semconv.MessagingSystemKey.String("nats")
+
+// headerCarrier lets the OpenTelemetry propagator read and write trace
+// context in NATS message headers.
+type headerCarrier nats.Header
+
+func (c headerCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c headerCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startPublishSpan starts a producer span and writes its context into the
+// message headers.
+func startPublishSpan(ctx context.Context, msg *nats.Msg) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, msg.Subject+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			messagingSystem,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(msg.Subject),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Header))
+	return ctx, span
+}
+
+// startProcessSpan continues the publisher's trace for a received message.
+// The delivery count and the time the message spent in the stream show
+// redeliveries and consumer lag.
+func startProcessSpan(ctx context.Context, msg *nats.Msg) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Header))
+
+	attrs := []attribute.KeyValue{
+		messagingSystem,
+		semconv.MessagingOperationTypeDeliver,
+		semconv.MessagingDestinationName(msg.Subject),
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		attrs = append(attrs,
+			attribute.Int64("messaging.nats.num_delivered", int64(meta.NumDelivered)),
+			attribute.Int64("messaging.nats.stream_sequence", int64(meta.Sequence.Stream)),
+			attribute.Int64("messaging.nats.queued_ms", time.Since(meta.Timestamp).Milliseconds()),
+		)
+	}
+	return tracer.Start(ctx, msg.Subject+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...))
+}
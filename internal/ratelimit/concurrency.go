@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// Concurrency caps the number of operations in flight. Callers over the cap
+// wait up to a fixed time for a slot and then give up with
+// domain.ErrOverloaded. It guards storage reads, and its state is exported as
+// the wb_db_* metrics.
+type Concurrency struct {
+	mu       sync.Mutex
+	limit    int
+	wait     time.Duration
+	inflight int
+	// closed and replaced on every release to wake up waiters
+	released chan struct{}
+}
+
+// NewConcurrency allows limit operations at once; 0 means no limit.
+func NewConcurrency(limit int, wait time.Duration) *Concurrency {
+	dbLimit.Set(float64(limit))
+	return &Concurrency{limit: limit, wait: wait, released: make(chan struct{})}
+}
+
+// SetLimit changes the cap. Operations already in flight are not affected.
+func (c *Concurrency) SetLimit(limit int, wait time.Duration) {
+	c.mu.Lock()
+	c.limit = limit
+	c.wait = wait
+	c.wakeLocked()
+	c.mu.Unlock()
+	dbLimit.Set(float64(limit))
+}
+
+// Acquire takes a slot, which must be given back with Release.
+func (c *Concurrency) Acquire(ctx context.Context) error {
+	var timeout <-chan time.Time
+	for {
+		c.mu.Lock()
+		if c.limit <= 0 || c.inflight < c.limit {
+			c.inflight++
+			c.mu.Unlock()
+			dbInFlight.Inc()
+			return nil
+		}
+		released := c.released
+		if timeout == nil {
+			timer := time.NewTimer(c.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timeout:
+			dbRejected.Inc()
+			return domain.ErrOverloaded
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Concurrency) Release() {
+	c.mu.Lock()
+	c.inflight--
+	c.wakeLocked()
+	c.mu.Unlock()
+	dbInFlight.Dec()
+}
+
+// InFlight returns the number of operations holding a slot.
+func (c *Concurrency) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight
+}
+
+// Limit returns the current cap, 0 meaning none.
+func (c *Concurrency) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+func (c *Concurrency) wakeLocked() {
+	close(c.released)
+	c.released = make(chan struct{})
+}
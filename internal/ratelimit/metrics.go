@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultRoute labels the budget shared by routes without an own one.
+const DefaultRoute = "default"
+
+var (
+	budgetGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "wb",
+		Name:      "rate_limit_budget",
+		Help:      "Configured rate limit per client and route: kind=rate in requests per second, kind=burst in requests.",
+	}, []string{"route", "kind"})
+
+	dbInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wb",
+		Name:      "db_inflight",
+		Help:      "Storage reads currently in flight.",
+	})
+	dbLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wb",
+		Name:      "db_concurrency_limit",
+		Help:      "Maximum number of concurrent storage reads, 0 meaning no limit.",
+	})
+	dbRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wb",
+		Name:      "db_rejected_total",
+		Help:      "Storage reads refused because the concurrency limit was reached.",
+	})
+)
+
+func recordBudgets(def Budget, routes map[string]Budget) {
+	budgetGauge.Reset()
+	set := func(route string, b Budget) {
+		budgetGauge.WithLabelValues(route, "rate").Set(b.Rate)
+		budgetGauge.WithLabelValues(route, "burst").Set(float64(b.Burst))
+	}
+	set(DefaultRoute, def)
+	for route, b := range routes {
+		set(route, b)
+	}
+}
@@ -0,0 +1,127 @@
+// Package ratelimit holds the HTTP rate limiter (token buckets per client and
+// route) and the concurrency limiter guarding storage reads.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Budget is a token bucket: Rate requests per second on average with bursts
+// of up to Burst requests.
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+// idleTTL is how long an unused client bucket is kept. A bucket idle that
+// long has refilled anyway, so dropping it does not change any decision.
+const idleTTL = 10 * time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter keeps a token bucket per route and client. Routes without an own
+// budget share the default one.
+type Limiter struct {
+	mu        sync.Mutex
+	enabled   bool
+	def       Budget
+	routes    map[string]Budget
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLimiter(def Budget, routes map[string]Budget) *Limiter {
+	l := &Limiter{enabled: true, buckets: make(map[string]*bucket), now: time.Now}
+	l.SetBudgets(def, routes)
+	return l
+}
+
+// SetBudgets replaces the budgets. Clients start over with full buckets.
+func (l *Limiter) SetBudgets(def Budget, routes map[string]Budget) {
+	copied := make(map[string]Budget, len(routes))
+	for route, b := range routes {
+		copied[route] = b
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def = def
+	l.routes = copied
+	clear(l.buckets)
+	recordBudgets(def, copied)
+}
+
+// SetEnabled turns limiting on or off; a disabled Limiter allows everything.
+func (l *Limiter) SetEnabled(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enabled = enabled
+}
+
+// Budget returns the budget that applies to route.
+func (l *Limiter) Budget(route string) Budget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.budgetLocked(route)
+}
+
+func (l *Limiter) budgetLocked(route string) Budget {
+	if b, ok := l.routes[route]; ok {
+		return b
+	}
+	return l.def
+}
+
+// Allow takes a token from the client's bucket for route. When the bucket is
+// empty it reports how long until the next token.
+func (l *Limiter) Allow(route, client string) (bool, time.Duration) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.enabled {
+		return true, 0
+	}
+	l.sweepLocked(now)
+
+	key := route + "\x00" + client
+	b, ok := l.buckets[key]
+	if !ok {
+		budget := l.budgetLocked(route)
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(budget.Rate), budget.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		// burst 0: the route is closed
+		return false, time.Duration(math.MaxInt64)
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func (l *Limiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < idleTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
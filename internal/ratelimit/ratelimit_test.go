@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+func TestLimiterBudgetsPerRouteAndClient(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewLimiter(Budget{Rate: 10, Burst: 10}, map[string]Budget{"orders_list": {Rate: 1, Burst: 2}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("orders_list", "ip:1.2.3.4"); !ok {
+			t.Fatalf("request %d within burst was rejected", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("orders_list", "ip:1.2.3.4")
+	if ok {
+		t.Fatal("request over burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("retry after: want (0, 1s], got %s", retryAfter)
+	}
+
+	if ok, _ := l.Allow("orders_list", "ip:5.6.7.8"); !ok {
+		t.Error("another client shares the bucket")
+	}
+	if ok, _ := l.Allow("order_get", "ip:1.2.3.4"); !ok {
+		t.Error("another route shares the bucket")
+	}
+
+	now = now.Add(retryAfter)
+	if ok, _ := l.Allow("orders_list", "ip:1.2.3.4"); !ok {
+		t.Error("request after retry-after was rejected")
+	}
+
+	l.SetEnabled(false)
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("orders_list", "ip:1.2.3.4"); !ok {
+			t.Fatal("disabled limiter rejected a request")
+		}
+	}
+}
+
+func TestConcurrencyRejectsAfterWait(t *testing.T) {
+	c := NewConcurrency(1, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if err := c.Acquire(ctx); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	if err := c.Acquire(ctx); !errors.Is(err, domain.ErrOverloaded) {
+		t.Fatalf("acquire over limit: want ErrOverloaded, got %v", err)
+	}
+
+	// a waiter gets the slot as soon as it is released
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		c.Release()
+	}()
+	if err := c.Acquire(ctx); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+
+	c.SetLimit(2, time.Second)
+	if err := c.Acquire(ctx); err != nil {
+		t.Fatalf("acquire after raising the limit: %v", err)
+	}
+	if got := c.InFlight(); got != 2 {
+		t.Errorf("in flight: want 2, got %d", got)
+	}
+}
@@ -0,0 +1,75 @@
+package redact
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// sensitiveKeys are masked when they appear as plain string attributes,
+// e.g. slog.String("email", ...).
+var sensitiveKeys = map[string]Mode{
+	"password":      ModeFull,
+	"secret":        ModeFull,
+	"token":         ModeFull,
+	"authorization": ModeFull,
+	"api_key":       ModeFull,
+	"email":         ModePartial,
+	"phone":         ModePartial,
+}
+
+// Handler redacts record attributes before passing them on: struct values
+// are redacted by their pii tags and string attributes by key.
+type Handler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func NewHandler(next slog.Handler, r *Redactor) *Handler {
+	return &Handler{next: next, redactor: r}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.attr(a)
+	}
+	return &Handler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *Handler) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = h.attr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindString:
+		if mode, ok := sensitiveKeys[strings.ToLower(a.Key)]; ok {
+			a.Value = slog.StringValue(h.redactor.Mask(mode, a.Value.String()))
+		}
+	case slog.KindAny:
+		a.Value = slog.AnyValue(h.redactor.Any(a.Value.Any()))
+	}
+	return a
+}
@@ -0,0 +1,216 @@
+// Package redact masks personal data before it leaves the service: in logs,
+// in responses to callers without access to it and in exports.
+//
+// Fields are selected with a `pii` struct tag naming the masking mode:
+//
+//	Phone string `json:"phone" pii:"partial"`
+//
+// Only string fields can be tagged. Nested structs, pointers and slices are
+// walked; values are copied, the input is never modified.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type Mode string
+
+const (
+	// ModeFull replaces the whole value.
+	ModeFull Mode = "full"
+	// ModePartial keeps a few characters at both ends: +7******12.
+	ModePartial Mode = "partial"
+	// ModeHash replaces the value with a keyed hash, so equal values can
+	// still be matched without revealing them.
+	ModeHash Mode = "hash"
+)
+
+// Masked is what ModeFull and too short partial values become.
+const Masked = "***"
+
+// ParseMode checks a mode name from a struct tag or config.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeFull, ModePartial, ModeHash:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown redaction mode %q, want full, partial or hash", s)
+}
+
+type Redactor struct {
+	key []byte
+	// erase masks every field as ModeFull, whatever its tag says
+	erase bool
+}
+
+// New returns a redactor whose hashes are keyed with hashKey. Without a key
+// hashes are plain SHA-256 and short values can be guessed by brute force.
+func New(hashKey string) *Redactor {
+	return &Redactor{key: []byte(hashKey)}
+}
+
+// Eraser returns a redactor that replaces every tagged value with Masked.
+// Unlike hashes and partial masks its output is the same when applied
+// again, which makes it fit for erasing stored personal data for good.
+func Eraser() *Redactor {
+	return &Redactor{erase: true}
+}
+
+// Mask applies mode to s. Empty values stay empty.
+func (r *Redactor) Mask(mode Mode, s string) string {
+	if s == "" {
+		return ""
+	}
+	if r.erase {
+		return Masked
+	}
+	switch mode {
+	case ModePartial:
+		return partial(s)
+	case ModeHash:
+		return r.hash(s)
+	default:
+		return Masked
+	}
+}
+
+// Apply returns a redacted copy of v.
+func Apply[T any](r *Redactor, v T) T {
+	rv := reflect.ValueOf(&v).Elem()
+	return r.value(rv).Interface().(T)
+}
+
+// Any is Apply for values of unknown type. Values without tagged fields are
+// returned unchanged.
+func (r *Redactor) Any(v any) any {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !hasPII(rv.Type()) {
+		return v
+	}
+	return r.value(rv).Interface()
+}
+
+func (r *Redactor) value(v reflect.Value) reflect.Value {
+	t := v.Type()
+	if !hasPII(t) {
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(t.Elem())
+		out.Elem().Set(r.value(v.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(r.value(v.Index(i)))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(t).Elem()
+		out.Set(v)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if mode, ok := fieldMode(field); ok {
+				out.Field(i).SetString(r.Mask(mode, v.Field(i).String()))
+			} else if hasPII(field.Type) {
+				out.Field(i).Set(r.value(v.Field(i)))
+			}
+		}
+		return out
+	}
+	return v
+}
+
+func (r *Redactor) hash(s string) string {
+	var sum []byte
+	if len(r.key) > 0 {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(s))
+		sum = mac.Sum(nil)
+	} else {
+		h := sha256.Sum256([]byte(s))
+		sum = h[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// partial keeps the first and last two characters; for emails the first
+// character of the local part and the domain.
+func partial(s string) string {
+	if at := strings.LastIndexByte(s, '@'); at > 0 {
+		first, _ := utf8.DecodeRuneInString(s)
+		return string(first) + strings.Repeat("*", utf8.RuneCountInString(s[:at])-1) + s[at:]
+	}
+
+	runes := []rune(s)
+	if len(runes) <= 4 {
+		return Masked
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-2:])
+}
+
+func fieldMode(field reflect.StructField) (Mode, bool) {
+	tag, ok := field.Tag.Lookup("pii")
+	if !ok || field.Type.Kind() != reflect.String {
+		return "", false
+	}
+	mode, err := ParseMode(tag)
+	if err != nil {
+		// a typo in a tag must not leak the value
+		mode = ModeFull
+	}
+	return mode, true
+}
+
+var piiTypes sync.Map // reflect.Type -> bool
+
+// hasPII reports whether values of t contain tagged fields and need walking.
+func hasPII(t reflect.Type) bool {
+	if v, ok := piiTypes.Load(t); ok {
+		return v.(bool)
+	}
+	found := inspect(t, map[reflect.Type]bool{})
+	piiTypes.Store(t, found)
+	return found
+}
+
+func inspect(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice:
+		return inspect(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if _, ok := fieldMode(field); ok || inspect(field.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
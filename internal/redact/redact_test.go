@@ -0,0 +1,108 @@
+package redact
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+func TestMask(t *testing.T) {
+	r := New("key")
+	tests := []struct {
+		mode Mode
+		in   string
+		want string
+	}{
+		{ModeFull, "Ploshad Mira 15", Masked},
+		{ModePartial, "+7916123412", "+7*******12"},
+		{ModePartial, "test@gmail.com", "t***@gmail.com"},
+		{ModePartial, "abcd", Masked},
+		{ModeFull, "", ""},
+	}
+	for _, tt := range tests {
+		if got := r.Mask(tt.mode, tt.in); got != tt.want {
+			t.Errorf("Mask(%s, %q) = %q, want %q", tt.mode, tt.in, got, tt.want)
+		}
+	}
+
+	h1, h2 := r.Mask(ModeHash, "customer"), r.Mask(ModeHash, "customer")
+	if h1 != h2 || !strings.HasPrefix(h1, "sha256:") || strings.Contains(h1, "customer") {
+		t.Errorf("Mask(hash): want a stable hash, got %q and %q", h1, h2)
+	}
+	if other := New("other key").Mask(ModeHash, "customer"); other == h1 {
+		t.Errorf("Mask(hash): want hashes to depend on the key")
+	}
+}
+
+func TestApplyCopiesOrder(t *testing.T) {
+	order := &domain.Order{
+		OrderUID:   "uid",
+		CustomerID: "customer",
+		Delivery:   domain.Delivery{Name: "Test Testov", Phone: "+9720000000", City: "Kiryat Mozkin", Email: "test@gmail.com"},
+		Items:      []domain.Item{{Name: "Mascaras"}},
+	}
+
+	got := Apply(New(""), order)
+
+	if got == order {
+		t.Fatal("Apply returned the input pointer")
+	}
+	if order.Delivery.Phone != "+9720000000" || order.CustomerID != "customer" {
+		t.Errorf("Apply modified its input: %+v", order)
+	}
+	if got.Delivery.Phone != "+9*******00" || got.Delivery.Email != "t***@gmail.com" {
+		t.Errorf("delivery not redacted: %+v", got.Delivery)
+	}
+	if got.Delivery.City != "Kiryat Mozkin" || got.OrderUID != "uid" || got.Items[0].Name != "Mascaras" {
+		t.Errorf("untagged fields changed: %+v", got)
+	}
+	if !strings.HasPrefix(got.CustomerID, "sha256:") {
+		t.Errorf("customer_id: want a hash, got %q", got.CustomerID)
+	}
+
+	list := Apply(New(""), []*domain.Order{order})
+	if list[0].Delivery.Name != "Te*******ov" {
+		t.Errorf("slice element not redacted: %q", list[0].Delivery.Name)
+	}
+}
+
+func TestEraserIsIdempotent(t *testing.T) {
+	order := &domain.Order{
+		CustomerID: "customer",
+		Delivery:   domain.Delivery{Name: "Test Testov", Phone: "+9720000000", City: "Kiryat Mozkin", Email: "test@gmail.com"},
+	}
+
+	once := Apply(Eraser(), order)
+	if once.CustomerID != Masked || once.Delivery.Phone != Masked || once.Delivery.Email != Masked {
+		t.Errorf("personal data left: %+v", once)
+	}
+	if once.Delivery.City != "Kiryat Mozkin" {
+		t.Errorf("untagged field changed: %q", once.Delivery.City)
+	}
+	if twice := Apply(Eraser(), once); !reflect.DeepEqual(twice, once) {
+		t.Errorf("erasing again changed the order:\n%+v\n%+v", once, twice)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil), New("")))
+
+	l.With(slog.String("password", "hunter2")).Info("order",
+		slog.Any("delivery", domain.Delivery{Phone: "+9720000000", Address: "Ploshad Mira 15"}),
+		slog.Group("contact", slog.String("email", "test@gmail.com")))
+
+	out := buf.String()
+	for _, leaked := range []string{"hunter2", "+9720000000", "Ploshad Mira 15", "test@gmail.com"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log record contains %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, "t***@gmail.com") {
+		t.Errorf("grouped email not partially masked: %s", out)
+	}
+}
@@ -1,72 +1,252 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("cache")
+
 type OrderRepository interface {
-	GetAllOrders() ([]*domain.Order, error)
+	GetAllOrders(ctx context.Context) ([]*domain.Order, error)
 }
 
 type OrderCache struct {
 	repo   OrderRepository
 	cache  sync.Map
 	logger *slog.Logger
+
+	// insertion order for evicting the oldest entries once maxEntries is hit
+	mu         sync.Mutex
+	order      *list.List
+	elems      map[string]*list.Element
+	maxEntries int
+	evicted    bool
+
+	// inverted index for Search: word -> order UID -> whether the word occurs
+	// in a public field (see domain.SearchTerms)
+	index map[string]map[string]bool
 }
 
 func NewOrderCache(logger *slog.Logger, repo OrderRepository) *OrderCache {
 	return &OrderCache{
 		logger: logger,
 		repo:   repo,
+		order:  list.New(),
+		elems:  make(map[string]*list.Element),
+		index:  make(map[string]map[string]bool),
 	}
 }
 
-func (c *OrderCache) Set(order *domain.Order) {
-	c.cache.Store(order.OrderUID, order)
-	c.logger.Info("Order added to cache",
+// SetLimit caps the number of cached orders, 0 meaning no limit. Lowering the
+// limit evicts the oldest entries right away.
+func (c *OrderCache) SetLimit(maxEntries int) {
+	c.mu.Lock()
+	c.maxEntries = maxEntries
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+
+	c.logger.Info("Cache limit updated",
+		slog.Int("maxEntries", maxEntries),
+		slog.Int("evicted", evicted))
+}
+
+func (c *OrderCache) Set(ctx context.Context, order *domain.Order) {
+	ctx, span := tracer.Start(ctx, "OrderCache.Set",
+		trace.WithAttributes(attribute.String("order.uid", order.OrderUID)))
+	defer span.End()
+
+	c.mu.Lock()
+	c.storeLocked(order)
+	c.evictLocked()
+	c.mu.Unlock()
+
+	c.logger.DebugContext(ctx, "Order added to cache",
 		slog.String("orderID", order.OrderUID))
 }
 
-func (c *OrderCache) Get(id string) (*domain.Order, bool) {
+func (c *OrderCache) storeLocked(order *domain.Order) {
+	if old, ok := c.cache.Load(order.OrderUID); ok {
+		c.unindexLocked(old.(*domain.Order))
+	}
+	c.cache.Store(order.OrderUID, order)
+	c.indexLocked(order)
+	if _, ok := c.elems[order.OrderUID]; !ok {
+		c.elems[order.OrderUID] = c.order.PushBack(order.OrderUID)
+	}
+}
+
+func (c *OrderCache) removeLocked(id string) {
+	if old, ok := c.cache.LoadAndDelete(id); ok {
+		c.unindexLocked(old.(*domain.Order))
+	}
+	if elem, ok := c.elems[id]; ok {
+		c.order.Remove(elem)
+		delete(c.elems, id)
+	}
+}
+
+func (c *OrderCache) indexLocked(order *domain.Order) {
+	public, private := domain.SearchTerms(order)
+	add := func(word string, isPublic bool) {
+		postings := c.index[word]
+		if postings == nil {
+			postings = make(map[string]bool)
+			c.index[word] = postings
+		}
+		postings[order.OrderUID] = postings[order.OrderUID] || isPublic
+	}
+	for _, w := range private {
+		add(w, false)
+	}
+	for _, w := range public {
+		add(w, true)
+	}
+}
+
+func (c *OrderCache) unindexLocked(order *domain.Order) {
+	public, private := domain.SearchTerms(order)
+	for _, w := range append(public, private...) {
+		postings := c.index[w]
+		delete(postings, order.OrderUID)
+		if len(postings) == 0 {
+			delete(c.index, w)
+		}
+	}
+}
+
+func (c *OrderCache) evictLocked() int {
+	evicted := 0
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeLocked(c.order.Front().Value.(string))
+		evicted++
+	}
+	if evicted > 0 {
+		c.evicted = true
+	}
+	return evicted
+}
+
+// Complete is true while the cache holds every order loaded by Restore or
+// added since.
+func (c *OrderCache) Complete() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.evicted
+}
+
+// Len returns the number of cached orders.
+func (c *OrderCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.elems)
+}
+
+// Stats describes what the cache holds.
+type Stats struct {
+	Orders     int  `json:"orders"`
+	MaxEntries int  `json:"max_entries"`
+	Complete   bool `json:"complete"`
+	Words      int  `json:"index_words"`
+}
+
+func (c *OrderCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Orders:     len(c.elems),
+		MaxEntries: c.maxEntries,
+		Complete:   !c.evicted,
+		Words:      len(c.index),
+	}
+}
+
+// Flush drops every cached order. Reads go to storage, and fill the cache
+// again, until the next Restore makes it complete.
+func (c *OrderCache) Flush(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "OrderCache.Flush")
+	defer span.End()
+
+	c.mu.Lock()
+	flushed := len(c.elems)
+	for id := range c.elems {
+		c.cache.Delete(id)
+	}
+	c.order.Init()
+	c.elems = make(map[string]*list.Element)
+	c.index = make(map[string]map[string]bool)
+	c.evicted = true
+	c.mu.Unlock()
+
+	span.SetAttributes(attribute.Int("cache.orders", flushed))
+	c.logger.InfoContext(ctx, "Cache flushed",
+		slog.Int("orderCount", flushed))
+}
+
+func (c *OrderCache) Get(ctx context.Context, id string) (*domain.Order, bool) {
+	ctx, span := tracer.Start(ctx, "OrderCache.Get",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer span.End()
+
 	value, found := c.cache.Load(id)
+	span.SetAttributes(attribute.Bool("cache.hit", found))
 	if found {
-		c.logger.Info("Cache hit", slog.String("orderID", id))
+		c.logger.DebugContext(ctx, "Cache hit", slog.String("orderID", id))
 		return value.(*domain.Order), true
 	}
-	c.logger.Info("Miss cache", slog.String("orderID", id))
+	c.logger.DebugContext(ctx, "Miss cache", slog.String("orderID", id))
 	return nil, false
 }
 
-func (c *OrderCache) Restore() error {
+func (c *OrderCache) Restore(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderCache.Restore")
+	defer func() { tracing.End(span, err) }()
+
 	startTime := time.Now()
-	c.logger.Info("Starting cache restore from DB")
+	c.logger.InfoContext(ctx, "Starting cache restore from DB")
 
-	orders, err := c.repo.GetAllOrders()
+	orders, err := c.repo.GetAllOrders(ctx)
 	if err != nil {
-		c.logger.Error("Failed to get orders for cache from DB",
+		c.logger.ErrorContext(ctx, "Failed to get orders for cache from DB",
 			slog.String("error", err.Error()))
 		return fmt.Errorf("failed to restore cache: %w", err)
 	}
 
+	c.mu.Lock()
+	c.evicted = false
 	for _, order := range orders {
-		c.cache.Store(order.OrderUID, order)
+		c.storeLocked(order)
 	}
+	c.evictLocked()
+	c.mu.Unlock()
+	span.SetAttributes(attribute.Int("cache.orders", len(orders)))
 
 	duration := time.Since(startTime)
-	c.logger.Info("Cache restored",
+	c.logger.InfoContext(ctx, "Cache restored",
 		slog.Int("orderCount", len(orders)),
 		slog.String("duration", duration.String()))
 	return nil
 }
 
-func (c *OrderCache) Delete(id string) {
-	c.cache.Delete(id)
-	c.logger.Info("Order removed from cache",
+func (c *OrderCache) Delete(ctx context.Context, id string) {
+	ctx, span := tracer.Start(ctx, "OrderCache.Delete",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer span.End()
+
+	c.mu.Lock()
+	c.removeLocked(id)
+	c.mu.Unlock()
+	c.logger.InfoContext(ctx, "Order removed from cache",
 		slog.String("orderID", id))
 }
 
@@ -78,3 +258,66 @@ func (c *OrderCache) GetAll() []*domain.Order {
 	})
 	return orders
 }
+
+// Search answers q from the cached orders, using the inverted index for the
+// text part. It only sees what is cached; check Complete before relying on it.
+func (c *OrderCache) Search(ctx context.Context, q domain.SearchQuery) []*domain.Order {
+	_, span := tracer.Start(ctx, "OrderCache.Search")
+	defer span.End()
+
+	var candidates []*domain.Order
+	words := domain.Tokenize(q.Text)
+	c.mu.Lock()
+	if len(words) == 0 {
+		c.cache.Range(func(_, value any) bool {
+			candidates = append(candidates, value.(*domain.Order))
+			return true
+		})
+	} else {
+		candidates = c.lookupLocked(words, q.IncludePII)
+	}
+	c.mu.Unlock()
+
+	found := make([]*domain.Order, 0, len(candidates))
+	for _, order := range candidates {
+		if q.MatchFilters(order) {
+			found = append(found, order)
+		}
+	}
+	domain.SortNewestFirst(found)
+	span.SetAttributes(attribute.Int("search.matches", len(found)))
+	return q.Page(found)
+}
+
+// lookupLocked returns the orders containing every word, walking the shortest
+// posting list and probing the others.
+func (c *OrderCache) lookupLocked(words []string, includePII bool) []*domain.Order {
+	postings := make([]map[string]bool, 0, len(words))
+	for _, w := range words {
+		p, ok := c.index[w]
+		if !ok {
+			return nil
+		}
+		postings = append(postings, p)
+	}
+	sort.Slice(postings, func(i, j int) bool { return len(postings[i]) < len(postings[j]) })
+
+	var orders []*domain.Order
+	for uid := range postings[0] {
+		matches := true
+		for _, p := range postings {
+			public, ok := p[uid]
+			if !ok || !(public || includePII) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if value, ok := c.cache.Load(uid); ok {
+			orders = append(orders, value.(*domain.Order))
+		}
+	}
+	return orders
+}
@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+)
+
+type rollupKey struct {
+	grain     analytics.Grain
+	dimension analytics.Dimension
+	start     int64
+	key       string
+	currency  string
+}
+
+func (r *OrderRepository) AddRollups(ctx context.Context, rows []analytics.Row) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range rows {
+		k := rollupKey{row.Grain, row.Dimension, row.Start.Unix(), row.Key, row.Currency}
+		if sum, ok := r.rollups[k]; ok {
+			row.Orders += sum.Orders
+			row.Items += sum.Items
+			row.Revenue += sum.Revenue
+			row.DeliveryCost += sum.DeliveryCost
+		}
+		row.Start = row.Start.UTC()
+		r.rollups[k] = row
+	}
+	return nil
+}
+
+func (r *OrderRepository) Rollups(ctx context.Context, q analytics.Query) ([]analytics.Row, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]analytics.Row, 0)
+	for k, row := range r.rollups {
+		if k.grain != q.Grain || k.dimension != q.Dimension ||
+			row.Start.Before(q.From) || !row.Start.Before(q.To) ||
+			(q.Currency != "" && k.currency != q.Currency) ||
+			(q.Key != "" && k.key != q.Key) {
+			continue
+		}
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Currency < b.Currency
+	})
+	return out, nil
+}
+
+func (r *OrderRepository) ClearRollups(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clear(r.rollups)
+	return nil
+}
@@ -0,0 +1,297 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// OrderRepository keeps orders in process memory. It follows the same
+// contract as the postgres repository: orders are copied on the way in and
+// out, a missing order is reported as nil, nil and saving an existing
+// OrderUID fails with domain.ErrOrderExists. Cancelled orders are kept with
+// their Deletion set.
+type OrderRepository struct {
+	mu       sync.RWMutex
+	orders   map[string]*domain.Order
+	versions map[string][]*domain.Version
+	// purged holds the orders whose personal data was erased
+	purged   map[string]bool
+	archived map[string]*domain.Order
+	runs     []*domain.RetentionRun
+	rollups  map[rollupKey]analytics.Row
+	logger   *slog.Logger
+}
+
+func NewOrderRepository(logger *slog.Logger) *OrderRepository {
+	return &OrderRepository{
+		orders:   make(map[string]*domain.Order),
+		versions: make(map[string][]*domain.Version),
+		purged:   make(map[string]bool),
+		archived: make(map[string]*domain.Order),
+		rollups:  make(map[rollupKey]analytics.Row),
+		logger:   logger,
+	}
+}
+
+func (r *OrderRepository) SaveOrder(ctx context.Context, order *domain.Order) error {
+	r.logger.InfoContext(ctx, "Attempting to save order", slog.String("orderUID", order.OrderUID))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[order.OrderUID]; ok {
+		r.logger.ErrorContext(ctx, "Order already exists", slog.String("orderUID", order.OrderUID))
+		return fmt.Errorf("failed to insert order info: %w", domain.ErrOrderExists)
+	}
+	r.orders[order.OrderUID] = liveCopy(order)
+	r.addVersionLocked(ctx, liveCopy(order))
+
+	r.logger.InfoContext(ctx, "Successfully saved order", slog.String("orderUID", order.OrderUID))
+	return nil
+}
+
+func (r *OrderRepository) SaveOrders(ctx context.Context, orders []*domain.Order) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var existing []string
+	for _, order := range orders {
+		if _, ok := r.orders[order.OrderUID]; ok {
+			existing = append(existing, order.OrderUID)
+			continue
+		}
+		r.orders[order.OrderUID] = liveCopy(order)
+		r.addVersionLocked(ctx, liveCopy(order))
+	}
+
+	r.logger.InfoContext(ctx, "Saved order batch",
+		slog.Int("saved", len(orders)-len(existing)),
+		slog.Int("existing", len(existing)))
+	return existing, nil
+}
+
+// RestoreOrder stores an order moved from another repository with its
+// cancellation and versions as they were there.
+func (r *OrderRepository) RestoreOrder(ctx context.Context, order *domain.Order, versions []*domain.Version) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[order.OrderUID]; ok {
+		return fmt.Errorf("failed to restore order: %w", domain.ErrOrderExists)
+	}
+	r.orders[order.OrderUID] = copyOrder(order)
+	r.versions[order.OrderUID] = make([]*domain.Version, 0, len(versions))
+	for _, v := range versions {
+		r.versions[order.OrderUID] = append(r.versions[order.OrderUID], copyVersion(v))
+	}
+
+	r.logger.InfoContext(ctx, "Restored order",
+		slog.String("orderUID", order.OrderUID),
+		slog.Int("versions", len(versions)))
+	return nil
+}
+
+// DeleteMovedOrder deletes the order unless it gained versions after
+// version.
+func (r *OrderRepository) DeleteMovedOrder(ctx context.Context, orderUID string, version int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orders[orderUID]; !ok || len(r.versions[orderUID]) != version {
+		return false, nil
+	}
+	delete(r.orders, orderUID)
+	delete(r.versions, orderUID)
+	delete(r.purged, orderUID)
+
+	r.logger.InfoContext(ctx, "Deleted moved order", slog.String("orderUID", orderUID))
+	return true, nil
+}
+
+func (r *OrderRepository) GetOrderByID(ctx context.Context, orderUID string) (*domain.Order, error) {
+	r.logger.InfoContext(ctx, "Attempting to get order by ID", slog.String("orderUID", orderUID))
+
+	r.mu.RLock()
+	order, ok := r.orders[orderUID]
+	r.mu.RUnlock()
+
+	if !ok {
+		r.logger.InfoContext(ctx, "Order not found", slog.String("orderUID", orderUID))
+		return nil, nil
+	}
+
+	r.logger.InfoContext(ctx, "Successfully retrieved order", slog.String("orderUID", orderUID))
+	return copyOrder(order), nil
+}
+
+func (r *OrderRepository) GetAllOrders(ctx context.Context) ([]*domain.Order, error) {
+	r.logger.InfoContext(ctx, "Attempting to get all orders")
+
+	r.mu.RLock()
+	orders := make([]*domain.Order, 0, len(r.orders))
+	for _, order := range r.orders {
+		if order.Deletion == nil {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+	r.mu.RUnlock()
+
+	r.logger.InfoContext(ctx, "Successfully retrieved all orders", slog.Int("count", len(orders)))
+	return orders, nil
+}
+
+func (r *OrderRepository) SearchOrders(ctx context.Context, q domain.SearchQuery) ([]*domain.Order, error) {
+	r.mu.RLock()
+	var found []*domain.Order
+	for _, order := range r.orders {
+		if q.Match(order) {
+			found = append(found, copyOrder(order))
+		}
+	}
+	r.mu.RUnlock()
+
+	domain.SortNewestFirst(found)
+	found = q.Page(found)
+	r.logger.InfoContext(ctx, "Searched orders", slog.Int("count", len(found)))
+	return found, nil
+}
+
+// StreamOrders passes copies of the orders matching q to fn, newest first.
+// Limit and Offset are ignored.
+func (r *OrderRepository) StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) error {
+	r.mu.RLock()
+	var found []*domain.Order
+	for _, order := range r.orders {
+		if q.Match(order) {
+			found = append(found, copyOrder(order))
+		}
+	}
+	r.mu.RUnlock()
+
+	domain.SortNewestFirst(found)
+	for _, order := range found {
+		// like a database cursor, stop once the caller is gone
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	r.logger.InfoContext(ctx, "Streamed orders", slog.Int("count", len(found)))
+	return nil
+}
+
+func (r *OrderRepository) UpdateOrder(ctx context.Context, order *domain.Order) (*domain.Version, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.orders[order.OrderUID]
+	if !ok {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderNotFound)
+	}
+	if stored.Deletion != nil {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderDeleted)
+	}
+	if stored.Equal(liveCopy(order)) {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderUnchanged)
+	}
+	r.orders[order.OrderUID] = liveCopy(order)
+	// the update may bring personal data back
+	delete(r.purged, order.OrderUID)
+	v := r.addVersionLocked(ctx, liveCopy(order))
+
+	r.logger.InfoContext(ctx, "Successfully updated order",
+		slog.String("orderUID", order.OrderUID),
+		slog.Int("version", v.Version))
+	return copyVersion(v), nil
+}
+
+func (r *OrderRepository) CancelOrder(ctx context.Context, c domain.Cancellation) (*domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.orders[c.OrderUID]
+	if !ok {
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderNotFound)
+	}
+	if stored.Deletion != nil {
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderDeleted)
+	}
+	stored.Deletion = &domain.Deletion{DeletedAt: time.Now().UTC(), Reason: c.Reason}
+	r.addVersionLocked(ctx, copyOrder(stored))
+
+	r.logger.InfoContext(ctx, "Successfully cancelled order",
+		slog.String("orderUID", c.OrderUID),
+		slog.String("reason", c.Reason))
+	return copyOrder(stored), nil
+}
+
+func (r *OrderRepository) OrderVersions(ctx context.Context, orderUID string) ([]*domain.Version, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := make([]*domain.Version, 0, len(r.versions[orderUID]))
+	for _, v := range r.versions[orderUID] {
+		versions = append(versions, copyVersion(v))
+	}
+	return versions, nil
+}
+
+func (r *OrderRepository) GetOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*domain.Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	v := domain.VersionAt(r.versions[orderUID], t)
+	if v == nil {
+		return nil, nil
+	}
+	return copyOrder(v.Order), nil
+}
+
+// addVersionLocked records snapshot, a copy the repository owns, as the
+// order's next version. r.mu must be held.
+func (r *OrderRepository) addVersionLocked(ctx context.Context, snapshot *domain.Order) *domain.Version {
+	v := &domain.Version{
+		OrderUID:  snapshot.OrderUID,
+		Version:   len(r.versions[snapshot.OrderUID]) + 1,
+		Source:    domain.SourceFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+		Order:     snapshot,
+	}
+	r.versions[snapshot.OrderUID] = append(r.versions[snapshot.OrderUID], v)
+	return v
+}
+
+func copyVersion(v *domain.Version) *domain.Version {
+	c := *v
+	c.Order = copyOrder(v.Order)
+	return &c
+}
+
+func copyOrder(order *domain.Order) *domain.Order {
+	c := *order
+	if order.Items != nil {
+		c.Items = make([]domain.Item, len(order.Items))
+		copy(c.Items, order.Items)
+	}
+	if order.Deletion != nil {
+		d := *order.Deletion
+		c.Deletion = &d
+	}
+	return &c
+}
+
+// liveCopy copies an order being written, dropping the Deletion that only
+// CancelOrder may set.
+func liveCopy(order *domain.Order) *domain.Order {
+	c := copyOrder(order)
+	c.Deletion = nil
+	return c
+}
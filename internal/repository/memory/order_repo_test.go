@@ -0,0 +1,17 @@
+package memory_test
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) service.OrderRepository {
+		return memory.NewOrderRepository(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	})
+}
@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// PurgePII erases the oldest orders first, like the SQL repositories.
+func (r *OrderRepository) PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []*domain.Order
+	for uid, order := range r.orders {
+		if !r.purged[uid] && order.DateCreated.Before(before) {
+			due = append(due, order)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].DateCreated.Before(due[j].DateCreated) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	ids := make([]string, 0, len(due))
+	for _, order := range due {
+		r.orders[order.OrderUID] = erase(copyOrder(order))
+		for _, v := range r.versions[order.OrderUID] {
+			v.Order = erase(v.Order)
+		}
+		r.purged[order.OrderUID] = true
+		ids = append(ids, order.OrderUID)
+	}
+
+	r.logger.InfoContext(ctx, "Purged personal data", slog.Int("count", len(ids)))
+	return ids, nil
+}
+
+func (r *OrderRepository) DeleteOrders(ctx context.Context, ids []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, uid := range ids {
+		delete(r.orders, uid)
+		delete(r.versions, uid)
+		delete(r.purged, uid)
+	}
+	r.logger.InfoContext(ctx, "Deleted orders", slog.Int("count", len(ids)))
+	return nil
+}
+
+// ArchiveOrders keeps copies of orders in the repository's archive, which
+// like the order_archive table of the SQL repositories survives
+// DeleteOrders.
+func (r *OrderRepository) ArchiveOrders(ctx context.Context, orders []*domain.Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, order := range orders {
+		r.archived[order.OrderUID] = copyOrder(order)
+	}
+	return nil
+}
+
+func (r *OrderRepository) ArchivedOrder(ctx context.Context, orderUID string) (*domain.Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	order, ok := r.archived[orderUID]
+	if !ok {
+		return nil, nil
+	}
+	return copyOrder(order), nil
+}
+
+func (r *OrderRepository) SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run.ID = int64(len(r.runs) + 1)
+	c := *run
+	r.runs = append(r.runs, &c)
+	return nil
+}
+
+func (r *OrderRepository) RetentionRuns(ctx context.Context, limit int) ([]*domain.RetentionRun, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	runs := make([]*domain.RetentionRun, 0, limit)
+	for i := len(r.runs) - 1; i >= 0 && len(runs) < limit; i-- {
+		c := *r.runs[i]
+		runs = append(runs, &c)
+	}
+	return runs, nil
+}
@@ -0,0 +1,117 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+)
+
+// rollupChunk bounds the rows per INSERT; 9 parameters each stay well under
+// the protocol limit of 65535.
+const rollupChunk = 1000
+
+// AddRollups upserts rows in a fixed order, so concurrent calls touching the
+// same buckets wait for each other instead of deadlocking.
+func (r *OrderRepository) AddRollups(ctx context.Context, rows []analytics.Row) error {
+	rows = append([]analytics.Row(nil), rows...)
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Grain != b.Grain {
+			return a.Grain < b.Grain
+		}
+		if a.Dimension != b.Dimension {
+			return a.Dimension < b.Dimension
+		}
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Currency < b.Currency
+	})
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const columns = 9
+	for len(rows) > 0 {
+		chunk := rows[:min(len(rows), rollupChunk)]
+		rows = rows[len(chunk):]
+
+		values := make([]string, 0, len(chunk))
+		args := make([]any, 0, len(chunk)*columns)
+		for i, row := range chunk {
+			n := i * columns
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9))
+			args = append(args, row.Grain, row.Dimension, row.Start.UTC(), row.Key, row.Currency,
+				row.Orders, row.Items, row.Revenue, row.DeliveryCost)
+		}
+		qctx, qspan := startQuery(ctx, "INSERT", "order_rollups")
+		_, err := tx.ExecContext(qctx, `
+            INSERT INTO order_rollups AS r (grain, dimension, bucket_start, key, currency,
+                                            orders, items, revenue, delivery_cost)
+            VALUES `+strings.Join(values, ", ")+`
+            ON CONFLICT (grain, dimension, bucket_start, key, currency) DO UPDATE SET
+                orders = r.orders + excluded.orders,
+                items = r.items + excluded.items,
+                revenue = r.revenue + excluded.revenue,
+                delivery_cost = r.delivery_cost + excluded.delivery_cost`, args...)
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to upsert rollups: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *OrderRepository) Rollups(ctx context.Context, q analytics.Query) (_ []analytics.Row, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "order_rollups")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT bucket_start, key, currency, orders, items, revenue, delivery_cost
+        FROM order_rollups
+        WHERE grain = $1 AND dimension = $2 AND bucket_start >= $3 AND bucket_start < $4
+          AND ($5 = '' OR currency = $5) AND ($6 = '' OR key = $6)
+        ORDER BY bucket_start, key, currency`,
+		q.Grain, q.Dimension, q.From.UTC(), q.To.UTC(), q.Currency, q.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]analytics.Row, 0)
+	for rows.Next() {
+		row := analytics.Row{Grain: q.Grain, Dimension: q.Dimension}
+		err := rows.Scan(&row.Start, &row.Key, &row.Currency, &row.Orders, &row.Items, &row.Revenue, &row.DeliveryCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		row.Start = row.Start.UTC()
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rollups: %w", err)
+	}
+	return out, nil
+}
+
+func (r *OrderRepository) ClearRollups(ctx context.Context) error {
+	qctx, qspan := startQuery(ctx, "TRUNCATE", "order_rollups")
+	_, err := r.db.ExecContext(qctx, `TRUNCATE order_rollups`)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to clear rollups: %w", err)
+	}
+	return nil
+}
@@ -1,127 +1,421 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("repository/postgres")
+
 type OrderRepository struct {
 	db     *sql.DB
 	logger *slog.Logger
+	// months holds the months whose partitions are known to exist
+	months sync.Map
 }
 
 func NewOrderRepository(db *sql.DB, logger *slog.Logger) *OrderRepository {
 	return &OrderRepository{db: db, logger: logger}
 }
 
-func (r *OrderRepository) SaveOrder(order *domain.Order) error {
-	r.logger.Info("Attempting to save order", slog.String("orderUID", order.OrderUID))
+func (r *OrderRepository) SaveOrder(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SaveOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	r.logger.InfoContext(ctx, "Attempting to save order", slog.String("orderUID", order.OrderUID))
 
-	tx, err := r.db.Begin()
+	if err := r.ensurePartitions(ctx, order.DateCreated); err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		r.logger.Error("Failed to begin transaction", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Order info
-	_, err = tx.Exec(`
-        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+	// order_uid is unique only in order_index
+	qctx, qspan := startQuery(ctx, "INSERT", "order_index")
+	_, err = tx.ExecContext(qctx, `INSERT INTO order_index (order_uid, date_created) VALUES ($1, $2)`,
+		order.OrderUID, order.DateCreated)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order index", slog.String("error", err.Error()))
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to insert order info: %w", domain.ErrOrderExists)
+		}
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+
+	// Order info, with the search vectors built from domain.SearchTerms so
+	// that both search paths split words the same way
+	public, private := domain.SearchTerms(order)
+	publicText := strings.Join(public, " ")
+	qctx, qspan = startQuery(ctx, "INSERT", "orders")
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard,
+                            search_public, search_all)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,
+                to_tsvector('simple', $12::text), to_tsvector('simple', $12::text || ' ' || $13::text))`,
 		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature,
-		order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard)
+		order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard,
+		publicText, strings.Join(private, " "))
+	tracing.End(qspan, err)
 	if err != nil {
-		r.logger.Error("Failed to insert order info", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to insert order info", slog.String("error", err.Error()))
 		return fmt.Errorf("failed to insert order info: %w", err)
 	}
+	if err := r.insertDetails(ctx, tx, order); err != nil {
+		return err
+	}
+	if _, err := r.insertVersion(ctx, tx, order, 1); err != nil {
+		return err
+	}
 
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully saved order", slog.String("orderUID", order.OrderUID))
+	return nil
+}
+
+// insertDetails writes the order's delivery, payment and items in tx, in the
+// partitions of its date_created.
+func (r *OrderRepository) insertDetails(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
 	// Delivery
-	_, err = tx.Exec(`
-        INSERT INTO delivery (order_uid, name, phone, zip, city, address, region, email)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-		order.OrderUID, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+	qctx, qspan := startQuery(ctx, "INSERT", "delivery")
+	_, err := tx.ExecContext(qctx, `
+        INSERT INTO delivery (order_uid, date_created, name, phone, zip, city, address, region, email)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		order.OrderUID, order.DateCreated, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
 		order.Delivery.City, order.Delivery.Address, order.Delivery.Region, order.Delivery.Email)
+	tracing.End(qspan, err)
 	if err != nil {
-		r.logger.Error("Failed to insert delivery info", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to insert delivery info", slog.String("error", err.Error()))
 		return fmt.Errorf("failed to insert delivery info: %w", err)
 	}
 
 	// Payment
-	_, err = tx.Exec(`
-        INSERT INTO payment (order_uid, transaction, request_id, currency, provider, amount, payment_dt, bank, delivery_cost, goods_total, custom_fee)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
-		order.OrderUID, order.Payment.Transaction, order.Payment.RequestID, order.Payment.Currency,
+	qctx, qspan = startQuery(ctx, "INSERT", "payment")
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO payment (order_uid, date_created, transaction, request_id, currency, provider, amount, payment_dt, bank, delivery_cost, goods_total, custom_fee)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		order.OrderUID, order.DateCreated, order.Payment.Transaction, order.Payment.RequestID, order.Payment.Currency,
 		order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt, order.Payment.Bank,
 		order.Payment.DeliveryCost, order.Payment.GoodsTotal, order.Payment.CustomFee)
+	tracing.End(qspan, err)
 	if err != nil {
-		r.logger.Error("Failed to insert payment info", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to insert payment info", slog.String("error", err.Error()))
 		return fmt.Errorf("failed to insert payment info: %w", err)
 	}
 
 	// Items
 	for _, item := range order.Items {
-		_, err = tx.Exec(`
-            INSERT INTO items (order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
-			order.OrderUID, item.ChrtID, item.TrackNumber, item.Price, item.RID, item.Name,
+		qctx, qspan = startQuery(ctx, "INSERT", "items")
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO items (order_uid, date_created, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			order.OrderUID, order.DateCreated, item.ChrtID, item.TrackNumber, item.Price, item.RID, item.Name,
 			item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status)
+		tracing.End(qspan, err)
 		if err != nil {
-			r.logger.Error("Failed to insert item",
+			r.logger.ErrorContext(ctx, "Failed to insert item",
 				slog.String("error", err.Error()),
 				slog.Int("chrtID", item.ChrtID))
 			return fmt.Errorf("failed to insert item: %w", err)
 		}
 	}
+	return nil
+}
+
+// insertChunk bounds the rows of one multi-row INSERT, keeping it under the
+// protocol's limit of 65535 bind parameters.
+const insertChunk = 2000
+
+// SaveOrders writes the batch in one transaction: order_index rows with a
+// multi-row INSERT that skips stored ids, the orders rows of the new ones,
+// then their delivery, payment and items with COPY.
+func (r *OrderRepository) SaveOrders(ctx context.Context, orders []*domain.Order) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SaveOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.Int("orders.count", len(orders))))
+	defer func() { tracing.End(span, err) }()
+
+	dates := make([]time.Time, len(orders))
+	for i, o := range orders {
+		dates[i] = o.DateCreated
+	}
+	if err := r.ensurePartitions(ctx, dates...); err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	inserted := make(map[string]bool, len(orders))
+	for start := 0; start < len(orders); start += insertChunk {
+		chunk := orders[start:min(start+insertChunk, len(orders))]
+		if err := r.insertIndexRows(ctx, tx, chunk, inserted); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := tx.Commit(); err != nil {
-		r.logger.Error("Failed to commit transaction", slog.String("error", err.Error()))
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	var existing []string
+	fresh := make([]*domain.Order, 0, len(inserted))
+	for _, order := range orders {
+		if inserted[order.OrderUID] {
+			fresh = append(fresh, order)
+		} else {
+			existing = append(existing, order.OrderUID)
+		}
+	}
+	for start := 0; start < len(fresh); start += insertChunk {
+		if err := r.insertOrderRows(ctx, tx, fresh[start:min(start+insertChunk, len(fresh))]); err != nil {
+			return nil, err
+		}
 	}
 
-	r.logger.Info("Successfully saved order", slog.String("orderUID", order.OrderUID))
+	err = r.copyRows(ctx, tx, "delivery", []string{"order_uid", "date_created", "name", "phone", "zip", "city", "address", "region", "email"},
+		fresh, func(o *domain.Order, emit func(...any) error) error {
+			d := o.Delivery
+			return emit(o.OrderUID, o.DateCreated, d.Name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = r.copyRows(ctx, tx, "payment", []string{"order_uid", "date_created", "transaction", "request_id", "currency", "provider", "amount",
+		"payment_dt", "bank", "delivery_cost", "goods_total", "custom_fee"},
+		fresh, func(o *domain.Order, emit func(...any) error) error {
+			p := o.Payment
+			return emit(o.OrderUID, o.DateCreated, p.Transaction, p.RequestID, p.Currency, p.Provider, p.Amount,
+				p.PaymentDt, p.Bank, p.DeliveryCost, p.GoodsTotal, p.CustomFee)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = r.copyRows(ctx, tx, "items", []string{"order_uid", "date_created", "chrt_id", "track_number", "price", "rid", "name",
+		"sale", "size", "total_price", "nm_id", "brand", "status"},
+		fresh, func(o *domain.Order, emit func(...any) error) error {
+			for _, item := range o.Items {
+				err := emit(o.OrderUID, o.DateCreated, item.ChrtID, item.TrackNumber, item.Price, item.RID, item.Name,
+					item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	// created_at is left to the column default, the database clock that
+	// insertVersion stamps later versions with
+	source := domain.SourceFromContext(ctx)
+	err = r.copyRows(ctx, tx, "order_versions", []string{"order_uid", "version", "source", "snapshot"},
+		fresh, func(o *domain.Order, emit func(...any) error) error {
+			snapshot, err := json.Marshal(o)
+			if err != nil {
+				return err
+			}
+			return emit(o.OrderUID, 1, source, string(snapshot))
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	_, qspan := startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Saved order batch",
+		slog.Int("saved", len(fresh)),
+		slog.Int("existing", len(existing)))
+	return existing, nil
+}
+
+// insertIndexRows inserts the order_index rows of chunk, skipping stored
+// ids, and marks the ids it inserted.
+func (r *OrderRepository) insertIndexRows(ctx context.Context, tx *sql.Tx, chunk []*domain.Order, inserted map[string]bool) (err error) {
+	values := make([]string, 0, len(chunk))
+	args := make([]any, 0, len(chunk)*2)
+	for i, o := range chunk {
+		values = append(values, fmt.Sprintf("($%d, $%d)", 2*i+1, 2*i+2))
+		args = append(args, o.OrderUID, o.DateCreated)
+	}
+
+	qctx, qspan := startQuery(ctx, "INSERT", "order_index")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := tx.QueryContext(qctx, `
+        INSERT INTO order_index (order_uid, date_created)
+        VALUES `+strings.Join(values, ", ")+`
+        ON CONFLICT (order_uid) DO NOTHING
+        RETURNING order_uid`, args...)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order index batch", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return fmt.Errorf("failed to insert order info: %w", err)
+		}
+		inserted[uid] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
 	return nil
 }
 
-func (r *OrderRepository) GetOrderByID(orderUID string) (*domain.Order, error) {
-	r.logger.Info("Attempting to get order by ID", slog.String("orderUID", orderUID))
-	// Optimization with JOIN
-	var order domain.Order
-	err := r.db.QueryRow(`
-        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard, 
+// insertOrderRows inserts the orders rows of chunk, whose ids insertIndexRows
+// has just claimed.
+func (r *OrderRepository) insertOrderRows(ctx context.Context, tx *sql.Tx, chunk []*domain.Order) (err error) {
+	const columns = 13
+	values := make([]string, 0, len(chunk))
+	args := make([]any, 0, len(chunk)*columns)
+	for i, o := range chunk {
+		n := i * columns
+		values = append(values, fmt.Sprintf(
+			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, to_tsvector('simple', $%d::text), to_tsvector('simple', $%d::text || ' ' || $%d::text))",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11, n+12, n+12, n+13))
+		public, private := domain.SearchTerms(o)
+		args = append(args, o.OrderUID, o.TrackNumber, o.Entry, o.Locale, o.InternalSignature,
+			o.CustomerID, o.DeliveryService, o.Shardkey, o.SmID, o.DateCreated, o.OofShard,
+			strings.Join(public, " "), strings.Join(private, " "))
+	}
+
+	qctx, qspan := startQuery(ctx, "INSERT", "orders")
+	defer func() { tracing.End(qspan, err) }()
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard,
+                            search_public, search_all)
+        VALUES `+strings.Join(values, ",\n               "), args...)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order batch", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+	return nil
+}
+
+// copyRows loads table with COPY FROM STDIN; rows calls emit for each row of
+// an order.
+func (r *OrderRepository) copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string,
+	orders []*domain.Order, rows func(o *domain.Order, emit func(...any) error) error) (err error) {
+	if len(orders) == 0 {
+		return nil
+	}
+	qctx, qspan := startQuery(ctx, "COPY", table)
+	defer func() { tracing.End(qspan, err) }()
+
+	stmt, err := tx.PrepareContext(qctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to start copy", slog.String("table", table), slog.String("error", err.Error()))
+		return fmt.Errorf("failed to copy %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	emit := func(args ...any) error {
+		_, err := stmt.ExecContext(qctx, args...)
+		return err
+	}
+	for _, o := range orders {
+		if err := rows(o, emit); err != nil {
+			r.logger.ErrorContext(ctx, "Failed to copy row", slog.String("table", table), slog.String("error", err.Error()))
+			return fmt.Errorf("failed to copy %s: %w", table, err)
+		}
+	}
+	if _, err := stmt.ExecContext(qctx); err != nil {
+		r.logger.ErrorContext(ctx, "Failed to finish copy", slog.String("table", table), slog.String("error", err.Error()))
+		return fmt.Errorf("failed to copy %s: %w", table, err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) GetOrderByID(ctx context.Context, orderUID string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetOrderByID",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	return r.getOrder(ctx, r.db, orderUID)
+}
+
+// getOrder reads an order through db, e.g. a transaction holding its lock.
+func (r *OrderRepository) getOrder(ctx context.Context, db querier, orderUID string) (_ *domain.Order, err error) {
+	r.logger.InfoContext(ctx, "Attempting to get order by ID", slog.String("orderUID", orderUID))
+	// order_index gives date_created, with which every other table is pruned
+	// to the order's partition while the query runs
+	var (
+		order     domain.Order
+		deletedAt sql.NullTime
+		reason    sql.NullString
+	)
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	err = db.QueryRowContext(qctx, `
+        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+				o.deleted_at, o.delete_reason,
 				d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
 				p.transaction, p.request_id, p.currency, p.provider, p.amount, 
 				p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
-        FROM orders o
-        JOIN delivery d ON o.order_uid = d.order_uid
-        JOIN payment p ON o.order_uid = p.order_uid
-        WHERE o.order_uid = $1`, orderUID).Scan(
+        FROM order_index x
+        JOIN orders o ON o.order_uid = x.order_uid AND o.date_created = x.date_created
+        JOIN delivery d ON d.order_uid = x.order_uid AND d.date_created = x.date_created
+        JOIN payment p ON p.order_uid = x.order_uid AND p.date_created = x.date_created
+        WHERE x.order_uid = $1`, orderUID).Scan(
 		&order.OrderUID, &order.TrackNumber, &order.Entry, &order.Locale, &order.InternalSignature,
 		&order.CustomerID, &order.DeliveryService, &order.Shardkey, &order.SmID, &order.DateCreated, &order.OofShard,
+		&deletedAt, &reason,
 		&order.Delivery.Name, &order.Delivery.Phone, &order.Delivery.Zip, &order.Delivery.City,
 		&order.Delivery.Address, &order.Delivery.Region, &order.Delivery.Email,
 		&order.Payment.Transaction, &order.Payment.RequestID, &order.Payment.Currency,
 		&order.Payment.Provider, &order.Payment.Amount, &order.Payment.PaymentDt, &order.Payment.Bank,
 		&order.Payment.DeliveryCost, &order.Payment.GoodsTotal, &order.Payment.CustomFee)
+	tracing.End(qspan, err)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			r.logger.Info("Order not found", slog.String("orderUID", orderUID))
+			r.logger.InfoContext(ctx, "Order not found", slog.String("orderUID", orderUID))
 			return nil, nil
 		}
-		r.logger.Error("Failed to get order", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to get order", slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to get order: %w", err)
 	}
+	order.Deletion = deletion(deletedAt, reason)
 
 	// Get Items
-	rows, err := r.db.Query(`
+	qctx, qspan = startQuery(ctx, "SELECT", "items")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := db.QueryContext(qctx, `
         SELECT chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
-        FROM items WHERE order_uid = $1`, orderUID)
+        FROM items WHERE order_uid = $1 AND date_created = $2 ORDER BY item_id`, orderUID, order.DateCreated)
 	if err != nil {
-		r.logger.Error("Failed to query items", slog.String("error", err.Error()))
+		r.logger.ErrorContext(ctx, "Failed to query items", slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to query items: %w", err)
 	}
 	defer rows.Close()
@@ -132,58 +426,82 @@ func (r *OrderRepository) GetOrderByID(orderUID string) (*domain.Order, error) {
 			&item.ChrtID, &item.TrackNumber, &item.Price, &item.RID, &item.Name,
 			&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status)
 		if err != nil {
-			r.logger.Error("Failed to scan item", slog.String("error", err.Error()))
+			r.logger.ErrorContext(ctx, "Failed to scan item", slog.String("error", err.Error()))
 			return nil, fmt.Errorf("failed to scan item: %w", err)
 		}
 		order.Items = append(order.Items, item)
 	}
 
-	r.logger.Info("Successfully retrieved order", slog.String("orderUID", orderUID))
+	r.logger.InfoContext(ctx, "Successfully retrieved order", slog.String("orderUID", orderUID))
 	return &order, nil
 }
 
-func (r *OrderRepository) GetAllOrders() ([]*domain.Order, error) {
-	r.logger.Info("Attempting to get all orders")
+// GetAllOrders returns the orders that are not cancelled.
+func (r *OrderRepository) GetAllOrders(ctx context.Context) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetAllOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	defer func() { tracing.End(span, err) }()
 
-	rows, err := r.db.Query(`
+	r.logger.InfoContext(ctx, "Attempting to get all orders")
+
+	// the query spans last until their rows are read
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	rows, err := r.db.QueryContext(qctx, `
         SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, 
                o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+               o.deleted_at, o.delete_reason,
                d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
                p.transaction, p.request_id, p.currency, p.provider, p.amount, 
                p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
         FROM orders o
-        JOIN delivery d ON o.order_uid = d.order_uid
-        JOIN payment p ON o.order_uid = p.order_uid`)
+        JOIN delivery d ON d.order_uid = o.order_uid AND d.date_created = o.date_created
+        JOIN payment p ON p.order_uid = o.order_uid AND p.date_created = o.date_created
+        WHERE o.deleted_at IS NULL`)
 	if err != nil {
-		r.logger.Error("Failed to query all orders", slog.String("error", err.Error()))
+		tracing.End(qspan, err)
+		r.logger.ErrorContext(ctx, "Failed to query all orders", slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to query all orders: %w", err)
 	}
 	defer rows.Close()
 
 	orders := make([]*domain.Order, 0)
 	for rows.Next() {
-		var o domain.Order
+		var (
+			o         domain.Order
+			deletedAt sql.NullTime
+			reason    sql.NullString
+		)
 		err := rows.Scan(
 			&o.OrderUID, &o.TrackNumber, &o.Entry, &o.Locale, &o.InternalSignature,
 			&o.CustomerID, &o.DeliveryService, &o.Shardkey, &o.SmID, &o.DateCreated, &o.OofShard,
+			&deletedAt, &reason,
 			&o.Delivery.Name, &o.Delivery.Phone, &o.Delivery.Zip, &o.Delivery.City,
 			&o.Delivery.Address, &o.Delivery.Region, &o.Delivery.Email,
 			&o.Payment.Transaction, &o.Payment.RequestID, &o.Payment.Currency,
 			&o.Payment.Provider, &o.Payment.Amount, &o.Payment.PaymentDt, &o.Payment.Bank,
 			&o.Payment.DeliveryCost, &o.Payment.GoodsTotal, &o.Payment.CustomFee)
 		if err != nil {
-			r.logger.Error("Failed to scan order", slog.String("error", err.Error()))
+			tracing.End(qspan, err)
+			r.logger.ErrorContext(ctx, "Failed to scan order", slog.String("error", err.Error()))
 			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
+		o.Deletion = deletion(deletedAt, reason)
 		orders = append(orders, &o)
 	}
-	// Get items singly
-	itemRows, err := r.db.Query(`
-        SELECT order_uid, chrt_id, track_number, price, rid, name, 
-               sale, size, total_price, nm_id, brand, status
-        FROM items`)
+	tracing.End(qspan, rows.Err())
+
+	// Get items singly, of the same live orders
+	qctx, qspan = startQuery(ctx, "SELECT", "items")
+	itemRows, err := r.db.QueryContext(qctx, `
+        SELECT i.order_uid, i.chrt_id, i.track_number, i.price, i.rid, i.name,
+               i.sale, i.size, i.total_price, i.nm_id, i.brand, i.status
+        FROM items i
+        JOIN orders o ON o.order_uid = i.order_uid AND o.date_created = i.date_created
+        WHERE o.deleted_at IS NULL
+        ORDER BY i.item_id`)
 	if err != nil {
-		r.logger.Error("Failed to query items", slog.String("error", err.Error()))
+		tracing.End(qspan, err)
+		r.logger.ErrorContext(ctx, "Failed to query items", slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to query items: %w", err)
 	}
 	defer itemRows.Close()
@@ -196,16 +514,592 @@ func (r *OrderRepository) GetAllOrders() ([]*domain.Order, error) {
 			&orderUID, &item.ChrtID, &item.TrackNumber, &item.Price, &item.RID, &item.Name,
 			&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status)
 		if err != nil {
-			r.logger.Error("Failed to scan item", slog.String("error", err.Error()))
+			tracing.End(qspan, err)
+			r.logger.ErrorContext(ctx, "Failed to scan item", slog.String("error", err.Error()))
 			return nil, fmt.Errorf("failed to scan item: %w", err)
 		}
 		itemMap[orderUID] = append(itemMap[orderUID], item)
 	}
+	tracing.End(qspan, itemRows.Err())
 	// then we mapping items with orders by uuid
 	for _, order := range orders {
 		order.Items = itemMap[order.OrderUID]
 	}
 
-	r.logger.Info("Successfully retrieved all orders", slog.Int("count", len(orders)))
+	r.logger.InfoContext(ctx, "Successfully retrieved all orders", slog.Int("count", len(orders)))
+	return orders, nil
+}
+
+// SearchOrders runs the text part of q against the search_public or
+// search_all vector (GIN indexed) and the filters as plain conditions.
+func (r *OrderRepository) SearchOrders(ctx context.Context, q domain.SearchQuery) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SearchOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	defer func() { tracing.End(span, err) }()
+
+	q = q.WithDefaults()
+	where, args := searchConditions(q)
+	args = append(args, q.Limit, q.Offset)
+
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	rows, err := r.db.QueryContext(qctx, fmt.Sprintf(`
+        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature,
+               o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+               o.deleted_at, o.delete_reason,
+               d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+               p.transaction, p.request_id, p.currency, p.provider, p.amount,
+               p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
+        FROM orders o
+        JOIN delivery d ON d.order_uid = o.order_uid AND d.date_created = o.date_created
+        JOIN payment p ON p.order_uid = o.order_uid AND p.date_created = o.date_created
+        %s
+        ORDER BY o.date_created DESC, o.order_uid
+        LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		tracing.End(qspan, err)
+		r.logger.ErrorContext(ctx, "Failed to search orders", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to search orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := make([]*domain.Order, 0)
+	uids := make([]string, 0)
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			tracing.End(qspan, err)
+			r.logger.ErrorContext(ctx, "Failed to scan order", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+		uids = append(uids, o.OrderUID)
+	}
+	tracing.End(qspan, rows.Err())
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search orders: %w", err)
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+
+	if err := r.loadItems(ctx, r.db, orders, uids); err != nil {
+		return nil, err
+	}
+
+	r.logger.InfoContext(ctx, "Searched orders", slog.Int("count", len(orders)))
 	return orders, nil
 }
+
+// exportBatch is the number of orders fetched from the export cursor at a
+// time; only one batch is held in memory.
+const exportBatch = 500
+
+// StreamOrders passes every order matching the filters and text of q to fn,
+// newest first, reading them through a server-side cursor in batches of
+// exportBatch. Limit and Offset are ignored. The cursor runs in a read-only
+// repeatable-read transaction, so the export is a consistent snapshot.
+func (r *OrderRepository) StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.StreamOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	where, args := searchConditions(q)
+	qctx, qspan := startQuery(ctx, "DECLARE", "orders")
+	_, err = tx.ExecContext(qctx, fmt.Sprintf(`
+        DECLARE export_orders NO SCROLL CURSOR FOR
+        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature,
+               o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+               o.deleted_at, o.delete_reason,
+               d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+               p.transaction, p.request_id, p.currency, p.provider, p.amount,
+               p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
+        FROM orders o
+        JOIN delivery d ON d.order_uid = o.order_uid AND d.date_created = o.date_created
+        JOIN payment p ON p.order_uid = o.order_uid AND p.date_created = o.date_created
+        %s
+        ORDER BY o.date_created DESC, o.order_uid`, where), args...)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to declare export cursor", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to declare export cursor: %w", err)
+	}
+
+	count := 0
+	for {
+		orders, uids, err := r.fetchBatch(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(orders) == 0 {
+			break
+		}
+		if err := r.loadItems(ctx, tx, orders, uids); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if err := fn(order); err != nil {
+				return err
+			}
+		}
+		count += len(orders)
+	}
+
+	r.logger.InfoContext(ctx, "Streamed orders", slog.Int("count", count))
+	return nil
+}
+
+func (r *OrderRepository) fetchBatch(ctx context.Context, tx *sql.Tx) (_ []*domain.Order, _ []string, err error) {
+	qctx, qspan := startQuery(ctx, "FETCH", "orders")
+	defer func() { tracing.End(qspan, err) }()
+
+	rows, err := tx.QueryContext(qctx, fmt.Sprintf("FETCH %d FROM export_orders", exportBatch))
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to fetch from export cursor", slog.String("error", err.Error()))
+		return nil, nil, fmt.Errorf("failed to fetch orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := make([]*domain.Order, 0, exportBatch)
+	uids := make([]string, 0, exportBatch)
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to scan order", slog.String("error", err.Error()))
+			return nil, nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+		uids = append(uids, o.OrderUID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch orders: %w", err)
+	}
+	return orders, uids, nil
+}
+
+// querier is satisfied by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadItems fills in the items of orders, whose ids are uids, with one query
+// limited to the partitions the orders' dates span.
+func (r *OrderRepository) loadItems(ctx context.Context, db querier, orders []*domain.Order, uids []string) (err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "items")
+	defer func() { tracing.End(qspan, err) }()
+
+	first, last := orders[0].DateCreated, orders[0].DateCreated
+	for _, o := range orders[1:] {
+		if o.DateCreated.Before(first) {
+			first = o.DateCreated
+		}
+		if o.DateCreated.After(last) {
+			last = o.DateCreated
+		}
+	}
+	itemRows, err := db.QueryContext(qctx, `
+        SELECT order_uid, chrt_id, track_number, price, rid, name,
+               sale, size, total_price, nm_id, brand, status
+        FROM items WHERE order_uid = ANY($1) AND date_created BETWEEN $2 AND $3
+        ORDER BY item_id`, pq.Array(uids), first, last)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to query items", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to query items: %w", err)
+	}
+	defer itemRows.Close()
+
+	itemMap := make(map[string][]domain.Item)
+	for itemRows.Next() {
+		var item domain.Item
+		var orderUID string
+		err := itemRows.Scan(
+			&orderUID, &item.ChrtID, &item.TrackNumber, &item.Price, &item.RID, &item.Name,
+			&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to scan item", slog.String("error", err.Error()))
+			return fmt.Errorf("failed to scan item: %w", err)
+		}
+		itemMap[orderUID] = append(itemMap[orderUID], item)
+	}
+	if err := itemRows.Err(); err != nil {
+		return fmt.Errorf("failed to query items: %w", err)
+	}
+	for _, order := range orders {
+		order.Items = itemMap[order.OrderUID]
+	}
+	return nil
+}
+
+// scanOrder reads the order, delivery and payment columns in the order the
+// SELECTs above list them.
+func scanOrder(rows *sql.Rows) (*domain.Order, error) {
+	var (
+		o         domain.Order
+		deletedAt sql.NullTime
+		reason    sql.NullString
+	)
+	err := rows.Scan(
+		&o.OrderUID, &o.TrackNumber, &o.Entry, &o.Locale, &o.InternalSignature,
+		&o.CustomerID, &o.DeliveryService, &o.Shardkey, &o.SmID, &o.DateCreated, &o.OofShard,
+		&deletedAt, &reason,
+		&o.Delivery.Name, &o.Delivery.Phone, &o.Delivery.Zip, &o.Delivery.City,
+		&o.Delivery.Address, &o.Delivery.Region, &o.Delivery.Email,
+		&o.Payment.Transaction, &o.Payment.RequestID, &o.Payment.Currency,
+		&o.Payment.Provider, &o.Payment.Amount, &o.Payment.PaymentDt, &o.Payment.Bank,
+		&o.Payment.DeliveryCost, &o.Payment.GoodsTotal, &o.Payment.CustomFee)
+	o.Deletion = deletion(deletedAt, reason)
+	return &o, err
+}
+
+func deletion(deletedAt sql.NullTime, reason sql.NullString) *domain.Deletion {
+	if !deletedAt.Valid {
+		return nil
+	}
+	return &domain.Deletion{DeletedAt: deletedAt.Time, Reason: reason.String}
+}
+
+// searchConditions turns q into a WHERE clause over orders o, delivery d and
+// payment p, with its arguments numbered from $1.
+func searchConditions(q domain.SearchQuery) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if !q.IncludeDeleted {
+		conds = append(conds, "o.deleted_at IS NULL")
+	}
+
+	if words := domain.Tokenize(q.Text); len(words) > 0 {
+		column := "o.search_public"
+		if q.IncludePII {
+			column = "o.search_all"
+		}
+		add(column+" @@ plainto_tsquery('simple', $%d)", strings.Join(words, " "))
+	}
+	if q.CustomerID != "" {
+		add("o.customer_id = $%d", q.CustomerID)
+	}
+	if q.DeliveryService != "" {
+		add("lower(o.delivery_service) = lower($%d)", q.DeliveryService)
+	}
+	if q.City != "" {
+		add("lower(d.city) = lower($%d)", q.City)
+	}
+	if q.Currency != "" {
+		add("lower(p.currency) = lower($%d)", q.Currency)
+	}
+	if !q.From.IsZero() {
+		add("o.date_created >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("o.date_created < $%d", q.To)
+	}
+	if q.Brand != "" {
+		add("EXISTS (SELECT 1 FROM items i WHERE i.order_uid = o.order_uid AND i.date_created = o.date_created AND lower(i.brand) = lower($%d))", q.Brand)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// UpdateOrder rewrites the order's rows and adds a version in one
+// transaction. The order_index row is locked first, so concurrent updates of
+// one order are numbered one after the other and a repeated update is seen
+// as unchanged. A new date_created moves the rows to another partition: the
+// details are deleted before the orders row moves and inserted after.
+func (r *OrderRepository) UpdateOrder(ctx context.Context, order *domain.Order) (_ *domain.Version, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.UpdateOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	if err := r.ensurePartitions(ctx, order.DateCreated); err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created, found, err := lockOrder(ctx, tx, order.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderNotFound)
+	}
+	var deleted bool
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	err = tx.QueryRowContext(qctx, `SELECT deleted_at IS NOT NULL FROM orders WHERE order_uid = $1 AND date_created = $2`,
+		order.OrderUID, created).Scan(&deleted)
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	if deleted {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderDeleted)
+	}
+
+	var (
+		latest   int
+		snapshot []byte
+	)
+	qctx, qspan = startQuery(ctx, "SELECT", "order_versions")
+	err = tx.QueryRowContext(qctx, `
+        SELECT version, snapshot FROM order_versions
+        WHERE order_uid = $1 ORDER BY version DESC LIMIT 1`, order.OrderUID).Scan(&latest, &snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if latest > 0 {
+		var stored domain.Order
+		if err := json.Unmarshal(snapshot, &stored); err != nil {
+			return nil, fmt.Errorf("failed to decode order version %d: %w", latest, err)
+		}
+		if stored.Equal(order) {
+			return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderUnchanged)
+		}
+	}
+
+	for _, table := range []string{"delivery", "payment", "items"} {
+		qctx, qspan = startQuery(ctx, "DELETE", table)
+		_, err = tx.ExecContext(qctx, `DELETE FROM `+table+` WHERE order_uid = $1 AND date_created = $2`, order.OrderUID, created)
+		tracing.End(qspan, err)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to delete order details", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+	public, private := domain.SearchTerms(order)
+	qctx, qspan = startQuery(ctx, "UPDATE", "orders")
+	_, err = tx.ExecContext(qctx, `
+        UPDATE orders SET track_number = $2, entry = $3, locale = $4, internal_signature = $5, customer_id = $6,
+                          delivery_service = $7, shardkey = $8, sm_id = $9, date_created = $10, oof_shard = $11,
+                          pii_purged_at = NULL,
+                          search_public = to_tsvector('simple', $12::text),
+                          search_all = to_tsvector('simple', $12::text || ' ' || $13::text)
+        WHERE order_uid = $1 AND date_created = $14`,
+		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature,
+		order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard,
+		strings.Join(public, " "), strings.Join(private, " "), created)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to update order info", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to update order info: %w", err)
+	}
+	qctx, qspan = startQuery(ctx, "UPDATE", "order_index")
+	_, err = tx.ExecContext(qctx, `UPDATE order_index SET date_created = $2 WHERE order_uid = $1`, order.OrderUID, order.DateCreated)
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update order index: %w", err)
+	}
+	if err := r.insertDetails(ctx, tx, order); err != nil {
+		return nil, err
+	}
+	v, err := r.insertVersion(ctx, tx, order, latest+1)
+	if err != nil {
+		return nil, err
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully updated order",
+		slog.String("orderUID", order.OrderUID),
+		slog.Int("version", v.Version))
+	return v, nil
+}
+
+// CancelOrder marks the order as deleted and records the cancelled order as
+// a new version. Its rows and versions are kept until the retention job
+// removes them.
+func (r *OrderRepository) CancelOrder(ctx context.Context, c domain.Cancellation) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.CancelOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", c.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created, found, err := lockOrder(ctx, tx, c.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderNotFound)
+	}
+	qctx, qspan := startQuery(ctx, "UPDATE", "orders")
+	res, err := tx.ExecContext(qctx, `
+        UPDATE orders SET deleted_at = now(), delete_reason = $3
+        WHERE order_uid = $1 AND date_created = $2 AND deleted_at IS NULL`, c.OrderUID, created, c.Reason)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to cancel order", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to cancel order: %w", err)
+	}
+	cancelled, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel order: %w", err)
+	}
+	if cancelled == 0 {
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderDeleted)
+	}
+
+	order, err := r.getOrder(ctx, tx, c.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderNotFound)
+	}
+	var latest int
+	qctx, qspan = startQuery(ctx, "SELECT", "order_versions")
+	err = tx.QueryRowContext(qctx, `SELECT COALESCE(MAX(version), 0) FROM order_versions WHERE order_uid = $1`,
+		c.OrderUID).Scan(&latest)
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if _, err := r.insertVersion(ctx, tx, order, latest+1); err != nil {
+		return nil, err
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully cancelled order",
+		slog.String("orderUID", c.OrderUID),
+		slog.String("reason", c.Reason))
+	return order, nil
+}
+
+// insertVersion records order as the given version, stamped by the database
+// clock and tagged with the context's source.
+func (r *OrderRepository) insertVersion(ctx context.Context, tx *sql.Tx, order *domain.Order, version int) (*domain.Version, error) {
+	snapshot, err := json.Marshal(order)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode order version: %w", err)
+	}
+	v := &domain.Version{
+		OrderUID: order.OrderUID,
+		Version:  version,
+		Source:   domain.SourceFromContext(ctx),
+		Order:    order,
+	}
+	qctx, qspan := startQuery(ctx, "INSERT", "order_versions")
+	err = tx.QueryRowContext(qctx, `
+        INSERT INTO order_versions (order_uid, version, source, snapshot)
+        VALUES ($1, $2, $3, $4)
+        RETURNING created_at`, v.OrderUID, v.Version, v.Source, snapshot).Scan(&v.CreatedAt)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order version", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to insert order version: %w", err)
+	}
+	return v, nil
+}
+
+func (r *OrderRepository) OrderVersions(ctx context.Context, orderUID string) (_ []*domain.Version, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.OrderVersions",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	return r.orderVersions(ctx, r.db, orderUID)
+}
+
+func (r *OrderRepository) orderVersions(ctx context.Context, db querier, orderUID string) (_ []*domain.Version, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "order_versions")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := db.QueryContext(qctx, `
+        SELECT version, source, created_at, snapshot
+        FROM order_versions WHERE order_uid = $1 ORDER BY version`, orderUID)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to query order versions", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to query order versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]*domain.Version, 0)
+	for rows.Next() {
+		v := &domain.Version{OrderUID: orderUID}
+		var snapshot []byte
+		if err := rows.Scan(&v.Version, &v.Source, &v.CreatedAt, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to scan order version: %w", err)
+		}
+		if err := json.Unmarshal(snapshot, &v.Order); err != nil {
+			return nil, fmt.Errorf("failed to decode order version %d: %w", v.Version, err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate order versions: %w", err)
+	}
+	return versions, nil
+}
+
+func (r *OrderRepository) GetOrderAsOf(ctx context.Context, orderUID string, t time.Time) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetOrderAsOf",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	var snapshot []byte
+	qctx, qspan := startQuery(ctx, "SELECT", "order_versions")
+	err = r.db.QueryRowContext(qctx, `
+        SELECT snapshot FROM order_versions
+        WHERE order_uid = $1 AND created_at <= $2
+        ORDER BY version DESC LIMIT 1`, orderUID, t).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		tracing.End(qspan, nil)
+		return nil, nil
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to get order version", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to get order version: %w", err)
+	}
+	var order domain.Order
+	if err := json.Unmarshal(snapshot, &order); err != nil {
+		return nil, fmt.Errorf("failed to decode order version: %w", err)
+	}
+	return &order, nil
+}
+
+func startQuery(ctx context.Context, operation, table string) (context.Context, trace.Span) {
+	return tracing.StartQuery(ctx, tracer, semconv.DBSystemPostgreSQL, operation, table)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
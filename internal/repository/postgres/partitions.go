@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+)
+
+// orders, delivery, payment and items are partitioned by month of
+// date_created (migration 000006). A partition must exist before a row can
+// go into it, so writes call ensurePartitions first; MaintainPartitions
+// creates the coming months ahead of time, keeping the DDL off the write
+// path in the normal case.
+
+// ensurePartitions creates the partitions for the months of dates that this
+// repository has not seen yet. It runs outside the caller's transaction:
+// creating a partition locks the parent table, which should not be held for
+// longer than the DDL itself.
+func (r *OrderRepository) ensurePartitions(ctx context.Context, dates ...time.Time) error {
+	for _, t := range dates {
+		month := monthOf(t)
+		if _, ok := r.months.Load(month); ok {
+			continue
+		}
+		qctx, qspan := startQuery(ctx, "SELECT", "create_order_partitions")
+		_, err := r.db.ExecContext(qctx, `SELECT create_order_partitions($1::timestamp)`, month)
+		tracing.End(qspan, err)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to create partitions",
+				slog.String("month", month.Format("2006-01")),
+				slog.String("error", err.Error()))
+			return fmt.Errorf("failed to create partitions for %s: %w", month.Format("2006-01"), err)
+		}
+		r.months.Store(month, struct{}{})
+	}
+	return nil
+}
+
+// CreatePartitions makes sure the partitions for the months months starting
+// with the month of from exist.
+func (r *OrderRepository) CreatePartitions(ctx context.Context, from time.Time, months int) error {
+	dates := make([]time.Time, months)
+	for i := range dates {
+		dates[i] = monthOf(from).AddDate(0, i, 0)
+	}
+	return r.ensurePartitions(ctx, dates...)
+}
+
+// MaintainPartitions keeps partitions for the current month and the ahead
+// months after it, checking every interval, until stop is called.
+func (r *OrderRepository) MaintainPartitions(ahead int, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// a failure is logged by ensurePartitions and retried on the next
+			// tick; writes create what they need meanwhile
+			r.CreatePartitions(ctx, time.Now().UTC(), ahead+1)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// monthOf returns the first instant of t's month as Postgres sees it: a
+// TIMESTAMP column keeps the wall clock of the value written, whatever its
+// zone.
+func monthOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// lockOrder locks the order's order_index row, which every write of a stored
+// order takes first, and returns the order's date_created, the partition key
+// of its other rows. found is false for an unknown order.
+func lockOrder(ctx context.Context, tx *sql.Tx, orderUID string) (created time.Time, found bool, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "order_index")
+	err = tx.QueryRowContext(qctx, `SELECT date_created FROM order_index WHERE order_uid = $1 FOR UPDATE`,
+		orderUID).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		tracing.End(qspan, nil)
+		return time.Time{}, false, nil
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to lock order: %w", err)
+	}
+	return created, true, nil
+}
@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RestoreOrder stores an order moved here from another database as it was
+// there: with its cancellation and its versions, sources and creation times
+// included. It fails with domain.ErrOrderExists for an order stored already.
+func (r *OrderRepository) RestoreOrder(ctx context.Context, order *domain.Order, versions []*domain.Version) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.RestoreOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	if err := r.ensurePartitions(ctx, order.DateCreated); err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qctx, qspan := startQuery(ctx, "INSERT", "order_index")
+	_, err = tx.ExecContext(qctx, `INSERT INTO order_index (order_uid, date_created) VALUES ($1, $2)`,
+		order.OrderUID, order.DateCreated)
+	tracing.End(qspan, err)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to restore order: %w", domain.ErrOrderExists)
+		}
+		return fmt.Errorf("failed to restore order: %w", err)
+	}
+
+	var (
+		deletedAt sql.NullTime
+		reason    sql.NullString
+	)
+	if order.Deletion != nil {
+		deletedAt = sql.NullTime{Time: order.Deletion.DeletedAt, Valid: true}
+		reason = sql.NullString{String: order.Deletion.Reason, Valid: true}
+	}
+	public, private := domain.SearchTerms(order)
+	qctx, qspan = startQuery(ctx, "INSERT", "orders")
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard,
+                            search_public, search_all, deleted_at, delete_reason)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,
+                to_tsvector('simple', $12::text), to_tsvector('simple', $12::text || ' ' || $13::text), $14, $15)`,
+		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature,
+		order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard,
+		strings.Join(public, " "), strings.Join(private, " "), deletedAt, reason)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order info", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+	if err := r.insertDetails(ctx, tx, order); err != nil {
+		return err
+	}
+	for _, v := range versions {
+		snapshot, err := json.Marshal(v.Order)
+		if err != nil {
+			return fmt.Errorf("failed to encode order version: %w", err)
+		}
+		qctx, qspan = startQuery(ctx, "INSERT", "order_versions")
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO order_versions (order_uid, version, source, created_at, snapshot)
+            VALUES ($1, $2, $3, $4, $5)`, v.OrderUID, v.Version, v.Source, v.CreatedAt, snapshot)
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to insert order version: %w", err)
+		}
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	r.logger.InfoContext(ctx, "Restored order",
+		slog.String("orderUID", order.OrderUID),
+		slog.Int("versions", len(versions)))
+	return nil
+}
+
+// DeleteMovedOrder deletes the order unless it gained versions after
+// version. The order_index row lock orders it with UpdateOrder and
+// CancelOrder, which take the same lock.
+func (r *OrderRepository) DeleteMovedOrder(ctx context.Context, orderUID string, version int) (_ bool, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.DeleteMovedOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, found, err := lockOrder(ctx, tx, orderUID)
+	if err != nil || !found {
+		return false, err
+	}
+	var latest int
+	qctx, qspan := startQuery(ctx, "SELECT", "order_versions")
+	err = tx.QueryRowContext(qctx, `SELECT COALESCE(MAX(version), 0) FROM order_versions WHERE order_uid = $1`,
+		orderUID).Scan(&latest)
+	tracing.End(qspan, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if latest != version {
+		return false, nil
+	}
+
+	// the foreign keys remove the order's rows and versions with its index row
+	qctx, qspan = startQuery(ctx, "DELETE", "order_index")
+	_, err = tx.ExecContext(qctx, `DELETE FROM order_index WHERE order_uid = $1`, orderUID)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to delete moved order", slog.String("error", err.Error()))
+		return false, fmt.Errorf("failed to delete moved order: %w", err)
+	}
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	r.logger.InfoContext(ctx, "Deleted moved order", slog.String("orderUID", orderUID))
+	return true, nil
+}
@@ -0,0 +1,303 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PurgePII erases the oldest due orders first, each in its own transaction,
+// so a long purge does not hold locks on the whole batch.
+func (r *OrderRepository) PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.PurgePII",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	defer func() { tracing.End(span, err) }()
+
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT order_uid FROM orders
+        WHERE pii_purged_at IS NULL AND date_created < $1
+        ORDER BY date_created LIMIT $2`, before, limit)
+	if err != nil {
+		tracing.End(qspan, err)
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	var due []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			tracing.End(qspan, err)
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		due = append(due, uid)
+	}
+	rows.Close()
+	tracing.End(qspan, rows.Err())
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate orders: %w", err)
+	}
+
+	ids := make([]string, 0, len(due))
+	for _, uid := range due {
+		purged, err := r.purgeOrder(ctx, uid, erase)
+		if err != nil {
+			return ids, err
+		}
+		if purged {
+			ids = append(ids, uid)
+		}
+	}
+	r.logger.InfoContext(ctx, "Purged personal data", slog.Int("count", len(ids)))
+	return ids, nil
+}
+
+// purgeOrder locks the order_index row, so an update cannot slip in between
+// reading and rewriting, and reports false if the order went away or was
+// purged meanwhile.
+func (r *OrderRepository) purgeOrder(ctx context.Context, uid string, erase func(*domain.Order) *domain.Order) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created, found, err := lockOrder(ctx, tx, uid)
+	if err != nil || !found {
+		return false, err
+	}
+	var purged bool
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	err = tx.QueryRowContext(qctx, `SELECT pii_purged_at IS NOT NULL FROM orders WHERE order_uid = $1 AND date_created = $2`,
+		uid, created).Scan(&purged)
+	tracing.End(qspan, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to get order: %w", err)
+	}
+	if purged {
+		return false, nil
+	}
+	// through tx: another connection could be what the pool is waiting for
+	stored, err := r.getOrder(ctx, tx, uid)
+	if err != nil || stored == nil {
+		return false, err
+	}
+	order := erase(stored)
+
+	public, private := domain.SearchTerms(order)
+	qctx, qspan = startQuery(ctx, "UPDATE", "orders")
+	_, err = tx.ExecContext(qctx, `
+        UPDATE orders SET customer_id = $2, pii_purged_at = now(),
+                          search_public = to_tsvector('simple', $3::text),
+                          search_all = to_tsvector('simple', $3::text || ' ' || $4::text)
+        WHERE order_uid = $1 AND date_created = $5`,
+		uid, order.CustomerID, strings.Join(public, " "), strings.Join(private, " "), created)
+	tracing.End(qspan, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to purge order info: %w", err)
+	}
+	qctx, qspan = startQuery(ctx, "UPDATE", "delivery")
+	_, err = tx.ExecContext(qctx, `
+        UPDATE delivery SET name = $2, phone = $3, zip = $4, city = $5, address = $6, region = $7, email = $8
+        WHERE order_uid = $1 AND date_created = $9`,
+		uid, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip, order.Delivery.City,
+		order.Delivery.Address, order.Delivery.Region, order.Delivery.Email, created)
+	tracing.End(qspan, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to purge delivery info: %w", err)
+	}
+
+	versions, err := r.orderVersions(ctx, tx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range versions {
+		snapshot, err := json.Marshal(erase(v.Order))
+		if err != nil {
+			return false, fmt.Errorf("failed to encode order version: %w", err)
+		}
+		qctx, qspan = startQuery(ctx, "UPDATE", "order_versions")
+		_, err = tx.ExecContext(qctx, `UPDATE order_versions SET snapshot = $3 WHERE order_uid = $1 AND version = $2`,
+			uid, v.Version, snapshot)
+		tracing.End(qspan, err)
+		if err != nil {
+			return false, fmt.Errorf("failed to purge order version: %w", err)
+		}
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// DeleteOrders removes the order_index rows and relies on ON DELETE CASCADE
+// to remove the orders, delivery, payment, items and versions with them.
+func (r *OrderRepository) DeleteOrders(ctx context.Context, ids []string) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.DeleteOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.Int("orders.count", len(ids))))
+	defer func() { tracing.End(span, err) }()
+
+	qctx, qspan := startQuery(ctx, "DELETE", "order_index")
+	_, err = r.db.ExecContext(qctx, `DELETE FROM order_index WHERE order_uid = ANY($1)`, pq.Array(ids))
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to delete orders", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to delete orders: %w", err)
+	}
+	r.logger.InfoContext(ctx, "Deleted orders", slog.Int("count", len(ids)))
+	return nil
+}
+
+// ArchiveOrders writes snapshots to order_archive, creating the yearly
+// partitions the orders fall into first.
+func (r *OrderRepository) ArchiveOrders(ctx context.Context, orders []*domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.ArchiveOrders",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.Int("orders.count", len(orders))))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	years := make(map[int]bool)
+	for _, order := range orders {
+		year := order.DateCreated.UTC().Year()
+		if years[year] {
+			continue
+		}
+		years[year] = true
+		partition := fmt.Sprintf("order_archive_%d", year)
+		qctx, qspan := startQuery(ctx, "CREATE", partition)
+		_, err = tx.ExecContext(qctx, fmt.Sprintf(`
+            CREATE TABLE IF NOT EXISTS %s PARTITION OF order_archive
+            FOR VALUES FROM ('%d-01-01') TO ('%d-01-01')`, partition, year, year+1))
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to create archive partition: %w", err)
+		}
+	}
+
+	for _, order := range orders {
+		snapshot, err := json.Marshal(order)
+		if err != nil {
+			return fmt.Errorf("failed to encode archived order: %w", err)
+		}
+		qctx, qspan := startQuery(ctx, "INSERT", "order_archive")
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO order_archive (order_uid, date_created, snapshot)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (order_uid, date_created) DO UPDATE
+            SET archived_at = now(), snapshot = EXCLUDED.snapshot`,
+			order.OrderUID, order.DateCreated.UTC(), snapshot)
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to archive order: %w", err)
+		}
+	}
+
+	_, qspan := startQuery(ctx, "COMMIT", "order_archive")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ArchivedOrder looks in every partition through their order_uid indexes;
+// the latest copy wins if the order was archived under two dates.
+func (r *OrderRepository) ArchivedOrder(ctx context.Context, orderUID string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.ArchivedOrder",
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	var snapshot []byte
+	qctx, qspan := startQuery(ctx, "SELECT", "order_archive")
+	err = r.db.QueryRowContext(qctx, `
+        SELECT snapshot FROM order_archive WHERE order_uid = $1
+        ORDER BY archived_at DESC LIMIT 1`, orderUID).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		tracing.End(qspan, nil)
+		return nil, nil
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived order: %w", err)
+	}
+	var order domain.Order
+	if err := json.Unmarshal(snapshot, &order); err != nil {
+		return nil, fmt.Errorf("failed to decode archived order: %w", err)
+	}
+	return &order, nil
+}
+
+func (r *OrderRepository) SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error {
+	qctx, qspan := startQuery(ctx, "INSERT", "retention_runs")
+	err := r.db.QueryRowContext(qctx, `
+        INSERT INTO retention_runs (triggered_by, started_at, finished_at, archive, archive_before, purge_pii_before,
+                                    archived, pii_purged, error)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        RETURNING id`,
+		run.Trigger, run.StartedAt, run.FinishedAt, run.Archive, nullTime(run.ArchiveBefore), nullTime(run.PurgePIIBefore),
+		run.Archived, run.PIIPurged, run.Error).Scan(&run.ID)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to insert retention run: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) RetentionRuns(ctx context.Context, limit int) (_ []*domain.RetentionRun, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "retention_runs")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT id, triggered_by, started_at, finished_at, archive, archive_before, purge_pii_before,
+               archived, pii_purged, error
+        FROM retention_runs ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query retention runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make([]*domain.RetentionRun, 0)
+	for rows.Next() {
+		var (
+			run                           domain.RetentionRun
+			archiveBefore, purgePIIBefore sql.NullTime
+		)
+		err := rows.Scan(&run.ID, &run.Trigger, &run.StartedAt, &run.FinishedAt, &run.Archive,
+			&archiveBefore, &purgePIIBefore, &run.Archived, &run.PIIPurged, &run.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan retention run: %w", err)
+		}
+		run.ArchiveBefore, run.PurgePIIBefore = archiveBefore.Time, purgePIIBefore.Time
+		runs = append(runs, &run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate retention runs: %w", err)
+	}
+	return runs, nil
+}
+
+// nullTime stores the zero time, a disabled cutoff, as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,770 @@
+// Package repotest is a conformance suite shared by every
+// service.OrderRepository implementation.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+// Factory returns an empty repository. It is called once per subtest.
+type Factory func(t *testing.T) service.OrderRepository
+
+func Run(t *testing.T, newRepo Factory) {
+	t.Run("SaveAndGet", func(t *testing.T) { testSaveAndGet(t, newRepo(t)) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, newRepo(t)) })
+	t.Run("Duplicate", func(t *testing.T) { testDuplicate(t, newRepo(t)) })
+	t.Run("SaveBatch", func(t *testing.T) { testSaveBatch(t, newRepo(t)) })
+	t.Run("GetAll", func(t *testing.T) { testGetAll(t, newRepo(t)) })
+	t.Run("GetAllEmpty", func(t *testing.T) { testGetAllEmpty(t, newRepo(t)) })
+	t.Run("ReturnsCopies", func(t *testing.T) { testReturnsCopies(t, newRepo(t)) })
+	t.Run("Search", func(t *testing.T) { testSearch(t, newRepo(t)) })
+	t.Run("Stream", func(t *testing.T) { testStream(t, newRepo(t)) })
+	t.Run("Versions", func(t *testing.T) { testVersions(t, newRepo(t)) })
+	t.Run("BatchVersions", func(t *testing.T) { testBatchVersions(t, newRepo(t)) })
+	t.Run("Cancel", func(t *testing.T) { testCancel(t, newRepo(t)) })
+	t.Run("UpdateRacesCancel", func(t *testing.T) { testUpdateRacesCancel(t, newRepo(t)) })
+	t.Run("Retention", func(t *testing.T) { testRetention(t, newRepo(t)) })
+	t.Run("Rollups", func(t *testing.T) { testRollups(t, newRepo(t)) })
+}
+
+// NewOrder returns a valid order with n items and a unique id derived from uid.
+func NewOrder(uid string, n int) *domain.Order {
+	order := &domain.Order{
+		OrderUID:          uid,
+		TrackNumber:       "WBILMTESTTRACK",
+		Entry:             "WBIL",
+		Locale:            "en",
+		InternalSignature: "",
+		CustomerID:        "test",
+		DeliveryService:   "meest",
+		Shardkey:          "9",
+		SmID:              99,
+		DateCreated:       time.Date(2021, 11, 26, 6, 22, 19, 123456000, time.UTC),
+		OofShard:          "1",
+		Delivery: domain.Delivery{
+			Name:    "Test Testov",
+			Phone:   "+9720000000",
+			Zip:     "2639809",
+			City:    "Kiryat Mozkin",
+			Address: "Ploshad Mira 15",
+			Region:  "Kraiot",
+			Email:   "test@gmail.com",
+		},
+		Payment: domain.Payment{
+			Transaction:  uid,
+			RequestID:    "",
+			Currency:     "USD",
+			Provider:     "wbpay",
+			Amount:       1817,
+			PaymentDt:    1637907727,
+			Bank:         "alpha",
+			DeliveryCost: 1500,
+			GoodsTotal:   317,
+			CustomFee:    0,
+		},
+	}
+	for i := 0; i < n; i++ {
+		order.Items = append(order.Items, domain.Item{
+			ChrtID:      9934930 + i,
+			TrackNumber: "WBILMTESTTRACK",
+			Price:       453,
+			RID:         fmt.Sprintf("ab4219087a764ae0btest-%d", i),
+			Name:        "Mascaras",
+			Sale:        30,
+			Size:        "0",
+			TotalPrice:  317,
+			NmID:        2389212,
+			Brand:       "Vivienne Sabo",
+			Status:      202,
+		})
+	}
+	return order
+}
+
+func testSaveAndGet(t *testing.T, repo service.OrderRepository) {
+	want := NewOrder("b563feb7b2b84b6test", 2)
+	if err := repo.SaveOrder(context.Background(), want); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+
+	got, err := repo.GetOrderByID(context.Background(), want.OrderUID)
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	if got == nil {
+		t.Fatal("GetOrderByID returned nil for a saved order")
+	}
+	assertEqual(t, want, got)
+}
+
+func testNotFound(t *testing.T, repo service.OrderRepository) {
+	got, err := repo.GetOrderByID(context.Background(), "missing")
+	if err != nil {
+		t.Fatalf("GetOrderByID: want nil error for missing order, got %v", err)
+	}
+	if got != nil {
+		t.Fatalf("GetOrderByID: want nil order for missing order, got %+v", got)
+	}
+}
+
+func testDuplicate(t *testing.T, repo service.OrderRepository) {
+	order := NewOrder("dup", 1)
+	if err := repo.SaveOrder(context.Background(), order); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+
+	dup := NewOrder("dup", 3)
+	dup.TrackNumber = "OTHER"
+	err := repo.SaveOrder(context.Background(), dup)
+	if !errors.Is(err, domain.ErrOrderExists) {
+		t.Fatalf("SaveOrder duplicate: want domain.ErrOrderExists, got %v", err)
+	}
+
+	// the failed save must not leave partial data behind
+	got, err := repo.GetOrderByID(context.Background(), "dup")
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	assertEqual(t, order, got)
+}
+
+func testSaveBatch(t *testing.T, repo service.OrderRepository) {
+	stored := NewOrder("stored", 1)
+	if err := repo.SaveOrder(context.Background(), stored); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+
+	changed := NewOrder("stored", 2)
+	changed.TrackNumber = "OTHER"
+	batch := []*domain.Order{NewOrder("x", 1), changed, NewOrder("y", 3)}
+	existing, err := repo.SaveOrders(context.Background(), batch)
+	if err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+	if !reflect.DeepEqual(existing, []string{"stored"}) {
+		t.Errorf("SaveOrders: want existing [stored], got %v", existing)
+	}
+
+	for _, want := range []*domain.Order{NewOrder("x", 1), stored, NewOrder("y", 3)} {
+		got, err := repo.GetOrderByID(context.Background(), want.OrderUID)
+		if err != nil || got == nil {
+			t.Fatalf("GetOrderByID %s: %v, %v", want.OrderUID, got, err)
+		}
+		assertEqual(t, want, got)
+	}
+
+	if existing, err := repo.SaveOrders(context.Background(), nil); err != nil || len(existing) != 0 {
+		t.Errorf("SaveOrders empty batch: %v, %v", existing, err)
+	}
+}
+
+func testGetAll(t *testing.T, repo service.OrderRepository) {
+	want := []*domain.Order{NewOrder("a", 1), NewOrder("b", 2), NewOrder("c", 3)}
+	for _, o := range want {
+		if err := repo.SaveOrder(context.Background(), o); err != nil {
+			t.Fatalf("SaveOrder %s: %v", o.OrderUID, err)
+		}
+	}
+
+	got, err := repo.GetAllOrders(context.Background())
+	if err != nil {
+		t.Fatalf("GetAllOrders: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GetAllOrders: want %d orders, got %d", len(want), len(got))
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].OrderUID < got[j].OrderUID })
+	for i := range want {
+		assertEqual(t, want[i], got[i])
+	}
+}
+
+func testGetAllEmpty(t *testing.T, repo service.OrderRepository) {
+	got, err := repo.GetAllOrders(context.Background())
+	if err != nil {
+		t.Fatalf("GetAllOrders: %v", err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Fatalf("GetAllOrders: want empty non-nil slice, got %#v", got)
+	}
+}
+
+func testReturnsCopies(t *testing.T, repo service.OrderRepository) {
+	order := NewOrder("copy", 1)
+	if err := repo.SaveOrder(context.Background(), order); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	order.TrackNumber = "mutated after save"
+	order.Items[0].Name = "mutated after save"
+
+	got, err := repo.GetOrderByID(context.Background(), "copy")
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	got.Delivery.Name = "mutated after get"
+
+	again, err := repo.GetOrderByID(context.Background(), "copy")
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	assertEqual(t, NewOrder("copy", 1), again)
+}
+
+func testSearch(t *testing.T, repo service.OrderRepository) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+
+	alice := NewOrder("alice", 1)
+	alice.DateCreated = day(1)
+	alice.Delivery.Name = "Alice Smith"
+	alice.Delivery.City = "Moscow"
+	alice.CustomerID = "cust-1"
+
+	bob := NewOrder("bob", 2)
+	bob.DateCreated = day(2)
+	bob.Delivery.Name = "Bob Brown"
+	bob.Delivery.Email = "bob@example.com"
+	bob.Items[1].Brand = "Nike"
+	bob.Items[1].Name = "Running Shoes"
+
+	carol := NewOrder("carol", 1)
+	carol.DateCreated = day(3)
+	carol.Delivery.Name = "Carol White"
+	carol.DeliveryService = "dhl"
+	carol.Payment.Currency = "EUR"
+
+	for _, o := range []*domain.Order{alice, bob, carol} {
+		if err := repo.SaveOrder(context.Background(), o); err != nil {
+			t.Fatalf("SaveOrder %s: %v", o.OrderUID, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    domain.SearchQuery
+		want []string
+	}{
+		{"all newest first", domain.SearchQuery{}, []string{"carol", "bob", "alice"}},
+		{"item name", domain.SearchQuery{Text: "running"}, []string{"bob"}},
+		{"every word must match", domain.SearchQuery{Text: "mascaras nike"}, []string{"bob"}},
+		{"city case-insensitive", domain.SearchQuery{Text: "MOSCOW"}, []string{"alice"}},
+		{"personal data hidden", domain.SearchQuery{Text: "alice"}, []string{}},
+		{"personal data", domain.SearchQuery{Text: "alice", IncludePII: true}, []string{"alice"}},
+		{"email", domain.SearchQuery{Text: "bob@example.com", IncludePII: true}, []string{"bob"}},
+		{"customer", domain.SearchQuery{CustomerID: "cust-1"}, []string{"alice"}},
+		{"delivery service", domain.SearchQuery{DeliveryService: "DHL"}, []string{"carol"}},
+		{"brand", domain.SearchQuery{Brand: "nike"}, []string{"bob"}},
+		{"currency", domain.SearchQuery{Currency: "eur"}, []string{"carol"}},
+		{"date range", domain.SearchQuery{From: day(2), To: day(3)}, []string{"bob"}},
+		{"page", domain.SearchQuery{Limit: 1, Offset: 1}, []string{"bob"}},
+		{"no match", domain.SearchQuery{Text: "nothing"}, []string{}},
+	} {
+		got, err := repo.SearchOrders(context.Background(), tc.q)
+		if err != nil {
+			t.Fatalf("%s: SearchOrders: %v", tc.name, err)
+		}
+		uids := make([]string, 0, len(got))
+		for _, o := range got {
+			uids = append(uids, o.OrderUID)
+		}
+		if !reflect.DeepEqual(uids, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, uids)
+		}
+	}
+
+	got, err := repo.SearchOrders(context.Background(), domain.SearchQuery{Text: "nike"})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("SearchOrders nike: %v, %d orders", err, len(got))
+	}
+	assertEqual(t, bob, got[0])
+}
+
+func testStream(t *testing.T, repo service.OrderRepository) {
+	want := []*domain.Order{NewOrder("a", 1), NewOrder("b", 2), NewOrder("c", 3)}
+	for i, o := range want {
+		o.DateCreated = o.DateCreated.Add(time.Duration(i) * time.Hour)
+		if i == 1 {
+			o.Payment.Currency = "EUR"
+		}
+		if err := repo.SaveOrder(context.Background(), o); err != nil {
+			t.Fatalf("SaveOrder %s: %v", o.OrderUID, err)
+		}
+	}
+
+	var got []*domain.Order
+	err := repo.StreamOrders(context.Background(), domain.SearchQuery{Limit: 1}, func(o *domain.Order) error {
+		got = append(got, o)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamOrders: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("StreamOrders: want all 3 orders regardless of Limit, got %d", len(got))
+	}
+	for i, o := range got {
+		assertEqual(t, want[len(want)-1-i], o)
+	}
+
+	var uids []string
+	err = repo.StreamOrders(context.Background(), domain.SearchQuery{Currency: "usd"}, func(o *domain.Order) error {
+		uids = append(uids, o.OrderUID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamOrders: %v", err)
+	}
+	if !reflect.DeepEqual(uids, []string{"c", "a"}) {
+		t.Errorf("StreamOrders currency usd: want [c a], got %v", uids)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = repo.StreamOrders(context.Background(), domain.SearchQuery{}, func(*domain.Order) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("StreamOrders: want the callback's error after 1 call, got %v after %d", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls = 0
+	err = repo.StreamOrders(ctx, domain.SearchQuery{}, func(*domain.Order) error {
+		calls++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("StreamOrders: want context.Canceled after 1 call, got %v after %d", err, calls)
+	}
+}
+
+func testVersions(t *testing.T, repo service.OrderRepository) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+
+	first := NewOrder("versioned", 1)
+	if err := repo.SaveOrder(domain.WithSource(ctx, "test:save"), first); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	if _, err := repo.UpdateOrder(ctx, NewOrder("unknown", 1)); !errors.Is(err, domain.ErrOrderNotFound) {
+		t.Fatalf("UpdateOrder unknown order: want domain.ErrOrderNotFound, got %v", err)
+	}
+	if _, err := repo.UpdateOrder(ctx, NewOrder("versioned", 1)); !errors.Is(err, domain.ErrOrderUnchanged) {
+		t.Fatalf("UpdateOrder with the stored order: want domain.ErrOrderUnchanged, got %v", err)
+	}
+
+	// versions are told apart by time, so keep the clock from standing still
+	time.Sleep(10 * time.Millisecond)
+	second := NewOrder("versioned", 2)
+	second.TrackNumber = "UPDATED"
+	second.Items[1].Brand = "Nike"
+	v, err := repo.UpdateOrder(domain.WithSource(ctx, "test:update"), second)
+	if err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	if v.Version != 2 || v.Source != "test:update" {
+		t.Errorf("UpdateOrder: want version 2 from test:update, got %d from %s", v.Version, v.Source)
+	}
+
+	got, err := repo.GetOrderByID(ctx, "versioned")
+	if err != nil || got == nil {
+		t.Fatalf("GetOrderByID: %v, %v", got, err)
+	}
+	assertEqual(t, second, got)
+	found, err := repo.SearchOrders(ctx, domain.SearchQuery{Brand: "nike"})
+	if err != nil || len(found) != 1 {
+		t.Errorf("SearchOrders by the updated brand: %v, %d orders", err, len(found))
+	}
+
+	versions, err := repo.OrderVersions(ctx, "versioned")
+	if err != nil {
+		t.Fatalf("OrderVersions: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("OrderVersions: want 2 versions, got %d", len(versions))
+	}
+	for i, want := range []struct {
+		source string
+		order  *domain.Order
+	}{{"test:save", first}, {"test:update", second}} {
+		v := versions[i]
+		if v.Version != i+1 || v.Source != want.source || v.OrderUID != "versioned" {
+			t.Errorf("version %d: got number %d, source %s, order %s", i+1, v.Version, v.Source, v.OrderUID)
+		}
+		assertEqual(t, want.order, v.Order)
+	}
+	if !versions[0].CreatedAt.Before(versions[1].CreatedAt) {
+		t.Errorf("versions not in time order: %v, %v", versions[0].CreatedAt, versions[1].CreatedAt)
+	}
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		want *domain.Order
+	}{
+		{"before the order existed", before, nil},
+		{"first version", versions[0].CreatedAt, first},
+		{"between versions", versions[1].CreatedAt.Add(-time.Millisecond), first},
+		{"latest version", time.Now().Add(time.Second), second},
+	} {
+		got, err := repo.GetOrderAsOf(ctx, "versioned", tc.at)
+		if err != nil {
+			t.Fatalf("%s: GetOrderAsOf: %v", tc.name, err)
+		}
+		if tc.want == nil {
+			if got != nil {
+				t.Errorf("%s: want no order, got %s", tc.name, got.TrackNumber)
+			}
+			continue
+		}
+		if got == nil {
+			t.Fatalf("%s: GetOrderAsOf returned nil", tc.name)
+		}
+		assertEqual(t, tc.want, got)
+	}
+
+	if versions, err := repo.OrderVersions(ctx, "unknown"); err != nil || len(versions) != 0 {
+		t.Errorf("OrderVersions unknown order: %v, %v", versions, err)
+	}
+}
+
+func testBatchVersions(t *testing.T, repo service.OrderRepository) {
+	ctx := domain.WithSource(context.Background(), "test:import")
+	if err := repo.SaveOrder(ctx, NewOrder("stored", 1)); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	if _, err := repo.SaveOrders(ctx, []*domain.Order{NewOrder("x", 1), NewOrder("stored", 2)}); err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+	for _, uid := range []string{"x", "stored"} {
+		versions, err := repo.OrderVersions(ctx, uid)
+		if err != nil {
+			t.Fatalf("OrderVersions %s: %v", uid, err)
+		}
+		if len(versions) != 1 || versions[0].Source != "test:import" {
+			t.Errorf("OrderVersions %s: want one version from test:import, got %d", uid, len(versions))
+		}
+	}
+}
+
+func testCancel(t *testing.T, repo service.OrderRepository) {
+	ctx := context.Background()
+	for _, uid := range []string{"kept", "cancelled"} {
+		if err := repo.SaveOrder(ctx, NewOrder(uid, 1)); err != nil {
+			t.Fatalf("SaveOrder %s: %v", uid, err)
+		}
+	}
+
+	before := time.Now().Add(-time.Second)
+	got, err := repo.CancelOrder(domain.WithSource(ctx, "test:cancel"), domain.Cancellation{OrderUID: "cancelled", Reason: "customer request"})
+	if err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+	if got.Deletion == nil || got.Deletion.Reason != "customer request" || got.Deletion.DeletedAt.Before(before) {
+		t.Fatalf("CancelOrder: want the deletion recorded, got %+v", got.Deletion)
+	}
+	versions, err := repo.OrderVersions(ctx, "cancelled")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("OrderVersions after CancelOrder: want 2 versions, got %d, %v", len(versions), err)
+	}
+	if v := versions[1]; v.Source != "test:cancel" || v.Order.Deletion == nil || v.Order.Deletion.Reason != "customer request" {
+		t.Errorf("OrderVersions: want version 2 recording the cancellation from test:cancel, got %s, %+v", v.Source, v.Order.Deletion)
+	}
+	if _, err := repo.CancelOrder(ctx, domain.Cancellation{OrderUID: "cancelled", Reason: "again"}); !errors.Is(err, domain.ErrOrderDeleted) {
+		t.Errorf("CancelOrder twice: want domain.ErrOrderDeleted, got %v", err)
+	}
+	if _, err := repo.CancelOrder(ctx, domain.Cancellation{OrderUID: "unknown", Reason: "typo"}); !errors.Is(err, domain.ErrOrderNotFound) {
+		t.Errorf("CancelOrder unknown order: want domain.ErrOrderNotFound, got %v", err)
+	}
+	if _, err := repo.UpdateOrder(ctx, NewOrder("cancelled", 2)); !errors.Is(err, domain.ErrOrderDeleted) {
+		t.Errorf("UpdateOrder cancelled order: want domain.ErrOrderDeleted, got %v", err)
+	}
+
+	stored, err := repo.GetOrderByID(ctx, "cancelled")
+	if err != nil || stored == nil {
+		t.Fatalf("GetOrderByID cancelled order: %v, %v", stored, err)
+	}
+	if stored.Deletion == nil || stored.Deletion.Reason != "customer request" {
+		t.Errorf("GetOrderByID: want the deletion, got %+v", stored.Deletion)
+	}
+
+	all, err := repo.GetAllOrders(ctx)
+	if err != nil || len(all) != 1 || all[0].OrderUID != "kept" {
+		t.Errorf("GetAllOrders: want only the live order, got %d orders, %v", len(all), err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    domain.SearchQuery
+		want int
+	}{
+		{"default", domain.SearchQuery{}, 1},
+		{"include deleted", domain.SearchQuery{IncludeDeleted: true}, 2},
+	} {
+		found, err := repo.SearchOrders(ctx, tc.q)
+		if err != nil || len(found) != tc.want {
+			t.Errorf("SearchOrders %s: want %d orders, got %d, %v", tc.name, tc.want, len(found), err)
+		}
+		streamed := 0
+		err = repo.StreamOrders(ctx, tc.q, func(*domain.Order) error {
+			streamed++
+			return nil
+		})
+		if err != nil || streamed != tc.want {
+			t.Errorf("StreamOrders %s: want %d orders, got %d, %v", tc.name, tc.want, streamed, err)
+		}
+	}
+}
+
+func testRetention(t *testing.T, repo service.OrderRepository) {
+	// retention.Store and retention.Archive; the retention tests use this
+	// package, so it cannot import them
+	store, ok := repo.(interface {
+		PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) ([]string, error)
+		DeleteOrders(ctx context.Context, ids []string) error
+		ArchiveOrders(ctx context.Context, orders []*domain.Order) error
+		ArchivedOrder(ctx context.Context, id string) (*domain.Order, error)
+		SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error
+		RetentionRuns(ctx context.Context, limit int) ([]*domain.RetentionRun, error)
+	})
+	if !ok {
+		t.Skip("repository does not support retention")
+	}
+	ctx := context.Background()
+	cutoff := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, uid := range []string{"oldest", "old", "new"} {
+		order := NewOrder(uid, 1)
+		order.DateCreated = cutoff.AddDate(0, i-2, 0)
+		if err := repo.SaveOrder(ctx, order); err != nil {
+			t.Fatalf("SaveOrder %s: %v", uid, err)
+		}
+	}
+	if _, err := repo.UpdateOrder(ctx, func() *domain.Order {
+		o := NewOrder("old", 2)
+		o.DateCreated = cutoff.AddDate(0, -1, 0)
+		return o
+	}()); err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+
+	eraser := redact.Eraser()
+	erase := func(o *domain.Order) *domain.Order { return redact.Apply(eraser, o) }
+	ids, err := store.PurgePII(ctx, cutoff, 1, erase)
+	if err != nil || len(ids) != 1 || ids[0] != "oldest" {
+		t.Fatalf("PurgePII limit 1: want [oldest], got %v, %v", ids, err)
+	}
+	ids, err = store.PurgePII(ctx, cutoff, 10, erase)
+	if err != nil || len(ids) != 1 || ids[0] != "old" {
+		t.Fatalf("PurgePII: want [old], got %v, %v", ids, err)
+	}
+	if ids, err := store.PurgePII(ctx, cutoff, 10, erase); err != nil || len(ids) != 0 {
+		t.Errorf("PurgePII again: want nothing left, got %v, %v", ids, err)
+	}
+
+	old, err := repo.GetOrderByID(ctx, "old")
+	if err != nil || old == nil {
+		t.Fatalf("GetOrderByID old: %v, %v", old, err)
+	}
+	if old.CustomerID != redact.Masked || old.Delivery.Phone != redact.Masked || old.Delivery.Email != redact.Masked {
+		t.Errorf("purged order still holds personal data: %+v", old.Delivery)
+	}
+	if len(old.Items) != 2 {
+		t.Errorf("purged order: want its 2 items kept, got %d", len(old.Items))
+	}
+	versions, err := repo.OrderVersions(ctx, "old")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("OrderVersions old: want 2, got %d, %v", len(versions), err)
+	}
+	for _, v := range versions {
+		if v.Order.Delivery.Name != redact.Masked {
+			t.Errorf("version %d still holds personal data: %+v", v.Version, v.Order.Delivery)
+		}
+	}
+	if kept, _ := repo.GetOrderByID(ctx, "new"); kept == nil || kept.CustomerID != "test" {
+		t.Errorf("order after the cutoff was purged: %+v", kept)
+	}
+
+	if err := store.ArchiveOrders(ctx, []*domain.Order{old}); err != nil {
+		t.Fatalf("ArchiveOrders: %v", err)
+	}
+	if err := store.DeleteOrders(ctx, []string{"old", "unknown"}); err != nil {
+		t.Fatalf("DeleteOrders: %v", err)
+	}
+	if got, err := repo.GetOrderByID(ctx, "old"); err != nil || got != nil {
+		t.Errorf("GetOrderByID deleted order: want nil, got %v, %v", got, err)
+	}
+	if versions, err := repo.OrderVersions(ctx, "old"); err != nil || len(versions) != 0 {
+		t.Errorf("OrderVersions deleted order: want none, got %d, %v", len(versions), err)
+	}
+	archived, err := store.ArchivedOrder(ctx, "old")
+	if err != nil || archived == nil {
+		t.Fatalf("ArchivedOrder: %v, %v", archived, err)
+	}
+	assertEqual(t, old, archived)
+	if got, err := store.ArchivedOrder(ctx, "new"); err != nil || got != nil {
+		t.Errorf("ArchivedOrder never archived: want nil, got %v, %v", got, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		run := &domain.RetentionRun{
+			Trigger:       fmt.Sprintf("test:%d", i),
+			StartedAt:     cutoff,
+			FinishedAt:    cutoff.Add(time.Second),
+			Archive:       "table",
+			ArchiveBefore: cutoff,
+			Archived:      i,
+		}
+		if err := store.SaveRetentionRun(ctx, run); err != nil {
+			t.Fatalf("SaveRetentionRun: %v", err)
+		}
+		if run.ID == 0 {
+			t.Errorf("SaveRetentionRun: want an id assigned")
+		}
+	}
+	runs, err := store.RetentionRuns(ctx, 2)
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("RetentionRuns: want 2, got %d, %v", len(runs), err)
+	}
+	if runs[0].Trigger != "test:3" || runs[1].Trigger != "test:2" {
+		t.Errorf("RetentionRuns: want newest first, got %s, %s", runs[0].Trigger, runs[1].Trigger)
+	}
+	if !runs[0].ArchiveBefore.Equal(cutoff) || !runs[0].PurgePIIBefore.IsZero() || runs[0].Archived != 3 {
+		t.Errorf("RetentionRuns: record mismatch: %+v", runs[0])
+	}
+}
+
+func assertEqual(t *testing.T, want, got *domain.Order) {
+	t.Helper()
+	if !want.DateCreated.Equal(got.DateCreated) {
+		t.Errorf("order %s: DateCreated: want %v, got %v", want.OrderUID, want.DateCreated, got.DateCreated)
+	}
+	w, g := *want, *got
+	w.DateCreated, g.DateCreated = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(w, g) {
+		t.Errorf("order %s mismatch:\nwant %+v\ngot  %+v", want.OrderUID, w, g)
+	}
+}
+
+func testRollups(t *testing.T, repo service.OrderRepository) {
+	store, ok := repo.(analytics.Store)
+	if !ok {
+		t.Skip("repository does not support analytics")
+	}
+	ctx := context.Background()
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	row := func(start time.Time, key, currency string, orders int64) analytics.Row {
+		return analytics.Row{
+			Grain: analytics.Day, Start: start, Dimension: analytics.Brand, Key: key, Currency: currency,
+			Orders: orders, Items: 2 * orders, Revenue: 100 * orders, DeliveryCost: 10 * orders,
+		}
+	}
+	if err := store.AddRollups(ctx, []analytics.Row{
+		row(day, "acme", "USD", 1),
+		row(day, "acme", "RUB", 1),
+		row(day.AddDate(0, 0, 1), "zeta", "USD", 1),
+		row(day.AddDate(0, 0, 2), "acme", "USD", 1),
+		{Grain: analytics.Hour, Start: day, Dimension: analytics.Brand, Key: "acme", Currency: "USD", Orders: 1},
+		{Grain: analytics.Day, Start: day, Dimension: analytics.Total, Currency: "USD", Orders: 1},
+	}); err != nil {
+		t.Fatalf("AddRollups: %v", err)
+	}
+	if err := store.AddRollups(ctx, []analytics.Row{row(day, "acme", "USD", 2)}); err != nil {
+		t.Fatalf("AddRollups again: %v", err)
+	}
+
+	q := analytics.Query{Grain: analytics.Day, Dimension: analytics.Brand, From: day, To: day.AddDate(0, 0, 2)}
+	rows, err := store.Rollups(ctx, q)
+	if err != nil {
+		t.Fatalf("Rollups: %v", err)
+	}
+	want := []analytics.Row{row(day, "acme", "RUB", 1), row(day, "acme", "USD", 3), row(day.AddDate(0, 0, 1), "zeta", "USD", 1)}
+	if len(rows) != len(want) {
+		t.Fatalf("Rollups: want %d rows, got %+v", len(want), rows)
+	}
+	for i := range want {
+		if !rows[i].Start.Equal(want[i].Start) {
+			t.Errorf("row %d: want start %v, got %v", i, want[i].Start, rows[i].Start)
+		}
+		rows[i].Start = want[i].Start
+		if rows[i] != want[i] {
+			t.Errorf("row %d: want %+v, got %+v", i, want[i], rows[i])
+		}
+	}
+
+	q.Currency, q.Key = "USD", "acme"
+	if rows, err := store.Rollups(ctx, q); err != nil || len(rows) != 1 || rows[0].Orders != 3 {
+		t.Errorf("Rollups of acme in USD: want one row of 3 orders, got %+v, %v", rows, err)
+	}
+
+	if err := store.ClearRollups(ctx); err != nil {
+		t.Fatalf("ClearRollups: %v", err)
+	}
+	q.Currency, q.Key = "", ""
+	if rows, err := store.Rollups(ctx, q); err != nil || len(rows) != 0 {
+		t.Errorf("Rollups after ClearRollups: want none, got %+v, %v", rows, err)
+	}
+}
+
+// testUpdateRacesCancel updates and cancels orders at once. Whichever comes
+// second must see the first: an update after the cancel fails, and the
+// latest version is the stored order either way.
+func testUpdateRacesCancel(t *testing.T, repo service.OrderRepository) {
+	ctx := context.Background()
+	const orders = 200
+	for i := 0; i < orders; i++ {
+		if err := repo.SaveOrder(ctx, NewOrder(fmt.Sprintf("race-%d", i), 1)); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < orders; i++ {
+		uid := fmt.Sprintf("race-%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updated := NewOrder(uid, 1)
+			updated.TrackNumber = "UPDATED"
+			if _, err := repo.UpdateOrder(ctx, updated); err != nil && !errors.Is(err, domain.ErrOrderDeleted) {
+				t.Errorf("UpdateOrder %s: %v", uid, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := repo.CancelOrder(ctx, domain.Cancellation{OrderUID: uid, Reason: "race"}); err != nil {
+				t.Errorf("CancelOrder %s: %v", uid, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < orders; i++ {
+		uid := fmt.Sprintf("race-%d", i)
+		stored, err := repo.GetOrderByID(ctx, uid)
+		if err != nil || stored == nil {
+			t.Fatalf("GetOrderByID %s: %v, %v", uid, stored, err)
+		}
+		versions, err := repo.OrderVersions(ctx, uid)
+		if err != nil || len(versions) == 0 {
+			t.Fatalf("OrderVersions %s: %d versions, %v", uid, len(versions), err)
+		}
+		latest := versions[len(versions)-1].Order
+		if stored.Deletion == nil || latest.Deletion == nil || latest.TrackNumber != stored.TrackNumber {
+			t.Errorf("%s: stored %s with deletion %+v, latest version %s with deletion %+v",
+				uid, stored.TrackNumber, stored.Deletion, latest.TrackNumber, latest.Deletion)
+		}
+	}
+}
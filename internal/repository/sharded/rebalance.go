@@ -0,0 +1,144 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+)
+
+// RebalanceStats counts what Rebalance found and did.
+type RebalanceStats struct {
+	// Misplaced orders are not on their home shard.
+	Misplaced int `json:"misplaced"`
+	Moved     int `json:"moved"`
+	// Changed orders were written to while being moved. They stay where
+	// they were; the next rebalance moves them.
+	Changed int `json:"changed"`
+	// Conflicts are orders found on their home shard as well, with other
+	// contents, or written to on both shards while being moved. They are
+	// left for an operator to sort out.
+	Conflicts int `json:"conflicts"`
+}
+
+// Rebalance moves every order that is not on its home shard under the
+// current map there, the orders of drained shards included: shards that
+// were dropped from the map and are to be emptied. With dryRun it only
+// counts the misplaced orders. Archived orders are not moved.
+//
+// An order is copied with its versions before it is deleted from where it
+// was, so an interrupted rebalance leaves orders in two places rather than
+// in none, and the next run finishes the move. The original is deleted only
+// if its latest version is still the one copied; a write that reached it in
+// between undoes the move instead.
+func (r *OrderRepository) Rebalance(ctx context.Context, drained []Shard, dryRun bool) (RebalanceStats, error) {
+	var stats RebalanceStats
+	sources := append(append([]Shard(nil), r.shards...), drained...)
+	for i, from := range sources {
+		var misplaced []string
+		err := from.StreamOrders(ctx, domain.SearchQuery{IncludeDeleted: true}, func(o *domain.Order) error {
+			if i >= len(r.shards) || Home(o.OrderUID, len(r.shards)) != i {
+				misplaced = append(misplaced, o.OrderUID)
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("failed to list orders of shard %d: %w", i, err)
+		}
+		stats.Misplaced += len(misplaced)
+		r.logger.InfoContext(ctx, "Found misplaced orders",
+			slog.Int("shard", i),
+			slog.Bool("drained", i >= len(r.shards)),
+			slog.Int("count", len(misplaced)))
+		if dryRun {
+			continue
+		}
+
+		for _, uid := range misplaced {
+			outcome, err := r.move(ctx, uid, from, r.home(uid))
+			if err != nil {
+				return stats, fmt.Errorf("failed to move order %s from shard %d: %w", uid, i, err)
+			}
+			switch outcome {
+			case moved:
+				stats.Moved++
+			case changed:
+				stats.Changed++
+			case conflict:
+				stats.Conflicts++
+				r.logger.WarnContext(ctx, "Order stored on two shards with different contents",
+					slog.String("orderUID", uid),
+					slog.Int("shard", i),
+					slog.Int("home", Home(uid, len(r.shards))))
+			}
+		}
+	}
+	r.logger.InfoContext(ctx, "Rebalance finished", slog.Any("stats", stats))
+	return stats, nil
+}
+
+type moveOutcome int
+
+const (
+	gone moveOutcome = iota
+	moved
+	changed
+	conflict
+)
+
+// move copies an order from one shard to another and deletes the original.
+func (r *OrderRepository) move(ctx context.Context, uid string, from, to Shard) (moveOutcome, error) {
+	order, versions, err := snapshot(ctx, from, uid)
+	if err != nil || order == nil {
+		return gone, err
+	}
+	err = to.RestoreOrder(ctx, order, versions)
+	if errors.Is(err, domain.ErrOrderExists) {
+		// copied by a run interrupted before it deleted the original
+		copied, err := to.GetOrderByID(ctx, uid)
+		if err != nil {
+			return gone, err
+		}
+		if !copied.Equal(order) {
+			return conflict, nil
+		}
+	} else if err != nil {
+		return gone, err
+	}
+
+	latest := 0
+	if len(versions) > 0 {
+		latest = versions[len(versions)-1].Version
+	}
+	deleted, err := from.DeleteMovedOrder(ctx, uid, latest)
+	if err != nil {
+		return gone, err
+	}
+	if deleted {
+		return moved, nil
+	}
+	// lookups find the copy first now, so it may have been written to as well
+	undone, err := to.DeleteMovedOrder(ctx, uid, latest)
+	if err != nil {
+		return gone, err
+	}
+	if !undone {
+		return conflict, nil
+	}
+	return changed, nil
+}
+
+// snapshot reads an order with its versions.
+func snapshot(ctx context.Context, s Shard, uid string) (*domain.Order, []*domain.Version, error) {
+	order, err := s.GetOrderByID(ctx, uid)
+	if err != nil || order == nil {
+		return nil, nil, err
+	}
+	versions, err := s.OrderVersions(ctx, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return order, versions, nil
+}
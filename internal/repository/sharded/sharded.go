@@ -0,0 +1,454 @@
+// Package sharded spreads orders over several repositories, the shards.
+//
+// The shard map is the ordered list of shards. An order lives on its home
+// shard, picked by hashing its OrderUID, so that GetOrderByID needs nothing
+// but the id to find it. (The order's own Shardkey comes from the producer
+// and is not used for routing.) Lists and searches ask every shard and merge
+// the results newest first.
+//
+// When the map changes, orders stay where they are until Rebalance moves
+// them; meanwhile lookups by id that miss the home shard try the others.
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/retention"
+	"github.com/velvetriddles/wb-level0/internal/service"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("repository/sharded")
+
+// Shard is a repository holding a part of the orders.
+type Shard interface {
+	service.OrderRepository
+	retention.Store
+	retention.Archive
+	analytics.Store
+	// RestoreOrder stores an order moved from another shard with its
+	// cancellation and versions, failing with domain.ErrOrderExists if the
+	// shard has it already.
+	RestoreOrder(ctx context.Context, order *domain.Order, versions []*domain.Version) error
+	// DeleteMovedOrder deletes an order copied to another shard if its
+	// latest version is still version, checked under the lock updates and
+	// cancellations take. It reports false and keeps the order otherwise.
+	DeleteMovedOrder(ctx context.Context, orderUID string, version int) (deleted bool, err error)
+}
+
+// OrderRepository implements service.OrderRepository, retention.Store,
+// retention.Archive and analytics.Store over shards. Retention run records
+// and analytics rollups are kept on the first shard.
+type OrderRepository struct {
+	shards []Shard
+	logger *slog.Logger
+}
+
+// NewOrderRepository returns a repository over shards, which must not be
+// empty. Their order is the shard map.
+func NewOrderRepository(shards []Shard, logger *slog.Logger) *OrderRepository {
+	return &OrderRepository{shards: shards, logger: logger}
+}
+
+// Home returns the index of the shard among n that orderUID belongs to. It
+// is a jump consistent hash (Lamping and Veach) of the FNV-1a hash of the
+// id: appending a shard to the map moves only the orders the new shard
+// takes over, about 1/n of them.
+func Home(orderUID string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(orderUID))
+	key := h.Sum64()
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (r *OrderRepository) home(orderUID string) Shard {
+	return r.shards[Home(orderUID, len(r.shards))]
+}
+
+// locate calls fn on the home shard of orderUID and, while fn reports the
+// order missing, on the other shards in turn: until a rebalance is done an
+// order may still be where an older shard map put it.
+func (r *OrderRepository) locate(orderUID string, fn func(Shard) (found bool, err error)) error {
+	home := Home(orderUID, len(r.shards))
+	for i := range r.shards {
+		found, err := fn(r.shards[(home+i)%len(r.shards)])
+		if err != nil || found {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls fn on every shard at once and returns the first error.
+func (r *OrderRepository) each(fn func(i int, s Shard) error) error {
+	errs := make([]error, len(r.shards))
+	var wg sync.WaitGroup
+	for i, s := range r.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, s)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// byHome groups orders by the index of their home shard.
+func (r *OrderRepository) byHome(orders []*domain.Order) map[int][]*domain.Order {
+	groups := make(map[int][]*domain.Order)
+	for _, o := range orders {
+		i := Home(o.OrderUID, len(r.shards))
+		groups[i] = append(groups[i], o)
+	}
+	return groups
+}
+
+// elsewhere reports whether orderUID is stored on a shard other than its
+// home, where an older shard map put it. The home shard itself rejects
+// duplicates on insert.
+func (r *OrderRepository) elsewhere(ctx context.Context, orderUID string) (found bool, err error) {
+	home := r.home(orderUID)
+	err = r.locate(orderUID, func(s Shard) (bool, error) {
+		if s == home {
+			return false, nil
+		}
+		o, err := s.GetOrderByID(ctx, orderUID)
+		found = o != nil
+		return found, err
+	})
+	return found, err
+}
+
+func (r *OrderRepository) SaveOrder(ctx context.Context, order *domain.Order) error {
+	found, err := r.elsewhere(ctx, order.OrderUID)
+	if err != nil {
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+	if found {
+		return fmt.Errorf("failed to insert order info: %w", domain.ErrOrderExists)
+	}
+	return r.home(order.OrderUID).SaveOrder(ctx, order)
+}
+
+// SaveOrders splits the batch by home shard. Orders found on other shards
+// are skipped as existing. Each shard stores its part in one transaction, so
+// a failure may leave the parts of other shards stored.
+func (r *OrderRepository) SaveOrders(ctx context.Context, orders []*domain.Order) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SaveOrders",
+		trace.WithAttributes(attribute.Int("orders.count", len(orders))))
+	defer func() { tracing.End(span, err) }()
+
+	groups := r.byHome(orders)
+	existing := make([][]string, len(r.shards))
+	err = r.each(func(i int, s Shard) error {
+		if len(groups[i]) == 0 {
+			return nil
+		}
+		fresh := make([]*domain.Order, 0, len(groups[i]))
+		for _, o := range groups[i] {
+			found, err := r.elsewhere(ctx, o.OrderUID)
+			if err != nil {
+				return err
+			}
+			if found {
+				existing[i] = append(existing[i], o.OrderUID)
+				continue
+			}
+			fresh = append(fresh, o)
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		stored, err := s.SaveOrders(ctx, fresh)
+		existing[i] = append(existing[i], stored...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var all []string
+	for _, ids := range existing {
+		all = append(all, ids...)
+	}
+	return all, nil
+}
+
+func (r *OrderRepository) GetOrderByID(ctx context.Context, id string) (order *domain.Order, err error) {
+	err = r.locate(id, func(s Shard) (bool, error) {
+		order, err = s.GetOrderByID(ctx, id)
+		return order != nil, err
+	})
+	return order, err
+}
+
+func (r *OrderRepository) GetAllOrders(ctx context.Context) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetAllOrders",
+		trace.WithAttributes(attribute.Int("shards", len(r.shards))))
+	defer func() { tracing.End(span, err) }()
+
+	parts := make([][]*domain.Order, len(r.shards))
+	err = r.each(func(i int, s Shard) error {
+		var err error
+		parts[i], err = s.GetAllOrders(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]*domain.Order, 0)
+	for _, part := range parts {
+		orders = append(orders, part...)
+	}
+	return orders, nil
+}
+
+// SearchOrders asks every shard for the first Offset+Limit matches and
+// merges them. Pages deeper than a shard serves in one search are cut out of
+// the merged streams instead.
+func (r *OrderRepository) SearchOrders(ctx context.Context, q domain.SearchQuery) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SearchOrders",
+		trace.WithAttributes(attribute.Int("shards", len(r.shards))))
+	defer func() { tracing.End(span, err) }()
+
+	q = q.WithDefaults()
+	want := q.Offset + q.Limit
+	if want > domain.MaxSearchLimit {
+		page := make([]*domain.Order, 0, q.Limit)
+		seen := 0
+		err := r.StreamOrders(ctx, q, func(o *domain.Order) error {
+			if seen++; seen > q.Offset {
+				page = append(page, o)
+			}
+			if len(page) == q.Limit {
+				return errPageFull
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageFull) {
+			return nil, err
+		}
+		return page, nil
+	}
+
+	top := q
+	top.Offset, top.Limit = 0, want
+	parts := make([][]*domain.Order, len(r.shards))
+	err = r.each(func(i int, s Shard) error {
+		var err error
+		parts[i], err = s.SearchOrders(ctx, top)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var found []*domain.Order
+	for _, part := range parts {
+		found = append(found, part...)
+	}
+	domain.SortNewestFirst(found)
+	return q.Page(found), nil
+}
+
+var errPageFull = errors.New("page full")
+
+// StreamOrders merges the streams of all shards, which come newest first
+// each, into one.
+func (r *OrderRepository) StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.StreamOrders",
+		trace.WithAttributes(attribute.Int("shards", len(r.shards))))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	streams := make([]chan *domain.Order, len(r.shards))
+	errs := make([]error, len(r.shards))
+	var wg sync.WaitGroup
+	for i, s := range r.shards {
+		streams[i] = make(chan *domain.Order, 64)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(streams[i])
+			errs[i] = s.StreamOrders(ctx, q, func(o *domain.Order) error {
+				select {
+				case streams[i] <- o:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+	// stop the shards before reporting, whichever way the merge ends
+	defer wg.Wait()
+
+	heads := make([]*domain.Order, len(streams))
+	for i, stream := range streams {
+		heads[i] = <-stream
+	}
+	for {
+		next := -1
+		for i, o := range heads {
+			if o != nil && (next < 0 || newer(o, heads[next])) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		// the shards may have buffered orders past a cancellation
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(heads[next]); err != nil {
+			cancel()
+			return err
+		}
+		heads[next] = <-streams[next]
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// newer reports whether a comes before b in domain.SortNewestFirst order.
+func newer(a, b *domain.Order) bool {
+	if !a.DateCreated.Equal(b.DateCreated) {
+		return a.DateCreated.After(b.DateCreated)
+	}
+	return a.OrderUID < b.OrderUID
+}
+
+func (r *OrderRepository) UpdateOrder(ctx context.Context, order *domain.Order) (v *domain.Version, err error) {
+	err = r.locate(order.OrderUID, func(s Shard) (bool, error) {
+		v, err = s.UpdateOrder(ctx, order)
+		if errors.Is(err, domain.ErrOrderNotFound) {
+			return false, nil
+		}
+		return true, err
+	})
+	if err == nil && v == nil {
+		err = fmt.Errorf("failed to update order: %w", domain.ErrOrderNotFound)
+	}
+	return v, err
+}
+
+func (r *OrderRepository) OrderVersions(ctx context.Context, id string) (versions []*domain.Version, err error) {
+	err = r.locate(id, func(s Shard) (bool, error) {
+		versions, err = s.OrderVersions(ctx, id)
+		return len(versions) > 0, err
+	})
+	return versions, err
+}
+
+func (r *OrderRepository) GetOrderAsOf(ctx context.Context, id string, t time.Time) (order *domain.Order, err error) {
+	err = r.locate(id, func(s Shard) (bool, error) {
+		order, err = s.GetOrderAsOf(ctx, id, t)
+		return order != nil, err
+	})
+	return order, err
+}
+
+func (r *OrderRepository) CancelOrder(ctx context.Context, c domain.Cancellation) (order *domain.Order, err error) {
+	err = r.locate(c.OrderUID, func(s Shard) (bool, error) {
+		order, err = s.CancelOrder(ctx, c)
+		if errors.Is(err, domain.ErrOrderNotFound) {
+			return false, nil
+		}
+		return true, err
+	})
+	if err == nil && order == nil {
+		err = fmt.Errorf("failed to cancel order: %w", domain.ErrOrderNotFound)
+	}
+	return order, err
+}
+
+// PurgePII goes through the shards one after the other until limit orders
+// are purged.
+func (r *OrderRepository) PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) ([]string, error) {
+	var ids []string
+	for i, s := range r.shards {
+		purged, err := s.PurgePII(ctx, before, limit-len(ids), erase)
+		ids = append(ids, purged...)
+		if err != nil {
+			return ids, fmt.Errorf("shard %d: %w", i, err)
+		}
+		if len(ids) == limit {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// DeleteOrders deletes the ids on every shard, as some may not be at home
+// yet.
+func (r *OrderRepository) DeleteOrders(ctx context.Context, ids []string) error {
+	return r.each(func(_ int, s Shard) error { return s.DeleteOrders(ctx, ids) })
+}
+
+func (r *OrderRepository) ArchiveOrders(ctx context.Context, orders []*domain.Order) error {
+	groups := r.byHome(orders)
+	return r.each(func(i int, s Shard) error {
+		if len(groups[i]) == 0 {
+			return nil
+		}
+		return s.ArchiveOrders(ctx, groups[i])
+	})
+}
+
+// ArchivedOrder looks in every shard's archive: Rebalance leaves archived
+// orders where they are.
+func (r *OrderRepository) ArchivedOrder(ctx context.Context, id string) (order *domain.Order, err error) {
+	err = r.locate(id, func(s Shard) (bool, error) {
+		order, err = s.ArchivedOrder(ctx, id)
+		return order != nil, err
+	})
+	return order, err
+}
+
+func (r *OrderRepository) SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error {
+	return r.shards[0].SaveRetentionRun(ctx, run)
+}
+
+func (r *OrderRepository) RetentionRuns(ctx context.Context, limit int) ([]*domain.RetentionRun, error) {
+	return r.shards[0].RetentionRuns(ctx, limit)
+}
+
+func (r *OrderRepository) AddRollups(ctx context.Context, rows []analytics.Row) error {
+	return r.shards[0].AddRollups(ctx, rows)
+}
+
+func (r *OrderRepository) Rollups(ctx context.Context, q analytics.Query) ([]analytics.Row, error) {
+	return r.shards[0].Rollups(ctx, q)
+}
+
+func (r *OrderRepository) ClearRollups(ctx context.Context) error {
+	return r.shards[0].ClearRollups(ctx)
+}
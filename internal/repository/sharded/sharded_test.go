@@ -0,0 +1,222 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newShards(n int) []Shard {
+	shards := make([]Shard, n)
+	for i := range shards {
+		shards[i] = memory.NewOrderRepository(logger)
+	}
+	return shards
+}
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) service.OrderRepository {
+		return NewOrderRepository(newShards(3), logger)
+	})
+}
+
+func TestHomeMovesOnlyToAddedShard(t *testing.T) {
+	const orders = 10000
+	movedTo3 := 0
+	for i := 0; i < orders; i++ {
+		uid := fmt.Sprintf("order-%d", i)
+		before, after := Home(uid, 3), Home(uid, 4)
+		if before != after {
+			if after != 3 {
+				t.Fatalf("%s moved from shard %d to %d, want only moves to the new shard", uid, before, after)
+			}
+			movedTo3++
+		}
+	}
+	// a quarter of the orders belong to the fourth shard
+	if movedTo3 < orders/5 || movedTo3 > orders*3/10 {
+		t.Errorf("want about %d orders moved, got %d", orders/4, movedTo3)
+	}
+}
+
+func TestSearchMergesDeepPages(t *testing.T) {
+	ctx := context.Background()
+	repo := NewOrderRepository(newShards(3), logger)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var batch []*domain.Order
+	for i := 0; i < 600; i++ {
+		o := repotest.NewOrder(fmt.Sprintf("order-%03d", i), 1)
+		o.DateCreated = start.Add(time.Duration(i) * time.Minute)
+		batch = append(batch, o)
+	}
+	if _, err := repo.SaveOrders(ctx, batch); err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+
+	// newest first, so offset 490 starts at order 109
+	page, err := repo.SearchOrders(ctx, domain.SearchQuery{Offset: 490, Limit: 20})
+	if err != nil {
+		t.Fatalf("SearchOrders: %v", err)
+	}
+	if len(page) != 20 || page[0].OrderUID != "order-109" || page[19].OrderUID != "order-090" {
+		t.Fatalf("SearchOrders: want order-109..order-090, got %d orders from %v", len(page), page[0].OrderUID)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(4)
+	old := NewOrderRepository(shards[:2], logger)
+	var uids []string
+	for i := 0; i < 200; i++ {
+		uid := fmt.Sprintf("order-%d", i)
+		uids = append(uids, uid)
+		if err := old.SaveOrder(ctx, repotest.NewOrder(uid, 1)); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+	}
+	updated := repotest.NewOrder("order-7", 2)
+	if _, err := old.UpdateOrder(ctx, updated); err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	if _, err := old.CancelOrder(ctx, domain.Cancellation{OrderUID: "order-8", Reason: "test"}); err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+
+	// grow to three shards, but drain the second of the old ones
+	grown := NewOrderRepository([]Shard{shards[0], shards[2], shards[3]}, logger)
+	// until the rebalance, orders are found on whichever shard of the map
+	// they are
+	for _, uid := range uids {
+		if o, _ := shards[1].GetOrderByID(ctx, uid); o != nil {
+			continue
+		}
+		if o, err := grown.GetOrderByID(ctx, uid); err != nil || o == nil {
+			t.Fatalf("GetOrderByID %s before rebalance: %v, %v", uid, o, err)
+		}
+	}
+
+	dry, err := grown.Rebalance(ctx, []Shard{shards[1]}, true)
+	if err != nil || dry.Misplaced == 0 || dry.Moved != 0 {
+		t.Fatalf("dry run: want misplaced orders and none moved, got %+v, %v", dry, err)
+	}
+	stats, err := grown.Rebalance(ctx, []Shard{shards[1]}, false)
+	if err != nil {
+		t.Fatalf("Rebalance: %v", err)
+	}
+	if stats.Moved != dry.Misplaced || stats.Changed != 0 || stats.Conflicts != 0 {
+		t.Errorf("Rebalance: want %d moved, got %+v", dry.Misplaced, stats)
+	}
+
+	if left, _ := shards[1].GetAllOrders(ctx); len(left) != 0 {
+		t.Errorf("drained shard still holds %d orders", len(left))
+	}
+	for _, uid := range uids {
+		home := grown.home(uid)
+		o, err := home.GetOrderByID(ctx, uid)
+		if err != nil || o == nil {
+			t.Fatalf("%s is not on its home shard: %v", uid, err)
+		}
+	}
+	if versions, _ := grown.OrderVersions(ctx, "order-7"); len(versions) != 2 || !versions[1].Order.Equal(updated) {
+		t.Errorf("order-7: want both versions moved, got %d", len(versions))
+	}
+	if o, _ := grown.GetOrderByID(ctx, "order-8"); o.Deletion == nil || o.Deletion.Reason != "test" {
+		t.Errorf("order-8: want cancellation moved, got %+v", o.Deletion)
+	}
+
+	again, err := grown.Rebalance(ctx, []Shard{shards[1]}, false)
+	if err != nil || again.Misplaced != 0 {
+		t.Errorf("second Rebalance: want nothing misplaced, got %+v, %v", again, err)
+	}
+}
+
+func TestSaveFindsOrdersOnOldShards(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(3)
+	old := NewOrderRepository(shards[:2], logger)
+	var moved []*domain.Order
+	for i := 0; len(moved) < 3; i++ {
+		o := repotest.NewOrder(fmt.Sprintf("order-%d", i), 1)
+		if err := old.SaveOrder(ctx, o); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+		if Home(o.OrderUID, 3) == 2 {
+			moved = append(moved, o)
+		}
+	}
+
+	// the grown map sends these orders to the new, empty shard
+	grown := NewOrderRepository(shards, logger)
+	if err := grown.SaveOrder(ctx, moved[0]); !errors.Is(err, domain.ErrOrderExists) {
+		t.Errorf("SaveOrder after growing: want domain.ErrOrderExists, got %v", err)
+	}
+	fresh := repotest.NewOrder("order-new", 1)
+	existing, err := grown.SaveOrders(ctx, []*domain.Order{moved[1], fresh, moved[2]})
+	if err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+	if len(existing) != 2 || existing[0] != moved[1].OrderUID || existing[1] != moved[2].OrderUID {
+		t.Errorf("SaveOrders after growing: want %s and %s existing, got %v", moved[1].OrderUID, moved[2].OrderUID, existing)
+	}
+	for _, o := range moved {
+		if copied, _ := shards[2].GetOrderByID(ctx, o.OrderUID); copied != nil {
+			t.Errorf("%s was stored again on its new home shard", o.OrderUID)
+		}
+	}
+	if o, _ := grown.GetOrderByID(ctx, fresh.OrderUID); o == nil {
+		t.Errorf("SaveOrders after growing: %s was not stored", fresh.OrderUID)
+	}
+}
+
+// lateWriter runs write just before the shard deletes a moved order, the
+// way an update already on its way to the old shard would land.
+type lateWriter struct {
+	Shard
+	write func()
+}
+
+func (s lateWriter) DeleteMovedOrder(ctx context.Context, orderUID string, version int) (bool, error) {
+	s.write()
+	return s.Shard.DeleteMovedOrder(ctx, orderUID, version)
+}
+
+func TestRebalanceKeepsLateWrites(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(2)
+	if err := shards[0].SaveOrder(ctx, repotest.NewOrder("order-1", 1)); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	updated := repotest.NewOrder("order-1", 2)
+	drained := lateWriter{Shard: shards[0], write: func() {
+		if _, err := shards[0].UpdateOrder(ctx, updated); err != nil {
+			t.Errorf("UpdateOrder: %v", err)
+		}
+	}}
+
+	grown := NewOrderRepository(shards[1:], logger)
+	stats, err := grown.Rebalance(ctx, []Shard{drained}, false)
+	if err != nil {
+		t.Fatalf("Rebalance: %v", err)
+	}
+	if stats.Moved != 0 || stats.Changed != 1 {
+		t.Errorf("Rebalance: want the move undone, got %+v", stats)
+	}
+	if o, _ := shards[0].GetOrderByID(ctx, "order-1"); o == nil || !o.Equal(updated) {
+		t.Errorf("the update on the old shard was lost: %+v", o)
+	}
+	if o, _ := shards[1].GetOrderByID(ctx, "order-1"); o != nil {
+		t.Error("the copy of the changed order was kept")
+	}
+}
@@ -0,0 +1,88 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+)
+
+// Rollup buckets are stored as unix seconds, as timestamps stored as text do
+// not compare reliably in SQL.
+
+func (r *OrderRepository) AddRollups(ctx context.Context, rows []analytics.Row) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qctx, qspan := startQuery(ctx, "INSERT", "order_rollups")
+	for _, row := range rows {
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO order_rollups (grain, dimension, bucket_start, key, currency,
+                                       orders, items, revenue, delivery_cost)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (grain, dimension, bucket_start, key, currency) DO UPDATE SET
+                orders = orders + excluded.orders,
+                items = items + excluded.items,
+                revenue = revenue + excluded.revenue,
+                delivery_cost = delivery_cost + excluded.delivery_cost`,
+			row.Grain, row.Dimension, row.Start.Unix(), row.Key, row.Currency,
+			row.Orders, row.Items, row.Revenue, row.DeliveryCost)
+		if err != nil {
+			break
+		}
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to upsert rollups: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (r *OrderRepository) Rollups(ctx context.Context, q analytics.Query) (_ []analytics.Row, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "order_rollups")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT bucket_start, key, currency, orders, items, revenue, delivery_cost
+        FROM order_rollups
+        WHERE grain = ? AND dimension = ? AND bucket_start >= ? AND bucket_start < ?
+          AND (? = '' OR currency = ?) AND (? = '' OR key = ?)
+        ORDER BY bucket_start, key, currency`,
+		q.Grain, q.Dimension, q.From.Unix(), q.To.Unix(), q.Currency, q.Currency, q.Key, q.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]analytics.Row, 0)
+	for rows.Next() {
+		row := analytics.Row{Grain: q.Grain, Dimension: q.Dimension}
+		var start int64
+		err := rows.Scan(&start, &row.Key, &row.Currency, &row.Orders, &row.Items, &row.Revenue, &row.DeliveryCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		row.Start = time.Unix(start, 0).UTC()
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate rollups: %w", err)
+	}
+	return out, nil
+}
+
+func (r *OrderRepository) ClearRollups(ctx context.Context) error {
+	qctx, qspan := startQuery(ctx, "DELETE", "order_rollups")
+	_, err := r.db.ExecContext(qctx, `DELETE FROM order_rollups`)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to clear rollups: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,834 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var tracer = tracing.Tracer("repository/sqlite")
+
+const schema = `
+CREATE TABLE IF NOT EXISTS orders (
+    order_uid TEXT PRIMARY KEY,
+    track_number TEXT,
+    entry TEXT,
+    locale TEXT,
+    internal_signature TEXT,
+    customer_id TEXT,
+    delivery_service TEXT,
+    shardkey TEXT,
+    sm_id INTEGER,
+    date_created TIMESTAMP,
+    oof_shard TEXT,
+    deleted_at TIMESTAMP,
+    delete_reason TEXT,
+    pii_purged_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS delivery (
+    order_uid TEXT PRIMARY KEY REFERENCES orders(order_uid) ON DELETE CASCADE,
+    name TEXT,
+    phone TEXT,
+    zip TEXT,
+    city TEXT,
+    address TEXT,
+    region TEXT,
+    email TEXT
+);
+
+CREATE TABLE IF NOT EXISTS payment (
+    order_uid TEXT PRIMARY KEY REFERENCES orders(order_uid) ON DELETE CASCADE,
+    transaction_id TEXT,
+    request_id TEXT,
+    currency TEXT,
+    provider TEXT,
+    amount INTEGER,
+    payment_dt INTEGER,
+    bank TEXT,
+    delivery_cost INTEGER,
+    goods_total INTEGER,
+    custom_fee INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS items (
+    item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_uid TEXT REFERENCES orders(order_uid) ON DELETE CASCADE,
+    chrt_id INTEGER,
+    track_number TEXT,
+    price INTEGER,
+    rid TEXT,
+    name TEXT,
+    sale INTEGER,
+    size TEXT,
+    total_price INTEGER,
+    nm_id INTEGER,
+    brand TEXT,
+    status INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS items_order_uid_idx ON items (order_uid);
+
+CREATE TABLE IF NOT EXISTS order_versions (
+    order_uid TEXT NOT NULL REFERENCES orders(order_uid) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    source TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    snapshot TEXT NOT NULL,
+    PRIMARY KEY (order_uid, version)
+);
+
+CREATE TABLE IF NOT EXISTS order_archive (
+    order_uid TEXT PRIMARY KEY,
+    date_created TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP NOT NULL,
+    snapshot TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS retention_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    triggered_by TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL,
+    archive TEXT NOT NULL,
+    archive_before TIMESTAMP,
+    purge_pii_before TIMESTAMP,
+    archived INTEGER NOT NULL,
+    pii_purged INTEGER NOT NULL,
+    error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS order_rollups (
+    grain TEXT NOT NULL,
+    dimension TEXT NOT NULL,
+    bucket_start INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    orders INTEGER NOT NULL,
+    items INTEGER NOT NULL,
+    revenue INTEGER NOT NULL,
+    delivery_cost INTEGER NOT NULL,
+    PRIMARY KEY (grain, dimension, bucket_start, key, currency)
+);
+`
+
+type OrderRepository struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewOrderRepository(db *sql.DB, logger *slog.Logger) *OrderRepository {
+	return &OrderRepository{db: db, logger: logger}
+}
+
+// Open opens (or creates) the SQLite database at path and makes sure the
+// schema exists. Use ":memory:" for a throwaway database.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being private to each pooled connection.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`PRAGMA foreign_keys = ON`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+	if err := addColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade schema: %w", err)
+	}
+	return db, nil
+}
+
+// addedColumns are the orders columns introduced after the first schema,
+// which CREATE TABLE IF NOT EXISTS does not add to existing databases.
+var addedColumns = []struct{ name, ddl string }{
+	{"deleted_at", "ALTER TABLE orders ADD COLUMN deleted_at TIMESTAMP"},
+	{"delete_reason", "ALTER TABLE orders ADD COLUMN delete_reason TEXT"},
+	{"pii_purged_at", "ALTER TABLE orders ADD COLUMN pii_purged_at TIMESTAMP"},
+}
+
+// addColumns upgrades orders tables created by an older version.
+func addColumns(db *sql.DB) error {
+	for _, c := range addedColumns {
+		var found int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('orders') WHERE name = ?`, c.name).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found > 0 {
+			continue
+		}
+		if _, err := db.Exec(c.ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OrderRepository) SaveOrder(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SaveOrder",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	r.logger.InfoContext(ctx, "Attempting to save order", slog.String("orderUID", order.OrderUID))
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := r.insertOrder(ctx, tx, order); err != nil {
+		return err
+	}
+	if err := r.insertVersion(ctx, tx, order, 1, domain.SourceFromContext(ctx), time.Now().UTC()); err != nil {
+		return err
+	}
+
+	_, qspan := startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully saved order", slog.String("orderUID", order.OrderUID))
+	return nil
+}
+
+// SaveOrders inserts the batch in one transaction, skipping orders that are
+// already stored.
+func (r *OrderRepository) SaveOrders(ctx context.Context, orders []*domain.Order) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SaveOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.Int("orders.count", len(orders))))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existing []string
+	for _, order := range orders {
+		var found int
+		qctx, qspan := startQuery(ctx, "SELECT", "orders")
+		err := tx.QueryRowContext(qctx, `SELECT 1 FROM orders WHERE order_uid = ?`, order.OrderUID).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		tracing.End(qspan, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check order: %w", err)
+		}
+		if found == 1 {
+			existing = append(existing, order.OrderUID)
+			continue
+		}
+		if err := r.insertOrder(ctx, tx, order); err != nil {
+			return nil, err
+		}
+		if err := r.insertVersion(ctx, tx, order, 1, domain.SourceFromContext(ctx), time.Now().UTC()); err != nil {
+			return nil, err
+		}
+	}
+
+	_, qspan := startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Saved order batch",
+		slog.Int("saved", len(orders)-len(existing)),
+		slog.Int("existing", len(existing)))
+	return existing, nil
+}
+
+// insertOrder writes the order with its delivery, payment and items in tx.
+func (r *OrderRepository) insertOrder(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
+	// Order info
+	qctx, qspan := startQuery(ctx, "INSERT", "orders")
+	_, err := tx.ExecContext(qctx, `
+        INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature,
+		order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order info", slog.String("error", err.Error()))
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to insert order info: %w", domain.ErrOrderExists)
+		}
+		return fmt.Errorf("failed to insert order info: %w", err)
+	}
+	return r.insertDetails(ctx, tx, order)
+}
+
+// insertDetails writes the order's delivery, payment and items in tx.
+func (r *OrderRepository) insertDetails(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
+	// Delivery
+	qctx, qspan := startQuery(ctx, "INSERT", "delivery")
+	_, err := tx.ExecContext(qctx, `
+        INSERT INTO delivery (order_uid, name, phone, zip, city, address, region, email)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.OrderUID, order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip,
+		order.Delivery.City, order.Delivery.Address, order.Delivery.Region, order.Delivery.Email)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert delivery info", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert delivery info: %w", err)
+	}
+
+	// Payment
+	qctx, qspan = startQuery(ctx, "INSERT", "payment")
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO payment (order_uid, transaction_id, request_id, currency, provider, amount, payment_dt, bank, delivery_cost, goods_total, custom_fee)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.OrderUID, order.Payment.Transaction, order.Payment.RequestID, order.Payment.Currency,
+		order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt, order.Payment.Bank,
+		order.Payment.DeliveryCost, order.Payment.GoodsTotal, order.Payment.CustomFee)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert payment info", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert payment info: %w", err)
+	}
+
+	// Items
+	for _, item := range order.Items {
+		qctx, qspan = startQuery(ctx, "INSERT", "items")
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO items (order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			order.OrderUID, item.ChrtID, item.TrackNumber, item.Price, item.RID, item.Name,
+			item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status)
+		tracing.End(qspan, err)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to insert item",
+				slog.String("error", err.Error()),
+				slog.Int("chrtID", item.ChrtID))
+			return fmt.Errorf("failed to insert item: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *OrderRepository) GetOrderByID(ctx context.Context, orderUID string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetOrderByID",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	return r.getOrder(ctx, r.db, orderUID)
+}
+
+// querier is satisfied by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// getOrder reads an order through db. With the single connection, a
+// transaction must read through itself.
+func (r *OrderRepository) getOrder(ctx context.Context, db querier, orderUID string) (_ *domain.Order, err error) {
+	r.logger.InfoContext(ctx, "Attempting to get order by ID", slog.String("orderUID", orderUID))
+
+	var (
+		order     domain.Order
+		deletedAt sql.NullTime
+		reason    sql.NullString
+	)
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	err = db.QueryRowContext(qctx, `
+        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+               o.deleted_at, o.delete_reason,
+               d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+               p.transaction_id, p.request_id, p.currency, p.provider, p.amount,
+               p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
+        FROM orders o
+        JOIN delivery d ON o.order_uid = d.order_uid
+        JOIN payment p ON o.order_uid = p.order_uid
+        WHERE o.order_uid = ?`, orderUID).Scan(
+		&order.OrderUID, &order.TrackNumber, &order.Entry, &order.Locale, &order.InternalSignature,
+		&order.CustomerID, &order.DeliveryService, &order.Shardkey, &order.SmID, &order.DateCreated, &order.OofShard,
+		&deletedAt, &reason,
+		&order.Delivery.Name, &order.Delivery.Phone, &order.Delivery.Zip, &order.Delivery.City,
+		&order.Delivery.Address, &order.Delivery.Region, &order.Delivery.Email,
+		&order.Payment.Transaction, &order.Payment.RequestID, &order.Payment.Currency,
+		&order.Payment.Provider, &order.Payment.Amount, &order.Payment.PaymentDt, &order.Payment.Bank,
+		&order.Payment.DeliveryCost, &order.Payment.GoodsTotal, &order.Payment.CustomFee)
+	tracing.End(qspan, err)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			r.logger.InfoContext(ctx, "Order not found", slog.String("orderUID", orderUID))
+			return nil, nil
+		}
+		r.logger.ErrorContext(ctx, "Failed to get order", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	order.Deletion = deletion(deletedAt, reason)
+
+	qctx, qspan = startQuery(ctx, "SELECT", "items")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := db.QueryContext(qctx, `
+        SELECT chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
+        FROM items WHERE order_uid = ? ORDER BY item_id`, orderUID)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to query items", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to query items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item domain.Item
+		err := rows.Scan(
+			&item.ChrtID, &item.TrackNumber, &item.Price, &item.RID, &item.Name,
+			&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to scan item", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to scan item: %w", err)
+		}
+		order.Items = append(order.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "Failed to iterate items", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to iterate items: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully retrieved order", slog.String("orderUID", orderUID))
+	return &order, nil
+}
+
+// GetAllOrders returns the orders that are not cancelled.
+func (r *OrderRepository) GetAllOrders(ctx context.Context) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.GetAllOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite))
+	defer func() { tracing.End(span, err) }()
+
+	r.logger.InfoContext(ctx, "Attempting to get all orders")
+	return r.allOrders(ctx, false)
+}
+
+func (r *OrderRepository) allOrders(ctx context.Context, includeDeleted bool) (_ []*domain.Order, err error) {
+	where := "WHERE o.deleted_at IS NULL"
+	if includeDeleted {
+		where = ""
+	}
+
+	// the query spans last until their rows are read
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature,
+               o.customer_id, o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+               o.deleted_at, o.delete_reason,
+               d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
+               p.transaction_id, p.request_id, p.currency, p.provider, p.amount,
+               p.payment_dt, p.bank, p.delivery_cost, p.goods_total, p.custom_fee
+        FROM orders o
+        JOIN delivery d ON o.order_uid = d.order_uid
+        JOIN payment p ON o.order_uid = p.order_uid
+        `+where)
+	if err != nil {
+		tracing.End(qspan, err)
+		r.logger.ErrorContext(ctx, "Failed to query all orders", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to query all orders: %w", err)
+	}
+
+	orders := make([]*domain.Order, 0)
+	for rows.Next() {
+		var (
+			o         domain.Order
+			deletedAt sql.NullTime
+			reason    sql.NullString
+		)
+		err := rows.Scan(
+			&o.OrderUID, &o.TrackNumber, &o.Entry, &o.Locale, &o.InternalSignature,
+			&o.CustomerID, &o.DeliveryService, &o.Shardkey, &o.SmID, &o.DateCreated, &o.OofShard,
+			&deletedAt, &reason,
+			&o.Delivery.Name, &o.Delivery.Phone, &o.Delivery.Zip, &o.Delivery.City,
+			&o.Delivery.Address, &o.Delivery.Region, &o.Delivery.Email,
+			&o.Payment.Transaction, &o.Payment.RequestID, &o.Payment.Currency,
+			&o.Payment.Provider, &o.Payment.Amount, &o.Payment.PaymentDt, &o.Payment.Bank,
+			&o.Payment.DeliveryCost, &o.Payment.GoodsTotal, &o.Payment.CustomFee)
+		if err != nil {
+			rows.Close()
+			tracing.End(qspan, err)
+			r.logger.ErrorContext(ctx, "Failed to scan order", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		o.Deletion = deletion(deletedAt, reason)
+		orders = append(orders, &o)
+	}
+	// the single connection has to be released before the items query
+	rows.Close()
+	tracing.End(qspan, rows.Err())
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "Failed to iterate orders", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to iterate orders: %w", err)
+	}
+
+	qctx, qspan = startQuery(ctx, "SELECT", "items")
+	itemRows, err := r.db.QueryContext(qctx, `
+        SELECT order_uid, chrt_id, track_number, price, rid, name,
+               sale, size, total_price, nm_id, brand, status
+        FROM items ORDER BY item_id`)
+	if err != nil {
+		tracing.End(qspan, err)
+		r.logger.ErrorContext(ctx, "Failed to query items", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to query items: %w", err)
+	}
+	defer itemRows.Close()
+
+	itemMap := make(map[string][]domain.Item)
+	for itemRows.Next() {
+		var item domain.Item
+		var orderUID string
+		err := itemRows.Scan(
+			&orderUID, &item.ChrtID, &item.TrackNumber, &item.Price, &item.RID, &item.Name,
+			&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status)
+		if err != nil {
+			tracing.End(qspan, err)
+			r.logger.ErrorContext(ctx, "Failed to scan item", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to scan item: %w", err)
+		}
+		itemMap[orderUID] = append(itemMap[orderUID], item)
+	}
+	tracing.End(qspan, itemRows.Err())
+	if err := itemRows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "Failed to iterate items", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to iterate items: %w", err)
+	}
+
+	for _, order := range orders {
+		order.Items = itemMap[order.OrderUID]
+	}
+
+	r.logger.InfoContext(ctx, "Successfully retrieved all orders", slog.Int("count", len(orders)))
+	return orders, nil
+}
+
+// SearchOrders filters all orders in Go with the same rules as the in-memory
+// repository. SQLite serves local runs and tests, where that is fast enough.
+func (r *OrderRepository) SearchOrders(ctx context.Context, q domain.SearchQuery) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.SearchOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite))
+	defer func() { tracing.End(span, err) }()
+
+	orders, err := r.allOrders(ctx, q.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]*domain.Order, 0)
+	for _, order := range orders {
+		if q.Match(order) {
+			found = append(found, order)
+		}
+	}
+	domain.SortNewestFirst(found)
+	return q.Page(found), nil
+}
+
+// StreamOrders passes the orders matching q to fn, newest first. Like
+// SearchOrders it filters in Go, so the orders are read up front. Limit and
+// Offset are ignored.
+func (r *OrderRepository) StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.StreamOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite))
+	defer func() { tracing.End(span, err) }()
+
+	orders, err := r.allOrders(ctx, q.IncludeDeleted)
+	if err != nil {
+		return err
+	}
+	found := make([]*domain.Order, 0)
+	for _, order := range orders {
+		if q.Match(order) {
+			found = append(found, order)
+		}
+	}
+	domain.SortNewestFirst(found)
+	for _, order := range found {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateOrder rewrites the order's rows and adds a version in one
+// transaction. Orders saved before versions existed get their stored state
+// as version 1, dated when the order was created.
+func (r *OrderRepository) UpdateOrder(ctx context.Context, order *domain.Order) (_ *domain.Version, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.UpdateOrder",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	// the single connection serializes this with other writers, so the
+	// checks below see the state the update replaces
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stored, err := r.getOrder(ctx, tx, order.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderNotFound)
+	}
+	if stored.Deletion != nil {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderDeleted)
+	}
+	if stored.Equal(order) {
+		return nil, fmt.Errorf("failed to update order: %w", domain.ErrOrderUnchanged)
+	}
+
+	latest, err := r.latestVersion(ctx, tx, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	qctx, qspan := startQuery(ctx, "UPDATE", "orders")
+	_, err = tx.ExecContext(qctx, `
+        UPDATE orders SET track_number = ?, entry = ?, locale = ?, internal_signature = ?, customer_id = ?,
+                          delivery_service = ?, shardkey = ?, sm_id = ?, date_created = ?, oof_shard = ?,
+                          pii_purged_at = NULL
+        WHERE order_uid = ?`,
+		order.TrackNumber, order.Entry, order.Locale, order.InternalSignature, order.CustomerID,
+		order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard, order.OrderUID)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to update order info", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to update order info: %w", err)
+	}
+	for _, table := range []string{"delivery", "payment", "items"} {
+		qctx, qspan = startQuery(ctx, "DELETE", table)
+		_, err = tx.ExecContext(qctx, `DELETE FROM `+table+` WHERE order_uid = ?`, order.OrderUID)
+		tracing.End(qspan, err)
+		if err != nil {
+			r.logger.ErrorContext(ctx, "Failed to delete order details", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+	if err := r.insertDetails(ctx, tx, order); err != nil {
+		return nil, err
+	}
+	v := &domain.Version{
+		OrderUID:  order.OrderUID,
+		Version:   latest + 1,
+		Source:    domain.SourceFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+		Order:     order,
+	}
+	if err := r.insertVersion(ctx, tx, order, v.Version, v.Source, v.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully updated order",
+		slog.String("orderUID", order.OrderUID),
+		slog.Int("version", v.Version))
+	return v, nil
+}
+
+// CancelOrder marks the order as deleted and records the cancelled order as
+// a new version in one transaction. Its rows and versions are kept.
+func (r *OrderRepository) CancelOrder(ctx context.Context, c domain.Cancellation) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.CancelOrder",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", c.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	// the single connection serializes this with other writers
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to begin transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	order, err := r.getOrder(ctx, tx, c.OrderUID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case order == nil:
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderNotFound)
+	case order.Deletion != nil:
+		return nil, fmt.Errorf("failed to cancel order: %w", domain.ErrOrderDeleted)
+	}
+	latest, err := r.latestVersion(ctx, tx, order)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	qctx, qspan := startQuery(ctx, "UPDATE", "orders")
+	_, err = tx.ExecContext(qctx, `UPDATE orders SET deleted_at = ?, delete_reason = ? WHERE order_uid = ?`,
+		now, c.Reason, c.OrderUID)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to cancel order", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to cancel order: %w", err)
+	}
+	order.Deletion = &domain.Deletion{DeletedAt: now, Reason: c.Reason}
+	if err := r.insertVersion(ctx, tx, order, latest+1, domain.SourceFromContext(ctx), now); err != nil {
+		return nil, err
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to commit transaction", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.logger.InfoContext(ctx, "Successfully cancelled order",
+		slog.String("orderUID", c.OrderUID),
+		slog.String("reason", c.Reason))
+	return order, nil
+}
+
+// latestVersion returns the number of the order's latest version, first
+// backfilling version 1 from stored if the order has none.
+func (r *OrderRepository) latestVersion(ctx context.Context, tx *sql.Tx, stored *domain.Order) (int, error) {
+	var latest int
+	qctx, qspan := startQuery(ctx, "SELECT", "order_versions")
+	err := tx.QueryRowContext(qctx, `SELECT COALESCE(MAX(version), 0) FROM order_versions WHERE order_uid = ?`,
+		stored.OrderUID).Scan(&latest)
+	tracing.End(qspan, err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if latest == 0 {
+		if err := r.insertVersion(ctx, tx, stored, 1, domain.SourceUnknown, stored.DateCreated); err != nil {
+			return 0, err
+		}
+		latest = 1
+	}
+	return latest, nil
+}
+
+func (r *OrderRepository) insertVersion(ctx context.Context, tx *sql.Tx, order *domain.Order, version int, source string, at time.Time) error {
+	snapshot, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to encode order version: %w", err)
+	}
+	qctx, qspan := startQuery(ctx, "INSERT", "order_versions")
+	_, err = tx.ExecContext(qctx, `
+        INSERT INTO order_versions (order_uid, version, source, created_at, snapshot)
+        VALUES (?, ?, ?, ?, ?)`,
+		order.OrderUID, version, source, at, string(snapshot))
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to insert order version", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to insert order version: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) OrderVersions(ctx context.Context, orderUID string) (_ []*domain.Version, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.OrderVersions",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	qctx, qspan := startQuery(ctx, "SELECT", "order_versions")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT version, source, created_at, snapshot
+        FROM order_versions WHERE order_uid = ? ORDER BY version`, orderUID)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to query order versions", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to query order versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]*domain.Version, 0)
+	for rows.Next() {
+		v := &domain.Version{OrderUID: orderUID}
+		var snapshot string
+		if err := rows.Scan(&v.Version, &v.Source, &v.CreatedAt, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to scan order version: %w", err)
+		}
+		if err := json.Unmarshal([]byte(snapshot), &v.Order); err != nil {
+			return nil, fmt.Errorf("failed to decode order version %d: %w", v.Version, err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate order versions: %w", err)
+	}
+	return versions, nil
+}
+
+// GetOrderAsOf picks the version in Go: an order has few versions, and
+// timestamps stored as text do not compare reliably in SQL.
+func (r *OrderRepository) GetOrderAsOf(ctx context.Context, orderUID string, t time.Time) (*domain.Order, error) {
+	versions, err := r.OrderVersions(ctx, orderUID)
+	if err != nil {
+		return nil, err
+	}
+	if v := domain.VersionAt(versions, t); v != nil {
+		return v.Order, nil
+	}
+	return nil, nil
+}
+
+func deletion(deletedAt sql.NullTime, reason sql.NullString) *domain.Deletion {
+	if !deletedAt.Valid {
+		return nil
+	}
+	return &domain.Deletion{DeletedAt: deletedAt.Time, Reason: reason.String}
+}
+
+func startQuery(ctx context.Context, operation, table string) (context.Context, trace.Span) {
+	return tracing.StartQuery(ctx, tracer, semconv.DBSystemSqlite, operation, table)
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY ||
+		sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
@@ -0,0 +1,22 @@
+package sqlite_test
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+	"github.com/velvetriddles/wb-level0/internal/repository/sqlite"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) service.OrderRepository {
+		db, err := sqlite.Open(":memory:")
+		if err != nil {
+			t.Fatalf("open sqlite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return sqlite.NewOrderRepository(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	})
+}
@@ -0,0 +1,268 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PurgePII picks the oldest orders in Go, as timestamps stored as text do
+// not compare reliably in SQL, and erases each in its own transaction.
+func (r *OrderRepository) PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.PurgePII",
+		trace.WithAttributes(semconv.DBSystemSqlite))
+	defer func() { tracing.End(span, err) }()
+
+	type candidate struct {
+		uid     string
+		created time.Time
+	}
+	qctx, qspan := startQuery(ctx, "SELECT", "orders")
+	rows, err := r.db.QueryContext(qctx, `SELECT order_uid, date_created FROM orders WHERE pii_purged_at IS NULL`)
+	if err != nil {
+		tracing.End(qspan, err)
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	var due []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.uid, &c.created); err != nil {
+			rows.Close()
+			tracing.End(qspan, err)
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		if c.created.Before(before) {
+			due = append(due, c)
+		}
+	}
+	rows.Close()
+	tracing.End(qspan, rows.Err())
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate orders: %w", err)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].created.Before(due[j].created) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	ids := make([]string, 0, len(due))
+	for _, c := range due {
+		if err := r.purgeOrder(ctx, c.uid, erase); err != nil {
+			return ids, err
+		}
+		ids = append(ids, c.uid)
+	}
+	r.logger.InfoContext(ctx, "Purged personal data", slog.Int("count", len(ids)))
+	return ids, nil
+}
+
+// purgeOrder rewrites the order's personal data and its versions.
+func (r *OrderRepository) purgeOrder(ctx context.Context, uid string, erase func(*domain.Order) *domain.Order) error {
+	// read before the transaction takes the single connection
+	stored, err := r.GetOrderByID(ctx, uid)
+	if err != nil || stored == nil {
+		return err
+	}
+	versions, err := r.OrderVersions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	order := erase(stored)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	qctx, qspan := startQuery(ctx, "UPDATE", "orders")
+	_, err = tx.ExecContext(qctx, `UPDATE orders SET customer_id = ?, pii_purged_at = ? WHERE order_uid = ?`,
+		order.CustomerID, time.Now().UTC(), uid)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to purge order info: %w", err)
+	}
+	qctx, qspan = startQuery(ctx, "UPDATE", "delivery")
+	_, err = tx.ExecContext(qctx, `
+        UPDATE delivery SET name = ?, phone = ?, zip = ?, city = ?, address = ?, region = ?, email = ?
+        WHERE order_uid = ?`,
+		order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip, order.Delivery.City,
+		order.Delivery.Address, order.Delivery.Region, order.Delivery.Email, uid)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to purge delivery info: %w", err)
+	}
+	for _, v := range versions {
+		snapshot, err := json.Marshal(erase(v.Order))
+		if err != nil {
+			return fmt.Errorf("failed to encode order version: %w", err)
+		}
+		qctx, qspan = startQuery(ctx, "UPDATE", "order_versions")
+		_, err = tx.ExecContext(qctx, `UPDATE order_versions SET snapshot = ? WHERE order_uid = ? AND version = ?`,
+			string(snapshot), uid, v.Version)
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to purge order version: %w", err)
+		}
+	}
+
+	_, qspan = startQuery(ctx, "COMMIT", "orders")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteOrders relies on the foreign keys to remove delivery, payment,
+// items and versions along with the orders.
+func (r *OrderRepository) DeleteOrders(ctx context.Context, ids []string) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.DeleteOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.Int("orders.count", len(ids))))
+	defer func() { tracing.End(span, err) }()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	qctx, qspan := startQuery(ctx, "DELETE", "orders")
+	_, err = r.db.ExecContext(qctx, `DELETE FROM orders WHERE order_uid IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	tracing.End(qspan, err)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "Failed to delete orders", slog.String("error", err.Error()))
+		return fmt.Errorf("failed to delete orders: %w", err)
+	}
+	r.logger.InfoContext(ctx, "Deleted orders", slog.Int("count", len(ids)))
+	return nil
+}
+
+func (r *OrderRepository) ArchiveOrders(ctx context.Context, orders []*domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.ArchiveOrders",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.Int("orders.count", len(orders))))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, order := range orders {
+		snapshot, err := json.Marshal(order)
+		if err != nil {
+			return fmt.Errorf("failed to encode archived order: %w", err)
+		}
+		qctx, qspan := startQuery(ctx, "INSERT", "order_archive")
+		_, err = tx.ExecContext(qctx, `
+            INSERT INTO order_archive (order_uid, date_created, archived_at, snapshot)
+            VALUES (?, ?, ?, ?)
+            ON CONFLICT (order_uid) DO UPDATE
+            SET date_created = excluded.date_created, archived_at = excluded.archived_at, snapshot = excluded.snapshot`,
+			order.OrderUID, order.DateCreated, now, string(snapshot))
+		tracing.End(qspan, err)
+		if err != nil {
+			return fmt.Errorf("failed to archive order: %w", err)
+		}
+	}
+
+	_, qspan := startQuery(ctx, "COMMIT", "order_archive")
+	err = tx.Commit()
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) ArchivedOrder(ctx context.Context, orderUID string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderRepository.ArchivedOrder",
+		trace.WithAttributes(semconv.DBSystemSqlite, attribute.String("order.uid", orderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	var snapshot string
+	qctx, qspan := startQuery(ctx, "SELECT", "order_archive")
+	err = r.db.QueryRowContext(qctx, `SELECT snapshot FROM order_archive WHERE order_uid = ?`, orderUID).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		tracing.End(qspan, nil)
+		return nil, nil
+	}
+	tracing.End(qspan, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived order: %w", err)
+	}
+	var order domain.Order
+	if err := json.Unmarshal([]byte(snapshot), &order); err != nil {
+		return nil, fmt.Errorf("failed to decode archived order: %w", err)
+	}
+	return &order, nil
+}
+
+func (r *OrderRepository) SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error {
+	qctx, qspan := startQuery(ctx, "INSERT", "retention_runs")
+	res, err := r.db.ExecContext(qctx, `
+        INSERT INTO retention_runs (triggered_by, started_at, finished_at, archive, archive_before, purge_pii_before,
+                                    archived, pii_purged, error)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Trigger, run.StartedAt, run.FinishedAt, run.Archive, nullTime(run.ArchiveBefore), nullTime(run.PurgePIIBefore),
+		run.Archived, run.PIIPurged, run.Error)
+	tracing.End(qspan, err)
+	if err != nil {
+		return fmt.Errorf("failed to insert retention run: %w", err)
+	}
+	run.ID, err = res.LastInsertId()
+	return err
+}
+
+func (r *OrderRepository) RetentionRuns(ctx context.Context, limit int) (_ []*domain.RetentionRun, err error) {
+	qctx, qspan := startQuery(ctx, "SELECT", "retention_runs")
+	defer func() { tracing.End(qspan, err) }()
+	rows, err := r.db.QueryContext(qctx, `
+        SELECT id, triggered_by, started_at, finished_at, archive, archive_before, purge_pii_before,
+               archived, pii_purged, error
+        FROM retention_runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query retention runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make([]*domain.RetentionRun, 0)
+	for rows.Next() {
+		var (
+			run                           domain.RetentionRun
+			archiveBefore, purgePIIBefore sql.NullTime
+		)
+		err := rows.Scan(&run.ID, &run.Trigger, &run.StartedAt, &run.FinishedAt, &run.Archive,
+			&archiveBefore, &purgePIIBefore, &run.Archived, &run.PIIPurged, &run.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan retention run: %w", err)
+		}
+		run.ArchiveBefore, run.PurgePIIBefore = archiveBefore.Time, purgePIIBefore.Time
+		runs = append(runs, &run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate retention runs: %w", err)
+	}
+	return runs, nil
+}
+
+// nullTime stores the zero time, a disabled cutoff, as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
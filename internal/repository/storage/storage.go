@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/analytics"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/postgres"
+	"github.com/velvetriddles/wb-level0/internal/repository/sharded"
+	"github.com/velvetriddles/wb-level0/internal/repository/sqlite"
+	"github.com/velvetriddles/wb-level0/internal/retention"
+	"github.com/velvetriddles/wb-level0/internal/service"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSharded  = "sharded"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
+)
+
+// Repository is an order repository together with the resources backing it.
+// Every backend also serves the retention job, keeps its own archive and
+// stores analytics rollups.
+type Repository interface {
+	orderStore
+	Close() error
+}
+
+type orderStore interface {
+	service.OrderRepository
+	retention.Store
+	retention.Archive
+	analytics.Store
+}
+
+type repository struct {
+	orderStore
+	close func() error
+}
+
+func (r *repository) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// NewOrderRepository builds the repository selected by cfg.Storage.Driver.
+func NewOrderRepository(ctx context.Context, cfg *config.Config, logger *slog.Logger) (Repository, error) {
+	switch cfg.Storage.Driver {
+	case DriverPostgres, "":
+		repo, close, err := openPostgres(ctx, cfg, cfg.DatabaseURL, logger)
+		if err != nil {
+			return nil, err
+		}
+		return &repository{orderStore: repo, close: close}, nil
+
+	case DriverSharded:
+		shards, close, err := OpenShards(ctx, cfg, cfg.Storage.Shards, logger)
+		if err != nil {
+			return nil, err
+		}
+		return &repository{orderStore: sharded.NewOrderRepository(shards, logger), close: close}, nil
+
+	case DriverSQLite:
+		db, err := sqlite.Open(cfg.Storage.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		return &repository{orderStore: sqlite.NewOrderRepository(db, logger), close: db.Close}, nil
+
+	case DriverMemory:
+		return &repository{orderStore: memory.NewOrderRepository(logger)}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Storage.Driver)
+	}
+}
+
+// OpenShards opens a Postgres repository per DSN, with the pool settings of
+// cfg.Storage. close closes them all.
+func OpenShards(ctx context.Context, cfg *config.Config, dsns []string, logger *slog.Logger) (_ []sharded.Shard, close func() error, err error) {
+	shards := make([]sharded.Shard, 0, len(dsns))
+	closers := make([]func() error, 0, len(dsns))
+	close = func() error {
+		var errs []error
+		for _, c := range closers {
+			errs = append(errs, c())
+		}
+		return errors.Join(errs...)
+	}
+	for i, dsn := range dsns {
+		repo, c, err := openPostgres(ctx, cfg, dsn, logger.With(slog.Int("shard", i)))
+		if err != nil {
+			close()
+			return nil, nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		shards = append(shards, repo)
+		closers = append(closers, c)
+	}
+	return shards, close, nil
+}
+
+// openPostgres connects to dsn and makes sure the partitions of the current
+// month and storage.partitions_ahead after it exist, keeping them so until
+// close.
+func openPostgres(ctx context.Context, cfg *config.Config, dsn string, logger *slog.Logger) (_ *postgres.OrderRepository, close func() error, err error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to DB: %w", err)
+	}
+	// pull for iptimization
+	db.SetMaxOpenConns(cfg.Storage.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Storage.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Storage.ConnMaxLifetime)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to ping DB: %w", err)
+	}
+	repo := postgres.NewOrderRepository(db, logger)
+	ahead := cfg.Storage.PartitionsAhead
+	if err := repo.CreatePartitions(ctx, time.Now().UTC(), ahead+1); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	stop := repo.MaintainPartitions(ahead, 24*time.Hour)
+	return repo, func() error {
+		stop()
+		return db.Close()
+	}, nil
+}
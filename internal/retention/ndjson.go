@@ -0,0 +1,171 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/export"
+)
+
+// NDJSONArchive keeps archived orders in a directory as gzipped NDJSON, one
+// file per month of DateCreated: orders-2024-01.ndjson.gz. ArchiveOrders
+// appends a gzip member to each file it touches, so files are never
+// rewritten, and an order archived twice is found by its last copy.
+//
+// Lookups go through an index of which file holds which order. It is built
+// by reading every file on the first lookup and kept up to date afterwards,
+// so the archive is meant to be written by a single process.
+type NDJSONArchive struct {
+	dir string
+
+	mu    sync.Mutex
+	index map[string]string // order uid -> file name, nil until the first lookup
+}
+
+func NewNDJSONArchive(dir string) (*NDJSONArchive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	return &NDJSONArchive{dir: dir}, nil
+}
+
+func (a *NDJSONArchive) ArchiveOrders(ctx context.Context, orders []*domain.Order) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	byFile := make(map[string][]*domain.Order)
+	for _, o := range orders {
+		name := archiveFile(o.DateCreated)
+		byFile[name] = append(byFile[name], o)
+	}
+	for name, batch := range byFile {
+		if err := a.appendFile(name, batch); err != nil {
+			return err
+		}
+		if a.index != nil {
+			for _, o := range batch {
+				a.index[o.OrderUID] = name
+			}
+		}
+	}
+	return nil
+}
+
+// appendFile writes orders as one gzip member at the end of the file. A
+// failed write is cut off again, so the members before it stay readable.
+func (a *NDJSONArchive) appendFile(name string, orders []*domain.Order) (err error) {
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Truncate(info.Size())
+		}
+	}()
+
+	w, err := export.NewWriter(f, export.Options{Format: export.NDJSON, Gzip: true})
+	if err != nil {
+		return err
+	}
+	for _, o := range orders {
+		if err := w.Write(o); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (a *NDJSONArchive) ArchivedOrder(ctx context.Context, id string) (*domain.Order, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.index == nil {
+		if err := a.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+	name, ok := a.index[id]
+	if !ok {
+		return nil, nil
+	}
+	var found *domain.Order
+	err := a.readFile(name, func(o *domain.Order) {
+		if o.OrderUID == id {
+			found = o
+		}
+	})
+	return found, err
+}
+
+func (a *NDJSONArchive) loadIndex() error {
+	names, err := filepath.Glob(filepath.Join(a.dir, "orders-*.ndjson.gz"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	index := make(map[string]string)
+	for _, path := range names {
+		name := filepath.Base(path)
+		err := a.readFile(name, func(o *domain.Order) {
+			index[o.OrderUID] = name
+		})
+		if err != nil {
+			return err
+		}
+	}
+	a.index = index
+	return nil
+}
+
+// readFile passes every order of the file to fn, in the order they were
+// archived.
+func (a *NDJSONArchive) readFile(name string, fn func(*domain.Order)) error {
+	f, err := os.Open(filepath.Join(a.dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	r, err := export.NewReader(gz, export.NDJSON)
+	if err != nil {
+		return err
+	}
+	for {
+		o, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		fn(o)
+	}
+}
+
+func archiveFile(dateCreated time.Time) string {
+	return "orders-" + dateCreated.UTC().Format("2006-01") + ".ndjson.gz"
+}
@@ -0,0 +1,286 @@
+// Package retention keeps storage from growing forever. A job, run on a
+// schedule or on demand, erases the personal data of orders past one age and
+// moves orders past another out of the live tables into an archive, from
+// which they are still served by ID. Every run leaves an audit record.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var tracer = tracing.Tracer("retention")
+
+// Archive targets.
+const (
+	// ArchiveTable keeps archived orders in the order_archive table of the
+	// storage backend.
+	ArchiveTable = "table"
+	// ArchiveNDJSON keeps them in gzipped NDJSON files on local disk.
+	ArchiveNDJSON = "ndjson"
+)
+
+// TriggerSchedule is the trigger of runs started by the schedule.
+const TriggerSchedule = "schedule"
+
+// ErrRunning is returned by Run while another run is in progress.
+var ErrRunning = errors.New("retention run already in progress")
+
+// Store is the part of the order repository the job works on.
+type Store interface {
+	SearchOrders(ctx context.Context, q domain.SearchQuery) ([]*domain.Order, error)
+	// PurgePII replaces up to limit orders created before t, whose personal
+	// data has not been erased yet, and every version of them with the
+	// result of erase. It returns the ids of the orders it changed.
+	PurgePII(ctx context.Context, before time.Time, limit int, erase func(*domain.Order) *domain.Order) ([]string, error)
+	// DeleteOrders removes orders with their versions for good. Unknown ids
+	// are ignored. It is the only way orders leave storage.
+	DeleteOrders(ctx context.Context, ids []string) error
+	SaveRetentionRun(ctx context.Context, run *domain.RetentionRun) error
+	// RetentionRuns returns the latest limit runs, newest first.
+	RetentionRuns(ctx context.Context, limit int) ([]*domain.RetentionRun, error)
+}
+
+// Archive keeps orders moved out of the live tables. Archiving an order
+// again replaces the archived copy.
+type Archive interface {
+	ArchiveOrders(ctx context.Context, orders []*domain.Order) error
+	// ArchivedOrder returns nil, nil for an order that was never archived.
+	ArchivedOrder(ctx context.Context, id string) (*domain.Order, error)
+}
+
+// Evictor drops orders from a cache, e.g. service.OrderCache.
+type Evictor interface {
+	Delete(ctx context.Context, id string)
+}
+
+// Broadcaster tells the other instances of the service to evict orders from
+// their caches, e.g. over NATS.
+type Broadcaster interface {
+	BroadcastEviction(ctx context.Context, ids []string, reason string) error
+}
+
+// Eviction reasons passed to Broadcaster.
+const (
+	EvictPIIPurged = "pii_purged"
+	EvictArchived  = "archived"
+)
+
+type noBroadcast struct{}
+
+func (noBroadcast) BroadcastEviction(context.Context, []string, string) error { return nil }
+
+// Policy says what a run does. Ages are in months; 0 disables the step.
+type Policy struct {
+	ArchiveAfter  int
+	PurgePIIAfter int
+	// Archive names the archive target in audit records.
+	Archive string
+	// BatchSize is the number of orders handled per storage round trip.
+	BatchSize int
+}
+
+type Job struct {
+	store   Store
+	archive Archive
+	cache   Evictor
+	peers   Broadcaster
+	policy  Policy
+	logger  *slog.Logger
+	now     func() time.Time
+
+	// running is held for the duration of a run
+	running sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewJob(store Store, archive Archive, cache Evictor, policy Policy, logger *slog.Logger) *Job {
+	return &Job{
+		store:   store,
+		archive: archive,
+		cache:   cache,
+		peers:   noBroadcast{},
+		policy:  policy,
+		logger:  logger,
+		now:     time.Now,
+	}
+}
+
+// SetBroadcaster makes runs tell the other instances through b to evict the
+// orders they changed, as cache only covers this one. It must be called
+// before the job is started or run.
+func (j *Job) SetBroadcaster(b Broadcaster) {
+	j.peers = b
+}
+
+// Run erases personal data first and archives second, so with PurgePIIAfter
+// no greater than ArchiveAfter nothing reaches the archive unerased. The
+// audit record is written even when the run fails or ctx is cancelled, and
+// is returned along with the error.
+func (j *Job) Run(ctx context.Context, trigger string) (_ *domain.RetentionRun, err error) {
+	if !j.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer j.running.Unlock()
+
+	ctx, span := tracer.Start(ctx, "Job.Run")
+	defer func() { tracing.End(span, err) }()
+
+	now := j.now().UTC()
+	run := &domain.RetentionRun{Trigger: trigger, StartedAt: now, Archive: j.policy.Archive}
+	if j.policy.PurgePIIAfter > 0 {
+		run.PurgePIIBefore = now.AddDate(0, -j.policy.PurgePIIAfter, 0)
+		err = j.purgePII(ctx, run)
+	}
+	if err == nil && j.policy.ArchiveAfter > 0 {
+		run.ArchiveBefore = now.AddDate(0, -j.policy.ArchiveAfter, 0)
+		err = j.archiveOrders(ctx, run)
+	}
+	run.FinishedAt = j.now().UTC()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	span.SetAttributes(
+		attribute.Int("retention.archived", run.Archived),
+		attribute.Int("retention.pii_purged", run.PIIPurged))
+
+	if saveErr := j.store.SaveRetentionRun(context.WithoutCancel(ctx), run); saveErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to save retention run: %w", saveErr))
+	}
+
+	attrs := []any{
+		slog.String("trigger", run.Trigger),
+		slog.Int("archived", run.Archived),
+		slog.Int("piiPurged", run.PIIPurged),
+		slog.String("duration", run.FinishedAt.Sub(run.StartedAt).String()),
+	}
+	if err != nil {
+		j.logger.ErrorContext(ctx, "Retention run failed", append(attrs, slog.String("error", err.Error()))...)
+		return run, err
+	}
+	j.logger.InfoContext(ctx, "Retention run finished", attrs...)
+	return run, nil
+}
+
+func (j *Job) purgePII(ctx context.Context, run *domain.RetentionRun) error {
+	eraser := redact.Eraser()
+	erase := func(o *domain.Order) *domain.Order { return redact.Apply(eraser, o) }
+	for {
+		ids, err := j.store.PurgePII(ctx, run.PurgePIIBefore, j.policy.BatchSize, erase)
+		if err != nil {
+			return fmt.Errorf("failed to purge personal data: %w", err)
+		}
+		// the caches still hold the data as it was
+		if err := j.evict(ctx, ids, EvictPIIPurged); err != nil {
+			return err
+		}
+		run.PIIPurged += len(ids)
+		if len(ids) < j.policy.BatchSize {
+			return nil
+		}
+	}
+}
+
+// archiveOrders copies a batch to the archive before deleting it, so a
+// failure in between leaves orders in both places rather than in neither;
+// the next run archives them again.
+func (j *Job) archiveOrders(ctx context.Context, run *domain.RetentionRun) error {
+	q := domain.SearchQuery{To: run.ArchiveBefore, IncludeDeleted: true, Limit: j.policy.BatchSize}
+	for {
+		orders, err := j.store.SearchOrders(ctx, q)
+		if err != nil {
+			return fmt.Errorf("failed to find orders to archive: %w", err)
+		}
+		if len(orders) == 0 {
+			return nil
+		}
+		if err := j.archive.ArchiveOrders(ctx, orders); err != nil {
+			return fmt.Errorf("failed to archive orders: %w", err)
+		}
+		ids := make([]string, len(orders))
+		for i, o := range orders {
+			ids[i] = o.OrderUID
+		}
+		if err := j.store.DeleteOrders(ctx, ids); err != nil {
+			return fmt.Errorf("failed to delete archived orders: %w", err)
+		}
+		if err := j.evict(ctx, ids, EvictArchived); err != nil {
+			return err
+		}
+		run.Archived += len(orders)
+		if len(orders) < j.policy.BatchSize {
+			return nil
+		}
+	}
+}
+
+// Runs returns the audit records of the latest limit runs, newest first.
+func (j *Job) Runs(ctx context.Context, limit int) ([]*domain.RetentionRun, error) {
+	runs, err := j.store.RetentionRuns(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get retention runs: %w", err)
+	}
+	return runs, nil
+}
+
+// Start runs the job right away and then every interval until Stop.
+func (j *Job) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// a failed run is logged and audited by Run
+			j.Run(ctx, TriggerSchedule)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop cancels a scheduled run in progress and waits for it to record its
+// audit entry.
+func (j *Job) Stop(ctx context.Context) error {
+	if j.cancel == nil {
+		return nil
+	}
+	j.cancel()
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// evict drops orders from the local cache and has the other instances drop
+// them too. A failed broadcast stops the run, so that its audit record shows
+// that other instances may still serve the old copies.
+func (j *Job) evict(ctx context.Context, ids []string, reason string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		j.cache.Delete(ctx, id)
+	}
+	if err := j.peers.BroadcastEviction(ctx, ids, reason); err != nil {
+		return fmt.Errorf("failed to broadcast eviction: %w", err)
+	}
+	return nil
+}
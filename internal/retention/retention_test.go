@@ -0,0 +1,133 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/velvetriddles/wb-level0/internal/redact"
+	"github.com/velvetriddles/wb-level0/internal/repository/memory"
+	"github.com/velvetriddles/wb-level0/internal/repository/repotest"
+)
+
+type evictions []string
+
+func (e *evictions) Delete(_ context.Context, id string) { *e = append(*e, id) }
+
+// broadcasts counts the orders broadcast per reason.
+type broadcasts map[string]int
+
+func (b broadcasts) BroadcastEviction(_ context.Context, ids []string, reason string) error {
+	b[reason] += len(ids)
+	return nil
+}
+
+func TestRunPurgesArchivesAndAudits(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	repo := memory.NewOrderRepository(logger)
+	for uid, months := range map[string]int{"ancient": 20, "old": 14, "aging": 8, "recent": 1} {
+		order := repotest.NewOrder(uid, 1)
+		order.DateCreated = now.AddDate(0, -months, 0)
+		if err := repo.SaveOrder(ctx, order); err != nil {
+			t.Fatalf("SaveOrder %s: %v", uid, err)
+		}
+	}
+	dir := t.TempDir()
+	archive, err := NewNDJSONArchive(dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONArchive: %v", err)
+	}
+
+	var evicted evictions
+	job := NewJob(repo, archive, &evicted, Policy{
+		ArchiveAfter:  12,
+		PurgePIIAfter: 6,
+		Archive:       ArchiveNDJSON,
+		// smaller than the number of due orders, so that steps take batches
+		BatchSize: 1,
+	}, logger)
+	job.now = func() time.Time { return now }
+	peers := broadcasts{}
+	job.SetBroadcaster(peers)
+
+	run, err := job.Run(ctx, "test")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if run.PIIPurged != 3 || run.Archived != 2 || run.Error != "" {
+		t.Errorf("Run: want 3 purged and 2 archived, got %+v", run)
+	}
+	if len(evicted) != 5 {
+		t.Errorf("Run: want every changed order evicted, got %v", evicted)
+	}
+	if peers[EvictPIIPurged] != 3 || peers[EvictArchived] != 2 {
+		t.Errorf("Run: want every changed order evicted on other instances, got %v", peers)
+	}
+
+	for uid, wantLive := range map[string]bool{"ancient": false, "old": false, "aging": true, "recent": true} {
+		live, err := repo.GetOrderByID(ctx, uid)
+		if err != nil {
+			t.Fatalf("GetOrderByID %s: %v", uid, err)
+		}
+		if (live != nil) != wantLive {
+			t.Errorf("%s: want live %v, got %v", uid, wantLive, live != nil)
+		}
+	}
+	if aging, _ := repo.GetOrderByID(ctx, "aging"); aging.Delivery.Phone != redact.Masked {
+		t.Errorf("aging: want personal data erased, got %+v", aging.Delivery)
+	}
+	if recent, _ := repo.GetOrderByID(ctx, "recent"); recent.Delivery.Phone == redact.Masked {
+		t.Errorf("recent: personal data erased too early")
+	}
+
+	// a fresh archive over the same directory rebuilds its index from the files
+	reopened, err := NewNDJSONArchive(dir)
+	if err != nil {
+		t.Fatalf("NewNDJSONArchive: %v", err)
+	}
+	for _, a := range []Archive{archive, reopened} {
+		old, err := a.ArchivedOrder(ctx, "old")
+		if err != nil || old == nil {
+			t.Fatalf("ArchivedOrder old: %v, %v", old, err)
+		}
+		if old.CustomerID != redact.Masked || old.Delivery.Email != redact.Masked {
+			t.Errorf("archived order holds personal data: %+v", old.Delivery)
+		}
+		if got, err := a.ArchivedOrder(ctx, "recent"); err != nil || got != nil {
+			t.Errorf("ArchivedOrder recent: want nil, got %v, %v", got, err)
+		}
+	}
+
+	again, err := job.Run(ctx, "test")
+	if err != nil || again.PIIPurged != 0 || again.Archived != 0 {
+		t.Errorf("second Run: want nothing to do, got %+v, %v", again, err)
+	}
+	runs, err := job.Runs(ctx, 10)
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("Runs: want 2, got %d, %v", len(runs), err)
+	}
+	if runs[1].ID != run.ID || !runs[1].ArchiveBefore.Equal(now.AddDate(-1, 0, 0)) || runs[1].Archive != ArchiveNDJSON {
+		t.Errorf("Runs: audit record mismatch: %+v", runs[1])
+	}
+}
+
+func TestRunRefusesConcurrentRuns(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := memory.NewOrderRepository(logger)
+	job := NewJob(repo, repo, &evictions{}, Policy{ArchiveAfter: 1, BatchSize: 10}, logger)
+
+	job.running.Lock()
+	if _, err := job.Run(context.Background(), "test"); !errors.Is(err, ErrRunning) {
+		t.Errorf("Run during a run: want ErrRunning, got %v", err)
+	}
+	job.running.Unlock()
+	if _, err := job.Run(context.Background(), "test"); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
@@ -1,109 +1,551 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync/atomic"
+	"time"
 
 	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("service")
+
+// OrderRepository stores orders and their versions. Every write records a
+// domain.Version tagged with domain.SourceFromContext. Cancelled orders are
+// kept with their Deletion set: GetOrderByID returns them, GetAllOrders
+// leaves them out and the searches include them only with IncludeDeleted.
 type OrderRepository interface {
-	SaveOrder(order *domain.Order) error
-	GetOrderByID(id string) (*domain.Order, error)
-	GetAllOrders() ([]*domain.Order, error)
+	SaveOrder(ctx context.Context, order *domain.Order) error
+	// SaveOrders stores a batch in one transaction, for bulk imports. Orders
+	// already stored are skipped and their ids returned; OrderUIDs within a
+	// batch must be unique.
+	SaveOrders(ctx context.Context, orders []*domain.Order) (existing []string, err error)
+	GetOrderByID(ctx context.Context, id string) (*domain.Order, error)
+	GetAllOrders(ctx context.Context) ([]*domain.Order, error)
+	// SearchOrders returns the page of orders matching q, newest first.
+	SearchOrders(ctx context.Context, q domain.SearchQuery) ([]*domain.Order, error)
+	// StreamOrders passes every order matching q to fn, newest first, without
+	// loading them all at once. Limit and Offset are ignored. An error from fn
+	// stops the stream and is returned.
+	StreamOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) error
+	// UpdateOrder replaces a stored order and records it as a new version. It
+	// fails with domain.ErrOrderNotFound for an order never saved and with
+	// domain.ErrOrderUnchanged when order equals the latest version.
+	UpdateOrder(ctx context.Context, order *domain.Order) (*domain.Version, error)
+	// OrderVersions returns the versions of an order, oldest first, and none
+	// for an unknown order.
+	OrderVersions(ctx context.Context, id string) ([]*domain.Version, error)
+	// GetOrderAsOf returns the order as it was at t, or nil, nil if it did
+	// not exist yet.
+	GetOrderAsOf(ctx context.Context, id string, t time.Time) (*domain.Order, error)
+	// CancelOrder soft-deletes an order, records it with its Deletion as a
+	// new version and returns it. It fails with domain.ErrOrderNotFound for
+	// an order never saved and with domain.ErrOrderDeleted for one cancelled
+	// before.
+	CancelOrder(ctx context.Context, c domain.Cancellation) (*domain.Order, error)
 }
 
 type OrderCache interface {
-	Set(order *domain.Order)
-	Get(id string) (*domain.Order, bool)
+	Set(ctx context.Context, order *domain.Order)
+	Get(ctx context.Context, id string) (*domain.Order, bool)
+	Delete(ctx context.Context, id string)
 	GetAll() []*domain.Order
-	Restore() error
+	Restore(ctx context.Context) error
+	Search(ctx context.Context, q domain.SearchQuery) []*domain.Order
+	// Complete reports whether the cache holds every stored order, i.e.
+	// nothing was evicted since the last Restore.
+	Complete() bool
+}
+
+// ReadLimiter caps concurrent repository reads so that a burst of cache
+// misses cannot exhaust the database.
+type ReadLimiter interface {
+	Acquire(ctx context.Context) error
+	Release()
 }
 
+// Notifier learns about orders accepted by CreateOrder and UpdateOrder and
+// cancelled by CancelOrder, e.g. to push them to live feeds. It must not
+// block.
+type Notifier interface {
+	OrderCreated(order *domain.Order)
+	OrderUpdated(order *domain.Order, version int)
+	OrderCancelled(order *domain.Order)
+}
+
+// OrderArchive serves orders the retention job moved out of the repository.
+type OrderArchive interface {
+	// ArchivedOrder returns nil, nil for an order that was never archived.
+	ArchivedOrder(ctx context.Context, id string) (*domain.Order, error)
+}
+
+// OrderAnalytics counts orders accepted by CreateOrder into rollups.
+type OrderAnalytics interface {
+	RecordOrder(ctx context.Context, order *domain.Order) error
+}
+
+type noLimit struct{}
+
+func (noLimit) Acquire(context.Context) error { return nil }
+func (noLimit) Release()                      {}
+
+type noNotifier struct{}
+
+func (noNotifier) OrderCreated(*domain.Order)      {}
+func (noNotifier) OrderUpdated(*domain.Order, int) {}
+func (noNotifier) OrderCancelled(*domain.Order)    {}
+
+type noArchive struct{}
+
+func (noArchive) ArchivedOrder(context.Context, string) (*domain.Order, error) { return nil, nil }
+
+type noAnalytics struct{}
+
+func (noAnalytics) RecordOrder(context.Context, *domain.Order) error { return nil }
+
 type OrderService struct {
-	repo   OrderRepository
-	cache  OrderCache
-	logger *slog.Logger
+	repo    OrderRepository
+	cache   OrderCache
+	logger  *slog.Logger
+	rules   atomic.Pointer[domain.Rules]
+	reads   ReadLimiter
+	notify  Notifier
+	archive OrderArchive
+	stats   OrderAnalytics
 }
 
 func NewOrderService(repo OrderRepository, cache OrderCache, logger *slog.Logger) *OrderService {
-	return &OrderService{
-		repo:   repo,
-		cache:  cache,
-		logger: logger,
+	s := &OrderService{
+		repo:    repo,
+		cache:   cache,
+		logger:  logger,
+		reads:   noLimit{},
+		notify:  noNotifier{},
+		archive: noArchive{},
+		stats:   noAnalytics{},
 	}
+	s.rules.Store(&domain.Rules{})
+	return s
+}
+
+// SetReadLimiter makes repository reads on cache misses wait for a slot of l.
+// It must be called before the service is used.
+func (s *OrderService) SetReadLimiter(l ReadLimiter) {
+	s.reads = l
+}
+
+// SetNotifier makes CreateOrder, UpdateOrder and CancelOrder report to n. It
+// must be called before the service is used.
+func (s *OrderService) SetNotifier(n Notifier) {
+	s.notify = n
 }
 
-func (s *OrderService) GetAllOrders() ([]*domain.Order, error) {
+// SetArchive makes GetOrder and GetOrderIncludingDeleted look up orders
+// missing from the repository in a. It must be called before the service is
+// used.
+func (s *OrderService) SetArchive(a OrderArchive) {
+	s.archive = a
+}
+
+// SetAnalytics makes CreateOrder count the orders it stores with a. It must be
+// called before the service is used.
+func (s *OrderService) SetAnalytics(a OrderAnalytics) {
+	s.stats = a
+}
+
+// SetRules swaps the business rules applied by CreateOrder. It is safe to call
+// while orders are being processed.
+func (s *OrderService) SetRules(rules domain.Rules) {
+	s.rules.Store(&rules)
+	s.logger.Info("Business rules updated",
+		slog.Bool("goodsTotal", rules.GoodsTotal),
+		slog.Bool("amount", rules.Amount),
+		slog.Bool("itemTotal", rules.ItemTotal))
+}
+
+func (s *OrderService) GetAllOrders(ctx context.Context) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.GetAllOrders")
+	defer func() { tracing.End(span, err) }()
+
 	cachedOrders := s.cache.GetAll()
-	if len(cachedOrders) > 0 {
-		s.logger.Info("Retrieved all orders from cache",
+	if len(cachedOrders) > 0 && s.cache.Complete() {
+		s.logger.InfoContext(ctx, "Retrieved all orders from cache",
 			slog.Int("count", len(cachedOrders)))
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		return cachedOrders, nil
 	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
 
-
-	orders, err := s.repo.GetAllOrders()
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to get all orders: %w", err)
+	}
+	orders, err := s.repo.GetAllOrders(ctx)
+	s.reads.Release()
 	if err != nil {
-		s.logger.Error("Failed to get all orders from repository",
+		s.logger.ErrorContext(ctx, "Failed to get all orders from repository",
 			slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to get all orders: %w", err)
 	}
 
 	for _, order := range orders {
-		s.cache.Set(order)
+		s.cache.Set(ctx, order)
 	}
 
-	s.logger.Info("Retrieved and cached all orders from repository",
+	s.logger.InfoContext(ctx, "Retrieved and cached all orders from repository",
 		slog.Int("count", len(orders)))
 	return orders, nil
 }
 
-func (s *OrderService) GetOrder(id string) (*domain.Order, error) {
-	if order, found := s.cache.Get(id); found {
-		s.logger.Info("Order found in cache",
+// SearchOrders answers from the cache's index while the cache holds every
+// order, and from the repository otherwise.
+func (s *OrderService) SearchOrders(ctx context.Context, q domain.SearchQuery) (_ []*domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.SearchOrders")
+	defer func() { tracing.End(span, err) }()
+
+	q = q.WithDefaults()
+	// the cache holds no cancelled orders
+	if s.cache.Complete() && !q.IncludeDeleted {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		orders := s.cache.Search(ctx, q)
+		s.logger.DebugContext(ctx, "Searched orders in cache",
+			slog.Int("count", len(orders)))
+		return orders, nil
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to search orders: %w", err)
+	}
+	orders, err := s.repo.SearchOrders(ctx, q)
+	s.reads.Release()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to search orders in repository",
+			slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to search orders: %w", err)
+	}
+	s.logger.DebugContext(ctx, "Searched orders in repository",
+		slog.Int("count", len(orders)))
+	return orders, nil
+}
+
+// ExportOrders streams the orders matching q from the repository to fn. The
+// cache is bypassed: exports need every order, not only the cached ones. The
+// stream holds a read slot for its whole duration.
+func (s *OrderService) ExportOrders(ctx context.Context, q domain.SearchQuery, fn func(*domain.Order) error) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.ExportOrders")
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()))
+		return fmt.Errorf("failed to export orders: %w", err)
+	}
+	defer s.reads.Release()
+
+	count := 0
+	err = s.repo.StreamOrders(ctx, q, func(order *domain.Order) error {
+		count++
+		return fn(order)
+	})
+	span.SetAttributes(attribute.Int("orders.count", count))
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to export orders",
+			slog.String("error", err.Error()),
+			slog.Int("count", count))
+		return fmt.Errorf("failed to export orders: %w", err)
+	}
+	s.logger.InfoContext(ctx, "Exported orders",
+		slog.Int("count", count))
+	return nil
+}
+
+func (s *OrderService) GetOrder(ctx context.Context, id string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.GetOrder",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer func() { tracing.End(span, err) }()
+
+	if order, found := s.cache.Get(ctx, id); found {
+		s.logger.DebugContext(ctx, "Order found in cache",
 			slog.String("orderID", id))
 		return order, nil
 	}
 
-	order, err := s.repo.GetOrderByID(id)
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	order, err := s.repo.GetOrderByID(ctx, id)
+	s.reads.Release()
 	if err != nil {
-		s.logger.Error("Failed to get order from repository",
+		s.logger.ErrorContext(ctx, "Failed to get order from repository",
 			slog.String("error", err.Error()),
 			slog.String("orderID", id))
 		return nil, fmt.Errorf("failed to get order: %w", err)
 	}
 
+	archived := false
+	if order == nil {
+		if order, err = s.archivedOrder(ctx, id); err != nil {
+			return nil, err
+		}
+		archived = order != nil
+	}
 	if order == nil {
-		s.logger.Info("Order not found",
+		s.logger.InfoContext(ctx, "Order not found",
 			slog.String("orderID", id))
 		return nil, nil
 	}
+	if order.Deletion != nil {
+		s.logger.InfoContext(ctx, "Order is cancelled",
+			slog.String("orderID", id))
+		return nil, nil
+	}
+	// archived orders stay out of the cache, which holds live ones only
+	if archived {
+		s.logger.InfoContext(ctx, "Order retrieved from archive",
+			slog.String("orderID", id))
+		return order, nil
+	}
 
-	s.cache.Set(order)
-	s.logger.Info("Order retrieved from repository and cached",
+	s.cache.Set(ctx, order)
+	s.logger.InfoContext(ctx, "Order retrieved from repository and cached",
 		slog.String("orderID", id))
 	return order, nil
 }
 
-func (s *OrderService) CreateOrder(order *domain.Order) error {
-	if err := order.Validate(); err != nil {
-		s.logger.Error("Invalid order data",
-			slog.String("error", err.Error()),
-			slog.String("orderID", order.OrderUID))
+func (s *OrderService) CreateOrder(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.CreateOrder",
+		trace.WithAttributes(attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	// only CancelOrder sets a deletion
+	order.Deletion = nil
+	if err := s.validate(ctx, order); err != nil {
 		return err
 	}
 
-	if err := s.repo.SaveOrder(order); err != nil {
-		s.logger.Error("Failed to save order in repository",
+	if err := s.repo.SaveOrder(ctx, order); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to save order in repository",
 			slog.String("error", err.Error()),
 			slog.String("orderID", order.OrderUID))
 		return fmt.Errorf("failed to save order: %w", err)
 	}
 
-	s.cache.Set(order)
+	s.cache.Set(ctx, order)
+	s.notify.OrderCreated(order)
+	// the order is stored either way; rebuilding the rollups counts it
+	if err := s.stats.RecordOrder(ctx, order); err != nil {
+		s.logger.ErrorContext(ctx, "Failed to record order in analytics",
+			slog.String("error", err.Error()),
+			slog.String("orderID", order.OrderUID))
+	}
 
-	s.logger.Info("Order created and cached",
+	s.logger.InfoContext(ctx, "Order created and cached",
 		slog.String("orderID", order.OrderUID))
 	return nil
 }
+
+// UpdateOrder replaces a stored order after the same checks as CreateOrder.
+// The repository keeps the previous state as a version; an update equal to
+// the stored order fails with domain.ErrOrderUnchanged and changes nothing.
+func (s *OrderService) UpdateOrder(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.UpdateOrder",
+		trace.WithAttributes(attribute.String("order.uid", order.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	order.Deletion = nil
+	if err := s.validate(ctx, order); err != nil {
+		return err
+	}
+
+	version, err := s.repo.UpdateOrder(ctx, order)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to update order in repository",
+			slog.String("error", err.Error()),
+			slog.String("orderID", order.OrderUID))
+		return fmt.Errorf("failed to update order: %w", err)
+	}
+	span.SetAttributes(attribute.Int("order.version", version.Version))
+
+	s.cache.Set(ctx, order)
+	s.notify.OrderUpdated(order, version.Version)
+
+	s.logger.InfoContext(ctx, "Order updated and cached",
+		slog.String("orderID", order.OrderUID),
+		slog.Int("version", version.Version),
+		slog.String("source", version.Source))
+	return nil
+}
+
+// OrderVersions returns the history of an order, oldest first, from the
+// repository.
+func (s *OrderService) OrderVersions(ctx context.Context, id string) (_ []*domain.Version, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.OrderVersions",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order versions: %w", err)
+	}
+	versions, err := s.repo.OrderVersions(ctx, id)
+	s.reads.Release()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to get order versions from repository",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order versions: %w", err)
+	}
+	span.SetAttributes(attribute.Int("order.versions", len(versions)))
+	return versions, nil
+}
+
+// GetOrderAsOf returns the order as it was at t, or nil if it did not exist
+// yet. The cache only holds current orders, so this always reads the
+// repository.
+func (s *OrderService) GetOrderAsOf(ctx context.Context, id string, t time.Time) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.GetOrderAsOf",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	order, err := s.repo.GetOrderAsOf(ctx, id, t)
+	s.reads.Release()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to get order version from repository",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	return order, nil
+}
+
+// GetOrderIncludingDeleted is GetOrder for callers allowed to see cancelled
+// orders. Those are never cached, so a miss always reads the repository.
+func (s *OrderService) GetOrderIncludingDeleted(ctx context.Context, id string) (_ *domain.Order, err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.GetOrderIncludingDeleted",
+		trace.WithAttributes(attribute.String("order.uid", id)))
+	defer func() { tracing.End(span, err) }()
+
+	if order, found := s.cache.Get(ctx, id); found {
+		return order, nil
+	}
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Repository read refused",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	order, err := s.repo.GetOrderByID(ctx, id)
+	s.reads.Release()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to get order from repository",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	if order == nil {
+		return s.archivedOrder(ctx, id)
+	}
+	return order, nil
+}
+
+// archivedOrder reads an order from the archive, under the same read limit
+// as the repository.
+func (s *OrderService) archivedOrder(ctx context.Context, id string) (*domain.Order, error) {
+	if err := s.reads.Acquire(ctx); err != nil {
+		s.logger.WarnContext(ctx, "Archive read refused",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	order, err := s.archive.ArchivedOrder(ctx, id)
+	s.reads.Release()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Failed to get order from archive",
+			slog.String("error", err.Error()),
+			slog.String("orderID", id))
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	return order, nil
+}
+
+// CancelOrder soft-deletes an order and evicts it from the cache. An order
+// cancelled before, e.g. by another instance handling the same message,
+// fails with domain.ErrOrderDeleted but is still evicted, so that every
+// instance drops it.
+func (s *OrderService) CancelOrder(ctx context.Context, c domain.Cancellation) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.CancelOrder",
+		trace.WithAttributes(attribute.String("order.uid", c.OrderUID)))
+	defer func() { tracing.End(span, err) }()
+
+	order, err := s.repo.CancelOrder(ctx, c)
+	if err != nil && !errors.Is(err, domain.ErrOrderDeleted) {
+		s.logger.ErrorContext(ctx, "Failed to cancel order in repository",
+			slog.String("error", err.Error()),
+			slog.String("orderID", c.OrderUID))
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	s.cache.Delete(ctx, c.OrderUID)
+	if err != nil {
+		s.logger.InfoContext(ctx, "Order already cancelled, evicted from cache",
+			slog.String("orderID", c.OrderUID))
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	s.notify.OrderCancelled(order)
+
+	s.logger.InfoContext(ctx, "Order cancelled and evicted from cache",
+		slog.String("orderID", c.OrderUID),
+		slog.String("reason", c.Reason))
+	return nil
+}
+
+// EvictOrders drops orders from the cache, so that the next read sees them
+// as stored, e.g. after the retention job changed or removed them.
+func (s *OrderService) EvictOrders(ctx context.Context, ids []string, reason string) {
+	for _, id := range ids {
+		s.cache.Delete(ctx, id)
+	}
+	s.logger.InfoContext(ctx, "Orders evicted from cache",
+		slog.Int("count", len(ids)),
+		slog.String("reason", reason))
+}
+
+func (s *OrderService) validate(ctx context.Context, order *domain.Order) (err error) {
+	ctx, span := tracer.Start(ctx, "OrderService.validate")
+	defer func() { tracing.End(span, err) }()
+
+	if err := order.Validate(); err != nil {
+		s.logger.ErrorContext(ctx, "Invalid order data",
+			slog.String("error", err.Error()),
+			slog.String("orderID", order.OrderUID))
+		return err
+	}
+
+	if err := s.rules.Load().Check(order); err != nil {
+		s.logger.ErrorContext(ctx, "Order breaks business rule",
+			slog.String("error", err.Error()),
+			slog.String("orderID", order.OrderUID))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package templates
+
+import "embed"
+
+// FS holds the HTML views so the binary does not depend on the working directory.
+//
+//go:embed *.html
+var FS embed.FS
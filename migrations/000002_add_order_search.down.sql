@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS orders_date_created_idx;
+DROP INDEX IF EXISTS orders_search_all_idx;
+DROP INDEX IF EXISTS orders_search_public_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS search_all, DROP COLUMN IF EXISTS search_public;
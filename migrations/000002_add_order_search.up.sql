@@ -0,0 +1,25 @@
+-- Full-text search over orders. The vectors are written by the application
+-- from domain.SearchTerms; the backfill below approximates its tokenizer.
+ALTER TABLE orders
+    ADD COLUMN search_public tsvector,
+    ADD COLUMN search_all tsvector;
+
+UPDATE orders o
+SET search_public = to_tsvector('simple', s.public_text),
+    search_all = to_tsvector('simple', s.public_text || ' ' || s.private_text)
+FROM (
+    SELECT o.order_uid,
+           regexp_replace(lower(concat_ws(' ', d.city,
+               (SELECT string_agg(i.brand || ' ' || i.name, ' ') FROM items i WHERE i.order_uid = o.order_uid))),
+               '[^[:alnum:]]+', ' ', 'g') AS public_text,
+           regexp_replace(lower(concat_ws(' ', o.customer_id, d.name, d.email)),
+               '[^[:alnum:]]+', ' ', 'g') AS private_text
+    FROM orders o
+    JOIN delivery d ON d.order_uid = o.order_uid
+) s
+WHERE s.order_uid = o.order_uid;
+
+CREATE INDEX orders_search_public_idx ON orders USING GIN (search_public);
+CREATE INDEX orders_search_all_idx ON orders USING GIN (search_all);
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC, order_uid);
+CREATE INDEX IF NOT EXISTS items_order_uid_idx ON items (order_uid);
@@ -0,0 +1,45 @@
+-- Every accepted change to an order is kept as a full JSON snapshot of
+-- domain.Order. Orders stored before this migration get their current state
+-- as version 1, dated when the order was created.
+CREATE TABLE order_versions (
+    order_uid VARCHAR(255) NOT NULL,
+    version INTEGER NOT NULL,
+    source VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    snapshot JSONB NOT NULL,
+    PRIMARY KEY (order_uid, version),
+    FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE
+);
+
+INSERT INTO order_versions (order_uid, version, source, created_at, snapshot)
+SELECT o.order_uid, 1, 'unknown', o.date_created AT TIME ZONE 'UTC',
+       jsonb_build_object(
+           'order_uid', o.order_uid,
+           'track_number', o.track_number,
+           'entry', o.entry,
+           'delivery', jsonb_build_object(
+               'name', d.name, 'phone', d.phone, 'zip', d.zip, 'city', d.city,
+               'address', d.address, 'region', d.region, 'email', d.email),
+           'payment', jsonb_build_object(
+               'transaction', p.transaction, 'request_id', p.request_id, 'currency', p.currency,
+               'provider', p.provider, 'amount', p.amount, 'payment_dt', p.payment_dt, 'bank', p.bank,
+               'delivery_cost', p.delivery_cost, 'goods_total', p.goods_total, 'custom_fee', p.custom_fee),
+           'items', COALESCE((
+               SELECT jsonb_agg(jsonb_build_object(
+                          'chrt_id', i.chrt_id, 'track_number', i.track_number, 'price', i.price,
+                          'rid', i.rid, 'name', i.name, 'sale', i.sale, 'size', i.size,
+                          'total_price', i.total_price, 'nm_id', i.nm_id, 'brand', i.brand,
+                          'status', i.status) ORDER BY i.item_id)
+               FROM items i WHERE i.order_uid = o.order_uid), '[]'::jsonb),
+           'locale', o.locale,
+           'internal_signature', o.internal_signature,
+           'customer_id', o.customer_id,
+           'delivery_service', o.delivery_service,
+           'shardkey', o.shardkey,
+           'sm_id', o.sm_id,
+           -- the RFC 3339 form encoding/json expects
+           'date_created', to_char(o.date_created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+           'oof_shard', o.oof_shard)
+FROM orders o
+JOIN delivery d ON d.order_uid = o.order_uid
+JOIN payment p ON p.order_uid = o.order_uid;
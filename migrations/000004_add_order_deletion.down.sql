@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS orders_live_date_created_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS delete_reason, DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,8 @@
+-- Cancelled orders are kept and hidden: deleted_at is set instead of
+-- deleting the rows. Only the retention job removes them for good.
+ALTER TABLE orders
+    ADD COLUMN deleted_at TIMESTAMPTZ,
+    ADD COLUMN delete_reason TEXT;
+
+-- the default listing and the cache restore read live orders only
+CREATE INDEX orders_live_date_created_idx ON orders (date_created DESC, order_uid) WHERE deleted_at IS NULL;
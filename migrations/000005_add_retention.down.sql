@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS retention_runs;
+DROP TABLE IF EXISTS order_archive;
+DROP INDEX IF EXISTS orders_pii_due_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS pii_purged_at;
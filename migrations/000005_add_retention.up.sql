@@ -0,0 +1,30 @@
+-- Retention: orders whose personal data was erased are marked, archived
+-- orders are kept as JSON snapshots in a table partitioned by year of
+-- date_created (the job creates the partitions it needs), and every run of
+-- the job leaves an audit record.
+ALTER TABLE orders ADD COLUMN pii_purged_at TIMESTAMPTZ;
+
+CREATE INDEX orders_pii_due_idx ON orders (date_created) WHERE pii_purged_at IS NULL;
+
+CREATE TABLE order_archive (
+    order_uid VARCHAR(255) NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    snapshot JSONB NOT NULL,
+    PRIMARY KEY (order_uid, date_created)
+) PARTITION BY RANGE (date_created);
+
+CREATE INDEX order_archive_order_uid_idx ON order_archive (order_uid);
+
+CREATE TABLE retention_runs (
+    id BIGSERIAL PRIMARY KEY,
+    triggered_by VARCHAR(255) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    archive VARCHAR(32) NOT NULL,
+    archive_before TIMESTAMPTZ,
+    purge_pii_before TIMESTAMPTZ,
+    archived INTEGER NOT NULL,
+    pii_purged INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,118 @@
+-- Back to plain tables keyed by order_uid.
+ALTER TABLE order_versions DROP CONSTRAINT order_versions_order_uid_fkey;
+ALTER SEQUENCE items_item_id_seq OWNED BY NONE;
+
+DROP INDEX orders_search_public_idx, orders_search_all_idx, orders_date_created_idx,
+    orders_live_date_created_idx, orders_pii_due_idx, items_order_uid_idx;
+ALTER TABLE orders RENAME TO orders_partitioned;
+ALTER TABLE delivery RENAME TO delivery_partitioned;
+ALTER TABLE payment RENAME TO payment_partitioned;
+ALTER TABLE items RENAME TO items_partitioned;
+ALTER INDEX orders_pkey RENAME TO orders_partitioned_pkey;
+ALTER INDEX delivery_pkey RENAME TO delivery_partitioned_pkey;
+ALTER INDEX payment_pkey RENAME TO payment_partitioned_pkey;
+ALTER INDEX items_pkey RENAME TO items_partitioned_pkey;
+
+CREATE TABLE orders (
+    order_uid VARCHAR(255) PRIMARY KEY,
+    track_number VARCHAR(255),
+    entry VARCHAR(255),
+    locale VARCHAR(255),
+    internal_signature VARCHAR(255),
+    customer_id VARCHAR(255),
+    delivery_service VARCHAR(255),
+    shardkey VARCHAR(255),
+    sm_id INTEGER,
+    date_created TIMESTAMP,
+    oof_shard VARCHAR(255),
+    search_public tsvector,
+    search_all tsvector,
+    deleted_at TIMESTAMPTZ,
+    delete_reason TEXT,
+    pii_purged_at TIMESTAMPTZ
+);
+
+CREATE TABLE delivery (
+    order_uid VARCHAR(255),
+    name VARCHAR(255),
+    phone VARCHAR(255),
+    zip VARCHAR(255),
+    city VARCHAR(255),
+    address VARCHAR(255),
+    region VARCHAR(255),
+    email VARCHAR(255),
+    PRIMARY KEY (order_uid),
+    FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE
+);
+
+CREATE TABLE payment (
+    order_uid VARCHAR(255),
+    transaction VARCHAR(255),
+    request_id VARCHAR(255),
+    currency VARCHAR(255),
+    provider VARCHAR(255),
+    amount INTEGER,
+    payment_dt INTEGER,
+    bank VARCHAR(255),
+    delivery_cost INTEGER,
+    goods_total INTEGER,
+    custom_fee INTEGER,
+    PRIMARY KEY (order_uid),
+    FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE
+);
+
+CREATE TABLE items (
+    item_id INTEGER NOT NULL DEFAULT nextval('items_item_id_seq') PRIMARY KEY,
+    order_uid VARCHAR(255),
+    chrt_id INTEGER,
+    track_number VARCHAR(255),
+    price INTEGER,
+    rid VARCHAR(255),
+    name VARCHAR(255),
+    sale INTEGER,
+    size VARCHAR(255),
+    total_price INTEGER,
+    nm_id INTEGER,
+    brand VARCHAR(255),
+    status INTEGER,
+    FOREIGN KEY (order_uid) REFERENCES orders(order_uid) ON DELETE CASCADE
+);
+
+ALTER SEQUENCE items_item_id_seq OWNED BY items.item_id;
+
+INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+                    shardkey, sm_id, date_created, oof_shard, search_public, search_all, deleted_at, delete_reason,
+                    pii_purged_at)
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+       shardkey, sm_id, date_created, oof_shard, search_public, search_all, deleted_at, delete_reason,
+       pii_purged_at
+FROM orders_partitioned;
+
+INSERT INTO delivery (order_uid, name, phone, zip, city, address, region, email)
+SELECT order_uid, name, phone, zip, city, address, region, email FROM delivery_partitioned;
+
+INSERT INTO payment (order_uid, transaction, request_id, currency, provider, amount, payment_dt, bank,
+                     delivery_cost, goods_total, custom_fee)
+SELECT order_uid, transaction, request_id, currency, provider, amount, payment_dt, bank,
+       delivery_cost, goods_total, custom_fee
+FROM payment_partitioned;
+
+INSERT INTO items (item_id, order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price,
+                   nm_id, brand, status)
+SELECT item_id, order_uid, chrt_id, track_number, price, rid, name, sale, size, total_price,
+       nm_id, brand, status
+FROM items_partitioned;
+
+DROP TABLE items_partitioned, payment_partitioned, delivery_partitioned, orders_partitioned, order_index;
+DROP FUNCTION create_order_partitions(TIMESTAMP);
+
+ALTER TABLE order_versions
+    ADD CONSTRAINT order_versions_order_uid_fkey
+    FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON DELETE CASCADE;
+
+CREATE INDEX orders_search_public_idx ON orders USING GIN (search_public);
+CREATE INDEX orders_search_all_idx ON orders USING GIN (search_all);
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC, order_uid);
+CREATE INDEX orders_live_date_created_idx ON orders (date_created DESC, order_uid) WHERE deleted_at IS NULL;
+CREATE INDEX orders_pii_due_idx ON orders (date_created) WHERE pii_purged_at IS NULL;
+CREATE INDEX items_order_uid_idx ON items (order_uid);
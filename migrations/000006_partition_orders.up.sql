@@ -0,0 +1,173 @@
+-- Range partitioning of orders, delivery, payment and items by month of
+-- date_created. The detail tables carry date_created as well, so every table
+-- is pruned by the same key and joins can go partition by partition.
+--
+-- A primary key of a partitioned table must contain the partition key, so
+-- order_uid alone is unique only in order_index, which maps it to
+-- date_created for lookups by id. The other tables hang off it: deleting an
+-- order from order_index removes its rows everywhere.
+--
+-- Partitions are created by create_order_partitions(): below for the months
+-- already stored and the next few, by the application ahead of time and
+-- before writing an order into a month that has none yet.
+ALTER TABLE order_versions DROP CONSTRAINT order_versions_order_uid_fkey;
+
+DROP INDEX orders_search_public_idx, orders_search_all_idx, orders_date_created_idx,
+    orders_live_date_created_idx, orders_pii_due_idx, items_order_uid_idx;
+ALTER TABLE orders RENAME TO orders_unpartitioned;
+ALTER TABLE delivery RENAME TO delivery_unpartitioned;
+ALTER TABLE payment RENAME TO payment_unpartitioned;
+ALTER TABLE items RENAME TO items_unpartitioned;
+ALTER INDEX orders_pkey RENAME TO orders_unpartitioned_pkey;
+ALTER INDEX delivery_pkey RENAME TO delivery_unpartitioned_pkey;
+ALTER INDEX payment_pkey RENAME TO payment_unpartitioned_pkey;
+ALTER INDEX items_pkey RENAME TO items_unpartitioned_pkey;
+-- item ids keep counting from where they are
+ALTER SEQUENCE items_item_id_seq OWNED BY NONE;
+
+CREATE TABLE order_index (
+    order_uid VARCHAR(255) PRIMARY KEY,
+    date_created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE orders (
+    order_uid VARCHAR(255) NOT NULL REFERENCES order_index (order_uid) ON DELETE CASCADE,
+    track_number VARCHAR(255),
+    entry VARCHAR(255),
+    locale VARCHAR(255),
+    internal_signature VARCHAR(255),
+    customer_id VARCHAR(255),
+    delivery_service VARCHAR(255),
+    shardkey VARCHAR(255),
+    sm_id INTEGER,
+    date_created TIMESTAMP NOT NULL,
+    oof_shard VARCHAR(255),
+    search_public tsvector,
+    search_all tsvector,
+    deleted_at TIMESTAMPTZ,
+    delete_reason TEXT,
+    pii_purged_at TIMESTAMPTZ,
+    PRIMARY KEY (order_uid, date_created)
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE delivery (
+    order_uid VARCHAR(255) NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    name VARCHAR(255),
+    phone VARCHAR(255),
+    zip VARCHAR(255),
+    city VARCHAR(255),
+    address VARCHAR(255),
+    region VARCHAR(255),
+    email VARCHAR(255),
+    PRIMARY KEY (order_uid, date_created),
+    FOREIGN KEY (order_uid, date_created) REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE payment (
+    order_uid VARCHAR(255) NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    transaction VARCHAR(255),
+    request_id VARCHAR(255),
+    currency VARCHAR(255),
+    provider VARCHAR(255),
+    amount INTEGER,
+    payment_dt INTEGER,
+    bank VARCHAR(255),
+    delivery_cost INTEGER,
+    goods_total INTEGER,
+    custom_fee INTEGER,
+    PRIMARY KEY (order_uid, date_created),
+    FOREIGN KEY (order_uid, date_created) REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+CREATE TABLE items (
+    item_id INTEGER NOT NULL DEFAULT nextval('items_item_id_seq'),
+    order_uid VARCHAR(255) NOT NULL,
+    date_created TIMESTAMP NOT NULL,
+    chrt_id INTEGER,
+    track_number VARCHAR(255),
+    price INTEGER,
+    rid VARCHAR(255),
+    name VARCHAR(255),
+    sale INTEGER,
+    size VARCHAR(255),
+    total_price INTEGER,
+    nm_id INTEGER,
+    brand VARCHAR(255),
+    status INTEGER,
+    PRIMARY KEY (item_id, date_created),
+    FOREIGN KEY (order_uid, date_created) REFERENCES orders (order_uid, date_created) ON DELETE CASCADE
+) PARTITION BY RANGE (date_created);
+
+ALTER SEQUENCE items_item_id_seq OWNED BY items.item_id;
+
+-- create_order_partitions creates the partitions of all four tables for the
+-- month containing day, named like orders_y2024m01, unless they exist. The
+-- advisory lock keeps instances creating the same month from colliding.
+CREATE FUNCTION create_order_partitions(day TIMESTAMP) RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    lo TIMESTAMP := date_trunc('month', day);
+    hi TIMESTAMP := date_trunc('month', day) + INTERVAL '1 month';
+    suffix TEXT := to_char(date_trunc('month', day), '"y"YYYY"m"MM');
+    parent TEXT;
+BEGIN
+    PERFORM pg_advisory_xact_lock(727501);
+    FOREACH parent IN ARRAY ARRAY['orders', 'delivery', 'payment', 'items'] LOOP
+        IF to_regclass(parent || '_' || suffix) IS NULL THEN
+            EXECUTE format('CREATE TABLE %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                           parent || '_' || suffix, parent, lo, hi);
+        END IF;
+    END LOOP;
+END;
+$$;
+
+SELECT create_order_partitions(m)
+FROM (
+    SELECT DISTINCT date_trunc('month', COALESCE(date_created, 'epoch')) AS m FROM orders_unpartitioned
+    UNION
+    SELECT date_trunc('month', now() AT TIME ZONE 'UTC') + make_interval(months => n) FROM generate_series(0, 3) n
+) months;
+
+-- orders never had a NULL date_created from the application; should one
+-- exist it goes to 1970
+INSERT INTO order_index (order_uid, date_created)
+SELECT order_uid, COALESCE(date_created, 'epoch') FROM orders_unpartitioned;
+
+INSERT INTO orders (order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+                    shardkey, sm_id, date_created, oof_shard, search_public, search_all, deleted_at, delete_reason,
+                    pii_purged_at)
+SELECT order_uid, track_number, entry, locale, internal_signature, customer_id, delivery_service,
+       shardkey, sm_id, COALESCE(date_created, 'epoch'), oof_shard, search_public, search_all, deleted_at, delete_reason,
+       pii_purged_at
+FROM orders_unpartitioned;
+
+INSERT INTO delivery (order_uid, date_created, name, phone, zip, city, address, region, email)
+SELECT d.order_uid, x.date_created, d.name, d.phone, d.zip, d.city, d.address, d.region, d.email
+FROM delivery_unpartitioned d JOIN order_index x ON x.order_uid = d.order_uid;
+
+INSERT INTO payment (order_uid, date_created, transaction, request_id, currency, provider, amount, payment_dt, bank,
+                     delivery_cost, goods_total, custom_fee)
+SELECT p.order_uid, x.date_created, p.transaction, p.request_id, p.currency, p.provider, p.amount, p.payment_dt, p.bank,
+       p.delivery_cost, p.goods_total, p.custom_fee
+FROM payment_unpartitioned p JOIN order_index x ON x.order_uid = p.order_uid;
+
+INSERT INTO items (item_id, order_uid, date_created, chrt_id, track_number, price, rid, name, sale, size, total_price,
+                   nm_id, brand, status)
+SELECT i.item_id, i.order_uid, x.date_created, i.chrt_id, i.track_number, i.price, i.rid, i.name, i.sale, i.size,
+       i.total_price, i.nm_id, i.brand, i.status
+FROM items_unpartitioned i JOIN order_index x ON x.order_uid = i.order_uid;
+
+DROP TABLE items_unpartitioned, payment_unpartitioned, delivery_unpartitioned, orders_unpartitioned;
+
+ALTER TABLE order_versions
+    ADD CONSTRAINT order_versions_order_uid_fkey
+    FOREIGN KEY (order_uid) REFERENCES order_index (order_uid) ON DELETE CASCADE;
+
+CREATE INDEX orders_search_public_idx ON orders USING GIN (search_public);
+CREATE INDEX orders_search_all_idx ON orders USING GIN (search_all);
+CREATE INDEX orders_date_created_idx ON orders (date_created DESC, order_uid);
+CREATE INDEX orders_live_date_created_idx ON orders (date_created DESC, order_uid) WHERE deleted_at IS NULL;
+CREATE INDEX orders_pii_due_idx ON orders (date_created) WHERE pii_purged_at IS NULL;
+CREATE INDEX items_order_uid_idx ON items (order_uid, date_created);
@@ -0,0 +1,15 @@
+-- Analytics: counters of orders per hour, day and week, per total,
+-- brand, delivery service or payment provider and per currency, added to
+-- as orders are created. bucket_start is the UTC start of the bucket.
+CREATE TABLE order_rollups (
+    grain VARCHAR(8) NOT NULL,
+    dimension VARCHAR(32) NOT NULL,
+    bucket_start TIMESTAMP NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    currency VARCHAR(16) NOT NULL,
+    orders BIGINT NOT NULL,
+    items BIGINT NOT NULL,
+    revenue BIGINT NOT NULL,
+    delivery_cost BIGINT NOT NULL,
+    PRIMARY KEY (grain, dimension, bucket_start, key, currency)
+);
@@ -0,0 +1,9 @@
+// Package migrations embeds the Postgres schema migrations so that binaries
+// can apply them without the source tree. Files follow the golang-migrate
+// naming: NNNNNN_name.up.sql and NNNNNN_name.down.sql.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
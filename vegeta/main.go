@@ -0,0 +1,272 @@
+// Command vegeta load tests the order service with a YAML scenario:
+//
+//	go run ./vegeta [flags] vegeta/scenarios/mixed.yaml
+//
+// Every target of the scenario is attacked at its share of the stage rate
+// while the optional publish load sends orders to NATS. The results, a text
+// and an HTML report with per-target percentiles, a latency plot and
+// metrics.json are written to --out. Pass a saved metrics.json as --baseline
+// to compare the run with it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+	"github.com/tsenart/vegeta/v12/lib/plot"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/logger"
+)
+
+// errRegressed makes the command exit with 1 after the reports are written.
+var errRegressed = errors.New("regressed against the baseline")
+
+// configFlags are passed on to config.Load.
+var configFlags = []string{"config", "http-port", "database-url", "nats-url", "nats-subject", "storage-driver"}
+
+type options struct {
+	out           string
+	format        string
+	baseline      string
+	saveBaseline  string
+	maxRegression float64
+}
+
+func main() {
+	fs := pflag.NewFlagSet("vegeta", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: vegeta [flags] SCENARIO.yaml")
+		fs.PrintDefaults()
+	}
+	var opts options
+	fs.StringVarP(&opts.out, "out", "o", "", "directory for results and reports (default vegeta/results/NAME-TIME)")
+	fs.StringVar(&opts.format, "format", "bin", "results encoding: bin (vegeta encode) or json")
+	fs.StringVar(&opts.baseline, "baseline", "", "metrics.json of an earlier run to compare with")
+	fs.StringVar(&opts.saveBaseline, "save-baseline", "", "also copy this run's metrics.json to this path")
+	fs.Float64Var(&opts.maxRegression, "max-regression", 0.2, "fail when a target's p95 grows by more than this share of the baseline; 0 only compares")
+	for _, name := range configFlags {
+		fs.String(name, "", "service config, see cmd/app")
+	}
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if fs.NArg() != 1 || (opts.format != "bin" && opts.format != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var cfgArgs []string
+	fs.Visit(func(f *pflag.Flag) {
+		for _, name := range configFlags {
+			if f.Name == name {
+				cfgArgs = append(cfgArgs, "--"+name+"="+f.Value.String())
+			}
+		}
+	})
+	cfg, err := config.Load(cfgArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vegeta: failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	log := logger.New(logger.Options{
+		Level:  logger.NewLevel(cfg.LogLevel),
+		Format: logger.FormatText,
+		Output: os.Stderr,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg, log, fs.Arg(0), opts); err != nil {
+		fmt.Fprintf(os.Stderr, "vegeta: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, cfg *config.Config, log *slog.Logger, path string, opts options) error {
+	s, err := LoadScenario(path)
+	if err != nil {
+		return err
+	}
+	if s.BaseURL == "" {
+		s.BaseURL = "http://" + cfg.HTTPPort
+		if strings.HasPrefix(cfg.HTTPPort, ":") {
+			s.BaseURL = "http://localhost" + cfg.HTTPPort
+		}
+	}
+	var base *Summary
+	if opts.baseline != "" {
+		if base, err = readSummary(opts.baseline); err != nil {
+			return err
+		}
+	}
+	ids, err := loadIDs(ctx, cfg, s, log)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	if opts.out == "" {
+		opts.out = filepath.Join("vegeta", "results", s.Name+"-"+started.Format("20060102-150405"))
+	}
+	if err := os.MkdirAll(opts.out, 0o755); err != nil {
+		return err
+	}
+	resultsFile, err := os.Create(filepath.Join(opts.out, "results."+opts.format))
+	if err != nil {
+		return err
+	}
+	defer resultsFile.Close()
+	enc := vegeta.NewEncoder(resultsFile)
+	if opts.format == "json" {
+		enc = vegeta.NewJSONEncoder(resultsFile)
+	}
+
+	log.Info("Attack started", slog.String("scenario", s.Name), slog.String("url", s.BaseURL),
+		slog.Duration("duration", s.Duration()), slog.String("out", opts.out))
+	sum := newSummary(s, started)
+	var total vegeta.Metrics
+	p := plot.New(plot.Title(s.Name), plot.Label(func(r *vegeta.Result) string { return r.Attack }))
+	for r := range attack(ctx, cfg, s, ids, log) {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("failed to write results: %w", err)
+		}
+		sum.Add(r)
+		total.Add(r)
+		if err := p.Add(r); err != nil {
+			return err
+		}
+	}
+	sum.Close()
+	total.Close()
+	p.Close()
+
+	var cmp []Comparison
+	if base != nil {
+		cmp = compare(sum, base, opts.maxRegression)
+	}
+	if err := writeReports(opts.out, sum, &total, cmp, p); err != nil {
+		return err
+	}
+	if opts.saveBaseline != "" {
+		if err := writeJSON(opts.saveBaseline, sum); err != nil {
+			return err
+		}
+	}
+	for _, c := range cmp {
+		if c.Regressed {
+			return fmt.Errorf("%s %w", c.Name, errRegressed)
+		}
+	}
+	return nil
+}
+
+// attack runs the targets and the publish load together and merges their
+// results. The channel is closed when the last stage ends or ctx is done.
+func attack(ctx context.Context, cfg *config.Config, s *Scenario, ids *orderIDs, log *slog.Logger) <-chan *vegeta.Result {
+	results := make(chan *vegeta.Result, 1024)
+	var wg sync.WaitGroup
+
+	var weights int
+	for _, t := range s.Targets {
+		weights += t.Weight
+	}
+	for i, t := range s.Targets {
+		attacker := vegeta.NewAttacker(vegeta.Timeout(s.Timeout), vegeta.Workers(s.Workers))
+		pacer := stagePacer{stages: s.Stages, share: float64(t.Weight) / float64(weights)}
+		hits := attacker.Attack(targeter(s, t, ids, s.Seed+int64(i)), pacer, s.Duration(), t.Name)
+		go func() {
+			<-ctx.Done()
+			attacker.Stop()
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range hits {
+				results <- r
+			}
+		}()
+	}
+
+	if s.Publish != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, s.Duration())
+			defer cancel()
+			if err := publishLoad(pctx, cfg, s.Publish, results, log); err != nil {
+				log.Error("Publish load failed", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+func writeReports(dir string, sum *Summary, total *vegeta.Metrics, cmp []Comparison, p *plot.Plot) error {
+	if err := writeJSON(filepath.Join(dir, "metrics.json"), sum); err != nil {
+		return err
+	}
+
+	var text bytes.Buffer
+	if err := writeText(&text, sum, cmp); err != nil {
+		return err
+	}
+	text.WriteString("\ntotal\n")
+	if err := vegeta.NewTextReporter(total).Report(&text); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), text.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if _, err := io.Copy(os.Stdout, &text); err != nil {
+		return err
+	}
+
+	var html bytes.Buffer
+	if err := htmlReport.Execute(&html, report{Summary: sum, Comparison: cmp}); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "report.html"), html.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "plot.html"))
+	if err != nil {
+		return err
+	}
+	if _, err := p.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain/generator"
+	natsclient "github.com/velvetriddles/wb-level0/internal/nats"
+	"golang.org/x/time/rate"
+)
+
+// publishAttack is the attack name of NATS publish results.
+const publishAttack = "nats_publish"
+
+// publishLoad publishes generated orders through the Publisher at p.Rate
+// until ctx is done, and sends one result per message to results. The
+// latency is the time until JetStream acknowledged the message.
+func publishLoad(ctx context.Context, cfg *config.Config, p *PublishLoad, results chan<- *vegeta.Result, log *slog.Logger) error {
+	nc, err := nats.Connect(cfg.NatsURL)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	subject := p.Subject
+	if subject == "" {
+		subject = cfg.NatsSubject
+	}
+	gcfg := generator.DefaultConfig(p.Seed)
+	gen, err := generator.New(gcfg)
+	if err != nil {
+		return err
+	}
+	// the generator is not safe for concurrent use
+	var genMu sync.Mutex
+	next := func() generator.Sample {
+		genMu.Lock()
+		defer genMu.Unlock()
+		return gen.Sample(p.Mutate, nil)
+	}
+
+	publisher := natsclient.NewPublisher(js, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	limiter := rate.NewLimiter(rate.Limit(p.Rate), 1)
+	var seq atomic.Uint64
+
+	log.Info("Publishing orders", slog.String("subject", subject), slog.Float64("rate", p.Rate), slog.Int("workers", p.Workers))
+	var wg sync.WaitGroup
+	for i := 0; i < p.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for limiter.Wait(ctx) == nil {
+				sample := next()
+				start := time.Now()
+				err := publisher.Publish(ctx, subject, sample.Data)
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					return
+				}
+				res := &vegeta.Result{
+					Attack:    publishAttack,
+					Seq:       seq.Add(1) - 1,
+					Timestamp: start,
+					Latency:   time.Since(start),
+					BytesOut:  uint64(len(sample.Data)),
+					Method:    "PUB",
+					URL:       "nats://" + subject,
+					Code:      200,
+				}
+				if err != nil {
+					res.Code, res.Error = 0, err.Error()
+				}
+				results <- res
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+// Summary is a run's metrics, written as metrics.json. A saved summary is
+// the baseline later runs are compared with.
+type Summary struct {
+	Scenario string          `json:"scenario"`
+	Started  time.Time       `json:"started"`
+	Targets  []*TargetReport `json:"targets"`
+}
+
+// TargetReport holds the metrics of one target, or of the NATS publish load.
+type TargetReport struct {
+	Name    string         `json:"name"`
+	Expect  int            `json:"expect"`
+	Metrics vegeta.Metrics `json:"metrics"`
+	// Expected is the share of responses with the expected status. Unlike
+	// Metrics.Success it counts a 404 for a missing ID as a success.
+	Expected float64 `json:"expected"`
+
+	matched uint64
+}
+
+func newSummary(s *Scenario, started time.Time) *Summary {
+	sum := &Summary{Scenario: s.Name, Started: started}
+	for _, t := range s.Targets {
+		sum.Targets = append(sum.Targets, &TargetReport{Name: t.Name, Expect: t.Expect})
+	}
+	if s.Publish != nil {
+		sum.Targets = append(sum.Targets, &TargetReport{Name: publishAttack, Expect: 200})
+	}
+	return sum
+}
+
+func (s *Summary) target(name string) *TargetReport {
+	for _, t := range s.Targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Summary) Add(r *vegeta.Result) {
+	t := s.target(r.Attack)
+	if t == nil {
+		return
+	}
+	t.Metrics.Add(r)
+	if int(r.Code) == t.Expect {
+		t.matched++
+	}
+}
+
+func (s *Summary) Close() {
+	for _, t := range s.Targets {
+		t.Metrics.Close()
+		if t.Metrics.Requests > 0 {
+			t.Expected = float64(t.matched) / float64(t.Metrics.Requests)
+		}
+	}
+}
+
+func readSummary(path string) (*Summary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Summary
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("baseline %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Comparison is how a target moved against the baseline. Deltas are
+// relative: 0.1 is 10% slower.
+type Comparison struct {
+	Name      string  `json:"name"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+	Rate      float64 `json:"throughput"`
+	Expected  float64 `json:"expected"` // percentage points
+	Regressed bool    `json:"regressed"`
+}
+
+// compare matches targets by name. A target regressed when its p95 grew by
+// more than maxRegression or its share of expected responses dropped by more
+// than a point; maxRegression <= 0 only reports the deltas.
+func compare(cur, base *Summary, maxRegression float64) []Comparison {
+	var out []Comparison
+	for _, t := range cur.Targets {
+		b := base.target(t.Name)
+		if b == nil || b.Metrics.Requests == 0 || t.Metrics.Requests == 0 {
+			continue
+		}
+		c := Comparison{
+			Name:     t.Name,
+			P50:      delta(t.Metrics.Latencies.P50, b.Metrics.Latencies.P50),
+			P95:      delta(t.Metrics.Latencies.P95, b.Metrics.Latencies.P95),
+			P99:      delta(t.Metrics.Latencies.P99, b.Metrics.Latencies.P99),
+			Rate:     relative(t.Metrics.Throughput, b.Metrics.Throughput),
+			Expected: (t.Expected - b.Expected) * 100,
+		}
+		c.Regressed = maxRegression > 0 && (c.P95 > maxRegression || c.Expected < -1)
+		out = append(out, c)
+	}
+	return out
+}
+
+func delta(cur, base time.Duration) float64 {
+	return relative(float64(cur), float64(base))
+}
+
+func relative(cur, base float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return cur/base - 1
+}
+
+// writeText writes the per-target table and, with a baseline, the
+// comparison.
+func writeText(w io.Writer, s *Summary, cmp []Comparison) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Scenario %s, started %s\n\n", s.Scenario, s.Started.Format(time.RFC3339))
+	fmt.Fprintln(tw, "target\trequests\trate\texpected\tsuccess\tmean\tp50\tp90\tp95\tp99\tmax\tcodes\t")
+	for _, t := range s.Targets {
+		m := t.Metrics
+		fmt.Fprintf(tw, "%s\t%d\t%.1f/s\t%.2f%%\t%.2f%%\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			t.Name, m.Requests, m.Rate, t.Expected*100, m.Success*100,
+			round(m.Latencies.Mean), round(m.Latencies.P50), round(m.Latencies.P90),
+			round(m.Latencies.P95), round(m.Latencies.P99), round(m.Latencies.Max), codes(m.StatusCodes))
+	}
+	if len(cmp) > 0 {
+		fmt.Fprintln(tw, "\nagainst baseline\tp50\tp95\tp99\tthroughput\texpected\t\t")
+		for _, c := range cmp {
+			mark := ""
+			if c.Regressed {
+				mark = "REGRESSED"
+			}
+			fmt.Fprintf(tw, "%s\t%+.1f%%\t%+.1f%%\t%+.1f%%\t%+.1f%%\t%+.2fpp\t%s\t\n",
+				c.Name, c.P50*100, c.P95*100, c.P99*100, c.Rate*100, c.Expected, mark)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, t := range s.Targets {
+		if len(t.Metrics.Errors) > 0 {
+			fmt.Fprintf(w, "\n%s errors:\n  %s\n", t.Name, strings.Join(t.Metrics.Errors, "\n  "))
+		}
+	}
+	return nil
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// codes formats status code counts as "200:950 404:50", 0 standing for
+// requests that got no response.
+func codes(m map[string]int) string {
+	parts := make([]string, 0, len(m))
+	for code, n := range m {
+		parts = append(parts, fmt.Sprintf("%s:%d", code, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// report is the data of htmlReport.
+type report struct {
+	Summary    *Summary
+	Comparison []Comparison
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"round":   round,
+	"percent": func(f float64) string { return fmt.Sprintf("%.2f%%", f*100) },
+	"signed":  func(f float64) string { return fmt.Sprintf("%+.1f%%", f*100) },
+	"codes":   codes,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Summary.Scenario}}: load test</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.regressed { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>{{.Summary.Scenario}}</h1>
+<p>Started {{.Summary.Started.Format "2006-01-02 15:04:05 MST"}}. Latencies over time: <a href="plot.html">plot.html</a>.</p>
+<table>
+<tr><th>target</th><th>requests</th><th>rate</th><th>expected</th><th>success</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th><th>codes</th></tr>
+{{range .Summary.Targets}}{{$expected := .Expected}}<tr><td>{{.Name}}</td>{{with .Metrics}}<td>{{.Requests}}</td><td>{{printf "%.1f/s" .Rate}}</td><td>{{percent $expected}}</td><td>{{percent .Success}}</td><td>{{round .Latencies.Mean}}</td><td>{{round .Latencies.P50}}</td><td>{{round .Latencies.P90}}</td><td>{{round .Latencies.P95}}</td><td>{{round .Latencies.P99}}</td><td>{{round .Latencies.Max}}</td><td>{{codes .StatusCodes}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Comparison}}<h2>Against baseline</h2>
+<table>
+<tr><th>target</th><th>p50</th><th>p95</th><th>p99</th><th>throughput</th><th>expected</th></tr>
+{{range .Comparison}}<tr{{if .Regressed}} class="regressed"{{end}}><td>{{.Name}}</td><td>{{signed .P50}}</td><td>{{signed .P95}}</td><td>{{signed .P99}}</td><td>{{signed .Rate}}</td><td>{{printf "%+.2fpp" .Expected}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
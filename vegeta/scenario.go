@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Target kinds.
+const (
+	KindHotID     = "hot_id"     // one of a few IDs, read over and over
+	KindRandomID  = "random_id"  // any order read from storage
+	KindMissingID = "missing_id" // an ID no order has
+	KindList      = "list"       // GET /orders
+	KindSearch    = "search"     // GET /orders/search
+)
+
+// Scenario is a load test read from a YAML file, see vegeta/scenarios.
+type Scenario struct {
+	Name    string        `yaml:"name"`
+	BaseURL string        `yaml:"base_url"` // default http://localhost + http_port
+	APIKey  string        `yaml:"api_key"`  // sent as X-API-Key, default $WB_API_KEY
+	Timeout time.Duration `yaml:"timeout"`
+	Workers uint64        `yaml:"workers"` // initial workers per target
+	Seed    int64         `yaml:"seed"`    // picks IDs; the same seed gives the same requests
+	IDs     IDSource      `yaml:"ids"`
+	Targets []Target      `yaml:"targets"`
+	Stages  []Stage       `yaml:"stages"`
+	Publish *PublishLoad  `yaml:"publish"`
+}
+
+// IDSource says where order IDs for hot_id and random_id targets come from.
+type IDSource struct {
+	Hot      []string `yaml:"hot"`       // fixed hot IDs
+	HotCount int      `yaml:"hot_count"` // or the first hot_count IDs read from storage
+	FromDB   int      `yaml:"from_db"`   // IDs read from storage for random_id
+}
+
+// Target is one kind of request. Targets share the stage rate in proportion
+// to their weights.
+type Target struct {
+	Name   string `yaml:"name"`
+	Kind   string `yaml:"kind"`
+	Weight int    `yaml:"weight"`
+	Format string `yaml:"format"` // json or html
+	Query  string `yaml:"query"`  // for list and search, e.g. "city=Moscow&limit=20"
+	Expect int    `yaml:"expect"` // expected status, default 200 (404 for missing_id)
+}
+
+// Stage ramps the request rate linearly from the previous stage's rate, 0
+// for the first one, to Rate over Duration.
+type Stage struct {
+	Duration time.Duration `yaml:"duration"`
+	Rate     float64       `yaml:"rate"`
+}
+
+// PublishLoad publishes generated orders to NATS while the HTTP stages run.
+type PublishLoad struct {
+	Rate    float64 `yaml:"rate"`    // orders per second
+	Workers int     `yaml:"workers"` // concurrent publishers
+	Subject string  `yaml:"subject"` // default nats_subject
+	Seed    int64   `yaml:"seed"`
+	Mutate  float64 `yaml:"mutate"` // share of corrupted orders, see generator.Mutations
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("scenario %s: %w", path, err)
+	}
+	s.setDefaults()
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("scenario %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func (s *Scenario) setDefaults() {
+	if s.Timeout == 0 {
+		s.Timeout = 5 * time.Second
+	}
+	if s.Workers == 0 {
+		s.Workers = 10
+	}
+	if s.APIKey == "" {
+		s.APIKey = os.Getenv("WB_API_KEY")
+	}
+	for i := range s.Targets {
+		t := &s.Targets[i]
+		if t.Name == "" {
+			t.Name = t.Kind
+		}
+		if t.Weight == 0 {
+			t.Weight = 1
+		}
+		if t.Format == "" {
+			t.Format = "json"
+		}
+		if t.Expect == 0 {
+			t.Expect = 200
+			if t.Kind == KindMissingID {
+				t.Expect = 404
+			}
+		}
+	}
+	if p := s.Publish; p != nil && p.Workers == 0 {
+		p.Workers = 1
+	}
+}
+
+func (s *Scenario) Validate() error {
+	var errs []error
+	if len(s.Targets) == 0 && s.Publish == nil {
+		errs = append(errs, errors.New("no targets and no publish load"))
+	}
+	names := make(map[string]bool)
+	for i, t := range s.Targets {
+		switch t.Kind {
+		case KindHotID, KindRandomID, KindMissingID, KindList, KindSearch:
+		default:
+			errs = append(errs, fmt.Errorf("targets[%d]: unknown kind %q", i, t.Kind))
+		}
+		if t.Format != "json" && t.Format != "html" {
+			errs = append(errs, fmt.Errorf("targets[%d]: format %q, want json or html", i, t.Format))
+		}
+		if t.Weight < 0 {
+			errs = append(errs, fmt.Errorf("targets[%d]: negative weight", i))
+		}
+		if names[t.Name] {
+			errs = append(errs, fmt.Errorf("targets[%d]: duplicate name %q", i, t.Name))
+		}
+		names[t.Name] = true
+	}
+	if s.needs(KindHotID) && len(s.IDs.Hot) == 0 && s.IDs.HotCount <= 0 {
+		errs = append(errs, errors.New("hot_id targets need ids.hot or ids.hot_count"))
+	}
+	if s.needs(KindRandomID) && s.IDs.FromDB <= 0 {
+		errs = append(errs, errors.New("random_id targets need ids.from_db"))
+	}
+	if len(s.Stages) == 0 {
+		errs = append(errs, errors.New("no stages"))
+	}
+	for i, st := range s.Stages {
+		if st.Duration <= 0 || st.Rate < 0 {
+			errs = append(errs, fmt.Errorf("stages[%d]: want a positive duration and a non-negative rate", i))
+		}
+	}
+	if p := s.Publish; p != nil && (p.Rate <= 0 || p.Workers < 0 || p.Mutate < 0 || p.Mutate > 1) {
+		errs = append(errs, errors.New("publish: want a positive rate and mutate between 0 and 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scenario) needs(kind string) bool {
+	for _, t := range s.Targets {
+		if t.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is the length of all stages together.
+func (s *Scenario) Duration() time.Duration {
+	var d time.Duration
+	for _, st := range s.Stages {
+		d += st.Duration
+	}
+	return d
+}
+
+// stagePacer paces an attack along the stages, scaled by share, the target's
+// part of the total rate. It implements vegeta.Pacer.
+type stagePacer struct {
+	stages []Stage
+	share  float64
+}
+
+// hits returns how many hits the stages call for in the first t.
+func (p stagePacer) hits(t time.Duration) float64 {
+	var total, from float64
+	for _, st := range p.stages {
+		d := st.Duration.Seconds()
+		x := min(t.Seconds(), d)
+		total += from*x + (st.Rate-from)*x*x/(2*d)
+		if t <= st.Duration {
+			break
+		}
+		t -= st.Duration
+		from = st.Rate
+	}
+	return total * p.share
+}
+
+func (p stagePacer) Rate(elapsed time.Duration) float64 {
+	var from float64
+	for _, st := range p.stages {
+		if elapsed < st.Duration {
+			return (from + (st.Rate-from)*elapsed.Seconds()/st.Duration.Seconds()) * p.share
+		}
+		elapsed -= st.Duration
+		from = st.Rate
+	}
+	return 0
+}
+
+func (p stagePacer) Pace(elapsed time.Duration, hits uint64) (time.Duration, bool) {
+	var end time.Duration
+	for _, st := range p.stages {
+		end += st.Duration
+	}
+	if elapsed >= end {
+		return 0, true
+	}
+	next := float64(hits + 1)
+	if p.hits(elapsed) >= next {
+		return 0, false
+	}
+	if p.hits(end) < next {
+		return end - elapsed, false
+	}
+	// the hit count only grows with time: search for when it reaches next
+	lo, hi := elapsed, end
+	for hi-lo > time.Microsecond {
+		mid := lo + (hi-lo)/2
+		if p.hits(mid) >= next {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi - elapsed, false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+func TestExampleScenarios(t *testing.T) {
+	paths, err := filepath.Glob("scenarios/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no scenarios: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := LoadScenario(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := &Scenario{
+		Targets: []Target{{Kind: KindHotID}, {Kind: "bogus"}, {Kind: KindRandomID, Format: "xml"}},
+		Stages:  []Stage{{Duration: 0, Rate: 10}},
+		Publish: &PublishLoad{Rate: 1, Mutate: 2},
+	}
+	s.setDefaults()
+	err := s.Validate()
+	if err == nil {
+		t.Fatal("invalid scenario accepted")
+	}
+	for _, want := range []string{"unknown kind", `format "xml"`, "ids.hot", "ids.from_db", "stages[0]", "mutate"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if s.Targets[0].Expect != 200 {
+		t.Errorf("default expect = %d, want 200", s.Targets[0].Expect)
+	}
+}
+
+func TestStagePacer(t *testing.T) {
+	// ramp to 100/s over 10s, hold for 10s: 500 + 1000 hits, a quarter of them ours
+	p := stagePacer{stages: []Stage{{10 * time.Second, 100}, {10 * time.Second, 100}}, share: 0.25}
+
+	if got := p.hits(20 * time.Second); math.Abs(got-375) > 1e-9 {
+		t.Errorf("hits over both stages = %v, want 375", got)
+	}
+	if got := p.Rate(5 * time.Second); math.Abs(got-12.5) > 1e-9 {
+		t.Errorf("rate halfway up the ramp = %v, want 12.5", got)
+	}
+
+	// replay the pacer the way the attacker does
+	var elapsed time.Duration
+	var hits uint64
+	for {
+		wait, stop := p.Pace(elapsed, hits)
+		if stop {
+			break
+		}
+		if wait == 0 {
+			hits++
+			continue
+		}
+		elapsed += wait
+	}
+	if hits < 374 || hits > 376 {
+		t.Errorf("pacer sent %d hits, want 375", hits)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	summary := func(p95 time.Duration, expected float64) *Summary {
+		r := &TargetReport{Name: "hot", Expected: expected}
+		r.Metrics.Requests = 100
+		r.Metrics.Latencies.P95 = p95
+		return &Summary{Targets: []*TargetReport{r, {Name: "new"}}}
+	}
+	base := summary(10*time.Millisecond, 1)
+
+	tests := []struct {
+		name      string
+		cur       *Summary
+		max       float64
+		regressed bool
+	}{
+		{"same", summary(10*time.Millisecond, 1), 0.2, false},
+		{"slightly slower", summary(11*time.Millisecond, 1), 0.2, false},
+		{"much slower", summary(13*time.Millisecond, 1), 0.2, true},
+		{"compare only", summary(13*time.Millisecond, 1), 0, false},
+		{"more errors", summary(10*time.Millisecond, 0.95), 0.2, true},
+	}
+	for _, tt := range tests {
+		cmp := compare(tt.cur, base, tt.max)
+		if len(cmp) != 1 {
+			t.Fatalf("%s: compared %d targets, want 1", tt.name, len(cmp))
+		}
+		if cmp[0].Regressed != tt.regressed {
+			t.Errorf("%s: regressed = %v, want %v (%+v)", tt.name, cmp[0].Regressed, tt.regressed, cmp[0])
+		}
+	}
+}
+
+func TestSummaryCountsExpectedStatus(t *testing.T) {
+	s := newSummary(&Scenario{Targets: []Target{{Name: "missing", Expect: 404}}}, time.Now())
+	for _, code := range []uint16{404, 404, 404, 500} {
+		s.Add(&vegeta.Result{Attack: "missing", Code: code, Timestamp: time.Now()})
+	}
+	s.Close()
+	if got := s.Targets[0].Expected; got != 0.75 {
+		t.Errorf("expected = %v, want 0.75", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+	"github.com/velvetriddles/wb-level0/internal/config"
+	"github.com/velvetriddles/wb-level0/internal/domain"
+	"github.com/velvetriddles/wb-level0/internal/repository/storage"
+)
+
+var errEnoughIDs = errors.New("enough IDs")
+
+// orderIDs holds the IDs the hot_id and random_id targets request.
+type orderIDs struct {
+	hot    []string
+	random []string
+}
+
+// loadIDs reads existing order IDs from storage, newest first, when the
+// scenario needs them.
+func loadIDs(ctx context.Context, cfg *config.Config, s *Scenario, log *slog.Logger) (*orderIDs, error) {
+	ids := &orderIDs{hot: s.IDs.Hot}
+	want := s.IDs.FromDB
+	if len(ids.hot) == 0 {
+		want = max(want, s.IDs.HotCount)
+	}
+	if want == 0 || (!s.needs(KindRandomID) && !s.needs(KindHotID)) {
+		return ids, nil
+	}
+
+	repo, err := storage.NewOrderRepository(ctx, cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+
+	var found []string
+	err = repo.StreamOrders(ctx, domain.SearchQuery{}, func(o *domain.Order) error {
+		found = append(found, o.OrderUID)
+		if len(found) == want {
+			return errEnoughIDs
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errEnoughIDs) {
+		return nil, fmt.Errorf("failed to read order IDs: %w", err)
+	}
+	if len(found) == 0 {
+		return nil, errors.New("storage has no orders; publish some first, e.g. wbctl publish --count 1000")
+	}
+	log.Info("Order IDs loaded", slog.Int("count", len(found)))
+
+	if len(ids.hot) == 0 {
+		ids.hot = found[:min(s.IDs.HotCount, len(found))]
+	}
+	ids.random = found[:min(s.IDs.FromDB, len(found))]
+	return ids, nil
+}
+
+// targeter returns the requests of one target. Request choice follows the
+// scenario seed.
+func targeter(s *Scenario, t Target, ids *orderIDs, seed int64) vegeta.Targeter {
+	base := strings.TrimSuffix(s.BaseURL, "/")
+	header := http.Header{}
+	if t.Format == "json" {
+		header.Set("Accept", "application/json")
+	} else {
+		header.Set("Accept", "text/html")
+	}
+	if s.APIKey != "" {
+		header.Set("X-API-Key", s.APIKey)
+	}
+
+	var (
+		mu  sync.Mutex
+		rnd = rand.New(rand.NewSource(seed))
+	)
+	pick := func(values []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return values[rnd.Intn(len(values))]
+	}
+	missing := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprintf("missing%016x", rnd.Uint64())
+	}
+
+	var path func() string
+	switch t.Kind {
+	case KindHotID:
+		path = func() string { return "/orders/" + url.PathEscape(pick(ids.hot)) }
+	case KindRandomID:
+		path = func() string { return "/orders/" + url.PathEscape(pick(ids.random)) }
+	case KindMissingID:
+		path = func() string { return "/orders/" + missing() }
+	case KindList:
+		path = func() string { return withQuery("/orders", t.Query) }
+	case KindSearch:
+		path = func() string { return withQuery("/orders/search", t.Query) }
+	}
+
+	return func(tgt *vegeta.Target) error {
+		if tgt == nil {
+			return vegeta.ErrNilTarget
+		}
+		tgt.Method = http.MethodGet
+		tgt.URL = base + path()
+		tgt.Header = header
+		return nil
+	}
+}
+
+func withQuery(path, query string) string {
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}